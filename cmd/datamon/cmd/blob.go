@@ -0,0 +1,28 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// blobCmd represents the commands operating on the blob store
+var blobCmd = &cobra.Command{
+	Use:   "blob",
+	Short: "Commands to manage the blob store",
+	Long: `Commands to manage the blob store.
+
+The blob store holds the content of the files of all bundles, addressed by their hash.
+`,
+}
+
+var blobOptions struct {
+	Layout string
+	DryRun bool
+}
+
+func init() {
+	rootCmd.AddCommand(blobCmd)
+	addBucketNameFlag(blobCmd)
+	addBlobBucket(blobCmd)
+}
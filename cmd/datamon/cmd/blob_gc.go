@@ -0,0 +1,56 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+)
+
+var blobGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete the blobs not used by any bundle",
+	Long: `Delete the blobs which are not used by the files of any bundle, left by deleted bundles.
+
+Uploads must be stopped while the collection runs: the blobs of bundles which are not complete yet
+are not used by any bundle, and would be deleted.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		metaStore, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		blobStore, err := newBlobStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		var count int64
+		err = core.CollectGarbage(context.Background(), metaStore, blobStore, blobOptions.DryRun, func(cafs.Key) {
+			atomic.AddInt64(&count, 1)
+		})
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		msg := fmt.Sprintf("Deleted %d blobs", count)
+		if blobOptions.DryRun {
+			msg = fmt.Sprintf("Would delete %d blobs", count)
+		}
+		printResult(struct {
+			Deleted int64 `json:"deleted"`
+			DryRun  bool  `json:"dryRun,omitempty"`
+		}{Deleted: count, DryRun: blobOptions.DryRun}, msg)
+	},
+}
+
+func init() {
+	blobGCCmd.Flags().BoolVar(&blobOptions.DryRun, dryRun, false, "Only count the blobs which would be deleted")
+	blobCmd.AddCommand(blobGCCmd)
+}
@@ -0,0 +1,58 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/spf13/cobra"
+)
+
+var migrateLayoutCmd = &cobra.Command{
+	Use:   "migrate-layout",
+	Short: "Move the blobs to another layout",
+	Long: `Move the blobs of the blob store to another layout, and record it in the store.
+
+The sharded layout spreads the blobs over nested prefixes instead of a single flat namespace.
+On an empty blob store this only records the layout used for new blobs.
+
+Uploads should be stopped while the migration runs. An interrupted migration can be run again.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		blobStore, err := newBlobStore()
+		if err != nil {
+			logFatalln(err)
+		}
+		ctx := context.Background()
+		current, err := cafs.ReadLayout(ctx, blobStore, "")
+		if err != nil {
+			logFatalln(err)
+		}
+		log.Printf("Migrating %s from %s to %s layout", blobStore, current, blobOptions.Layout)
+		var count int64
+		err = cafs.MigrateLayout(ctx, blobStore, "", blobOptions.Layout, func(from, to string) {
+			atomic.AddInt64(&count, 1)
+		})
+		if err != nil {
+			logFatalln(err)
+		}
+		printResult(struct {
+			Moved int64 `json:"moved"`
+		}{Moved: count}, fmt.Sprintf("Moved %d blobs", count))
+	},
+}
+
+func addLayoutFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&blobOptions.Layout, layout, cafs.ShardedLayout,
+		fmt.Sprintf("The layout of the blobs, either %s or %s", cafs.ShardedLayout, cafs.FlatLayout))
+	return layout
+}
+
+func init() {
+	addLayoutFlag(migrateLayoutCmd)
+	blobCmd.AddCommand(migrateLayoutCmd)
+}
@@ -0,0 +1,46 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/spf13/cobra"
+)
+
+var migrateRootsCmd = &cobra.Command{
+	Use:   "migrate-roots",
+	Short: "Move the root objects of the files to their own namespace",
+	Long: `Move the root objects, which list the blobs of each file, to their own namespace in the blob store.
+
+Listing the files stored in the blob store is then a plain listing instead of reading every blob.
+This has to run once per blob store, and reads every blob.
+
+Uploads should be stopped while the migration runs. An interrupted migration can be run again.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		blobStore, err := newBlobStore()
+		if err != nil {
+			logFatalln(err)
+		}
+		log.Printf("Moving root objects of %s to %s", blobStore, cafs.RootsNamespace)
+		var count int64
+		err = cafs.MigrateRoots(context.Background(), blobStore, "", func(from, to string) {
+			atomic.AddInt64(&count, 1)
+		})
+		if err != nil {
+			logFatalln(err)
+		}
+		printResult(struct {
+			Moved int64 `json:"moved"`
+		}{Moved: count}, fmt.Sprintf("Moved %d root objects", count))
+	},
+}
+
+func init() {
+	blobCmd.AddCommand(migrateRootsCmd)
+}
@@ -0,0 +1,48 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+)
+
+var blobReindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the reference index of the blobs",
+	Long: `Rebuild the index mapping blobs to the bundles and files using them, from the file lists of all bundles.
+
+The index is maintained on upload, rebuilding it is only needed after a failed upload or to index older bundles.
+Lookups are incomplete while the rebuild runs.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		metaStore, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		blobStore, err := newBlobStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		var count int
+		err = core.RebuildIndex(context.Background(), metaStore, blobStore, func(repo, bundleID string) {
+			count++
+		})
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(struct {
+			Bundles int `json:"bundles"`
+		}{Bundles: count}, fmt.Sprintf("Indexed %d bundles", count))
+	},
+}
+
+func init() {
+	blobCmd.AddCommand(blobReindexCmd)
+}
@@ -0,0 +1,49 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+var blobWhereCmd = &cobra.Command{
+	Use:   "where <key>",
+	Short: "List the bundles and files using a blob",
+	Long: `List the bundles and files using a blob, from the reference index.
+
+The key is either the hash of a file, or the key of one of its blobs.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		refs, err := core.FindBlobReferences(context.Background(), args[0], store)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		lines := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			lines = append(lines, fmt.Sprintf("%s , %s , %s , %s", ref.Repo, ref.BundleID, ref.Root, strings.Join(ref.Paths, " ")))
+		}
+		if len(refs) == 0 {
+			log.Printf("No bundle references %s", args[0])
+			refs = []model.BlobReference{}
+		}
+		printResult(refs, lines...)
+	},
+}
+
+func init() {
+	blobCmd.AddCommand(blobWhereCmd)
+}
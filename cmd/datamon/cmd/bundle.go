@@ -3,10 +3,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"log"
 
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -27,7 +29,21 @@ var bundleOptions struct {
 	Message          string
 	ContributorEmail string
 	MountPath        string
+	StagingDir       string
 	File             string
+	Compression      string
+	Chunker          string
+	Force            bool
+	DryRun           bool
+}
+
+// bundleResult is printed by the bundle commands with --output json
+type bundleResult struct {
+	Repo     string `json:"repo"`
+	BundleID string `json:"bundle"`
+	Path     string `json:"path,omitempty"`
+	File     string `json:"file,omitempty"`
+	DryRun   bool   `json:"dryRun,omitempty"`
 }
 
 func init() {
@@ -41,6 +57,16 @@ func addBundleFlag(cmd *cobra.Command) string {
 	return bundleID
 }
 
+func addForceFlag(cmd *cobra.Command, usage string) string {
+	cmd.Flags().BoolVar(&bundleOptions.Force, force, false, usage)
+	return force
+}
+
+func addDryRunFlag(cmd *cobra.Command) string {
+	cmd.Flags().BoolVar(&bundleOptions.DryRun, dryRun, false, "Only list what would be deleted")
+	return dryRun
+}
+
 func addDataPathFlag(cmd *cobra.Command) string {
 	cmd.Flags().StringVar(&bundleOptions.DataPath, destination, "", "The path to the download dir")
 	return destination
@@ -51,6 +77,11 @@ func addMountPathFlag(cmd *cobra.Command) string {
 	return mount
 }
 
+func addStagingFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&bundleOptions.StagingDir, staging, "", "The directory staging the files written to the mount")
+	return staging
+}
+
 func addPathFlag(cmd *cobra.Command) string {
 	cmd.Flags().StringVar(&bundleOptions.DataPath, path, "", "The path to the folder or bucket (gs://<bucket>) for the data")
 	return path
@@ -66,14 +97,26 @@ func addBundleFileFlag(cmd *cobra.Command) string {
 	return file
 }
 
-func setLatestBundle(store storage.Store) error {
+func addCompressionFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&bundleOptions.Compression, compression, "",
+		fmt.Sprintf("Compress the uploaded blobs, one of %v", cafs.CompressionCodecs()))
+	return compression
+}
+
+func addChunkerFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&bundleOptions.Chunker, chunker, "",
+		fmt.Sprintf("Split files into blobs of variable size with %s (content defined chunking), fixed size blobs when not set", cafs.FastCDCChunker))
+	return chunker
+}
+
+func setLatestBundle(c *client.Client) error {
 	if bundleOptions.ID == "" {
-		key, err := core.GetLatestBundle(repoParams.RepoName, store)
+		key, err := c.LatestBundle(context.Background(), repoParams.RepoName)
 		if err != nil {
 			return err
 		}
 		bundleOptions.ID = key
 	}
-	fmt.Printf("Using bundle: %s\n", bundleOptions.ID)
+	log.Printf("Using bundle: %s", bundleOptions.ID)
 	return nil
 }
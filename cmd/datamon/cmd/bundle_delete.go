@@ -0,0 +1,60 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+)
+
+var bundleDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete a bundle",
+	Long: `Delete the metadata of a bundle. Labeled bundles and the parents of other bundles are only deleted with --force.
+
+The files of the bundle stay in the blob store until "datamon blob gc" runs.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		err = core.DeleteBundle(context.Background(), store, repoParams.RepoName, bundleOptions.ID,
+			core.DeleteForce(bundleOptions.Force),
+			core.DeleteDryRun(bundleOptions.DryRun),
+		)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		msg := fmt.Sprintf("Deleted bundle %s, run \"datamon blob gc\" to delete its files", bundleOptions.ID)
+		if bundleOptions.DryRun {
+			msg = fmt.Sprintf("Would delete bundle %s", bundleOptions.ID)
+		}
+		printResult(bundleResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bundleOptions.ID,
+			DryRun:   bundleOptions.DryRun,
+		}, msg)
+	},
+}
+
+func init() {
+	requiredFlags := []string{addRepoNameOptionFlag(bundleDeleteCmd), addBundleFlag(bundleDeleteCmd)}
+	addForceFlag(bundleDeleteCmd, "Delete the bundle even when it is labeled or the parent of other bundles")
+	addDryRunFlag(bundleDeleteCmd)
+	addBucketNameFlag(bundleDeleteCmd)
+
+	for _, flag := range requiredFlags {
+		err := bundleDeleteCmd.MarkFlagRequired(flag)
+		if err != nil {
+			logFatalln(err)
+		}
+	}
+
+	bundleCmd.AddCommand(bundleDeleteCmd)
+}
@@ -4,13 +4,9 @@ package cmd
 
 import (
 	"context"
-	"os"
 	"path/filepath"
 
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
-	"github.com/oneconcern/datamon/pkg/storage/localfs"
-	"github.com/spf13/afero"
+	"github.com/oneconcern/datamon/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -20,48 +16,32 @@ var BundleDownloadCmd = &cobra.Command{
 	Long: "Download a readonly, non-interactive view of the entire data that is part of a bundle. If --bundle is not specified" +
 		" the latest bundle will be downloaded",
 	Run: func(cmd *cobra.Command, args []string) {
-
-		sourceStore, err := gcs.New(repoParams.MetadataBucket, config.Credential)
-		if err != nil {
-			logFatalln(err)
-		}
-		blobStore, err := gcs.New(repoParams.BlobBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
 		path, err := filepath.Abs(filepath.Clean(bundleOptions.DataPath))
 		if err != nil {
 			logFatalf("Failed path validation: %s", err)
+			return
 		}
-		// Ignore error
-		_ = os.MkdirAll(path, 0700)
-		fs := afero.NewBasePathFs(afero.NewOsFs(), path)
-		empty, err := afero.IsEmpty(fs, "/")
-		if err != nil {
-			logFatalf("Failed path validation: %s", err)
-		}
-		if !empty {
-			logFatalf("%s should be empty", path)
-		}
-		destinationStore := localfs.New(fs)
-
-		err = setLatestBundle(sourceStore)
-		if err != nil {
+		if err = setLatestBundle(c); err != nil {
 			logFatalln(err)
+			return
 		}
-		bd := core.NewBDescriptor()
-		bundle := core.New(bd,
-			core.Repo(repoParams.RepoName),
-			core.MetaStore(sourceStore),
-			core.ConsumableStore(destinationStore),
-			core.BlobStore(blobStore),
-			core.BundleID(bundleOptions.ID),
-		)
-
-		err = core.Publish(context.Background(), bundle)
+		tracker, finish := startProgress()
+		err = c.Download(context.Background(), repoParams.RepoName, bundleOptions.ID, path, client.DownloadProgress(tracker))
+		finish()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(bundleResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bundleOptions.ID,
+			Path:     path,
+		})
 	},
 }
 
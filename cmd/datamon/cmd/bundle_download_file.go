@@ -2,13 +2,8 @@ package cmd
 
 import (
 	"context"
-	"os"
 	"path/filepath"
 
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
-	"github.com/oneconcern/datamon/pkg/storage/localfs"
-	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -17,38 +12,31 @@ var bundleDownloadFileCmd = &cobra.Command{
 	Short: "Download a file from bundle",
 	Long:  "Download a readonly, non-interactive view of a single file from a bundle",
 	Run: func(cmd *cobra.Command, args []string) {
-
-		sourceStore, err := gcs.New(repoParams.MetadataBucket, config.Credential)
-		if err != nil {
-			logFatalln(err)
-		}
-		blobStore, err := gcs.New(repoParams.BlobBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
 		path, err := filepath.Abs(filepath.Clean(bundleOptions.DataPath))
 		if err != nil {
 			logFatalf("Failed path validation: %s", err)
+			return
 		}
-		_ = os.MkdirAll(path, 0700)
-		destinationStore := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), path))
-		err = setLatestBundle(sourceStore)
-		if err != nil {
+		if err = setLatestBundle(c); err != nil {
 			logFatalln(err)
+			return
 		}
-		bd := core.NewBDescriptor()
-		bundle := core.New(bd,
-			core.Repo(repoParams.RepoName),
-			core.MetaStore(sourceStore),
-			core.ConsumableStore(destinationStore),
-			core.BlobStore(blobStore),
-			core.BundleID(bundleOptions.ID),
-		)
-
-		err = core.PublishFile(context.Background(), bundle, bundleOptions.File)
+		err = c.DownloadFile(context.Background(), repoParams.RepoName, bundleOptions.ID, bundleOptions.File, path)
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(bundleResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bundleOptions.ID,
+			Path:     path,
+			File:     bundleOptions.File,
+		})
 	},
 }
 
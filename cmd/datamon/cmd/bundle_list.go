@@ -1,10 +1,7 @@
 package cmd
 
 import (
-	"log"
-
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
+	"context"
 
 	"github.com/spf13/cobra"
 )
@@ -12,18 +9,32 @@ import (
 var BundleListCommand = &cobra.Command{
 	Use:   "list",
 	Short: "List bundles",
-	Long:  "List the bundles in a repo",
+	Long: `List the bundles in a repo, oldest first.
+
+Bundles can be filtered by time range, contributor and message. Scripts should use --format json or yaml,
+and --limit with --token to page through large repos.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := gcs.New(repoParams.MetadataBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		keys, err := core.ListBundles(repoParams.RepoName, store)
+		opts, err := listCoreOptions()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		for _, key := range keys {
-			log.Println(key)
+		bundles, next, err := c.ListBundles(context.Background(), repoParams.RepoName, opts...)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		rows := make([][]string, 0, len(bundles))
+		for _, bd := range bundles {
+			rows = append(rows, []string{bd.ID, bd.Timestamp.String(), bd.Message})
+		}
+		if err = printList(bundles, []string{"ID", "TIMESTAMP", "MESSAGE"}, rows, next); err != nil {
+			logFatalln(err)
 		}
 	},
 }
@@ -34,6 +45,7 @@ func init() {
 
 	addBucketNameFlag(BundleListCommand)
 	addBlobBucket(BundleListCommand)
+	addListFlags(BundleListCommand, "Only list the bundles with a message containing this string")
 
 	for _, flag := range requiredFlags {
 		err := BundleListCommand.MarkFlagRequired(flag)
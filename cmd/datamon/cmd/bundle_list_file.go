@@ -4,10 +4,6 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/oneconcern/datamon/pkg/core"
-
-	"github.com/oneconcern/datamon/pkg/model"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
 	"github.com/spf13/cobra"
 )
 
@@ -16,31 +12,25 @@ var bundleFileList = &cobra.Command{
 	Short: "List files in a bundle",
 	Long:  "List all the files in a bundle",
 	Run: func(cmd *cobra.Command, args []string) {
-
-		store, err := gcs.New(repoParams.MetadataBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		err = setLatestBundle(store)
-		if err != nil {
+		if err = setLatestBundle(c); err != nil {
 			logFatalln(err)
+			return
 		}
-		bundle := core.Bundle{
-			RepoID:           repoParams.RepoName,
-			BundleID:         bundleOptions.ID,
-			MetaStore:        store,
-			ConsumableStore:  nil,
-			BlobStore:        nil,
-			BundleDescriptor: model.BundleDescriptor{},
-			BundleEntries:    nil,
-		}
-		err = core.PopulateFiles(context.Background(), &bundle)
+		entries, err := c.ListFiles(context.Background(), repoParams.RepoName, bundleOptions.ID)
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		for _, e := range bundle.BundleEntries {
-			fmt.Printf("name:%s, size:%d, hash:%s\n", e.NameWithPath, e.Size, e.Hash)
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			lines = append(lines, fmt.Sprintf("name:%s, size:%d, hash:%s", e.NameWithPath, e.Size, e.Hash))
 		}
+		printResult(entries, lines...)
 	},
 }
 
@@ -3,13 +3,9 @@
 package cmd
 
 import (
+	"context"
 	"time"
 
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
-	"github.com/oneconcern/datamon/pkg/storage/localfs"
-	"github.com/spf13/afero"
-
 	"github.com/spf13/cobra"
 )
 
@@ -22,33 +18,21 @@ var mountBundleCmd = &cobra.Command{
 
 		DieIfNotAccessible(bundleOptions.DataPath)
 
-		metadataSource, err := gcs.New(repoParams.MetadataBucket, config.Credential)
-		if err != nil {
-			logFatalln(err)
-		}
-		blobStore, err := gcs.New(repoParams.BlobBucket, config.Credential)
-		if err != nil {
-			logFatalln(err)
-		}
-		consumableStore := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), bundleOptions.DataPath))
-
-		bd := core.NewBDescriptor()
-		bundle := core.New(bd,
-			core.Repo(repoParams.RepoName),
-			core.BundleID(bundleOptions.ID),
-			core.BlobStore(blobStore),
-			core.ConsumableStore(consumableStore),
-			core.MetaStore(metadataSource),
-		)
-
-		fs, err := core.NewReadOnlyFS(bundle)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		err = fs.MountReadOnly(bundleOptions.MountPath)
+		_, err = c.Mount(context.Background(), repoParams.RepoName, bundleOptions.ID, bundleOptions.MountPath, bundleOptions.DataPath)
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(bundleResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bundleOptions.ID,
+			Path:     bundleOptions.MountPath,
+		})
 		for {
 			time.Sleep(time.Hour)
 		}
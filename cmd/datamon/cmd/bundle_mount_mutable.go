@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+)
+
+// controlSocket is the unix socket controlling a mutable mount, in its staging directory
+const controlSocket = "mount.sock"
+
+func controlSocketPath() string {
+	return filepath.Join(bundleOptions.StagingDir, controlSocket)
+}
+
+// mountResult is printed by the commands controlling mutable mounts with --output json
+type mountResult struct {
+	Repo     string `json:"repo,omitempty"`
+	BundleID string `json:"bundle,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Staging  string `json:"staging"`
+}
+
+var mountMutableCmd = &cobra.Command{
+	Use:   "mutable",
+	Short: "Mount a writable bundle",
+	Long: `Mount a writable view of a bundle, or an empty one without --bundle. The files written are staged
+in the staging directory, and committed as new bundles with the commit command. The mount is controlled
+with the commit, abort and status commands, given the same staging directory.
+
+The changes since the last commit are committed when the mount is interrupted. Failed commits are saved
+under failed-commits/ in the staging directory. The namespace of the mount is journaled to the staging directory,
+to recover the files with the recover command when the mount dies.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		ctx := context.Background()
+		fs, err := c.MountMutable(ctx, repoParams.RepoName, bundleOptions.ID, bundleOptions.MountPath, bundleOptions.StagingDir,
+			client.UploadMessage(bundleOptions.Message),
+			client.UploadCompression(bundleOptions.Compression),
+			client.UploadChunker(bundleOptions.Chunker),
+		)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		serveMutableMount(fs, mountResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bundleOptions.ID,
+			Path:     bundleOptions.MountPath,
+			Staging:  bundleOptions.StagingDir,
+		})
+	},
+}
+
+// serveMutableMount serves the controls of a mutable mount until it is aborted or interrupted
+func serveMutableMount(fs *core.MutableFS, result mountResult) {
+	ctl, err := client.ServeMountControl(fs, bundleOptions.MountPath, controlSocketPath())
+	if err != nil {
+		_ = fs.Abort(bundleOptions.MountPath)
+		logFatalln(err)
+		return
+	}
+	defer ctl.Close()
+	printResult(result)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-ctl.Done():
+	case <-interrupted:
+		if err = fs.Unmount(bundleOptions.MountPath); err != nil {
+			_ = ctl.Close()
+			logFatalln(err)
+		}
+	}
+}
+
+var mountRecoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "Recover a mutable mount",
+	Long: `Recover the files of a mutable mount that died from its staging directory. The files are committed
+as a new bundle when they changed since the last commit, or mounted again with --mount.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		fs, err := c.RecoverMutable(context.Background(), bundleOptions.StagingDir)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		status := fs.Status()
+		if bundleOptions.MountPath != "" {
+			if err = fs.MountMutable(bundleOptions.MountPath); err != nil {
+				logFatalln(err)
+				return
+			}
+			serveMutableMount(fs, mountResult{
+				Repo:    status.Repo,
+				Path:    bundleOptions.MountPath,
+				Staging: bundleOptions.StagingDir,
+			})
+			return
+		}
+		if status.Dirty {
+			if err = fs.CommitMessage(bundleOptions.Message); err != nil {
+				logFatalln(err)
+				return
+			}
+			status = fs.Status()
+		}
+		if err = fs.Close(); err != nil {
+			logFatalln(err)
+			return
+		}
+		var bundleID string
+		if len(status.Bundles) > 0 {
+			bundleID = status.Bundles[len(status.Bundles)-1]
+		}
+		printResult(mountResult{Repo: status.Repo, BundleID: bundleID, Staging: bundleOptions.StagingDir}, bundleID)
+	},
+}
+
+var mountCommitCmd = &cobra.Command{
+	Use:   "commit",
+	Short: "Commit a mutable mount",
+	Long:  "Commit the files of a mutable mount as a new bundle, with the bundle of the last commit as parent, and print the ID of the bundle",
+	Run: func(cmd *cobra.Command, args []string) {
+		bundleID, err := client.MountCommit(context.Background(), controlSocketPath(), bundleOptions.Message)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(mountResult{BundleID: bundleID, Staging: bundleOptions.StagingDir}, bundleID)
+	},
+}
+
+var mountAbortCmd = &cobra.Command{
+	Use:   "abort",
+	Short: "Abort a mutable mount",
+	Long:  "Unmount a mutable mount, without committing the changes since its last commit",
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := client.MountAbort(context.Background(), controlSocketPath())
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(status, statusLines(status)...)
+	},
+}
+
+var mountStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of a mutable mount",
+	Long:  "Show the bundles committed by a mutable mount, whether its files changed since, and its failed commits",
+	Run: func(cmd *cobra.Command, args []string) {
+		status, err := client.MountStatus(context.Background(), controlSocketPath())
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(status, statusLines(status)...)
+	},
+}
+
+func statusLines(status *core.MutableStatus) []string {
+	lines := []string{
+		fmt.Sprintf("repo: %s", status.Repo),
+		fmt.Sprintf("path: %s", status.Path),
+		fmt.Sprintf("parents: %s", strings.Join(status.Parents, ", ")),
+		fmt.Sprintf("bundles: %s", strings.Join(status.Bundles, ", ")),
+		fmt.Sprintf("dirty: %t", status.Dirty),
+	}
+	if status.LastError != "" {
+		lines = append(lines, fmt.Sprintf("last error: %s", status.LastError))
+	}
+	for _, failed := range status.FailedCommits {
+		lines = append(lines, fmt.Sprintf("failed commit: %s", filepath.Join(bundleOptions.StagingDir, failed)))
+	}
+	return lines
+}
+
+func init() {
+	requiredFlags := []string{addRepoNameOptionFlag(mountMutableCmd), addMountPathFlag(mountMutableCmd),
+		addStagingFlag(mountMutableCmd)}
+	addBucketNameFlag(mountMutableCmd)
+	addBlobBucket(mountMutableCmd)
+	mountMutableCmd.Flags().StringVar(&bundleOptions.ID, bundleID, "", "The bundle the files start from, no files when not specified")
+	addCommitMessageFlag(mountMutableCmd)
+	addCompressionFlag(mountMutableCmd)
+	addChunkerFlag(mountMutableCmd)
+	for _, flag := range requiredFlags {
+		if err := mountMutableCmd.MarkFlagRequired(flag); err != nil {
+			logFatalln(err)
+		}
+	}
+
+	for _, cmd := range []*cobra.Command{mountCommitCmd, mountAbortCmd, mountStatusCmd} {
+		if err := cmd.MarkFlagRequired(addStagingFlag(cmd)); err != nil {
+			logFatalln(err)
+		}
+	}
+	addCommitMessageFlag(mountCommitCmd)
+
+	if err := mountRecoverCmd.MarkFlagRequired(addStagingFlag(mountRecoverCmd)); err != nil {
+		logFatalln(err)
+	}
+	addBucketNameFlag(mountRecoverCmd)
+	addBlobBucket(mountRecoverCmd)
+	mountRecoverCmd.Flags().StringVar(&bundleOptions.MountPath, mount, "", "The path to mount the files again, committed when not set")
+	mountRecoverCmd.Flags().StringVar(&bundleOptions.Message, message, "",
+		"The message of the bundle committed, the message of the mount when not set")
+
+	mountBundleCmd.AddCommand(mountMutableCmd, mountCommitCmd, mountAbortCmd, mountStatusCmd, mountRecoverCmd)
+}
@@ -0,0 +1,67 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+)
+
+var bundlePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete the bundles not kept by the retention policy of a repo",
+	Long: `Delete the bundles of a repo which are not kept by its retention policy, set with "datamon repo retention".
+
+Labeled bundles and the parents of kept bundles are skipped, like "datamon bundle delete" does without --force.
+The files of the deleted bundles stay in the blob store until "datamon blob gc" runs.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		pruned, skipped, err := core.PruneBundles(context.Background(), store, repoParams.RepoName, bundleOptions.DryRun)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		lines := append(pruned[:len(pruned):len(pruned)], fmt.Sprintf("Deleted %d bundles, run \"datamon blob gc\" to delete their files", len(pruned)))
+		if bundleOptions.DryRun {
+			lines[len(lines)-1] = fmt.Sprintf("Would delete %d bundles", len(pruned))
+		}
+		for _, s := range skipped {
+			lines = append(lines, fmt.Sprintf("Skipped %s: %s", s.ID, s.Reason))
+		}
+		if pruned == nil {
+			pruned = []string{}
+		}
+		if skipped == nil {
+			skipped = []core.SkippedBundle{}
+		}
+		printResult(struct {
+			Repo    string               `json:"repo"`
+			Bundles []string             `json:"bundles"`
+			Skipped []core.SkippedBundle `json:"skipped"`
+			DryRun  bool                 `json:"dryRun,omitempty"`
+		}{Repo: repoParams.RepoName, Bundles: pruned, Skipped: skipped, DryRun: bundleOptions.DryRun}, lines...)
+	},
+}
+
+func init() {
+	requiredFlags := []string{addRepoNameOptionFlag(bundlePruneCmd)}
+	addDryRunFlag(bundlePruneCmd)
+	addBucketNameFlag(bundlePruneCmd)
+
+	for _, flag := range requiredFlags {
+		err := bundlePruneCmd.MarkFlagRequired(flag)
+		if err != nil {
+			logFatalln(err)
+		}
+	}
+
+	bundleCmd.AddCommand(bundlePruneCmd)
+}
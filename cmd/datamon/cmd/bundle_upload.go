@@ -2,17 +2,9 @@ package cmd
 
 import (
 	"context"
-	"fmt"
 	"strings"
 
-	"github.com/oneconcern/datamon/pkg/storage"
-
-	"github.com/oneconcern/datamon/pkg/model"
-
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
-	"github.com/oneconcern/datamon/pkg/storage/localfs"
-	"github.com/spf13/afero"
+	"github.com/oneconcern/datamon/pkg/client"
 	"github.com/spf13/cobra"
 )
 
@@ -22,47 +14,32 @@ var uploadBundleCmd = &cobra.Command{
 	Short: "Upload a bundle",
 	Long:  "Upload a bundle consisting of all files stored in a directory",
 	Run: func(cmd *cobra.Command, args []string) {
-
-		fmt.Println(config.Credential)
-		MetaStore, err := gcs.New(repoParams.MetadataBucket, config.Credential)
-		if err != nil {
-			logFatalln(err)
-		}
-		blobStore, err := gcs.New(repoParams.BlobBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		var sourceStore storage.Store
-		if strings.HasPrefix(bundleOptions.DataPath, "gs://") {
-			fmt.Println(bundleOptions.DataPath[4:])
-			sourceStore, err = gcs.New(bundleOptions.DataPath[5:], config.Credential)
-			if err != nil {
-				logFatalln(err)
-			}
-		} else {
+		if !strings.HasPrefix(bundleOptions.DataPath, "gs://") {
 			DieIfNotAccessible(bundleOptions.DataPath)
 			DieIfNotDirectory(bundleOptions.DataPath)
-			sourceStore = localfs.New(afero.NewBasePathFs(afero.NewOsFs(), bundleOptions.DataPath))
 		}
-		bd := core.NewBDescriptor(
-			core.Message(bundleOptions.Message),
-			core.Contributors([]model.Contributor{{
-				Name:  repoParams.ContributorName,
-				Email: repoParams.ContributorEmail,
-			},
-			}),
+		tracker, finish := startProgress()
+		bd, err := c.UploadDir(context.Background(), repoParams.RepoName, bundleOptions.DataPath,
+			client.UploadMessage(bundleOptions.Message),
+			client.UploadCompression(bundleOptions.Compression),
+			client.UploadChunker(bundleOptions.Chunker),
+			client.UploadProgress(tracker),
 		)
-		bundle := core.New(bd,
-			core.Repo(repoParams.RepoName),
-			core.BlobStore(blobStore),
-			core.ConsumableStore(sourceStore),
-			core.MetaStore(MetaStore),
-		)
-
-		err = core.Upload(context.Background(), bundle)
+		finish()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(bundleResult{
+			Repo:     repoParams.RepoName,
+			BundleID: bd.ID,
+			Path:     bundleOptions.DataPath,
+		}, bd.ID)
 	},
 }
 
@@ -71,6 +48,8 @@ func init() {
 	requiredFlags := []string{addRepoNameOptionFlag(uploadBundleCmd)}
 	requiredFlags = append(requiredFlags, addPathFlag(uploadBundleCmd))
 	requiredFlags = append(requiredFlags, addCommitMessageFlag(uploadBundleCmd))
+	addCompressionFlag(uploadBundleCmd)
+	addChunkerFlag(uploadBundleCmd)
 
 	for _, flag := range requiredFlags {
 		err := uploadBundleCmd.MarkFlagRequired(flag)
@@ -3,6 +3,7 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/oneconcern/datamon/pkg/model"
 	"github.com/oneconcern/datamon/pkg/storage"
 
 	"github.com/oneconcern/datamon/pkg/cafs"
@@ -34,7 +36,6 @@ const (
 	consumedData   = destinationDir + "/downloads"
 	repo1          = "test-repo1"
 	repo2          = "test-repo2"
-	timeForm       = "2006-01-02 15:04:05.999999999 -0700 MST"
 )
 
 type uploadTree struct {
@@ -175,7 +176,6 @@ func TestCreateRepo(t *testing.T) {
 }
 
 type repoListEntry struct {
-	rawLine     string
 	repo        string
 	name        string
 	description string
@@ -224,34 +224,35 @@ func listRepos(t *testing.T) ([]repoListEntry, error) {
 	if err != nil {
 		panic(err)
 	}
-	log.SetOutput(w)
+	stdout := os.Stdout
+	os.Stdout = w
 	//
 	runCmd(t, []string{"repo",
 		"list",
-	}, "create second test repo", false)
+		"--format", "json",
+	}, "list repos", false)
 	//
-	log.SetOutput(os.Stdout)
+	os.Stdout = stdout
 	w.Close()
 	//
 	lb, err := ioutil.ReadAll(r)
 	require.NoError(t, err, "i/o error reading patched log from pipe")
 	//
-	rles := make([]repoListEntry, 0)
-	for _, line := range getDataLogLines(t, string(lb), []string{`Using config file`}) {
-		sl := strings.Split(line, ",")
-		t, err := time.Parse(timeForm, strings.TrimSpace(sl[4]))
-		if err != nil {
-			return nil, err
-		}
-		rle := repoListEntry{
-			rawLine:     line,
-			repo:        strings.TrimSpace(sl[0]),
-			name:        strings.TrimSpace(sl[2]),
-			description: strings.TrimSpace(sl[1]),
-			email:       strings.TrimSpace(sl[3]),
-			time:        t,
-		}
-		rles = append(rles, rle)
+	var page struct {
+		Items []model.RepoDescriptor `json:"items"`
+	}
+	if err = json.Unmarshal(lb, &page); err != nil {
+		return nil, err
+	}
+	rles := make([]repoListEntry, 0, len(page.Items))
+	for _, rd := range page.Items {
+		rles = append(rles, repoListEntry{
+			repo:        rd.Name,
+			name:        rd.Contributor.Name,
+			description: rd.Description,
+			email:       rd.Contributor.Email,
+			time:        rd.Timestamp,
+		})
 	}
 	return rles, nil
 }
@@ -361,7 +362,6 @@ func TestUploadBundle_filePath(t *testing.T) {
 }
 
 type bundleListEntry struct {
-	rawLine string
 	hash    string
 	message string
 	time    time.Time
@@ -372,30 +372,31 @@ func listBundles(t *testing.T, repoName string) ([]bundleListEntry, error) {
 	if err != nil {
 		panic(err)
 	}
-	log.SetOutput(w)
+	stdout := os.Stdout
+	os.Stdout = w
 	runCmd(t, []string{"bundle",
 		"list",
 		"--repo", repoName,
+		"--format", "json",
 	}, "list bundles", false)
-	log.SetOutput(os.Stdout)
+	os.Stdout = stdout
 	w.Close()
 	//
 	lb, err := ioutil.ReadAll(r)
 	require.NoError(t, err, "i/o error reading patched log from pipe")
-	bles := make([]bundleListEntry, 0)
-	for _, line := range getDataLogLines(t, string(lb), []string{`Using config file`}) {
-		sl := strings.Split(line, ",")
-		t, err := time.Parse(timeForm, strings.TrimSpace(sl[1]))
-		if err != nil {
-			return nil, err
-		}
-		rle := bundleListEntry{
-			rawLine: line,
-			hash:    strings.TrimSpace(sl[0]),
-			message: strings.TrimSpace(sl[2]),
-			time:    t,
-		}
-		bles = append(bles, rle)
+	var page struct {
+		Items []model.BundleDescriptor `json:"items"`
+	}
+	if err = json.Unmarshal(lb, &page); err != nil {
+		return nil, err
+	}
+	bles := make([]bundleListEntry, 0, len(page.Items))
+	for _, bd := range page.Items {
+		bles = append(bles, bundleListEntry{
+			hash:    bd.ID,
+			message: bd.Message,
+			time:    bd.Timestamp,
+		})
 	}
 	return bles, nil
 }
@@ -677,6 +678,7 @@ func TestBundlesDownloadFiles(t *testing.T) {
 
 /** untested:
  * - bundle_mount.go
+ * - bundle_mount_mutable.go
  * - config_generate.go
  */
 
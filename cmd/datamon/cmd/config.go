@@ -16,6 +16,7 @@ type Config struct {
 	Email      string `json:"email" yaml:"email"`
 	Name       string `json:"name" yaml:"name"`
 	Credential string `json:"credential" yaml:"credential"`
+	KeyFile    string `json:"keyfile" yaml:"keyfile"` // Key used to encrypt repo data client side
 }
 
 func newConfig() (*Config, error) {
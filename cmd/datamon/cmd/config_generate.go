@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/user"
 
+	"github.com/oneconcern/datamon/pkg/storage/encrypted"
 	"gopkg.in/yaml.v2"
 
 	"github.com/spf13/cobra"
@@ -19,22 +20,40 @@ var configGen = &cobra.Command{
 		if user == nil || err != nil {
 			logFatalln("Could not get home directory for user")
 		}
+		if keyFile != "" {
+			if _, err = os.Stat(keyFile); os.IsNotExist(err) {
+				key, err := encrypted.GenerateKey()
+				if err != nil {
+					logFatalln(err)
+				}
+				if err = ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+					logFatalln(err)
+				}
+			}
+		}
 		config := Config{
 			Email:      repoParams.ContributorEmail,
 			Name:       repoParams.ContributorName,
 			Metadata:   repoParams.MetadataBucket,
 			Blob:       repoParams.BlobBucket,
 			Credential: credFile,
+			KeyFile:    keyFile,
 		}
 		o, e := yaml.Marshal(config)
 		if e != nil {
 			logFatalln(e)
 		}
 		_ = os.Mkdir(user.HomeDir+"/.datamon", 0700)
-		err = ioutil.WriteFile(user.HomeDir+"/.datamon/datamon.yaml", o, 0600)
+		path := user.HomeDir + "/.datamon/datamon.yaml"
+		err = ioutil.WriteFile(path, o, 0600)
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(struct {
+			Path string `json:"path"`
+			Config
+		}{Path: path, Config: config})
 	},
 }
 
@@ -45,6 +64,7 @@ func init() {
 	addBucketNameFlag(configGen)
 	addBlobBucket(configGen)
 	addCredentialFile(configGen)
+	addKeyFileFlag(configGen)
 
 	for _, flag := range requiredFlags {
 		err := configGen.MarkFlagRequired(flag)
@@ -0,0 +1,78 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/oneconcern/datamon/pkg/csi"
+)
+
+var csiOptions struct {
+	Endpoint   string
+	NodeID     string
+	StagingDir string
+	Node       bool
+	Controller bool
+}
+
+var csiCmd = &cobra.Command{
+	Use:   "csi",
+	Short: "Serve bundles as kubernetes volumes",
+	Long: `Run the datamon CSI plugin, mounting bundles in pods. The manifests of deploy/ run it on the nodes with --node,
+and as the provisioner and snapshotter of volumes with --node --controller.
+
+Volumes are configured with attributes, or with the parameters of storage classes:
+  repo         the repo of the volume
+  mode         ro for a read only bundle, rw for a mutable volume committed as a new bundle when unpublished
+  bundle       the bundle of a read only volume, the latest bundle by default, or the bundle a mutable volume starts from
+  label        the label of the bundle of a read only volume, or the label set on the bundles committed by a mutable volume
+  sourceLabel  the label of the bundle a mutable volume starts from
+  message      the message of the bundles committed by a mutable volume
+
+Snapshots of mutable volumes commit them as new bundles, their IDs are <repo>/<bundle>.
+The node plugin publishing a volume commits its snapshots, requested by the controller in the metadata store.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !csiOptions.Node && !csiOptions.Controller {
+			logFatalf("csi needs --%s, --%s or both", node, controller)
+			return
+		}
+		if csiOptions.NodeID == "" {
+			csiOptions.NodeID, _ = os.Hostname()
+		}
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		logger, err := zap.NewProduction()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		defer func() { _ = logger.Sync() }()
+		driver := csi.NewDriver(csi.Config{
+			NodeID:     csiOptions.NodeID,
+			StagingDir: csiOptions.StagingDir,
+			Logger:     logger,
+		}, c)
+		driver.Run(csiOptions.Endpoint, csiOptions.Node, csiOptions.Controller)
+	},
+}
+
+func init() {
+	csiCmd.Flags().StringVar(&csiOptions.Endpoint, endpoint, "unix:///csi/csi.sock", "The CSI endpoint the plugin listens on")
+	csiCmd.Flags().StringVar(&csiOptions.NodeID, nodeID, "", "The name of the node, the host name by default")
+	csiCmd.Flags().StringVar(&csiOptions.StagingDir, staging, "/var/lib/datamon",
+		"The directory caching the files of read only volumes and staging the files written to mutable volumes")
+	csiCmd.Flags().BoolVar(&csiOptions.Node, node, false, "Serve the node service, mounting volumes")
+	csiCmd.Flags().BoolVar(&csiOptions.Controller, controller, false, "Serve the controller service")
+	addBucketNameFlag(csiCmd)
+	addBlobBucket(csiCmd)
+	addContributorEmail(csiCmd)
+	addContributorName(csiCmd)
+	rootCmd.AddCommand(csiCmd)
+}
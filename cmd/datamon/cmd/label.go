@@ -0,0 +1,133 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+// labelCmd represents the label related commands
+var labelCmd = &cobra.Command{
+	Use:   "label",
+	Short: "Commands to manage labels for a repo",
+	Long: `Commands to manage labels for a repo.
+
+A label is a name pointing to a bundle of a repo, labeled bundles are protected from deletion.
+`,
+}
+
+var labelOptions struct {
+	Name string
+}
+
+var labelSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Point a label to a bundle",
+	Long:  "Point a label to a bundle, replacing the bundle it pointed to. If --bundle is not specified the latest bundle is labeled",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = setLatestBundle(c); err != nil {
+			logFatalln(err)
+			return
+		}
+		l, err := c.SetLabel(context.Background(), repoParams.RepoName, labelOptions.Name, bundleOptions.ID)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(l)
+	},
+}
+
+var labelGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Get the bundle of a label",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		l, err := c.GetLabel(context.Background(), repoParams.RepoName, labelOptions.Name)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(l, l.Name+" , "+l.BundleID+" , "+l.Timestamp.String())
+	},
+}
+
+var labelListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the labels of a repo",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		labels, err := c.ListLabels(context.Background(), repoParams.RepoName)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		lines := make([]string, 0, len(labels))
+		for _, l := range labels {
+			lines = append(lines, l.Name+" , "+l.BundleID+" , "+l.Timestamp.String())
+		}
+		if labels == nil {
+			labels = []model.Label{}
+		}
+		printResult(labels, lines...)
+	},
+}
+
+var labelDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete a label, the bundle is left alone",
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = c.DeleteLabel(context.Background(), repoParams.RepoName, labelOptions.Name); err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(model.Label{Name: labelOptions.Name})
+	},
+}
+
+func addLabelNameFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&labelOptions.Name, label, "", "The name of the label")
+	return label
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{labelSetCmd, labelGetCmd, labelListCmd, labelDeleteCmd} {
+		requiredFlags := []string{addRepoNameOptionFlag(cmd)}
+		if cmd != labelListCmd {
+			requiredFlags = append(requiredFlags, addLabelNameFlag(cmd))
+		}
+		addBucketNameFlag(cmd)
+		for _, flag := range requiredFlags {
+			if err := cmd.MarkFlagRequired(flag); err != nil {
+				logFatalln(err)
+			}
+		}
+		labelCmd.AddCommand(cmd)
+	}
+	addBundleFlag(labelSetCmd)
+	addContributorEmail(labelSetCmd)
+	addContributorName(labelSetCmd)
+
+	rootCmd.AddCommand(labelCmd)
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+var listOptions struct {
+	Format      string
+	Limit       int
+	Token       string
+	Since       string
+	Until       string
+	Contributor string
+	Message     string
+	Descending  bool
+}
+
+// listPage is the document printed by list commands in the json and yaml formats
+type listPage struct {
+	Items     interface{} `json:"items" yaml:"items"`
+	NextToken string      `json:"nextToken,omitempty" yaml:"nextToken,omitempty"`
+}
+
+func addListFlags(cmd *cobra.Command, messageUsage string) {
+	cmd.Flags().StringVar(&listOptions.Format, format, formatTable, "The output format: table, json or yaml")
+	cmd.Flags().IntVar(&listOptions.Limit, limit, 0, "The maximum number of items to list, all of them when 0")
+	cmd.Flags().StringVar(&listOptions.Token, token, "", "Continue the listing from the page token printed by the previous call")
+	cmd.Flags().StringVar(&listOptions.Since, since, "", "Only list the items created at or after this RFC3339 time")
+	cmd.Flags().StringVar(&listOptions.Until, until, "", "Only list the items created before this RFC3339 time")
+	cmd.Flags().StringVar(&listOptions.Contributor, contributor, "", "Only list the items with a contributor name or email containing this string")
+	cmd.Flags().StringVar(&listOptions.Message, message, "", messageUsage)
+	cmd.Flags().BoolVar(&listOptions.Descending, descending, false, "List in reverse order")
+}
+
+// listCoreOptions converts the list flags to core options
+func listCoreOptions() ([]core.ListOption, error) {
+	switch listOptions.Format {
+	case formatTable, formatJSON, formatYAML:
+	default:
+		return nil, fmt.Errorf("unknown format %q, expecting %s, %s or %s", listOptions.Format, formatTable, formatJSON, formatYAML)
+	}
+	opts := []core.ListOption{
+		core.ListLimit(listOptions.Limit),
+		core.ListToken(listOptions.Token),
+		core.ListContributor(listOptions.Contributor),
+		core.ListMessage(listOptions.Message),
+		core.ListDescending(listOptions.Descending),
+	}
+	if listOptions.Since != "" {
+		t, err := time.Parse(time.RFC3339, listOptions.Since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %v", since, err)
+		}
+		opts = append(opts, core.ListSince(t))
+	}
+	if listOptions.Until != "" {
+		t, err := time.Parse(time.RFC3339, listOptions.Until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %v", until, err)
+		}
+		opts = append(opts, core.ListUntil(t))
+	}
+	return opts, nil
+}
+
+// printList prints a page of items on stdout, in the format of the list flags or as json with --output json.
+// The table format prints the header and rows, and logs the next page token when there is one.
+func printList(items interface{}, header []string, rows [][]string, next string) error {
+	page := listPage{Items: items, NextToken: next}
+	format := listOptions.Format
+	if outputFormat == outputJSON {
+		format = formatJSON
+	}
+	switch format {
+	case formatJSON:
+		return printJSON(os.Stdout, page)
+	case formatYAML:
+		b, err := yaml.Marshal(page)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if next != "" {
+			log.Printf("more items, continue with --%s %s", token, next)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Exit codes, so scripts can tell failures apart
+const (
+	exitError    = 1
+	exitNotFound = 2
+	exitExists   = 3
+	exitAuth     = 4
+	exitIO       = 5
+)
+
+var errorKinds = map[int]string{
+	exitError:    "error",
+	exitNotFound: "not-found",
+	exitExists:   "already-exists",
+	exitAuth:     "auth",
+	exitIO:       "io",
+}
+
+var outputFormat string
+
+// errorResult is printed on stdout by failing commands with --output json
+type errorResult struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+	Code  int    `json:"code"`
+}
+
+func addOutputFlag(cmd *cobra.Command) string {
+	cmd.PersistentFlags().StringVar(&outputFormat, output, outputText,
+		"The format of the result printed on stdout: text or json. Logs are printed on stderr")
+	return output
+}
+
+// printResult prints the result of a command on stdout: the result as a json object with --output json,
+// the lines of text otherwise
+func printResult(result interface{}, lines ...string) {
+	if outputFormat == outputJSON {
+		if err := printJSON(os.Stdout, result); err != nil {
+			logFatalln(err)
+		}
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintln(os.Stdout, line)
+	}
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// fatalln logs the error and exits with the code of its kind
+func fatalln(v ...interface{}) {
+	fail(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), v)
+}
+
+// fatalf logs the error and exits with the code of its kind
+func fatalf(format string, v ...interface{}) {
+	fail(fmt.Sprintf(format, v...), v)
+}
+
+func fail(msg string, v []interface{}) {
+	code := exitError
+	for _, arg := range v {
+		if err, ok := arg.(error); ok {
+			code = exitCode(err)
+			break
+		}
+	}
+	log.Println(msg)
+	if outputFormat == outputJSON {
+		_ = printJSON(os.Stdout, errorResult{Error: msg, Kind: errorKinds[code], Code: code})
+	}
+	os.Exit(code)
+}
+
+// exitCode returns the exit code of the kind of an error
+func exitCode(err error) int {
+	switch client.Kind(err) {
+	case client.ErrNotFound:
+		return exitNotFound
+	case client.ErrExists:
+		return exitExists
+	case client.ErrForbidden:
+		return exitAuth
+	case client.ErrIO:
+		return exitIO
+	}
+	return exitError
+}
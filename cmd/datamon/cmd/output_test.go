@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	gcsStorage "cloud.google.com/go/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("failed"), exitError},
+		{storage.NotFoundf("repo validation: Repo:%s does not exist", "test"), exitNotFound},
+		{fmt.Errorf("reading: %w", gcsStorage.ErrObjectNotExist), exitNotFound},
+		{&os.PathError{Op: "open", Path: "missing", Err: os.ErrNotExist}, exitNotFound},
+		{storage.Existsf("repo already exists: %s", "test"), exitExists},
+		{fmt.Errorf("create record for %q: %w", "key", os.ErrExist), exitExists},
+		{&googleapi.Error{Code: 412}, exitExists},
+		{storage.Forbiddenf("repo %s is encrypted", "test"), exitAuth},
+		{&googleapi.Error{Code: 403}, exitAuth},
+		{&os.PathError{Op: "write", Path: "file", Err: errors.New("no space left on device")}, exitIO},
+		{io.ErrUnexpectedEOF, exitIO},
+	} {
+		require.Equal(t, tc.code, exitCode(tc.err), tc.err.Error())
+	}
+	require.Equal(t, "repo already exists: test", storage.Existsf("repo already exists: %s", "test").Error())
+}
@@ -0,0 +1,40 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/progress"
+)
+
+const (
+	barRefreshInterval  = 200 * time.Millisecond
+	jsonRefreshInterval = 5 * time.Second
+)
+
+// startProgress creates a tracker that is rendered on stderr, as a progress bar
+// when attached to a terminal and as periodic JSON lines otherwise.
+// The returned function finishes the tracker and renders the final state.
+func startProgress() (*progress.Tracker, func()) {
+	tracker := progress.New()
+	var stop func()
+	if isTerminal(os.Stderr) {
+		stop = progress.Watch(tracker, barRefreshInterval, progress.Bar(os.Stderr))
+	} else {
+		stop = progress.Watch(tracker, jsonRefreshInterval, progress.JSONLines(os.Stderr))
+	}
+	return tracker, func() {
+		tracker.Finish()
+		stop()
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
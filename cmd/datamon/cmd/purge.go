@@ -0,0 +1,95 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+var purgeOptions struct {
+	Hashes []string
+	Paths  []string
+	Reason string
+	DryRun bool
+}
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete specific content from all bundles",
+	Long: `Delete the content of files from the blob store, even when bundles still use it.
+
+The content is given by hashes, of files or of their blobs, or by the paths of files in the bundles of a repo,
+or of all repos when no repo is given. The files using the content are kept in the bundles as purged,
+downloading them fails with the ID of the purge. An audit record of the purge is kept in the metadata.
+
+Other files sharing a blob with the purged content can't be read anymore, they are purged as well.
+Use --dry-run to list the files which would be purged first.
+
+The purge relies on the blob reference index, run "datamon blob reindex" first if an upload failed to index its bundle.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(purgeOptions.Hashes) == 0 && len(purgeOptions.Paths) == 0 {
+			logFatalf("at least one --%s or --%s is required", hash, path)
+			return
+		}
+		metaStore, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		blobStore, err := newBlobStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		record, err := core.Purge(context.Background(), metaStore, blobStore, purgeOptions.Hashes, purgeOptions.Paths,
+			core.PurgeRepo(repoParams.RepoName),
+			core.PurgeReason(purgeOptions.Reason),
+			core.PurgeContributor(model.Contributor{
+				Name:  repoParams.ContributorName,
+				Email: repoParams.ContributorEmail,
+			}),
+			core.PurgeDryRun(purgeOptions.DryRun),
+		)
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		var lines []string
+		refLines := func(refs []model.BlobReference) {
+			for _, ref := range refs {
+				lines = append(lines, fmt.Sprintf("%s , %s , %s", ref.Repo, ref.BundleID, strings.Join(ref.Paths, " ")))
+			}
+		}
+		refLines(record.Files)
+		if len(record.Collateral) > 0 {
+			lines = append(lines, "Sharing blobs with the purged content:")
+			refLines(record.Collateral)
+		}
+		if purgeOptions.DryRun {
+			lines = append(lines, fmt.Sprintf("Would delete %d files and %d blobs", len(record.Roots), len(record.Leaves)))
+		} else {
+			lines = append(lines, fmt.Sprintf("Purge %s deleted %d files and %d blobs", record.ID, len(record.Roots), len(record.Leaves)))
+		}
+		printResult(record, lines...)
+	},
+}
+
+func init() {
+	purgeCmd.Flags().StringSliceVar(&purgeOptions.Hashes, hash, nil, "The hash of content to purge")
+	purgeCmd.Flags().StringSliceVar(&purgeOptions.Paths, path, nil, "The path of a file to purge, in all bundles")
+	purgeCmd.Flags().StringVar(&purgeOptions.Reason, reason, "", "The reason of the purge, kept in its audit record")
+	purgeCmd.Flags().BoolVar(&purgeOptions.DryRun, dryRun, false, "List what would be purged, without deleting anything")
+	addRepoNameOptionFlag(purgeCmd)
+	addContributorEmail(purgeCmd)
+	addContributorName(purgeCmd)
+	addBucketNameFlag(purgeCmd)
+	addBlobBucket(purgeCmd)
+	rootCmd.AddCommand(purgeCmd)
+}
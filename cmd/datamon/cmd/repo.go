@@ -3,6 +3,10 @@
 package cmd
 
 import (
+	"context"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -31,6 +35,22 @@ type RepoParams struct {
 
 var repoParams = RepoParams{}
 
+var repoOptions struct {
+	Force  bool
+	Target string
+	Resume string
+}
+
+func addTargetRepoFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&repoOptions.Target, targetRepo, "", "The name of the new repo")
+	return targetRepo
+}
+
+func addResumeLockFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&repoOptions.Resume, resumeLock, "", "Resume the interrupted command holding the repo lock with this owner")
+	return resumeLock
+}
+
 func addRepoNameOptionFlag(cmd *cobra.Command) string {
 	cmd.Flags().StringVar(&repoParams.RepoName, repo, "", "The name of this repository")
 	return repo
@@ -61,3 +81,13 @@ func addContributorName(cmd *cobra.Command) string {
 	cmd.Flags().StringVar(&repoParams.ContributorName, contributorName, "", "The name of the contributor")
 	return contributorName
 }
+
+// printRepo prints the descriptor of a repo as the result of a command
+func printRepo(store storage.Store, name string) {
+	rd, err := core.GetRepoDescriptorByRepoName(context.Background(), name, store)
+	if err != nil {
+		logFatalln(err)
+		return
+	}
+	printResult(rd)
+}
@@ -1,13 +1,7 @@
 package cmd
 
 import (
-	"time"
-
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
-
-	"github.com/oneconcern/datamon/pkg/core"
-
-	"github.com/oneconcern/datamon/pkg/model"
+	"context"
 
 	"github.com/spf13/cobra"
 )
@@ -18,24 +12,17 @@ var repoCreate = &cobra.Command{
 	Long: "Create a repo. Repo names must not contain special characters. " +
 		"Allowed characters Unicode characters, digits and hyphen. Example: dm-test-repo-1",
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := gcs.New(repoParams.MetadataBucket, config.Credential)
+		c, err := newClient()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-
-		repo := model.RepoDescriptor{
-			Name:        repoParams.RepoName,
-			Description: repoParams.Description,
-			Timestamp:   time.Now(),
-			Contributor: model.Contributor{
-				Email: repoParams.ContributorEmail,
-				Name:  repoParams.ContributorName,
-			},
-		}
-		err = core.CreateRepo(repo, store)
+		repo, err := c.CreateRepo(context.Background(), repoParams.RepoName, repoParams.Description)
 		if err != nil {
 			logFatalln(err)
+			return
 		}
+		printResult(repo)
 	},
 }
 
@@ -1,33 +1,45 @@
 package cmd
 
 import (
-	"log"
+	"context"
 
-	"github.com/oneconcern/datamon/pkg/core"
-	"github.com/oneconcern/datamon/pkg/storage/gcs"
 	"github.com/spf13/cobra"
 )
 
 var repoList = &cobra.Command{
 	Use:   "list",
 	Short: "List repos",
-	Long:  "List repos that have been created",
+	Long: `List repos that have been created, by name.
+
+Scripts should use --format json or yaml, and --limit with --token to page through the repos.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		store, err := gcs.New(repoParams.MetadataBucket, config.Credential)
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		opts, err := listCoreOptions()
 		if err != nil {
 			logFatalln(err)
+			return
 		}
-		keys, err := core.ListRepos(store)
+		repos, next, err := c.ListRepos(context.Background(), opts...)
 		if err != nil {
 			logFatalln(err)
+			return
+		}
+		rows := make([][]string, 0, len(repos))
+		for _, rd := range repos {
+			rows = append(rows, []string{rd.Name, rd.Description, rd.Contributor.Name, rd.Contributor.Email, rd.Timestamp.String()})
 		}
-		for _, key := range keys {
-			log.Println(key)
+		if err = printList(repos, []string{"NAME", "DESCRIPTION", "CONTRIBUTOR", "EMAIL", "TIMESTAMP"}, rows, next); err != nil {
+			logFatalln(err)
 		}
 	},
 }
 
 func init() {
 	addBucketNameFlag(repoList)
+	addListFlags(repoList, "Only list the repos with a description containing this string")
 	repoCmd.AddCommand(repoList)
 }
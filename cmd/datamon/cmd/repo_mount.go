@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// repoResult is printed by repo mount with --output json
+type repoResult struct {
+	Repo string `json:"repo"`
+	Path string `json:"path"`
+}
+
+var repoMount = &cobra.Command{
+	Use:   "mount",
+	Short: "Mount a repo",
+	Long: `Mount a readonly view of all the bundles of a repo, to compare them with the usual tools:
+  bundles/<id>/  the files of each bundle, read when they are first looked up
+  labels/<name>  symlinks to the bundles of the labels
+  latest         a symlink to the latest bundle
+
+Bundles and labels created while the repo is mounted show up without remounting.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if _, err = c.MountRepo(context.Background(), repoParams.RepoName, bundleOptions.MountPath); err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(repoResult{
+			Repo: repoParams.RepoName,
+			Path: bundleOptions.MountPath,
+		})
+		for {
+			time.Sleep(time.Hour)
+		}
+	},
+}
+
+func init() {
+	requiredFlags := []string{addRepoNameOptionFlag(repoMount), addMountPathFlag(repoMount)}
+	addBucketNameFlag(repoMount)
+	addBlobBucket(repoMount)
+	for _, flag := range requiredFlags {
+		if err := repoMount.MarkFlagRequired(flag); err != nil {
+			logFatalln(err)
+		}
+	}
+	repoCmd.AddCommand(repoMount)
+}
@@ -0,0 +1,52 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+var retentionOptions model.Retention
+
+var repoRetentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Set the retention policy of a repo",
+	Long: `Set the bundles kept when the repo is pruned with "datamon bundle prune".
+
+A bundle is kept when any of the rules keeps it. Labeled bundles and the parents of kept bundles are always kept.
+Setting no rule removes the policy, and the repo can't be pruned.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		policy := retentionOptions
+		if err = core.UpdateRepo(context.Background(), store, repoParams.RepoName, core.RepoRetention(&policy)); err != nil {
+			logFatalln(err)
+			return
+		}
+		printRepo(store, repoParams.RepoName)
+	},
+}
+
+func init() {
+	requiredFlags := []string{addRepoNameOptionFlag(repoRetentionCmd)}
+	repoRetentionCmd.Flags().IntVar(&retentionOptions.KeepLast, keepLast, 0, "Keep the last N bundles")
+	repoRetentionCmd.Flags().IntVar(&retentionOptions.KeepDays, keepDays, 0, "Keep the bundles younger than N days")
+	addBucketNameFlag(repoRetentionCmd)
+
+	for _, flag := range requiredFlags {
+		err := repoRetentionCmd.MarkFlagRequired(flag)
+		if err != nil {
+			logFatalln(err)
+		}
+	}
+
+	repoCmd.AddCommand(repoRetentionCmd)
+}
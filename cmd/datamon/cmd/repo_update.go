@@ -0,0 +1,153 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+var repoUpdate = &cobra.Command{
+	Use:   "update",
+	Short: "Update the description or the contributor of a repo",
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		var opts []core.RepoOption
+		if cmd.Flags().Changed(description) {
+			opts = append(opts, core.RepoDescription(repoParams.Description))
+		}
+		if cmd.Flags().Changed(contributorEmail) || cmd.Flags().Changed(contributorName) {
+			opts = append(opts, core.RepoContributor(model.Contributor{
+				Email: repoParams.ContributorEmail,
+				Name:  repoParams.ContributorName,
+			}))
+		}
+		if len(opts) == 0 {
+			logFatalf("nothing to update, use --%s, --%s or --%s", description, contributorEmail, contributorName)
+			return
+		}
+		if err = core.UpdateRepo(context.Background(), store, repoParams.RepoName, opts...); err != nil {
+			logFatalln(err)
+			return
+		}
+		printRepo(store, repoParams.RepoName)
+	},
+}
+
+var repoDelete = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete a repo",
+	Long: `Delete a repo. Repos with bundles are only deleted with --force, with all their bundles and labels.
+
+The files of the bundles stay in the blob store until "datamon blob gc" runs.
+An interrupted delete can be run again with --resume and the owner of the lock it left,
+it finishes deleting what is left of the repo.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = core.DeleteRepo(context.Background(), store, repoParams.RepoName, repoOptions.Force,
+			core.ResumeLock(repoOptions.Resume)); err != nil {
+			logFatalln(err)
+			return
+		}
+		printResult(model.RepoDescriptor{Name: repoParams.RepoName})
+	},
+}
+
+var repoRename = &cobra.Command{
+	Use:   "rename",
+	Short: "Rename a repo",
+	Long: `Move the bundles and labels of a repo to a new repo, and delete the repo.
+
+Both repos are locked while the bundles are moved.
+An interrupted rename can be run again with --resume and the owner of the locks it left.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = core.RenameRepo(context.Background(), store, repoParams.RepoName, repoOptions.Target,
+			core.ResumeLock(repoOptions.Resume)); err != nil {
+			logFatalln(err)
+			return
+		}
+		printRepo(store, repoOptions.Target)
+	},
+}
+
+var repoCopy = &cobra.Command{
+	Use:   "copy",
+	Short: "Copy a repo",
+	Long: `Copy the bundles and labels of a repo to a new repo. The files of the bundles are shared in the blob store.
+
+Both repos are locked while the bundles are copied.
+An interrupted copy can be run again with --resume and the owner of the locks it left.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = core.CopyRepo(context.Background(), store, repoParams.RepoName, repoOptions.Target,
+			core.ResumeLock(repoOptions.Resume)); err != nil {
+			logFatalln(err)
+			return
+		}
+		printRepo(store, repoOptions.Target)
+	},
+}
+
+var repoUnlock = &cobra.Command{
+	Use:   "unlock",
+	Short: "Remove the lock left on a repo by an interrupted command",
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := newMetadataStore()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if err = core.UnlockRepo(context.Background(), store, repoParams.RepoName); err != nil {
+			logFatalln(err)
+			return
+		}
+		printRepo(store, repoParams.RepoName)
+	},
+}
+
+func init() {
+	addRepoDescription(repoUpdate)
+	addContributorEmail(repoUpdate)
+	addContributorName(repoUpdate)
+	repoDelete.Flags().BoolVar(&repoOptions.Force, force, false, "Delete the repo with all its bundles and labels")
+	for _, cmd := range []*cobra.Command{repoDelete, repoRename, repoCopy} {
+		addResumeLockFlag(cmd)
+	}
+
+	for _, cmd := range []*cobra.Command{repoUpdate, repoDelete, repoRename, repoCopy, repoUnlock} {
+		requiredFlags := []string{addRepoNameOptionFlag(cmd)}
+		if cmd == repoRename || cmd == repoCopy {
+			requiredFlags = append(requiredFlags, addTargetRepoFlag(cmd))
+		}
+		addBucketNameFlag(cmd)
+		for _, flag := range requiredFlags {
+			if err := cmd.MarkFlagRequired(flag); err != nil {
+				logFatalln(err)
+			}
+		}
+		repoCmd.AddCommand(cmd)
+	}
+}
@@ -27,6 +27,34 @@ const (
 	contributorName  = "name"
 	credential       = "credential"
 	file             = "file"
+	keyfile          = "keyfile"
+	compression      = "compression"
+	chunker          = "chunker"
+	layout           = "layout"
+	hash             = "hash"
+	reason           = "reason"
+	dryRun           = "dry-run"
+	label            = "label"
+	force            = "force"
+	keepLast         = "keep-last"
+	keepDays         = "keep-days"
+	targetRepo       = "to"
+	resumeLock       = "resume"
+	format           = "format"
+	limit            = "limit"
+	token            = "token"
+	since            = "since"
+	until            = "until"
+	contributor      = "contributor"
+	descending       = "desc"
+	output           = "output"
+	listen           = "listen"
+	authToken        = "auth-token"
+	staging          = "staging"
+	endpoint         = "endpoint"
+	nodeID           = "node-id"
+	node             = "node"
+	controller       = "controller"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -45,23 +73,25 @@ It executes pipelines by scheduling the processors as serverless functions on ei
 
 var config *Config
 var credFile string
+var keyFile string
 
 // used to patch over calls to os.Exit() during test
-var logFatalln = log.Fatalln
-var logFatalf = log.Fatalf
+var logFatalln = fatalln
+var logFatalf = fatalf
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	var err error
 	if err = rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
 }
 
 func init() {
 	log.SetFlags(0)
+	addOutputFlag(rootCmd)
 	cobra.OnInitialize(initConfig)
 }
 
@@ -79,6 +109,10 @@ func initConfig() {
 		viper.SetConfigName("datamon")
 	}
 
+	if outputFormat != outputText && outputFormat != outputJSON {
+		logFatalf("unknown output %q, expecting %s or %s", outputFormat, outputText, outputJSON)
+	}
+
 	viper.AutomaticEnv() // read in environment variables that match
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
@@ -101,3 +135,8 @@ func addCredentialFile(cmd *cobra.Command) string {
 	cmd.Flags().StringVar(&credFile, credential, "", "The path to the credential file")
 	return contributorName
 }
+
+func addKeyFileFlag(cmd *cobra.Command) string {
+	cmd.Flags().StringVar(&keyFile, keyfile, "", "The path to the key file used to encrypt repo data, created if missing")
+	return keyfile
+}
@@ -0,0 +1,110 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/oneconcern/datamon/pkg/web"
+	"github.com/spf13/cobra"
+)
+
+var serveOptions struct {
+	Listen     string
+	AuthToken  string
+	StagingDir string
+}
+
+var serveS3Options struct {
+	Listen string
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve repos and bundles over HTTP",
+	Long: `Serve a REST API to list repos and bundles, download files and upload bundles.
+
+Requests must authenticate with the bearer token of --auth-token or of the DATAMON_AUTH_TOKEN environment variable,
+the API is open when none is set. Bundles uploaded through the API are contributed by --name and --email.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		if serveOptions.AuthToken == "" {
+			serveOptions.AuthToken = os.Getenv("DATAMON_AUTH_TOKEN")
+		}
+		if serveOptions.AuthToken == "" {
+			log.Println("No auth token set, the API is open to anyone reaching", serveOptions.Listen)
+		}
+		opts := []web.Option{web.Token(serveOptions.AuthToken)}
+		if serveOptions.StagingDir != "" {
+			opts = append(opts, web.StagingDir(serveOptions.StagingDir))
+		}
+		listenAndServe(serveOptions.Listen, web.New(c, opts...))
+	},
+}
+
+var serveS3Cmd = &cobra.Command{
+	Use:   "s3",
+	Short: "Serve bundles as read only S3 buckets",
+	Long: `Serve an S3 compatible gateway, reading bundles with the tools that speak S3.
+
+Each repo is a bucket, and the files of bundles are the objects <bundle or label>/<path>.
+Clients must use path style requests, and may use any credentials: request signatures are not verified.
+
+Example:
+  aws --endpoint-url http://localhost:9000 s3 cp s3://ritesh-test-repo/production/path/to/file .`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newClient()
+		if err != nil {
+			logFatalln(err)
+			return
+		}
+		listenAndServe(serveS3Options.Listen, web.NewS3Gateway(c))
+	},
+}
+
+// listenAndServe serves requests until the process is interrupted
+func listenAndServe(addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("Shutting down")
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	log.Printf("Serving on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logFatalln(err)
+	}
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveOptions.Listen, listen, ":8080", "The address to listen on")
+	serveCmd.Flags().StringVar(&serveOptions.AuthToken, authToken, "", "The bearer token requests must authenticate with")
+	serveCmd.Flags().StringVar(&serveOptions.StagingDir, staging, "",
+		"The directory staging uploaded files until they are committed, the temporary directory by default")
+	addBucketNameFlag(serveCmd)
+	addBlobBucket(serveCmd)
+	addContributorEmail(serveCmd)
+	addContributorName(serveCmd)
+	rootCmd.AddCommand(serveCmd)
+
+	serveS3Cmd.Flags().StringVar(&serveS3Options.Listen, listen, ":9000", "The address to listen on")
+	addBucketNameFlag(serveS3Cmd)
+	addBlobBucket(serveS3Cmd)
+	serveCmd.AddCommand(serveS3Cmd)
+}
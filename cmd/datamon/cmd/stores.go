@@ -0,0 +1,42 @@
+// Copyright © 2018 One Concern
+
+package cmd
+
+import (
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// newClient creates a client on the buckets of the flags, with the configured credential and key
+func newClient() (*client.Client, error) {
+	return client.New(client.Config{
+		MetadataBucket: repoParams.MetadataBucket,
+		BlobBucket:     repoParams.BlobBucket,
+		Credential:     config.Credential,
+		KeyFile:        config.KeyFile,
+		Contributor: model.Contributor{
+			Name:  repoParams.ContributorName,
+			Email: repoParams.ContributorEmail,
+		},
+	})
+}
+
+// newMetadataStore creates the store for repo and bundle metadata.
+// Repo descriptors are kept in clear text so that they can record the encryption of the repo.
+func newMetadataStore() (storage.Store, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.MetaStore(), nil
+}
+
+// newBlobStore creates the store for the content addressable blobs.
+func newBlobStore() (storage.Store, error) {
+	c, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return c.BlobStore(), nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/aws/aws-sdk-go v1.18.6
 	github.com/container-storage-interface/spec v0.3.0
 	github.com/docker/go-units v0.3.3
+	github.com/golang/protobuf v1.2.0
 	github.com/hashicorp/go-immutable-radix v1.0.0
 	github.com/jacobsa/fuse v0.0.0-20180417054321-cd3959611bcb
 	github.com/json-iterator/go v1.1.6
@@ -10,6 +10,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"github.com/oneconcern/datamon/pkg/progress"
 	"github.com/oneconcern/datamon/pkg/storage"
 	"github.com/oneconcern/datamon/pkg/storage/localfs"
 
@@ -33,6 +34,32 @@ func LeafSize(sz uint32) Option {
 	}
 }
 
+// Progress reports the bytes written by Put and read by Get to the tracker
+func Progress(t *progress.Tracker) Option {
+	return func(w *defaultFs) {
+		w.progress = t
+	}
+}
+
+// Compression compresses the leaves written by Put with the named codec, and reads back the leaves written with it.
+// Keys are always computed over the uncompressed data: the compressed leaves are stored apart from the raw ones,
+// so the same codec must be used to read content, as recorded by the bundle.
+func Compression(codec string) Option {
+	return func(w *defaultFs) {
+		w.compression = codec
+	}
+}
+
+// ContentDefinedChunking splits the content written by Put into leaves of variable size, from min to max bytes,
+// at boundaries found with FastCDC rather than every leaf size bytes.
+//
+// Inserting data in a file then only changes the leaves around the insertion, instead of every leaf after it.
+func ContentDefinedChunking(min, avg, max uint32) Option {
+	return func(w *defaultFs) {
+		w.chunkSizes = []uint32{min, avg, max}
+	}
+}
+
 type HasOption func(*hasOpts)
 
 func HasOnlyRoots() HasOption {
@@ -77,6 +104,7 @@ type Fs interface {
 	Keys(context.Context) ([]Key, error)
 	RootKeys(context.Context) ([]Key, error)
 	Has(context.Context, Key, ...HasOption) (bool, []Key, error)
+	Leaves(context.Context, Key) ([]Key, error)
 }
 
 // New creates a new file system operations instance for a repository
@@ -89,6 +117,16 @@ func New(opts ...Option) (Fs, error) {
 	for _, apply := range opts {
 		apply(f)
 	}
+	if err := validCompression(f.compression); err != nil {
+		return nil, err
+	}
+	if f.chunkSizes != nil {
+		c, err := newChunker(f.chunkSizes[0], f.chunkSizes[1], f.chunkSizes[2])
+		if err != nil {
+			return nil, err
+		}
+		f.chunker = c
+	}
 	return f, nil
 }
 
@@ -99,10 +137,23 @@ type defaultFs struct {
 	zl             zap.Logger //nolint:structcheck,unused
 	l              log.Logger //nolint:structcheck,unused
 	leafTruncation bool
+	progress       *progress.Tracker
+	compression    string
+	chunkSizes     []uint32
+	chunker        *chunker
+}
+
+// layout returns the paths of the blobs, as recorded in the store
+func (d *defaultFs) layout(ctx context.Context) (*blobLayout, error) {
+	return layouts.get(ctx, d.fs, d.prefix)
 }
 
 func (d *defaultFs) Put(ctx context.Context, src io.Reader) (int64, Key, []byte, bool, error) {
-	w := d.writer(d.prefix)
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return 0, Key{}, nil, false, err
+	}
+	w := d.writer(ctx, layout)
 	defer w.Close()
 	written, err := io.Copy(w, src)
 	if err != nil {
@@ -115,15 +166,15 @@ func (d *defaultFs) Put(ctx context.Context, src io.Reader) (int64, Key, []byte,
 	if err = w.Close(); err != nil {
 		return 0, Key{}, nil, false, err
 	}
-	found, _ := d.fs.Has(context.TODO(), d.prefix+key.String())
+	found, _ := d.fs.Has(ctx, layout.root(key.String()))
 	if !found {
 		crcFS, ok := d.fs.(storage.StoreCRC)
 		if ok {
 			buffer := append(keys, key[:]...)
 			crc := crc32.Checksum(buffer, crc32.MakeTable(crc32.Castagnoli))
-			err = crcFS.PutCRC(context.TODO(), d.prefix+key.String(), bytes.NewReader(buffer), storage.OverWrite, crc)
+			err = crcFS.PutCRC(ctx, layout.root(key.String()), bytes.NewReader(buffer), storage.OverWrite, crc)
 		} else {
-			err = d.fs.Put(ctx, d.prefix+key.String(), bytes.NewReader(append(keys, key[:]...)), storage.OverWrite)
+			err = d.fs.Put(ctx, layout.root(key.String()), bytes.NewReader(append(keys, key[:]...)), storage.OverWrite)
 		}
 		if err != nil {
 			return 0, Key{}, nil, found, err
@@ -133,40 +184,68 @@ func (d *defaultFs) Put(ctx context.Context, src io.Reader) (int64, Key, []byte,
 	return written, key, keys, found, nil
 }
 
+// Get returns a reader of the content of a key. It is also an io.Seeker, seeking from the start of the content.
 func (d *defaultFs) Get(ctx context.Context, hash Key) (io.ReadCloser, error) {
-	return newReader(d.fs, hash, d.leafSize, d.prefix, TruncateLeaf(d.leafTruncation))
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(ctx, d.fs, hash, d.leafSize, d.prefix, TruncateLeaf(d.leafTruncation), ReportTo(d.progress), withLayout(layout, d.compression))
 }
 
-func (d *defaultFs) writer(prefix string) Writer {
+func (d *defaultFs) writer(ctx context.Context, layout *blobLayout) Writer {
+	bufSize := int(d.leafSize)
+	if d.chunker != nil {
+		bufSize = d.chunker.max
+	}
 	return &fsWriter{
+		ctx:           ctx,
 		fs:            d.fs,
 		leafSize:      d.leafSize,
 		leafs:         nil,
-		buf:           make([]byte, d.leafSize),
+		buf:           make([]byte, bufSize),
 		offset:        0,
 		flushed:       0,
-		pather:        nil,
-		prefix:        prefix,
+		pather:        layout.compressedLeaf(d.compression),
+		prefix:        d.prefix,
 		count:         0,
 		flushChan:     make(chan blobFlush, 100000),
 		errC:          make(chan error, 1000000),
 		maxGoRoutines: make(chan struct{}, maxGoRoutinesPerPut),
 		wg:            sync.WaitGroup{},
+		progress:      d.progress,
+		compression:   d.compression,
+		chunker:       d.chunker,
 	}
 }
 
+// Delete deletes a root object and its leaves, whatever codec they were written with
 func (d *defaultFs) Delete(ctx context.Context, hash Key) error {
-	keys, err := LeafsForHash(d.fs, hash, d.leafSize, d.prefix)
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return err
+	}
+	keys, _, err := leafsAndLengthsAt(ctx, d.fs, layout.root(hash.String()), hash, d.leafSize)
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
-		if err = d.fs.Delete(ctx, key.String()); err != nil {
-			return err
+		for _, namespace := range append([]string{""}, codecNamespaces()...) {
+			path := layout.at(namespace, key.String())
+			found, err := d.fs.Has(ctx, path)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			if err = d.fs.Delete(ctx, path); err != nil {
+				return err
+			}
 		}
 	}
 
-	return d.fs.Delete(ctx, hash.String())
+	return d.fs.Delete(ctx, layout.root(hash.String()))
 }
 
 func (d *defaultFs) Clear(ctx context.Context) error {
@@ -178,19 +257,26 @@ func (d *defaultFs) Keys(ctx context.Context) ([]Key, error) {
 }
 
 func (d *defaultFs) keys(ctx context.Context, matches func(Key) bool) ([]Key, error) {
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return nil, err
+	}
 	v, err := d.fs.Keys(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	result := make([]Key, 0, len(v))
+	seen := make(map[Key]bool, len(v))
 	for _, k := range v {
-		kk, err := KeyFromString(k)
+		kk, _, ok, err := layout.parse(k)
 		if err != nil {
 			return nil, err
 		}
 
-		if matches(kk) {
+		// a leaf written with several codecs is listed once
+		if ok && !seen[kk] && matches(kk) {
+			seen[kk] = true
 			result = append(result, kk)
 		}
 	}
@@ -198,11 +284,52 @@ func (d *defaultFs) keys(ctx context.Context, matches func(Key) bool) ([]Key, er
 }
 
 func (d *defaultFs) RootKeys(ctx context.Context) ([]Key, error) {
-	return d.keys(ctx, d.matchOnlyObjectRoots)
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if layout.Roots == "" {
+		// root objects are mixed with the leaves, every blob has to be read, see MigrateRoots
+		return d.keys(ctx, func(key Key) bool { return d.matchOnlyObjectRoots(ctx, layout, key) })
+	}
+	var (
+		result []Key
+		token  string
+	)
+	for {
+		paths, next, err := d.fs.KeysPrefix(ctx, token, d.prefix+layout.Roots, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			k, _, ok, err := layout.parse(p)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				result = append(result, k)
+			}
+		}
+		if next == "" {
+			return result, nil
+		}
+		token = next
+	}
+}
+
+func (d *defaultFs) matchOnlyObjectRoots(ctx context.Context, layout *blobLayout, key Key) bool {
+	keys, _, err := leafsAndLengthsAt(ctx, d.fs, layout.root(key.String()), key, d.leafSize)
+	return err == nil && len(keys) > 0
 }
 
-func (d *defaultFs) matchOnlyObjectRoots(key Key) bool {
-	return IsRootKey(d.fs, key, d.leafSize)
+// Leaves returns the keys of the leaves of a root key
+func (d *defaultFs) Leaves(ctx context.Context, key Key) ([]Key, error) {
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, _, err := leafsAndLengthsAt(ctx, d.fs, layout.root(key.String()), key, d.leafSize)
+	return keys, err
 }
 
 func (d *defaultFs) Has(ctx context.Context, key Key, cfgs ...HasOption) (bool, []Key, error) {
@@ -211,7 +338,11 @@ func (d *defaultFs) Has(ctx context.Context, key Key, cfgs ...HasOption) (bool,
 		apply(&opts)
 	}
 
-	has, err := d.fs.Has(ctx, key.String())
+	layout, err := d.layout(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	has, err := d.fs.Has(ctx, layout.root(key.String()))
 	if err != nil {
 		return false, nil, err
 	}
@@ -224,7 +355,7 @@ func (d *defaultFs) Has(ctx context.Context, key Key, cfgs ...HasOption) (bool,
 		return has, nil, nil
 	}
 
-	ks, err := LeafsForHash(d.fs, key, d.leafSize, d.prefix)
+	ks, _, err := leafsAndLengthsAt(ctx, d.fs, layout.root(key.String()), key, d.leafSize)
 	if err != nil {
 		return false, nil, nil
 	}
@@ -235,7 +366,7 @@ func (d *defaultFs) Has(ctx context.Context, key Key, cfgs ...HasOption) (bool,
 	var keys []Key
 	if opts.GatherIncomplete {
 		for _, k := range ks {
-			if ok, err := d.fs.Has(ctx, k.String()); err != nil || !ok {
+			if ok, err := d.fs.Has(ctx, layout.compressedLeaf(d.compression)(k.String())); err != nil || !ok {
 				keys = append(keys, k)
 			}
 		}
@@ -245,6 +376,7 @@ func (d *defaultFs) Has(ctx context.Context, key Key, cfgs ...HasOption) (bool,
 
 func matchAnyKey(_ Key) bool { return true }
 
+// IsRootKey tells if a key is the key of a root object in a blob store without prefix
 func IsRootKey(fs storage.Store, key Key, leafSize uint32) bool {
 	keys, err := LeafsForHash(fs, key, leafSize, "")
 	if err != nil {
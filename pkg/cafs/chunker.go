@@ -0,0 +1,88 @@
+package cafs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// FastCDCChunker is the name recorded for content defined chunking
+const FastCDCChunker = "fastcdc"
+
+// Default chunk sizes for content defined chunking
+const (
+	DefaultMinChunkSize = 512 * 1024
+	DefaultAvgChunkSize = 2 * 1024 * 1024
+	DefaultMaxChunkSize = 8 * 1024 * 1024
+)
+
+// gear is the table of random values rolled into the fingerprint.
+// It is derived from a fixed seed: changing it changes every chunk boundary.
+var gear = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("datamon-fastcdc-gear-%d", i)))
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return
+}()
+
+// chunker finds content defined chunk boundaries with FastCDC and normalized chunking.
+//
+// Boundaries only depend on the bytes right before them, so inserting data in a file only
+// changes the leaves around the insertion.
+type chunker struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+func newChunker(min, avg, max uint32) (*chunker, error) {
+	if min == 0 || min >= avg || avg >= max {
+		return nil, fmt.Errorf("invalid chunk sizes min:%d avg:%d max:%d, expected 0 < min < avg < max", min, avg, max)
+	}
+	b := bits.Len32(avg) - 1 // log2 of avg
+	if b < 2 || b > 62 {
+		return nil, fmt.Errorf("invalid average chunk size %d", avg)
+	}
+	return &chunker{
+		min:   int(min),
+		avg:   int(avg),
+		max:   int(max),
+		maskS: topBits(b + 1), // before the average size: harder to match
+		maskL: topBits(b - 1), // past the average size: easier to match
+	}, nil
+}
+
+func topBits(n int) uint64 {
+	return ^uint64(0) << uint(64-n)
+}
+
+// cut returns the length of the first chunk in data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,130 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testMinChunk = 2 * 1024
+	testAvgChunk = 8 * 1024
+	testMaxChunk = 32 * 1024
+)
+
+func TestChunker_Bounds(t *testing.T) {
+	c, err := newChunker(testMinChunk, testAvgChunk, testMaxChunk)
+	require.NoError(t, err)
+
+	data := internal.RandBytesMaskImprSrc(1024 * 1024)
+	var total, count int
+	for rest := data; len(rest) > 0; {
+		n := c.cut(rest)
+		require.True(t, n <= testMaxChunk)
+		if n < len(rest) {
+			require.True(t, n >= testMinChunk)
+		}
+		total += n
+		count++
+		rest = rest[n:]
+	}
+	require.Equal(t, len(data), total)
+	avg := len(data) / count
+	require.True(t, avg > testMinChunk && avg < testMaxChunk, "average chunk size %d", avg)
+
+	_, err = newChunker(testAvgChunk, testMinChunk, testMaxChunk)
+	require.Error(t, err)
+}
+
+func putCDC(t *testing.T, fs Fs, data []byte) (Key, []Key) {
+	_, key, _, _, err := fs.Put(context.Background(), bytes.NewReader(data))
+	require.NoError(t, err)
+	leafs, err := LeafsForHash(fs.(*defaultFs).fs, key, leafSize, "")
+	require.NoError(t, err)
+	return key, leafs
+}
+
+func TestCAFS_ContentDefinedChunking(t *testing.T) {
+	ctx := context.Background()
+	blobs := localfs.New(afero.NewMemMapFs())
+	fs, err := New(
+		LeafSize(leafSize),
+		Backend(blobs),
+		ContentDefinedChunking(testMinChunk, testAvgChunk, testMaxChunk),
+	)
+	require.NoError(t, err)
+
+	data := internal.RandBytesMaskImprSrc(512*1024 + 17)
+	key, leafs := putCDC(t, fs, data)
+
+	// lengths are recorded in the root object and verified by the root key
+	rdr, err := blobs.Get(ctx, key.String())
+	require.NoError(t, err)
+	root, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	keys, lengths, err := LeafKeysAndLengths(key, root, leafSize)
+	require.NoError(t, err)
+	require.Equal(t, leafs, keys)
+	var total int
+	for _, l := range lengths {
+		total += int(l)
+	}
+	require.Equal(t, len(data), total)
+
+	root[len(root)-KeySize-len(leafLengthsMagic)-1] ^= 0xff
+	_, _, err = LeafKeysAndLengths(key, root, leafSize)
+	require.Error(t, err)
+
+	got, err := fs.Get(ctx, key)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(got)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// WriterAt fast path rebuilds offsets from the lengths
+	r, err := newReader(ctx, blobs, key, leafSize, "")
+	require.NoError(t, err)
+	w := &fakeWriteAt{data: make([]byte, len(data))}
+	n, err := r.(*chunkReader).WriteTo(w)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, w.data)
+
+	// Inserting a few bytes at the start only changes the first leaves
+	edited := append([]byte("inserted"), data...)
+	_, editedLeafs := putCDC(t, fs, edited)
+	shared := make(map[Key]bool, len(leafs))
+	for _, k := range leafs {
+		shared[k] = true
+	}
+	var reused int
+	for _, k := range editedLeafs {
+		if shared[k] {
+			reused++
+		}
+	}
+	require.True(t, reused >= len(leafs)-2, "only %d leaves out of %d reused", reused, len(leafs))
+}
+
+func TestCAFS_ContentDefinedChunkingEmpty(t *testing.T) {
+	fs, err := New(
+		LeafSize(leafSize),
+		Backend(localfs.New(afero.NewMemMapFs())),
+		ContentDefinedChunking(testMinChunk, testAvgChunk, testMaxChunk),
+	)
+	require.NoError(t, err)
+	key, leafs := putCDC(t, fs, nil)
+	require.Empty(t, leafs)
+
+	got, err := fs.Get(context.Background(), key)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(got)
+	require.NoError(t, err)
+	require.Empty(t, b)
+}
@@ -0,0 +1,162 @@
+package cafs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Compression codecs for leaf blobs
+const (
+	NoCompression   = ""
+	GzipCompression = "gzip"
+)
+
+// leafMagic prefixes the leaves written with compression, it is followed by the codec id.
+// Leaves written without compression are stored as is.
+var leafMagic = []byte("DMZLEAF")
+
+const (
+	leafHeaderSize = 8
+	rawCodecID     = 0 // the leaf did not get smaller compressed, and is stored as is after the header
+)
+
+type codec struct {
+	id         byte
+	compress   func(io.Writer) io.WriteCloser
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	GzipCompression: {
+		id:       1,
+		compress: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// CompressionCodecs lists the names of the supported leaf compression codecs
+func CompressionCodecs() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validCompression(name string) error {
+	if name == NoCompression {
+		return nil
+	}
+	if _, ok := codecs[name]; !ok {
+		return fmt.Errorf("unsupported compression %q, expected one of %v", name, CompressionCodecs())
+	}
+	return nil
+}
+
+// encodeLeaf compresses a leaf with the named codec, the leaf is kept as is without codec.
+// Compressed leaves start with a header, which records that the leaf was kept raw when compression
+// would not have made it smaller.
+func encodeLeaf(name string, leaf []byte) ([]byte, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return leaf, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(leaf) / 2)
+	buf.Write(leafMagic)
+	buf.WriteByte(c.id)
+	cw := c.compress(&buf)
+	if _, err := cw.Write(leaf); err != nil {
+		return nil, fmt.Errorf("compress leaf: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		return nil, fmt.Errorf("compress leaf: %v", err)
+	}
+	if buf.Len() >= len(leaf)+leafHeaderSize {
+		return rawLeaf(leaf), nil
+	}
+	return buf.Bytes(), nil
+}
+
+func rawLeaf(leaf []byte) []byte {
+	blob := make([]byte, leafHeaderSize+len(leaf))
+	copy(blob, leafMagic)
+	blob[len(leafMagic)] = rawCodecID
+	copy(blob[leafHeaderSize:], leaf)
+	return blob
+}
+
+type leafReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (l *leafReader) Close() error {
+	var err error
+	for _, c := range l.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// decodeLeaf decompresses a leaf read from the blob store, written with the named codec.
+// The codec comes from the bundle, leaves written without compression are read as is whatever they start with.
+func decodeLeaf(name string, rdr io.ReadCloser) (io.ReadCloser, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return rdr, nil
+	}
+	br := bufio.NewReader(rdr)
+	header, err := br.Peek(leafHeaderSize)
+	if err != nil && err != io.EOF {
+		rdr.Close()
+		return nil, err
+	}
+	if len(header) < leafHeaderSize || !bytes.Equal(header[:len(leafMagic)], leafMagic) {
+		rdr.Close()
+		return nil, fmt.Errorf("leaf compressed with %s has no header", name)
+	}
+	_, _ = br.Discard(leafHeaderSize)
+	switch header[len(leafMagic)] {
+	case rawCodecID:
+		return &leafReader{Reader: br, closers: []io.Closer{rdr}}, nil
+	case c.id:
+		dr, err := c.decompress(br)
+		if err != nil {
+			rdr.Close()
+			return nil, fmt.Errorf("decompress leaf: %v", err)
+		}
+		return &leafReader{Reader: dr, closers: []io.Closer{dr, rdr}}, nil
+	default:
+		rdr.Close()
+		return nil, fmt.Errorf("leaf compressed with codec %d, expected %s", header[len(leafMagic)], name)
+	}
+}
+
+// codecNamespace returns the namespace of the leaves compressed with a codec, none for raw leaves.
+// The key of a leaf is computed over the uncompressed data, so the leaves of bundles written with
+// and without compression are stored apart, and each is read as written by its bundle.
+func codecNamespace(name string) string {
+	if name == NoCompression {
+		return ""
+	}
+	return name + "/"
+}
+
+// codecNamespaces lists the namespaces of the compressed leaves
+func codecNamespaces() []string {
+	names := CompressionCodecs()
+	for i, name := range names {
+		names[i] = codecNamespace(name)
+	}
+	return names
+}
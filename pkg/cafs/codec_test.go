@@ -0,0 +1,162 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAFS_Compression(t *testing.T) {
+	ctx := context.Background()
+	const leafSize = 4 * 1024
+	data := []byte(strings.Repeat("id,name,value\n1,datamon,42\n", 1000))
+
+	raw := localfs.New(afero.NewMemMapFs())
+	plainFs, err := New(LeafSize(leafSize), Backend(raw))
+	require.NoError(t, err)
+	_, plainKey, plainLeafs, _, err := plainFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	blobs := localfs.New(afero.NewMemMapFs())
+	gzFs, err := New(LeafSize(leafSize), Backend(blobs), Compression(GzipCompression))
+	require.NoError(t, err)
+	_, gzKey, gzLeafs, _, err := gzFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// Keys are computed over the uncompressed content
+	require.Equal(t, plainKey, gzKey)
+	require.Equal(t, plainLeafs, gzLeafs)
+
+	leafs, err := LeafsForHash(blobs, gzKey, leafSize, "")
+	require.NoError(t, err)
+	rdr, err := blobs.Get(ctx, codecNamespace(GzipCompression)+leafs[0].String())
+	require.NoError(t, err)
+	stored, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(stored, leafMagic))
+	require.True(t, len(stored) < leafSize)
+
+	got, err := gzFs.Get(ctx, gzKey)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(got)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	// WriterAt fast path
+	rdr, err = gzFs.Get(ctx, gzKey)
+	require.NoError(t, err)
+	w := &fakeWriteAt{data: make([]byte, len(data))}
+	n, err := rdr.(*chunkReader).WriteTo(w)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, w.data)
+
+	// leaves written without compression are stored as is
+	leafs, err = LeafsForHash(raw, plainKey, leafSize, "")
+	require.NoError(t, err)
+	rdr, err = raw.Get(ctx, leafs[0].String())
+	require.NoError(t, err)
+	stored, err = ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, data[:leafSize], stored)
+}
+
+func TestCAFS_CompressionIncompressible(t *testing.T) {
+	ctx := context.Background()
+	const leafSize = 4 * 1024
+	data := make([]byte, 2*leafSize+10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	blobs := localfs.New(afero.NewMemMapFs())
+	fs, err := New(LeafSize(leafSize), Backend(blobs), Compression(GzipCompression))
+	require.NoError(t, err)
+	_, key, _, _, err := fs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	// Random data is stored raw since compression would make it larger
+	leafs, err := LeafsForHash(blobs, key, leafSize, "")
+	require.NoError(t, err)
+	rdr, err := blobs.Get(ctx, codecNamespace(GzipCompression)+leafs[0].String())
+	require.NoError(t, err)
+	stored, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, rawLeaf(data[:leafSize]), stored)
+
+	got, err := fs.Get(ctx, key)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(got)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+}
+
+func TestCAFS_RawLeafWithMagic(t *testing.T) {
+	ctx := context.Background()
+	const leafSize = 4 * 1024
+	// a raw leaf which looks like a gzip compressed one
+	data := make([]byte, leafSize+10)
+	rand.New(rand.NewSource(2)).Read(data)
+	copy(data, leafMagic)
+	data[len(leafMagic)] = codecs[GzipCompression].id
+
+	for _, compression := range []string{NoCompression, GzipCompression} {
+		blobs := localfs.New(afero.NewMemMapFs())
+		fs, err := New(LeafSize(leafSize), Backend(blobs), Compression(compression))
+		require.NoError(t, err)
+		_, key, _, _, err := fs.Put(ctx, bytes.NewReader(data))
+		require.NoError(t, err)
+
+		got, err := fs.Get(ctx, key)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(got)
+		require.NoError(t, err)
+		require.Equal(t, data, b, compression)
+	}
+}
+
+func TestCAFS_CompressionSharedStore(t *testing.T) {
+	ctx := context.Background()
+	const leafSize = 4 * 1024
+	data := []byte(strings.Repeat("id,name,value\n1,datamon,42\n", 300))
+
+	// the same content written with and without compression, in either order
+	blobs := localfs.New(afero.NewMemMapFs())
+	plainFs, err := New(LeafSize(leafSize), Backend(blobs))
+	require.NoError(t, err)
+	gzFs, err := New(LeafSize(leafSize), Backend(blobs), Compression(GzipCompression))
+	require.NoError(t, err)
+	_, plainKey, _, _, err := plainFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	_, gzKey, _, _, err := gzFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, plainKey, gzKey)
+
+	// the leaves are stored apart and each filesystem reads its own
+	for _, fs := range []Fs{plainFs, gzFs} {
+		got, err := fs.Get(ctx, plainKey)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(got)
+		require.NoError(t, err)
+		require.Equal(t, data, b)
+	}
+	keys, err := plainFs.Keys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+
+	// deleting the content deletes the leaves of every codec
+	require.NoError(t, plainFs.Delete(ctx, plainKey))
+	paths, err := blobs.Keys(ctx)
+	require.NoError(t, err)
+	require.Empty(t, paths)
+}
+
+func TestCAFS_UnknownCompression(t *testing.T) {
+	_, err := New(Compression("lz4"))
+	require.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package cafs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// Sweep deletes the blobs of a store which are not kept, to collect the garbage left by deleted bundles.
+//
+// keep is called with the key of every root object and leaf found in the store.
+// deleted is called for every blob deleted, or which would be deleted in a dry run.
+// Objects which are not blobs, like the layout marker, are left alone.
+func Sweep(ctx context.Context, blobs storage.Store, prefix string, keep func(Key) bool, dryRun bool, deleted func(Key)) error {
+	layout, err := readBlobLayout(ctx, blobs, prefix)
+	if err != nil {
+		return err
+	}
+	paths, err := blobs.Keys(ctx)
+	if err != nil {
+		return err
+	}
+	return internal.Parallel(len(paths), migrationConcurrency, func(i int) error {
+		k, _, ok, err := layout.parse(paths[i])
+		if err != nil || !ok || keep(k) {
+			return nil
+		}
+		if !dryRun {
+			if err = blobs.Delete(ctx, paths[i]); err != nil {
+				return fmt.Errorf("%s: %v", paths[i], err)
+			}
+		}
+		if deleted != nil {
+			deleted(k)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	blobs := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, MigrateLayout(ctx, blobs, "", ShardedLayout, nil))
+
+	fs, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	_, live, _, _, err := fs.Put(ctx, bytes.NewReader(internal.RandBytesMaskImprSrc(2*1024+5)))
+	require.NoError(t, err)
+	_, garbage, _, _, err := fs.Put(ctx, bytes.NewReader(internal.RandBytesMaskImprSrc(3*1024)))
+	require.NoError(t, err)
+
+	kept := map[Key]bool{live: true}
+	leaves, err := fs.Leaves(ctx, live)
+	require.NoError(t, err)
+	for _, k := range leaves {
+		kept[k] = true
+	}
+	keep := func(k Key) bool { return kept[k] }
+
+	var (
+		lock    sync.Mutex
+		deleted []Key
+	)
+	collect := func(k Key) {
+		lock.Lock()
+		deleted = append(deleted, k)
+		lock.Unlock()
+	}
+	require.NoError(t, Sweep(ctx, blobs, "", keep, true, collect))
+	require.Len(t, deleted, 4)
+	require.Contains(t, deleted, garbage)
+	keys, err := fs.Keys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 8)
+
+	deleted = nil
+	require.NoError(t, Sweep(ctx, blobs, "", keep, false, collect))
+	require.Len(t, deleted, 4)
+	keys, err = fs.Keys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 4)
+
+	// the marker is left alone and the live file is still readable
+	layout, err := ReadLayout(ctx, blobs, "")
+	require.NoError(t, err)
+	require.Equal(t, ShardedLayout, layout)
+	rdr, err := fs.Get(ctx, live)
+	require.NoError(t, err)
+	require.NoError(t, rdr.Close())
+}
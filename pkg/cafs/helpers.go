@@ -3,6 +3,7 @@ package cafs
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -21,7 +22,25 @@ func CopyPaddedJSON(w io.Writer, buf *bytes.Buffer) {
 	fmt.Fprint(w, string(buf.Bytes()[buf.Len()-3:]))
 }
 
+// leafLengthsMagic marks root objects recording the length of every leaf, as written by content defined chunking.
+//
+// Such root objects are laid out as: leaf keys | leaf lengths (4 bytes each) | magic | root key
+var leafLengthsMagic = []byte("DMCDC\x00\x00\x01")
+
 func RootHash(leaves []Key, leafSize uint32) (Key, error) {
+	return rootHash(leaves, nil, leafSize)
+}
+
+// RootHashWithLengths computes the root key of leaves of variable length.
+// The lengths are part of the hash, so the offsets rebuilt from a root object can be verified.
+func RootHashWithLengths(leaves []Key, lengths []uint32, leafSize uint32) (Key, error) {
+	if len(leaves) != len(lengths) {
+		return Key{}, fmt.Errorf("got %d leaf lengths for %d leaves", len(lengths), len(leaves))
+	}
+	return rootHash(leaves, encodeLengths(lengths), leafSize)
+}
+
+func rootHash(leaves []Key, suffix []byte, leafSize uint32) (Key, error) {
 	// Compute hash of level 1 root key
 	hasher, err := blake2b.New(&blake2b.Config{
 		Size: blake2b.Size,
@@ -46,6 +65,11 @@ func RootHash(leaves []Key, leafSize uint32) (Key, error) {
 			return Key{}, err
 		}
 	}
+	if len(suffix) > 0 {
+		if _, err = hasher.Write(suffix); err != nil {
+			return Key{}, err
+		}
+	}
 
 	k, err := NewKey(hasher.Sum(nil))
 	if err != nil {
@@ -54,47 +78,122 @@ func RootHash(leaves []Key, leafSize uint32) (Key, error) {
 	return k, nil
 }
 
+func encodeLengths(lengths []uint32) []byte {
+	b := make([]byte, 4*len(lengths))
+	for i, l := range lengths {
+		binary.BigEndian.PutUint32(b[4*i:], l)
+	}
+	return b
+}
+
+// encodeLeafIndex lays out the leaf keys, followed by their lengths when known, as stored before the root key
+func encodeLeafIndex(leaves []Key, lengths []uint32) []byte {
+	size := len(leaves) * KeySize
+	if lengths != nil {
+		size += 4*len(lengths) + len(leafLengthsMagic)
+	}
+	b := make([]byte, 0, size)
+	for _, leaf := range leaves {
+		b = append(b, leaf[:]...)
+	}
+	if lengths != nil {
+		b = append(b, encodeLengths(lengths)...)
+		b = append(b, leafLengthsMagic...)
+	}
+	return b
+}
+
+// LeafsForHash returns the leaf keys of a root key, read from the path of the root object in the layout of the store
 func LeafsForHash(blobs storage.Store, hash Key, leafSize uint32, prefix string) ([]Key, error) {
-	rdr, err := blobs.Get(context.Background(), hash.StringWithPrefix(prefix))
+	keys, _, err := LeafsAndLengthsForHash(blobs, hash, leafSize, prefix)
+	return keys, err
+}
+
+// LeafsAndLengthsForHash returns the leaf keys of a root key, and their lengths when the content was split
+// with content defined chunking. The lengths are nil for leaves of fixed size.
+func LeafsAndLengthsForHash(blobs storage.Store, hash Key, leafSize uint32, prefix string) ([]Key, []uint32, error) {
+	ctx := context.Background()
+	layout, err := layouts.get(ctx, blobs, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leafsAndLengthsAt(ctx, blobs, layout.root(hash.String()), hash, leafSize)
+}
+
+// leafsAndLengthsAt reads the root object stored at path
+func leafsAndLengthsAt(ctx context.Context, blobs storage.Store, path string, hash Key, leafSize uint32) ([]Key, []uint32, error) {
+	rdr, err := blobs.Get(ctx, path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rdr.Close()
 
 	b, err := ioutil.ReadAll(rdr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err = rdr.Close(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return LeafKeys(hash, b, leafSize)
+	return LeafKeysAndLengths(hash, b, leafSize)
 }
 
 func LeafKeys(verify Key, data []byte, leafSize uint32) ([]Key, error) {
+	keys, _, err := LeafKeysAndLengths(verify, data, leafSize)
+	return keys, err
+}
+
+// LeafKeysAndLengths parses and verifies a root object, see LeafsAndLengthsForHash
+func LeafKeysAndLengths(verify Key, data []byte, leafSize uint32) ([]Key, []uint32, error) {
 	if len(data) < KeySize {
-		return nil, errors.New("the last hash in the file is not the checksum")
+		return nil, nil, errors.New("the last hash in the file is not the checksum")
 	}
 	if !bytes.Equal(data[len(data)-KeySize:], verify[:]) {
-		return nil, errors.New("the last hash in the file is not the checksum")
+		return nil, nil, errors.New("the last hash in the file is not the checksum")
+	}
+
+	if keys, lengths, ok := leafKeysWithLengths(verify, data[:len(data)-KeySize], leafSize); ok {
+		return keys, lengths, nil
 	}
 
 	keys := make([]Key, 0, len(data)/KeySize-1)
 	for i := 0; i < len(data)-KeySize; i += KeySize {
 		key, kerr := NewKey(data[i : i+KeySize])
 		if kerr != nil {
-			return nil, kerr
+			return nil, nil, kerr
 		}
 		keys = append(keys, key)
 	}
 
 	checksum, err := RootHash(keys, leafSize)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if verify != checksum {
-		return nil, fmt.Errorf("leaves (count: %d) checksum doesn't match hash value\n\t%s\n\t%s", len(keys), verify, checksum)
+		return nil, nil, fmt.Errorf("leaves (count: %d) checksum doesn't match hash value\n\t%s\n\t%s", len(keys), verify, checksum)
+	}
+	return keys, nil, nil
+}
+
+func leafKeysWithLengths(verify Key, index []byte, leafSize uint32) ([]Key, []uint32, bool) {
+	if !bytes.HasSuffix(index, leafLengthsMagic) {
+		return nil, nil, false
+	}
+	index = index[:len(index)-len(leafLengthsMagic)]
+	if len(index)%(KeySize+4) != 0 {
+		return nil, nil, false
+	}
+	n := len(index) / (KeySize + 4)
+	keys := make([]Key, n)
+	lengths := make([]uint32, n)
+	for i := range keys {
+		copy(keys[i][:], index[i*KeySize:])
+		lengths[i] = binary.BigEndian.Uint32(index[n*KeySize+4*i:])
+	}
+	checksum, err := RootHashWithLengths(keys, lengths, leafSize)
+	if err != nil || checksum != verify {
+		return nil, nil, false
 	}
-	return keys, nil
+	return keys, lengths, true
 }
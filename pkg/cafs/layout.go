@@ -0,0 +1,335 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// Layouts of the blobs in a blob store
+const (
+	// FlatLayout stores every blob at prefix + hex(key)
+	FlatLayout = "flat"
+	// ShardedLayout stores every blob at prefix + hex[0:2]/hex[2:4]/hex(key), spreading the load over many prefixes
+	ShardedLayout = "sharded"
+)
+
+// LayoutMarker is the object recording the layout of a blob store, next to the blobs.
+// Blob stores without a marker use the flat layout.
+const LayoutMarker = "datamon-layout.yaml"
+
+// RootsNamespace holds the root objects once they are separated from the leaves with MigrateRoots,
+// so they can be listed without reading any blob.
+const RootsNamespace = "roots/"
+
+const migrationConcurrency = 32
+
+type layoutMarker struct {
+	Layout string `json:"layout" yaml:"layout"`
+	Roots  string `json:"roots,omitempty" yaml:"roots,omitempty"` // namespace of the root objects, stored with the leaves when empty
+	_      struct{}
+}
+
+// blobLayout maps keys to their path in the blob store
+type blobLayout struct {
+	layoutMarker
+	prefix string
+	path   func(string) string
+}
+
+func newBlobLayout(marker layoutMarker, prefix string) (*blobLayout, error) {
+	l := &blobLayout{layoutMarker: marker, prefix: prefix}
+	switch marker.Layout {
+	case FlatLayout:
+		l.path = func(k string) string { return k }
+	case ShardedLayout:
+		l.path = func(k string) string { return k[:2] + "/" + k[2:4] + "/" + k }
+	default:
+		return nil, fmt.Errorf("unsupported blob layout %q, expected %s or %s", marker.Layout, FlatLayout, ShardedLayout)
+	}
+	return l, nil
+}
+
+// at returns the path of a blob in a namespace, from its hex key
+func (l *blobLayout) at(namespace, k string) string {
+	return l.prefix + namespace + l.path(k)
+}
+
+// leaf returns the path of a leaf blob stored raw, from its hex key
+func (l *blobLayout) leaf(k string) string {
+	return l.at("", k)
+}
+
+// compressedLeaf returns the paths of the leaves compressed with a codec, the raw leaves without codec
+func (l *blobLayout) compressedLeaf(codec string) func(string) string {
+	namespace := codecNamespace(codec)
+	return func(k string) string { return l.at(namespace, k) }
+}
+
+// root returns the path of a root object, from its hex key
+func (l *blobLayout) root(k string) string {
+	return l.at(l.Roots, k)
+}
+
+// parse returns the key of the blob stored at path and the namespace it is in:
+// the roots namespace, the namespace of a compression codec, or none for raw leaves and roots stored with them.
+// It returns false for objects which are not blobs, like the layout marker.
+func (l *blobLayout) parse(path string) (key Key, namespace string, ok bool, err error) {
+	if !strings.HasPrefix(path, l.prefix) {
+		return Key{}, "", false, nil
+	}
+	path = strings.TrimPrefix(path, l.prefix)
+	if path == LayoutMarker {
+		return Key{}, "", false, nil
+	}
+	for _, ns := range append(codecNamespaces(), l.Roots) {
+		if ns != "" && strings.HasPrefix(path, ns) {
+			namespace = ns
+			break
+		}
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		path = path[i+1:]
+	}
+	key, err = KeyFromString(path)
+	if err != nil {
+		return Key{}, "", false, err
+	}
+	return key, namespace, true, nil
+}
+
+func (l *blobLayout) write(ctx context.Context, blobs storage.Store) error {
+	b, err := yaml.Marshal(l.layoutMarker)
+	if err != nil {
+		return err
+	}
+	if err = blobs.Put(ctx, l.prefix+LayoutMarker, bytes.NewReader(b), storage.OverWrite); err != nil {
+		return err
+	}
+	layouts.set(blobs, l)
+	return nil
+}
+
+type layoutCacheKey struct {
+	blobs  storage.Store
+	prefix string
+}
+
+// layoutCache keeps the layout of the blob stores, so the marker is only read once per store and prefix.
+// The layout of a store only changes with a migration, which updates the cache.
+type layoutCache struct {
+	sync.Mutex
+	layouts map[layoutCacheKey]*blobLayout
+}
+
+var layouts = layoutCache{layouts: make(map[layoutCacheKey]*blobLayout)}
+
+// get returns the layout of a blob store, reading its marker the first time
+func (c *layoutCache) get(ctx context.Context, blobs storage.Store, prefix string) (*blobLayout, error) {
+	if !reflect.TypeOf(blobs).Comparable() {
+		return readBlobLayout(ctx, blobs, prefix)
+	}
+	key := layoutCacheKey{blobs: blobs, prefix: prefix}
+	c.Lock()
+	l, ok := c.layouts[key]
+	c.Unlock()
+	if ok {
+		return l, nil
+	}
+	l, err := readBlobLayout(ctx, blobs, prefix)
+	if err != nil {
+		return nil, err
+	}
+	c.set(blobs, l)
+	return l, nil
+}
+
+func (c *layoutCache) set(blobs storage.Store, l *blobLayout) {
+	if !reflect.TypeOf(blobs).Comparable() {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.layouts[layoutCacheKey{blobs: blobs, prefix: l.prefix}] = l
+}
+
+func readBlobLayout(ctx context.Context, blobs storage.Store, prefix string) (*blobLayout, error) {
+	marker := layoutMarker{Layout: FlatLayout}
+	has, err := blobs.Has(ctx, prefix+LayoutMarker)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		rdr, err := blobs.Get(ctx, prefix+LayoutMarker)
+		if err != nil {
+			return nil, err
+		}
+		defer rdr.Close()
+		b, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(b, &marker); err != nil {
+			return nil, fmt.Errorf("reading blob layout marker: %v", err)
+		}
+	}
+	return newBlobLayout(marker, prefix)
+}
+
+// ReadLayout returns the layout recorded in the blob store, FlatLayout when there is no marker
+func ReadLayout(ctx context.Context, blobs storage.Store, prefix string) (string, error) {
+	l, err := readBlobLayout(ctx, blobs, prefix)
+	if err != nil {
+		return "", err
+	}
+	return l.Layout, nil
+}
+
+// MigrateLayout moves the blobs of a store to another layout.
+//
+// All blobs are copied before the marker is switched, and the old copies are only deleted after that,
+// so readers keep working while the migration runs. An interrupted migration can be run again.
+// Concurrent uploads should be stopped: blobs written with the old layout during the migration may be missed.
+// The layout is cached once read, other processes using the store should be restarted after the migration.
+//
+// Migrating an empty store only records the layout, new blobs are then written with it.
+func MigrateLayout(ctx context.Context, blobs storage.Store, prefix, layout string, moved func(from, to string)) error {
+	current, err := readBlobLayout(ctx, blobs, prefix)
+	if err != nil {
+		return err
+	}
+	target, err := newBlobLayout(layoutMarker{Layout: layout, Roots: current.Roots}, prefix)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, blobs, current, target, moved, func(_ Key, isRoot bool, _ string) (bool, error) {
+		return isRoot, nil
+	})
+}
+
+// MigrateRoots moves the root objects of a store to the roots namespace, so RootKeys only needs to list them.
+//
+// This reads every blob of the store once, to tell root objects from leaves. Like MigrateLayout,
+// it can be run again when interrupted and concurrent uploads should be stopped.
+func MigrateRoots(ctx context.Context, blobs storage.Store, prefix string, moved func(from, to string)) error {
+	current, err := readBlobLayout(ctx, blobs, prefix)
+	if err != nil {
+		return err
+	}
+	target, err := newBlobLayout(layoutMarker{Layout: current.Layout, Roots: RootsNamespace}, prefix)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, blobs, current, target, moved, func(k Key, isRoot bool, path string) (bool, error) {
+		if isRoot || strings.HasPrefix(path, target.prefix+target.Roots) {
+			return true, nil
+		}
+		rdr, err := blobs.Get(ctx, path)
+		if err != nil {
+			return false, err
+		}
+		defer rdr.Close()
+		b, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return false, err
+		}
+		return isRootObject(k, b), nil
+	})
+}
+
+// isRootObject tells root objects apart from leaves: a root object ends with its own key,
+// which a leaf can't do without breaking blake2b.
+func isRootObject(k Key, b []byte) bool {
+	return len(b) >= KeySize && bytes.Equal(b[len(b)-KeySize:], k[:])
+}
+
+func migrate(
+	ctx context.Context,
+	blobs storage.Store,
+	current, target *blobLayout,
+	moved func(from, to string),
+	isRoot func(Key, bool, string) (bool, error),
+) error {
+	paths, err := blobs.Keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// find the blobs to move, blobs left at another path by an interrupted migration are moved as well
+	destinations := make([]string, len(paths))
+	err = internal.Parallel(len(paths), migrationConcurrency, func(i int) error {
+		k, namespace, ok, err := current.parse(paths[i])
+		if err != nil || !ok {
+			return nil
+		}
+		to := target.at(namespace, k.String())
+		if namespace == current.Roots {
+			// compressed leaves stay in the namespace of their codec, other blobs may be roots
+			root, err := isRoot(k, namespace != "", paths[i])
+			if err != nil {
+				return err
+			}
+			to = target.leaf(k.String())
+			if root {
+				to = target.root(k.String())
+			}
+		}
+		if paths[i] != to {
+			destinations[i] = to
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var moves [][2]string
+	for i, to := range destinations {
+		if to != "" {
+			moves = append(moves, [2]string{paths[i], to})
+		}
+	}
+
+	err = internal.Parallel(len(moves), migrationConcurrency, func(i int) error {
+		found, err := blobs.Has(ctx, moves[i][1])
+		if err != nil || found {
+			return err
+		}
+		rdr, err := blobs.Get(ctx, moves[i][0])
+		if err != nil {
+			return err
+		}
+		defer rdr.Close()
+		b, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return err
+		}
+		return blobs.Put(ctx, moves[i][1], bytes.NewReader(b), storage.OverWrite)
+	})
+	if err != nil {
+		return fmt.Errorf("copying blobs: %v", err)
+	}
+	if err = target.write(ctx, blobs); err != nil {
+		return err
+	}
+	var lock sync.Mutex // moved is called once at a time
+	return internal.Parallel(len(moves), migrationConcurrency, func(i int) error {
+		if err := blobs.Delete(ctx, moves[i][0]); err != nil {
+			return fmt.Errorf("%s: %v", moves[i][0], err)
+		}
+		if moved != nil {
+			lock.Lock()
+			moved(moves[i][0], moves[i][1])
+			lock.Unlock()
+		}
+		return nil
+	})
+}
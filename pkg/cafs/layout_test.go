@@ -0,0 +1,239 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout_Paths(t *testing.T) {
+	k := "abcdef"
+	flat, err := newBlobLayout(layoutMarker{Layout: FlatLayout}, "p/")
+	require.NoError(t, err)
+	require.Equal(t, "p/abcdef", flat.leaf(k))
+	require.Equal(t, "p/abcdef", flat.root(k))
+
+	sharded, err := newBlobLayout(layoutMarker{Layout: ShardedLayout, Roots: RootsNamespace}, "p/")
+	require.NoError(t, err)
+	require.Equal(t, "p/ab/cd/abcdef", sharded.leaf(k))
+	require.Equal(t, "p/roots/ab/cd/abcdef", sharded.root(k))
+	require.Equal(t, "p/gzip/ab/cd/abcdef", sharded.compressedLeaf(GzipCompression)(k))
+	require.Equal(t, "p/ab/cd/abcdef", sharded.compressedLeaf(NoCompression)(k))
+
+	key := internal.RandBytesMaskImprSrc(KeySize)
+	hex := Key{}
+	copy(hex[:], key)
+	for path, namespace := range map[string]string{
+		sharded.leaf(hex.String()):                            "",
+		sharded.root(hex.String()):                            RootsNamespace,
+		sharded.compressedLeaf(GzipCompression)(hex.String()): "gzip/",
+	} {
+		parsed, ns, ok, err := sharded.parse(path)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, hex, parsed)
+		require.Equal(t, namespace, ns, path)
+	}
+
+	_, err = newBlobLayout(layoutMarker{Layout: "deep"}, "")
+	require.Error(t, err)
+}
+
+func TestLayout_Migrate(t *testing.T) {
+	ctx := context.Background()
+	blobs := localfs.New(afero.NewMemMapFs())
+	data := internal.RandBytesMaskImprSrc(3*1024 + 5)
+
+	flatFs, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	_, key, _, _, err := flatFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	flatKeys, err := flatFs.Keys(ctx)
+	require.NoError(t, err)
+	require.Len(t, flatKeys, 5)
+
+	var moved int
+	require.NoError(t, MigrateLayout(ctx, blobs, "", ShardedLayout, func(_, _ string) { moved++ }))
+	require.Equal(t, 5, moved)
+
+	layout, err := ReadLayout(ctx, blobs, "")
+	require.NoError(t, err)
+	require.Equal(t, ShardedLayout, layout)
+
+	has, err := blobs.Has(ctx, key.String())
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = blobs.Has(ctx, key.String()[:2]+"/"+key.String()[2:4]+"/"+key.String())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// cafs picks up the layout from the marker
+	shardedFs, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	rdr, err := shardedFs.Get(ctx, key)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	found, missing, err := shardedFs.Has(ctx, key, HasGatherIncomplete())
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Empty(t, missing)
+
+	shardedKeys, err := shardedFs.Keys(ctx)
+	require.NoError(t, err)
+	sortKeys := func(k []Key) {
+		sort.Slice(k, func(i, j int) bool { return k[i].String() < k[j].String() })
+	}
+	sortKeys(flatKeys)
+	sortKeys(shardedKeys)
+	require.Equal(t, flatKeys, shardedKeys)
+
+	roots, err := shardedFs.RootKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Key{key}, roots)
+
+	// new blobs are written with the sharded layout, and migrating back restores the flat one
+	_, other, _, _, err := shardedFs.Put(ctx, bytes.NewReader([]byte("other")))
+	require.NoError(t, err)
+	has, err = blobs.Has(ctx, other.String()[:2]+"/"+other.String()[2:4]+"/"+other.String())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.NoError(t, MigrateLayout(ctx, blobs, "", FlatLayout, nil))
+	has, err = blobs.Has(ctx, other.String())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	flatFs, err = New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	require.NoError(t, flatFs.Delete(ctx, other))
+	has, err = blobs.Has(ctx, other.String())
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestLayout_MigrateRoots(t *testing.T) {
+	ctx := context.Background()
+	blobs := localfs.New(afero.NewMemMapFs())
+	data := internal.RandBytesMaskImprSrc(3*1024 + 5)
+
+	fs, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	_, key, _, _, err := fs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	compressed := bytes.Repeat([]byte("compressed"), 200)
+	gzFs, err := New(LeafSize(1024), Backend(blobs), Compression(GzipCompression))
+	require.NoError(t, err)
+	_, gzKey, _, _, err := gzFs.Put(ctx, bytes.NewReader(compressed))
+	require.NoError(t, err)
+
+	var moved []string
+	require.NoError(t, MigrateRoots(ctx, blobs, "", func(from, to string) { moved = append(moved, to) }))
+	require.ElementsMatch(t, []string{RootsNamespace + gzKey.String(), RootsNamespace + key.String()}, moved)
+
+	// migrating the layout keeps the roots namespace
+	require.NoError(t, MigrateLayout(ctx, blobs, "", ShardedLayout, nil))
+	rootPath := RootsNamespace + key.String()[:2] + "/" + key.String()[2:4] + "/" + key.String()
+	has, err := blobs.Has(ctx, rootPath)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// compressed leaves stay in the namespace of their codec
+	gzFs, err = New(LeafSize(1024), Backend(blobs), Compression(GzipCompression))
+	require.NoError(t, err)
+	rdr, err := gzFs.Get(ctx, gzKey)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, compressed, got)
+	require.NoError(t, gzFs.Delete(ctx, gzKey))
+
+	fs, err = New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	roots, err := fs.RootKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Key{key}, roots)
+	keys, err := fs.Keys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 5)
+
+	rdr, err = fs.Get(ctx, key)
+	require.NoError(t, err)
+	got, err = ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// root objects are looked up in their namespace
+	leafs, err := LeafsForHash(blobs, key, 1024, "")
+	require.NoError(t, err)
+	require.Len(t, leafs, 4)
+	require.True(t, IsRootKey(blobs, key, 1024))
+	require.False(t, IsRootKey(blobs, leafs[0], 1024))
+
+	// new root objects go to the roots namespace
+	_, other, _, _, err := fs.Put(ctx, bytes.NewReader([]byte("other")))
+	require.NoError(t, err)
+	roots, err = fs.RootKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 2)
+	found, _, err := fs.Has(ctx, other)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	require.NoError(t, fs.Delete(ctx, other))
+	roots, err = fs.RootKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Key{key}, roots)
+}
+
+type markerCountingStore struct {
+	storage.Store
+	reads int32
+}
+
+func (s *markerCountingStore) Has(ctx context.Context, key string) (bool, error) {
+	if key == LayoutMarker {
+		atomic.AddInt32(&s.reads, 1)
+	}
+	return s.Store.Has(ctx, key)
+}
+
+func TestLayout_ReadOnce(t *testing.T) {
+	ctx := context.Background()
+	blobs := &markerCountingStore{Store: localfs.New(afero.NewMemMapFs())}
+
+	fs, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	require.Zero(t, atomic.LoadInt32(&blobs.reads))
+	_, key, _, _, err := fs.Put(ctx, bytes.NewReader([]byte("content")))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, atomic.LoadInt32(&blobs.reads))
+
+	other, err := New(LeafSize(1024), Backend(blobs))
+	require.NoError(t, err)
+	found, _, err := other.Has(ctx, key)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.EqualValues(t, 1, atomic.LoadInt32(&blobs.reads))
+
+	// a migration updates the cached layout
+	require.NoError(t, MigrateLayout(ctx, blobs, "", ShardedLayout, nil))
+	found, _, err = other.Has(ctx, key)
+	require.NoError(t, err)
+	require.True(t, found)
+	leafs, err := LeafsForHash(blobs, key, 1024, "")
+	require.NoError(t, err)
+	require.Len(t, leafs, 1)
+	require.EqualValues(t, 2, atomic.LoadInt32(&blobs.reads))
+}
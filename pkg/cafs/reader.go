@@ -2,9 +2,12 @@ package cafs
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
 
+	"github.com/oneconcern/datamon/pkg/progress"
 	"github.com/oneconcern/datamon/pkg/storage"
 )
 
@@ -16,25 +19,44 @@ func TruncateLeaf(t bool) ReaderOption {
 	}
 }
 
+// ReportTo reports the bytes read to the tracker
+func ReportTo(t *progress.Tracker) ReaderOption {
+	return func(reader *chunkReader) {
+		reader.progress = t
+	}
+}
+
+// withLayout reads blobs at the paths of the layout of the store, the leaves as written with the codec
+func withLayout(layout *blobLayout, codec string) ReaderOption {
+	return func(reader *chunkReader) {
+		reader.pather = layout.compressedLeaf(codec)
+		reader.rootPather = layout.root
+		reader.compression = codec
+	}
+}
+
 func Keys(keys []Key) ReaderOption {
 	return func(reader *chunkReader) {
 		reader.keys = keys
 	}
 }
 
-func newReader(blobs storage.Store, hash Key, leafSize uint32, prefix string, opts ...ReaderOption) (io.ReadCloser, error) {
+func newReader(ctx context.Context, blobs storage.Store, hash Key, leafSize uint32, prefix string, opts ...ReaderOption) (io.ReadCloser, error) {
 	c := &chunkReader{
+		ctx:      ctx,
 		fs:       blobs,
 		hash:     hash,
 		leafSize: leafSize,
+		pather:   func(k string) string { return prefix + k },
 	}
+	c.rootPather = c.pather
 
 	for _, apply := range opts {
 		apply(c)
 	}
 	var err error
 	if c.keys == nil {
-		c.keys, err = LeafsForHash(blobs, hash, leafSize, prefix)
+		c.keys, c.lengths, err = leafsAndLengthsAt(ctx, blobs, c.rootPather(hash.String()), hash, leafSize)
 		if err != nil {
 			return nil, err
 		}
@@ -43,17 +65,23 @@ func newReader(blobs storage.Store, hash Key, leafSize uint32, prefix string, op
 }
 
 type chunkReader struct {
+	ctx      context.Context
 	fs       storage.Store
 	leafSize uint32
 	hash     Key
-	prefix   string
 	keys     []Key
+	lengths  []uint32 // leaf lengths with content defined chunking, nil for fixed size leaves
 	idx      int
 
+	pather     func(string) string // path of the leaves
+	rootPather func(string) string // path of the root object
+
 	rdr            io.ReadCloser
 	readSoFar      int
 	lastChunk      bool
 	leafTruncation bool
+	compression    string // codec the leaves were written with
+	progress       *progress.Tracker
 }
 
 func (r *chunkReader) Close() error {
@@ -98,6 +126,7 @@ func (r *chunkReader) WriteTo(writer io.Writer) (n int64, err error) {
 	var wg sync.WaitGroup
 
 	// Start a go routine for each key and give the offset to write at.
+	var offset int64
 	for index, key := range r.keys {
 		wg.Add(1)
 		var truncation uint32
@@ -105,11 +134,18 @@ func (r *chunkReader) WriteTo(writer io.Writer) (n int64, err error) {
 			truncation = 32 * 1024 // Buffer size used by io.Copy
 		}
 		i := int64(index) * int64(r.leafSize-truncation)
+		if r.lengths != nil {
+			i = offset
+			offset += int64(r.lengths[index])
+		}
 		go func(writeAt int64, writer io.WriterAt, key Key, cafs storage.Store, wg *sync.WaitGroup) {
-			rdr, err := cafs.Get(context.Background(), key.StringWithPrefix(r.prefix)) // thread safe
+			defer wg.Done()
+			rdr, err := r.getLeaf(key) // thread safe
 			if err != nil {
 				errC <- err
+				return
 			}
+			defer rdr.Close()
 			w := &cafsWriterAt{
 				w:      writer,
 				offset: writeAt,
@@ -117,9 +153,10 @@ func (r *chunkReader) WriteTo(writer io.Writer) (n int64, err error) {
 			written, err := io.Copy(w, rdr) // io.WriteAt is expected to be thread safe.
 			if err != nil {
 				errC <- err
+				return
 			}
+			r.progress.BytesDone(written, false)
 			writtenC <- written
-			wg.Done()
 		}(i, w, key, r.fs, &wg)
 	}
 	var count int
@@ -141,15 +178,21 @@ func (r *chunkReader) WriteTo(writer io.Writer) (n int64, err error) {
 }
 
 func (r *chunkReader) Read(data []byte) (int, error) {
+	n, err := r.read(data)
+	r.progress.BytesDone(int64(n), false)
+	return n, err
+}
+
+func (r *chunkReader) read(data []byte) (int, error) {
 	bytesToRead := len(data)
 
-	if r.lastChunk && r.rdr == nil {
+	if (r.lastChunk && r.rdr == nil) || len(r.keys) == 0 {
 		return 0, io.EOF
 	}
 	for {
 		key := r.keys[r.idx]
 		if r.rdr == nil {
-			rdr, err := r.fs.Get(context.Background(), key.StringWithPrefix(r.prefix))
+			rdr, err := r.getLeaf(key)
 			if err != nil {
 				return r.readSoFar, err
 			}
@@ -188,3 +231,69 @@ func (r *chunkReader) Read(data []byte) (int, error) {
 		}
 	}
 }
+
+// Seek moves the reader to an offset from the start of the content, the only supported whence.
+// The leaf holding the offset is read again from its start.
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, fmt.Errorf("cafs reader can only seek from the start, got whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	if r.rdr != nil {
+		//#nosec
+		r.rdr.Close()
+		r.rdr = nil
+	}
+	r.readSoFar = 0
+	var skip int64
+	r.idx, skip = r.leafAt(offset)
+	r.lastChunk = r.idx >= len(r.keys)
+	if r.lastChunk {
+		return offset, nil
+	}
+	rdr, err := r.getLeaf(r.keys[r.idx])
+	if err != nil {
+		return 0, err
+	}
+	// past the end of the last leaf, the next read returns io.EOF
+	if _, err = io.CopyN(ioutil.Discard, rdr, skip); err != nil && err != io.EOF {
+		//#nosec
+		rdr.Close()
+		return 0, err
+	}
+	r.rdr = rdr
+	return offset, nil
+}
+
+// leafAt returns the index of the leaf holding an offset, and the offset in the leaf
+func (r *chunkReader) leafAt(offset int64) (int, int64) {
+	if r.lengths == nil {
+		size := int64(r.leafSize)
+		if r.leafTruncation {
+			size -= 32 * 1024
+		}
+		idx := offset / size
+		if idx >= int64(len(r.keys)) {
+			return len(r.keys), 0
+		}
+		return int(idx), offset % size
+	}
+	for i, l := range r.lengths {
+		if offset < int64(l) {
+			return i, offset
+		}
+		offset -= int64(l)
+	}
+	return len(r.lengths), 0
+}
+
+// getLeaf reads a leaf blob, decompressing it when it was written with compression
+func (r *chunkReader) getLeaf(key Key) (io.ReadCloser, error) {
+	rdr, err := r.fs.Get(r.ctx, r.pather(key.String()))
+	if err != nil {
+		return nil, err
+	}
+	return decodeLeaf(r.compression, rdr)
+}
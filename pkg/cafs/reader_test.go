@@ -1,6 +1,7 @@
 package cafs
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
@@ -45,7 +46,7 @@ func TestChunkReader_SmallOnly(t *testing.T) {
 func verifyChunkReader(t testing.TB, blobs storage.Store, tf testFile) {
 	rkey := keyFromFile(t, tf.RootHash)
 
-	rdr, err := newReader(blobs, rkey, leafSize, "")
+	rdr, err := newReader(context.Background(), blobs, rkey, leafSize, "")
 	require.NoError(t, err)
 	defer rdr.Close()
 
@@ -142,7 +143,7 @@ func TestWriteTo(t *testing.T) {
 	key2, err := KeyFromString(keyStr2)
 	require.NoError(t, err)
 	keys := []Key{key1, key2}
-	reader, err := newReader(&testFakeStore, key, 64*1024, "",
+	reader, err := newReader(context.Background(), &testFakeStore, key, 64*1024, "",
 		TruncateLeaf(false),
 		Keys(keys),
 	)
@@ -168,3 +169,46 @@ func TestWriteTo(t *testing.T) {
 	require.Equal(t, testFakeStore.chunks[keyStr2], fakeWriter.data[64*1024:])
 	// Set truncation on and verify.
 }
+
+func TestChunkReader_Seek(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	for _, opts := range [][]Option{
+		{LeafSize(1024)},
+		{LeafSize(1024), Compression(GzipCompression)},
+		{LeafSize(4096), ContentDefinedChunking(256, 1024, 4096)},
+	} {
+		fs, err := New(append(opts, Backend(localfs.New(afero.NewMemMapFs())))...)
+		require.NoError(t, err)
+		_, key, _, _, err := fs.Put(context.Background(), bytes.NewReader(data))
+		require.NoError(t, err)
+
+		rdr, err := fs.Get(context.Background(), key)
+		require.NoError(t, err)
+		seeker, ok := rdr.(io.ReadSeeker)
+		require.True(t, ok)
+		for _, offset := range []int64{5000, 0, 1023, 1024, 9990, 3000} {
+			pos, err := seeker.Seek(offset, io.SeekStart)
+			require.NoError(t, err)
+			require.Equal(t, offset, pos)
+			b := make([]byte, 100)
+			n, err := io.ReadFull(seeker, b)
+			if offset+100 > int64(len(data)) {
+				require.Equal(t, io.ErrUnexpectedEOF, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, data[offset:offset+int64(n)], b[:n], "offset %d", offset)
+		}
+		_, err = seeker.Seek(20000, io.SeekStart)
+		require.NoError(t, err)
+		n, err := seeker.Read(make([]byte, 10))
+		require.Equal(t, 0, n)
+		require.Equal(t, io.EOF, err)
+		_, err = seeker.Seek(0, io.SeekEnd)
+		require.Error(t, err)
+		require.NoError(t, rdr.Close())
+	}
+}
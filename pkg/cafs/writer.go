@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
 	"sync"
 	"sync/atomic"
 
+	"github.com/oneconcern/datamon/pkg/progress"
 	"github.com/oneconcern/datamon/pkg/storage"
 
 	"github.com/minio/blake2b-simd"
@@ -21,10 +23,12 @@ const (
 // Writer interface for a content addressable FS
 type Writer interface {
 	io.WriteCloser
+	// Flush returns the root key and the leaf index stored before it in the root object
 	Flush() (Key, []byte, error)
 }
 
 type fsWriter struct {
+	ctx           context.Context     // Context of the Put writing the blobs
 	fs            storage.Store       // CAFS backing store
 	prefix        string              // Prefix for fs paths
 	leafSize      uint32              // Size of chunks
@@ -38,6 +42,10 @@ type fsWriter struct {
 	errC          chan error          // channel for errors during parallel writes
 	maxGoRoutines chan struct{}       // Max number of concurrent writes
 	wg            sync.WaitGroup      // Sync
+	progress      *progress.Tracker   // Reports bytes flushed, may be nil
+	compression   string              // Codec used to compress leaves
+	chunker       *chunker            // Content defined chunking, fixed size leaves when nil
+	lengths       []uint32            // Length of every leaf with content defined chunking
 }
 
 func (w *fsWriter) Write(p []byte) (n int, err error) {
@@ -48,29 +56,23 @@ func (w *fsWriter) Write(p []byte) (n int, err error) {
 		}
 		// Copy p to w.buf
 		writable := len(w.buf) - w.offset
-		if len(p) < writable {
-			writable = len(p)
+		if len(p)-written < writable {
+			writable = len(p) - written
 		}
-		c := copy(w.buf[w.offset:], p[written:writable])
+		c := copy(w.buf[w.offset:], p[written:written+writable])
 		w.offset += c
 		written += c
 		if w.offset == len(w.buf) { // sizes line up, flush and continue
-			w.wg.Add(1)
-			w.count++ // next leaf
-			w.maxGoRoutines <- struct{}{}
-			go pFlush(
-				false,
-				w.buf,
-				w.prefix,
-				w.leafSize,
-				w.count,
-				w.flushChan,
-				w.errC,
-				w.maxGoRoutines,
-				w.pather,
-				w.fs,
-				&w.wg,
-			)
+			if w.chunker != nil {
+				// flush the first chunk and carry over the remainder
+				n := w.chunker.cut(w.buf)
+				next := make([]byte, len(w.buf))
+				w.offset = copy(next, w.buf[n:])
+				w.flushLeaf(w.buf[:n])
+				w.buf = next
+				continue
+			}
+			w.flushLeaf(w.buf)
 			w.buf = make([]byte, w.leafSize) // new buffer
 			w.offset = 0                     // new offset for new buffer
 			continue
@@ -78,12 +80,38 @@ func (w *fsWriter) Write(p []byte) (n int, err error) {
 	}
 }
 
+// flushLeaf writes a leaf in the background
+func (w *fsWriter) flushLeaf(leaf []byte) {
+	w.wg.Add(1)
+	w.count++ // next leaf
+	w.maxGoRoutines <- struct{}{}
+	go pFlush(
+		w.ctx,
+		false,
+		leaf,
+		w.prefix,
+		w.leafSize,
+		w.count,
+		w.flushChan,
+		w.errC,
+		w.maxGoRoutines,
+		w.pather,
+		w.fs,
+		&w.wg,
+		w.progress,
+		w.compression,
+		w.chunker != nil,
+	)
+}
+
 type blobFlush struct {
 	count uint64
 	key   Key
+	size  uint32
 }
 
 func pFlush(
+	ctx context.Context,
 	isLastNode bool,
 	buffer []byte,
 	prefix string,
@@ -95,19 +123,27 @@ func pFlush(
 	pather func(string) string,
 	destination storage.Store,
 	wg *sync.WaitGroup,
+	tracker *progress.Tracker,
+	compression string,
+	chunked bool,
 ) {
 	done := func() {
 		wg.Done()
 		<-maxGoRoutines
 	}
 	// Calculate hash value
+	nodeOffset := count
+	if chunked {
+		// content defined leaves are hashed independently of their position, so they dedup across offsets
+		nodeOffset = 0
+	}
 	hasher, err := blake2b.New(&blake2b.Config{
 		Size: blake2b.Size,
 		Tree: &blake2b.Tree{
 			Fanout:        0,
 			MaxDepth:      2,
 			LeafSize:      leafSize,
-			NodeOffset:    count,
+			NodeOffset:    nodeOffset,
 			NodeDepth:     0,
 			InnerHashSize: blake2b.Size,
 			IsLastNode:    isLastNode,
@@ -137,27 +173,36 @@ func pFlush(
 		// w.pather = func(lks string) string { return filepath.Join(lks[:3], lks[3:6], lks[6:]) }
 		pather = func(lks string) string { return prefix + lks }
 	}
-	found, _ := destination.Has(context.TODO(), pather(leafKey.String()))
+	found, _ := destination.Has(ctx, pather(leafKey.String()))
 	if !found {
+		var blob []byte
+		blob, err = encodeLeaf(compression, buffer)
+		if err != nil {
+			errC <- err
+			done()
+			return
+		}
 		d, ok := destination.(storage.StoreCRC)
 		if ok {
-			crc := crc32.Checksum(buffer, crc32.MakeTable(crc32.Castagnoli))
-			err = d.PutCRC(context.TODO(), pather(leafKey.String()), bytes.NewReader(buffer), storage.OverWrite, crc)
+			crc := crc32.Checksum(blob, crc32.MakeTable(crc32.Castagnoli))
+			err = d.PutCRC(ctx, pather(leafKey.String()), bytes.NewReader(blob), storage.OverWrite, crc)
 		} else {
-			err = destination.Put(context.TODO(), pather(leafKey.String()), bytes.NewReader(buffer), storage.OverWrite)
+			err = destination.Put(ctx, pather(leafKey.String()), bytes.NewReader(blob), storage.OverWrite)
 		}
 		if err != nil {
 			errC <- fmt.Errorf("write segment file: %v", err)
 			done()
 			return
 		}
-		fmt.Printf("Uploading blob:%s\n", leafKey.String())
+		log.Printf("Uploading blob:%s", leafKey.String())
 	} else {
-		fmt.Printf("Duplicate blob:%s\n", leafKey.String())
+		log.Printf("Duplicate blob:%s", leafKey.String())
 	}
+	tracker.BytesDone(int64(len(buffer)), found)
 	flushChan <- blobFlush{
 		count: count,
 		key:   leafKey,
+		size:  uint32(len(buffer)),
 	}
 	done()
 }
@@ -166,61 +211,92 @@ func (w *fsWriter) flush(isLastNode bool) (int, error) {
 	if w.offset == 0 {
 		return 0, nil
 	}
+	leafKey, err := w.storeLeaf(w.buf[:w.offset], uint64(len(w.leafs)), isLastNode)
+	if err != nil {
+		return 0, err
+	}
+
+	n := w.offset
+	w.offset = 0
+	w.leafs = append(w.leafs, leafKey)
+	return n, nil
+}
+
+// flushChunks splits what remains in the buffer into content defined leaves
+func (w *fsWriter) flushChunks() error {
+	for w.offset > 0 {
+		n := w.chunker.cut(w.buf[:w.offset])
+		leafKey, err := w.storeLeaf(w.buf[:n], 0, false)
+		if err != nil {
+			return err
+		}
+		w.leafs = append(w.leafs, leafKey)
+		w.lengths = append(w.lengths, uint32(n))
+		w.offset = copy(w.buf, w.buf[n:w.offset])
+	}
+	return nil
+}
+
+func (w *fsWriter) storeLeaf(leaf []byte, nodeOffset uint64, isLastNode bool) (Key, error) {
 	hasher, err := blake2b.New(&blake2b.Config{
 		Size: blake2b.Size,
 		Tree: &blake2b.Tree{
 			Fanout:        0,
 			MaxDepth:      2,
 			LeafSize:      w.leafSize,
-			NodeOffset:    uint64(len(w.leafs)),
+			NodeOffset:    nodeOffset,
 			NodeDepth:     0,
 			InnerHashSize: blake2b.Size,
 			IsLastNode:    isLastNode,
 		},
 	})
 	if err != nil {
-		return 0, err
+		return Key{}, err
 	}
 
-	_, err = hasher.Write(w.buf[:w.offset])
+	_, err = hasher.Write(leaf)
 	if err != nil {
-		return 0, fmt.Errorf("flush segment hash: %v", err)
+		return Key{}, fmt.Errorf("flush segment hash: %v", err)
 	}
 
 	leafKey, err := NewKey(hasher.Sum(nil))
 	if err != nil {
-		return 0, fmt.Errorf("flush key segment: %v", err)
+		return Key{}, fmt.Errorf("flush key segment: %v", err)
 	}
 
 	if w.pather == nil {
 		// w.pather = func(lks string) string { return filepath.Join(lks[:3], lks[3:6], lks[6:]) }
 		w.pather = func(lks string) string { return w.prefix + lks }
 	}
-	found, _ := w.fs.Has(context.TODO(), w.pather(leafKey.String()))
+	found, _ := w.fs.Has(w.ctx, w.pather(leafKey.String()))
 	if !found {
+		blob, err := encodeLeaf(w.compression, leaf)
+		if err != nil {
+			return Key{}, err
+		}
 		d, ok := w.fs.(storage.StoreCRC)
 		if ok {
-			crc := crc32.Checksum(w.buf[:w.offset], crc32.MakeTable(crc32.Castagnoli))
-			err = d.PutCRC(context.TODO(), w.pather(leafKey.String()), bytes.NewReader(w.buf[:w.offset]), storage.OverWrite, crc)
+			crc := crc32.Checksum(blob, crc32.MakeTable(crc32.Castagnoli))
+			err = d.PutCRC(w.ctx, w.pather(leafKey.String()), bytes.NewReader(blob), storage.OverWrite, crc)
 		} else {
-			err = w.fs.Put(context.TODO(), w.pather(leafKey.String()), bytes.NewReader(w.buf[:w.offset]), storage.OverWrite)
+			err = w.fs.Put(w.ctx, w.pather(leafKey.String()), bytes.NewReader(blob), storage.OverWrite)
 		}
 		if err != nil {
-			return 0, fmt.Errorf("write segment file: %v", err)
+			return Key{}, fmt.Errorf("write segment file: %v", err)
 		}
-		fmt.Printf("Uploading blob:%s, bytes:%d\n", leafKey.String(), w.offset)
+		log.Printf("Uploading blob:%s, bytes:%d", leafKey.String(), len(leaf))
 	} else {
-		fmt.Printf("Duplicate blob:%s, bytes:%d\n", leafKey.String(), w.offset)
+		log.Printf("Duplicate blob:%s, bytes:%d", leafKey.String(), len(leaf))
 	}
-
-	n := w.offset
-	w.offset = 0
-	w.leafs = append(w.leafs, leafKey)
-	return n, nil
+	w.progress.BytesDone(int64(len(leaf)), found)
+	return leafKey, nil
 }
 
 func (w *fsWriter) Flush() (Key, []byte, error) {
 	w.leafs = make([]Key, w.count)
+	if w.chunker != nil {
+		w.lengths = make([]uint32, w.count)
+	}
 	if w.count > 0 {
 		w.wg.Wait()
 		for {
@@ -228,6 +304,9 @@ func (w *fsWriter) Flush() (Key, []byte, error) {
 			case bf := <-w.flushChan:
 				w.count--
 				w.leafs[bf.count-1] = bf.key
+				if w.chunker != nil {
+					w.lengths[bf.count-1] = bf.size
+				}
 				if w.count == 0 {
 					break
 				}
@@ -243,6 +322,17 @@ func (w *fsWriter) Flush() (Key, []byte, error) {
 	}
 	atomic.StoreUint32(&w.flushed, 1)
 
+	if w.chunker != nil {
+		if err := w.flushChunks(); err != nil {
+			return Key{}, nil, err
+		}
+		rhash, err := RootHashWithLengths(w.leafs, w.lengths, w.leafSize)
+		if err != nil {
+			return Key{}, nil, fmt.Errorf("flush make root hash: %v", err)
+		}
+		return rhash, encodeLeafIndex(w.leafs, w.lengths), nil
+	}
+
 	_, err := w.flush(true)
 	if err != nil {
 		return Key{}, nil, err
@@ -253,12 +343,7 @@ func (w *fsWriter) Flush() (Key, []byte, error) {
 		return Key{}, nil, fmt.Errorf("flush make root hash: %v", err)
 	}
 
-	leafHashes := make([]byte, len(w.leafs)*KeySize)
-	for i, leaf := range w.leafs {
-		offset := KeySize * i
-		copy(leafHashes[offset:offset+KeySize], leaf[:])
-	}
-	return rhash, leafHashes, nil
+	return rhash, encodeLeafIndex(w.leafs, nil), nil
 }
 
 func (w *fsWriter) Close() error {
@@ -0,0 +1,35 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// A single write spanning several leaves must be split across the leaf buffers
+func TestCAFS_WriteSpanningLeaves(t *testing.T) {
+	const leafSize = 4 * 1024
+	ctx := context.Background()
+	fs, err := New(LeafSize(leafSize), Backend(localfs.New(afero.NewMemMapFs())))
+	require.NoError(t, err)
+
+	for _, size := range []int{leafSize + 1, 2*leafSize + 10, 3 * leafSize} {
+		data := internal.RandBytesMaskImprSrc(size)
+		written, key, _, _, err := fs.Put(ctx, bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, int64(size), written)
+
+		rdr, err := fs.Get(ctx, key)
+		require.NoError(t, err)
+		actual, err := ioutil.ReadAll(rdr)
+		require.NoError(t, err)
+		require.NoError(t, rdr.Close())
+		require.Equal(t, data, actual)
+	}
+}
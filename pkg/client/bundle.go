@@ -0,0 +1,340 @@
+// Copyright © 2018 One Concern
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/progress"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/gcs"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+// UploadOption configures the upload of a bundle
+type UploadOption func(*uploadOpts)
+
+type uploadOpts struct {
+	message     string
+	compression string
+	chunker     string
+	parents     []string
+	progress    *progress.Tracker
+}
+
+// UploadMessage is the message of the bundle
+func UploadMessage(message string) UploadOption {
+	return func(o *uploadOpts) {
+		o.message = message
+	}
+}
+
+// UploadCompression compresses the blobs of the bundle with a codec
+func UploadCompression(codec string) UploadOption {
+	return func(o *uploadOpts) {
+		o.compression = codec
+	}
+}
+
+// UploadChunker splits the files of the bundle with a content defined chunker, cafs.FastCDCChunker,
+// instead of fixed size leaves
+func UploadChunker(algorithm string) UploadOption {
+	return func(o *uploadOpts) {
+		o.chunker = algorithm
+	}
+}
+
+// UploadParents are the bundles the bundle derives from
+func UploadParents(bundleIDs ...string) UploadOption {
+	return func(o *uploadOpts) {
+		o.parents = bundleIDs
+	}
+}
+
+// UploadProgress reports the progress of the upload to a tracker
+func UploadProgress(tracker *progress.Tracker) UploadOption {
+	return func(o *uploadOpts) {
+		o.progress = tracker
+	}
+}
+
+// DownloadOption configures the download of a bundle
+type DownloadOption func(*downloadOpts)
+
+type downloadOpts struct {
+	progress *progress.Tracker
+}
+
+// DownloadProgress reports the progress of the download to a tracker
+func DownloadProgress(tracker *progress.Tracker) DownloadOption {
+	return func(o *downloadOpts) {
+		o.progress = tracker
+	}
+}
+
+// ListBundles returns a page of the bundles of a repo, oldest first, and the token of the next page
+func (c *Client) ListBundles(ctx context.Context, repo string, opts ...core.ListOption) ([]model.BundleDescriptor, string, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, "", err
+	}
+	bundles, next, err := core.ListBundles(ctx, repo, c.metaStore, opts...)
+	return bundles, next, wrap(err)
+}
+
+// LatestBundle returns the ID of the latest bundle of a repo
+func (c *Client) LatestBundle(ctx context.Context, repo string) (string, error) {
+	id, err := core.GetLatestBundle(ctx, repo, c.metaStore)
+	return id, wrap(err)
+}
+
+// GetBundle returns the descriptor of a bundle
+func (c *Client) GetBundle(ctx context.Context, repo, bundleID string) (model.BundleDescriptor, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return model.BundleDescriptor{}, err
+	}
+	bd, err := core.GetBundle(ctx, repo, bundleID, c.metaStore)
+	return bd, wrap(err)
+}
+
+// ListFiles returns the files of a bundle
+func (c *Client) ListFiles(ctx context.Context, repo, bundleID string) ([]model.BundleEntry, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	bundle := c.bundle(repo, bundleID, nil, nil)
+	if err := core.PopulateFiles(ctx, bundle); err != nil {
+		return nil, wrap(err)
+	}
+	return bundle.BundleEntries, nil
+}
+
+// UploadDir uploads the files of a directory as a new bundle of a repo, and returns its descriptor.
+// The directory is local, or a GCS bucket as gs://bucket.
+func (c *Client) UploadDir(ctx context.Context, repo, dir string, opts ...UploadOption) (model.BundleDescriptor, error) {
+	var o uploadOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return model.BundleDescriptor{}, err
+	}
+	var source storage.Store
+	if strings.HasPrefix(dir, "gs://") {
+		var err error
+		if source, err = gcs.New(dir[5:], c.config.Credential); err != nil {
+			return model.BundleDescriptor{}, wrap(err)
+		}
+	} else {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return model.BundleDescriptor{}, wrap(err)
+		}
+		if !fi.IsDir() {
+			return model.BundleDescriptor{}, wrap(fmt.Errorf("%s is not a directory", dir))
+		}
+		source = localfs.New(afero.NewBasePathFs(afero.NewOsFs(), dir))
+	}
+	bd, err := c.descriptor(o)
+	if err != nil {
+		return model.BundleDescriptor{}, wrap(err)
+	}
+	bundle := core.New(bd,
+		core.Repo(repo),
+		core.BlobStore(c.blobStore),
+		core.ConsumableStore(source),
+		core.MetaStore(c.metaStore),
+		core.Progress(o.progress),
+	)
+	if err := core.Upload(ctx, bundle); err != nil {
+		return model.BundleDescriptor{}, wrap(err)
+	}
+	bundle.BundleDescriptor.ID = bundle.BundleID
+	return bundle.BundleDescriptor, nil
+}
+
+// Download downloads the files of a bundle to a local directory, which must be empty
+func (c *Client) Download(ctx context.Context, repo, bundleID, dir string, opts ...DownloadOption) error {
+	var o downloadOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return err
+	}
+	destination, err := localDir(dir)
+	if err != nil {
+		return wrap(err)
+	}
+	empty, err := afero.IsEmpty(destination, "/")
+	if err != nil {
+		return wrap(err)
+	}
+	if !empty {
+		return wrap(storage.Existsf("%s should be empty", dir))
+	}
+	bundle := c.bundle(repo, bundleID, localfs.New(destination), o.progress)
+	return wrap(core.Publish(ctx, bundle))
+}
+
+// DownloadFile downloads a file of a bundle to a local directory
+func (c *Client) DownloadFile(ctx context.Context, repo, bundleID, file, dir string) error {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return err
+	}
+	destination, err := localDir(dir)
+	if err != nil {
+		return wrap(err)
+	}
+	bundle := c.bundle(repo, bundleID, localfs.New(destination), nil)
+	return wrap(core.PublishFile(ctx, bundle, file))
+}
+
+// OpenFile opens a file of a bundle for reading, without downloading the bundle
+func (c *Client) OpenFile(ctx context.Context, repo, bundleID, file string) (io.ReadSeekCloser, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	f, err := core.OpenFile(ctx, c.bundle(repo, bundleID, nil, nil), file)
+	return f, wrap(err)
+}
+
+// OpenEntry opens a file listed by ListFiles in a bundle returned by GetBundle, without reading
+// the metadata of the repo and the bundle again
+func (c *Client) OpenEntry(ctx context.Context, repo string, bd model.BundleDescriptor, e model.BundleEntry) (io.ReadSeekCloser, error) {
+	bundle := core.New(&bd,
+		core.Repo(repo),
+		core.BundleID(bd.ID),
+		core.MetaStore(c.metaStore),
+		core.BlobStore(c.blobStore),
+	)
+	f, err := core.OpenEntry(ctx, bundle, e)
+	return f, wrap(err)
+}
+
+// Mount mounts a bundle read only at a path. The files read are cached in a local directory.
+// The bundle stays mounted until it is unmounted from the returned file system.
+func (c *Client) Mount(ctx context.Context, repo, bundleID, path, cacheDir string) (*core.ReadOnlyFS, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	cache, err := localDir(cacheDir)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	fs, err := core.NewReadOnlyFS(ctx, c.bundle(repo, bundleID, localfs.New(cache), nil))
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err = fs.MountReadOnly(path); err != nil {
+		return nil, wrap(err)
+	}
+	return fs, nil
+}
+
+// MountMutable mounts a writable filesystem at a path, starting with the files of a parent bundle,
+// or empty when parentID is empty. The files written are staged in a local directory,
+// and uploaded as a new bundle when the filesystem is committed or unmounted.
+func (c *Client) MountMutable(ctx context.Context, repo, parentID, path, stagingDir string, opts ...UploadOption) (*core.MutableFS, error) {
+	var o uploadOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	if parentID != "" {
+		if _, err := c.GetBundle(ctx, repo, parentID); err != nil {
+			return nil, err
+		}
+		o.parents = []string{parentID}
+	}
+	bd, err := c.descriptor(o)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err = os.MkdirAll(stagingDir, 0700); err != nil {
+		return nil, wrap(err)
+	}
+	bundle := core.New(bd,
+		core.Repo(repo),
+		core.MetaStore(c.metaStore),
+		core.BlobStore(c.blobStore),
+	)
+	var fs *core.MutableFS
+	if parentID != "" {
+		// the files of the parent are read from the blob store until they are written
+		fs, err = core.NewMutableFSFrom(ctx, bundle, c.bundle(repo, parentID, nil, nil), stagingDir)
+	} else {
+		fs, err = core.NewMutableFS(bundle, stagingDir)
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err = fs.MountMutable(path); err != nil {
+		return nil, wrap(err)
+	}
+	return fs, nil
+}
+
+// RecoverMutable recovers the writable filesystem staged in a directory by a mount that died.
+// The filesystem is committed or mounted again, and closed once committed to remove its journal.
+// The error is ErrNotFound when the directory holds no filesystem to recover.
+func (c *Client) RecoverMutable(ctx context.Context, stagingDir string) (*core.MutableFS, error) {
+	fs, err := core.RecoverMutableFS(ctx, stagingDir, c.metaStore, c.blobStore)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	return fs, nil
+}
+
+// descriptor returns the descriptor of a new bundle uploaded with options
+func (c *Client) descriptor(o uploadOpts) (*model.BundleDescriptor, error) {
+	descriptorOpts := []core.BundleDescriptorOption{
+		core.Message(o.message),
+		core.Contributors([]model.Contributor{c.config.Contributor}),
+		core.Compression(o.compression),
+		core.Parents(o.parents),
+	}
+	switch o.chunker {
+	case "":
+	case cafs.FastCDCChunker:
+		descriptorOpts = append(descriptorOpts,
+			core.ContentDefinedChunking(cafs.DefaultMinChunkSize, cafs.DefaultAvgChunkSize, cafs.DefaultMaxChunkSize))
+	default:
+		return nil, fmt.Errorf("unsupported chunker %q", o.chunker)
+	}
+	return core.NewBDescriptor(descriptorOpts...), nil
+}
+
+func (c *Client) bundle(repo, bundleID string, consumable storage.Store, tracker *progress.Tracker) *core.Bundle {
+	return core.New(core.NewBDescriptor(),
+		core.Repo(repo),
+		core.BundleID(bundleID),
+		core.MetaStore(c.metaStore),
+		core.BlobStore(c.blobStore),
+		core.ConsumableStore(consumable),
+		core.Progress(tracker),
+	)
+}
+
+// localDir creates a local directory if missing, and returns a file system rooted at it
+func localDir(dir string) (afero.Fs, error) {
+	path, err := filepath.Abs(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(), path), nil
+}
@@ -0,0 +1,142 @@
+// Copyright © 2018 One Concern
+
+// Package client is the API of datamon for programs embedding it.
+//
+// A Client wires the metadata, blob and consumable stores around the core package,
+// the way the datamon CLI does.
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/encrypted"
+	"github.com/oneconcern/datamon/pkg/storage/gcs"
+)
+
+// Config describes the stores of a client, and who contributes with it
+type Config struct {
+	MetadataBucket string            `json:"metadata" yaml:"metadata"`
+	BlobBucket     string            `json:"blob" yaml:"blob"`
+	Credential     string            `json:"credential,omitempty" yaml:"credential,omitempty"` // GCS credential file, the default credentials when empty
+	KeyFile        string            `json:"keyfile,omitempty" yaml:"keyfile,omitempty"`       // Key used to encrypt repo data client side
+	Contributor    model.Contributor `json:"contributor" yaml:"contributor"`
+}
+
+// Option overrides the stores built from the config
+type Option func(*Client)
+
+// MetaStore uses a store for repo and bundle metadata instead of the metadata bucket
+func MetaStore(store storage.Store) Option {
+	return func(c *Client) {
+		c.metaStore = store
+	}
+}
+
+// BlobStore uses a store for blobs instead of the blob bucket
+func BlobStore(store storage.Store) Option {
+	return func(c *Client) {
+		c.blobStore = store
+	}
+}
+
+// Client runs datamon operations on the stores of a config
+type Client struct {
+	config    Config
+	keys      encrypted.KeyProvider
+	metaStore storage.Store
+	blobStore storage.Store
+}
+
+// New creates a client. The stores are GCS buckets unless they are given as options,
+// and their content is encrypted when the config has a key file.
+func New(config Config, opts ...Option) (*Client, error) {
+	c := &Client{config: config}
+	for _, apply := range opts {
+		apply(c)
+	}
+	var err error
+	if config.KeyFile != "" {
+		if c.keys, err = encrypted.NewKeyFile(config.KeyFile); err != nil {
+			return nil, wrap(err)
+		}
+	}
+	if c.metaStore == nil {
+		if c.metaStore, err = gcs.New(config.MetadataBucket, config.Credential); err != nil {
+			return nil, wrap(err)
+		}
+	}
+	if c.blobStore == nil {
+		if c.blobStore, err = gcs.New(config.BlobBucket, config.Credential); err != nil {
+			return nil, wrap(err)
+		}
+	}
+	if c.keys != nil {
+		// repo descriptors are kept in clear text, so that they can record the encryption of the repo
+		c.metaStore = encrypted.New(c.metaStore, c.keys, encrypted.Exclude(func(key string) bool {
+			return strings.HasPrefix(key, model.GetArchivePathPrefixToRepos())
+		}))
+		c.blobStore = encrypted.New(c.blobStore, c.keys)
+	}
+	return c, nil
+}
+
+// MetaStore returns the store for repo and bundle metadata, for operations of the core package
+func (c *Client) MetaStore() storage.Store {
+	return c.metaStore
+}
+
+// BlobStore returns the store for blobs, for operations of the core package
+func (c *Client) BlobStore() storage.Store {
+	return c.blobStore
+}
+
+// Contributor returns the contributor of the config
+func (c *Client) Contributor() model.Contributor {
+	return c.config.Contributor
+}
+
+// Ping checks that the metadata and blob stores respond, and that their buckets or directories exist
+func (c *Client) Ping(ctx context.Context) error {
+	for _, store := range []storage.Store{c.metaStore, c.blobStore} {
+		if err := storage.Ping(ctx, store); err != nil {
+			return wrap(fmt.Errorf("%v: %w", store, err))
+		}
+	}
+	return nil
+}
+
+// encryption describes the encryption new repos are created with
+func (c *Client) encryption() *model.Encryption {
+	if c.keys == nil {
+		return nil
+	}
+	return &model.Encryption{
+		Algorithm: encrypted.Algorithm,
+		KeyID:     c.keys.KeyID(),
+	}
+}
+
+// CheckRepo verifies that a repo exists, and that the configured key matches the encryption recorded for it
+func (c *Client) CheckRepo(ctx context.Context, repo string) error {
+	rd, err := core.GetRepoDescriptorByRepoName(ctx, repo, c.metaStore)
+	if err != nil {
+		return wrap(err)
+	}
+	current := c.encryption()
+	switch {
+	case rd.Encryption == nil && current == nil:
+		return nil
+	case rd.Encryption == nil:
+		return wrap(fmt.Errorf("repo %s is not encrypted, remove the keyfile from the config to use it", repo))
+	case current == nil:
+		return wrap(storage.Forbiddenf("repo %s is encrypted with key %s, a keyfile must be configured", repo, rd.Encryption.KeyID))
+	case rd.Encryption.KeyID != current.KeyID:
+		return wrap(storage.Forbiddenf("repo %s is encrypted with key %s, configured key is %s", repo, rd.Encryption.KeyID, current.KeyID))
+	}
+	return nil
+}
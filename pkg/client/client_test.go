@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+const repo = "client-test-repo"
+
+func newTestClient(t *testing.T) *Client {
+	c, err := New(Config{
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	},
+		MetaStore(localfs.New(afero.NewMemMapFs())),
+		BlobStore(localfs.New(afero.NewMemMapFs())),
+	)
+	require.NoError(t, err)
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	require.NoError(t, c.Ping(ctx))
+
+	rd, err := c.CreateRepo(ctx, repo, "test repo")
+	require.NoError(t, err)
+	require.Equal(t, "test", rd.Contributor.Name)
+	_, err = c.CreateRepo(ctx, repo, "test repo")
+	require.True(t, errors.Is(err, ErrExists), "%v", err)
+
+	repos, next, err := c.ListRepos(ctx)
+	require.NoError(t, err)
+	require.Empty(t, next)
+	require.Len(t, repos, 1)
+	require.Equal(t, "test repo", repos[0].Description)
+
+	// a file spanning several leaves, and a small one in a sub directory
+	dir, err := ioutil.TempDir("", "datamon-client-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	large := make([]byte, 2*cafs.DefaultLeafSize+1234)
+	rand.New(rand.NewSource(1)).Read(large)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "large"), large, 0600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "small"), []byte("small file"), 0600))
+
+	_, err = c.UploadDir(ctx, "missing", dir)
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+	_, err = c.UploadDir(ctx, repo, filepath.Join(dir, "large"))
+	require.Error(t, err)
+
+	bd, err := c.UploadDir(ctx, repo, dir, UploadMessage("first"))
+	require.NoError(t, err)
+	require.NotEmpty(t, bd.ID)
+	require.Equal(t, "first", bd.Message)
+
+	bundles, _, err := c.ListBundles(ctx, repo)
+	require.NoError(t, err)
+	require.Len(t, bundles, 1)
+	require.Equal(t, bd.ID, bundles[0].ID)
+	got, err := c.GetBundle(ctx, repo, bd.ID)
+	require.NoError(t, err)
+	require.Equal(t, "first", got.Message)
+	_, err = c.GetBundle(ctx, repo, "missing")
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+	latest, err := c.LatestBundle(ctx, repo)
+	require.NoError(t, err)
+	require.Equal(t, bd.ID, latest)
+
+	files, err := c.ListFiles(ctx, repo, bd.ID)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// random access to a file
+	f, err := c.OpenFile(ctx, repo, bd.ID, "large")
+	require.NoError(t, err)
+	offset := int64(cafs.DefaultLeafSize + 100)
+	pos, err := f.Seek(offset, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, offset, pos)
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	require.Equal(t, large[offset:offset+1000], buf)
+	_, err = f.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	tail, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, large[len(large)-10:], tail)
+	require.NoError(t, f.Close())
+
+	_, err = c.OpenFile(ctx, repo, bd.ID, "missing")
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+
+	// files listed before are opened without reading the bundle again
+	for _, e := range files {
+		if e.NameWithPath != "large" {
+			continue
+		}
+		f, err = c.OpenEntry(ctx, repo, got, e)
+		require.NoError(t, err)
+		_, err = f.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		_, err = io.ReadFull(f, buf)
+		require.NoError(t, err)
+		require.Equal(t, large[offset:offset+1000], buf)
+		require.NoError(t, f.Close())
+	}
+
+	// downloads
+	dest, err := ioutil.TempDir("", "datamon-client-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, c.Download(ctx, repo, bd.ID, dest))
+	content, err := ioutil.ReadFile(filepath.Join(dest, "sub", "small"))
+	require.NoError(t, err)
+	require.Equal(t, "small file", string(content))
+	err = c.Download(ctx, repo, bd.ID, dest)
+	require.True(t, errors.Is(err, ErrExists), "%v", err)
+
+	single := filepath.Join(dest, "single")
+	require.NoError(t, c.DownloadFile(ctx, repo, bd.ID, "sub/small", single))
+	content, err = ioutil.ReadFile(filepath.Join(single, "sub", "small"))
+	require.NoError(t, err)
+	require.Equal(t, "small file", string(content))
+
+	// labels
+	label, err := c.SetLabel(ctx, repo, "prod", bd.ID)
+	require.NoError(t, err)
+	require.Equal(t, bd.ID, label.BundleID)
+	labels, err := c.ListLabels(ctx, repo)
+	require.NoError(t, err)
+	require.Len(t, labels, 1)
+	require.NoError(t, c.DeleteLabel(ctx, repo, "prod"))
+	_, err = c.GetLabel(ctx, repo, "prod")
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+	require.Equal(t, ErrNotFound, Kind(err))
+}
+
+func TestPing_MissingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datamon-client-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := New(Config{
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	},
+		MetaStore(localfs.New(afero.NewBasePathFs(afero.NewOsFs(), dir))),
+		BlobStore(localfs.New(afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(dir, "missing")))),
+	)
+	require.NoError(t, err)
+	err = c.Ping(context.Background())
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+}
+
+func TestKind(t *testing.T) {
+	require.Nil(t, Kind(errors.New("plain")))
+	require.Equal(t, ErrNotFound, Kind(os.ErrNotExist))
+	require.Equal(t, ErrIO, Kind(io.ErrUnexpectedEOF))
+	err := wrap(&os.PathError{Op: "open", Path: "x", Err: os.ErrPermission})
+	require.True(t, errors.Is(err, ErrForbidden))
+	require.True(t, errors.Is(err, os.ErrPermission))
+	require.Equal(t, err, wrap(err))
+}
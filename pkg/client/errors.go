@@ -0,0 +1,83 @@
+// Copyright © 2018 One Concern
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	gcsStorage "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// Kinds of the errors returned by the client, to be matched with errors.Is
+var (
+	ErrNotFound  error = storage.ErrNotFound
+	ErrExists    error = storage.ErrExists
+	ErrForbidden error = storage.ErrForbidden
+	ErrIO              = errors.New("i/o error")
+)
+
+// Error is returned by the client. It matches its kind with errors.Is, and unwraps to the failure.
+type Error struct {
+	Kind error // one of the kinds of errors, nil when the failure is of no known kind
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: Kind(err), Err: err}
+}
+
+// Kind returns the kind of an error, from the errors of datamon, of the storage backends and of the OS.
+// It is nil when the error is of no known kind.
+func Kind(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case 401, 403:
+			return ErrForbidden
+		case 404:
+			return ErrNotFound
+		case 409, 412:
+			return ErrExists
+		}
+	}
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, os.ErrNotExist), errors.Is(err, gcsStorage.ErrObjectNotExist),
+		errors.Is(err, gcsStorage.ErrBucketNotExist):
+		return ErrNotFound
+	case errors.Is(err, storage.ErrExists), errors.Is(err, os.ErrExist):
+		return ErrExists
+	case errors.Is(err, storage.ErrForbidden), errors.Is(err, os.ErrPermission):
+		return ErrForbidden
+	case errors.As(err, &pathErr), errors.As(err, &linkErr), errors.As(err, &syscallErr), errors.As(err, &netErr),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrIO
+	}
+	return nil
+}
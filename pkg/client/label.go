@@ -0,0 +1,35 @@
+// Copyright © 2018 One Concern
+
+package client
+
+import (
+	"context"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+)
+
+// SetLabel points a label of a repo to a bundle, contributed by the contributor of the config
+func (c *Client) SetLabel(ctx context.Context, repo, name, bundleID string) (model.Label, error) {
+	if err := core.SetLabel(ctx, c.metaStore, repo, name, bundleID, c.config.Contributor); err != nil {
+		return model.Label{}, wrap(err)
+	}
+	return c.GetLabel(ctx, repo, name)
+}
+
+// GetLabel returns a label of a repo
+func (c *Client) GetLabel(ctx context.Context, repo, name string) (model.Label, error) {
+	label, err := core.GetLabel(ctx, c.metaStore, repo, name)
+	return label, wrap(err)
+}
+
+// ListLabels returns the labels of a repo, by name
+func (c *Client) ListLabels(ctx context.Context, repo string) ([]model.Label, error) {
+	labels, err := core.ListLabels(ctx, c.metaStore, repo)
+	return labels, wrap(err)
+}
+
+// DeleteLabel deletes a label of a repo, the bundle is left alone
+func (c *Client) DeleteLabel(ctx context.Context, repo, name string) error {
+	return wrap(core.DeleteLabel(ctx, c.metaStore, repo, name))
+}
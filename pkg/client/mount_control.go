@@ -0,0 +1,225 @@
+// Copyright © 2018 One Concern
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/oneconcern/datamon/pkg/core"
+)
+
+// MountControl serves the controls of a mutable mount as json over a unix socket:
+//
+//	GET  /status  the status of the mount
+//	POST /commit  commit the files as a new bundle, with the message of the {"message": "..."} body
+//	POST /abort   unmount without committing the changes since the last commit
+//
+// Failures return {"error": "...", "kind": "..."}.
+type MountControl struct {
+	fs       *core.MutableFS
+	path     string
+	socket   string
+	listener net.Listener
+	server   *http.Server
+
+	once sync.Once
+	done chan struct{}
+}
+
+// CommitResult is returned by the commit control
+type CommitResult struct {
+	BundleID string `json:"bundle"`
+}
+
+// controlError is the body of failed controls
+type controlError struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+var controlKinds = map[string]error{
+	"not-found":      ErrNotFound,
+	"already-exists": ErrExists,
+	"auth":           ErrForbidden,
+	"io":             ErrIO,
+}
+
+// ServeMountControl serves the controls of a filesystem mounted at a path on a unix socket,
+// until the mount is aborted or the control is closed
+func ServeMountControl(fs *core.MutableFS, path, socket string) (*MountControl, error) {
+	// a socket left by a mount that died is replaced
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, wrap(err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	m := &MountControl{
+		fs:       fs,
+		path:     path,
+		socket:   socket,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", m.status)
+	mux.HandleFunc("/commit", m.commit)
+	mux.HandleFunc("/abort", m.abort)
+	m.server = &http.Server{Handler: mux}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Mount control stopped: %s", err)
+		}
+	}()
+	return m, nil
+}
+
+// Done is closed when the mount is aborted
+func (m *MountControl) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close stops serving the controls and removes the socket
+func (m *MountControl) Close() error {
+	m.once.Do(func() { close(m.done) })
+	err := m.server.Close()
+	if rmErr := os.Remove(m.socket); err == nil && rmErr != nil && !os.IsNotExist(rmErr) {
+		err = rmErr
+	}
+	return wrap(err)
+}
+
+func (m *MountControl) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeControl(w, http.StatusOK, m.fs.Status())
+}
+
+func (m *MountControl) commit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid commit request: %v", err))
+		return
+	}
+	if err := m.fs.CommitMessage(req.Message); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeControl(w, http.StatusOK, CommitResult{BundleID: m.fs.BundleID()})
+}
+
+func (m *MountControl) abort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := m.fs.Abort(m.path); err != nil {
+		writeControlError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeControl(w, http.StatusOK, m.fs.Status())
+	m.once.Do(func() { close(m.done) })
+}
+
+func writeControl(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write control response: %s", err)
+	}
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	kind := "error"
+	for name, k := range controlKinds {
+		if Kind(err) == k {
+			kind = name
+		}
+	}
+	writeControl(w, status, controlError{Error: err.Error(), Kind: kind})
+}
+
+// controlClient sends controls to a mount over its unix socket
+func controlClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// control sends a control to the mount serving a socket, and decodes its result
+func control(ctx context.Context, socket, method, name string, body, result interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return wrap(err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://mount/"+name, &payload)
+	if err != nil {
+		return wrap(err)
+	}
+	resp, err := controlClient(socket).Do(req.WithContext(ctx))
+	if err != nil {
+		return &Error{Kind: ErrIO, Err: fmt.Errorf("no mount controlled by %s: %w", socket, err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure controlError
+		if err = json.NewDecoder(resp.Body).Decode(&failure); err != nil {
+			return wrap(fmt.Errorf("%s failed: %s", name, resp.Status))
+		}
+		return &Error{Kind: controlKinds[failure.Kind], Err: errors.New(failure.Error)}
+	}
+	return wrap(json.NewDecoder(resp.Body).Decode(result))
+}
+
+// MountStatus returns the status of the mutable mount controlled by a socket
+func MountStatus(ctx context.Context, socket string) (*core.MutableStatus, error) {
+	var status core.MutableStatus
+	if err := control(ctx, socket, http.MethodGet, "status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// MountCommit commits the files of the mutable mount controlled by a socket as a new bundle with a message,
+// and returns the ID of the bundle
+func MountCommit(ctx context.Context, socket, message string) (string, error) {
+	var result CommitResult
+	if err := control(ctx, socket, http.MethodPost, "commit", map[string]string{"message": message}, &result); err != nil {
+		return "", err
+	}
+	return result.BundleID, nil
+}
+
+// MountAbort unmounts the mutable mount controlled by a socket, without committing the changes since its last commit
+func MountAbort(ctx context.Context, socket string) (*core.MutableStatus, error) {
+	var status core.MutableStatus
+	if err := control(ctx, socket, http.MethodPost, "abort", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
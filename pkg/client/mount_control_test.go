@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/core"
+)
+
+func TestMountControl(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	_, err := c.CreateRepo(ctx, repo, "test repo")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "datamon-control-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "mount.sock")
+
+	_, err = MountStatus(ctx, socket)
+	require.Equal(t, ErrIO, Kind(err), "%v", err)
+
+	bd, err := c.descriptor(uploadOpts{message: "mounted"})
+	require.NoError(t, err)
+	fs, err := core.NewMutableFS(core.New(bd,
+		core.Repo(repo),
+		core.MetaStore(c.metaStore),
+		core.BlobStore(c.blobStore),
+	), dir)
+	require.NoError(t, err)
+	ctl, err := ServeMountControl(fs, filepath.Join(dir, "mount"), socket)
+	require.NoError(t, err)
+
+	status, err := MountStatus(ctx, socket)
+	require.NoError(t, err)
+	require.Equal(t, repo, status.Repo)
+	require.False(t, status.Dirty)
+	require.Empty(t, status.Bundles)
+
+	first, err := MountCommit(ctx, socket, "first")
+	require.NoError(t, err)
+	second, err := MountCommit(ctx, socket, "")
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	for _, id := range []string{first, second} {
+		got, err := c.GetBundle(ctx, repo, id)
+		require.NoError(t, err)
+		require.Equal(t, "first", got.Message)
+		require.Equal(t, "test", got.Contributors[0].Name)
+	}
+	status, err = MountStatus(ctx, socket)
+	require.NoError(t, err)
+	require.Equal(t, []string{first, second}, status.Bundles)
+
+	require.NoError(t, ctl.Close())
+	<-ctl.Done()
+	_, err = os.Stat(socket)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,55 @@
+// Copyright © 2018 One Concern
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+)
+
+// CreateRepo creates a repo contributed by the contributor of the config,
+// encrypted when the config has a key file
+func (c *Client) CreateRepo(ctx context.Context, repo, description string) (model.RepoDescriptor, error) {
+	rd := model.RepoDescriptor{
+		Name:        repo,
+		Description: description,
+		Timestamp:   time.Now(),
+		Contributor: c.config.Contributor,
+		Encryption:  c.encryption(),
+	}
+	if err := core.CreateRepo(ctx, rd, c.metaStore); err != nil {
+		return rd, wrap(err)
+	}
+	return rd, nil
+}
+
+// GetRepo returns the descriptor of a repo
+func (c *Client) GetRepo(ctx context.Context, repo string) (model.RepoDescriptor, error) {
+	rd, err := core.GetRepoDescriptorByRepoName(ctx, repo, c.metaStore)
+	return rd, wrap(err)
+}
+
+// ListRepos returns a page of the repos, by name, and the token of the next page
+func (c *Client) ListRepos(ctx context.Context, opts ...core.ListOption) ([]model.RepoDescriptor, string, error) {
+	repos, next, err := core.ListRepos(ctx, c.metaStore, opts...)
+	return repos, next, wrap(err)
+}
+
+// MountRepo mounts a read only filesystem at a path, browsing the bundles of a repo under bundles/,
+// its labels under labels/ and its latest bundle as latest. New bundles and labels show up while mounted.
+func (c *Client) MountRepo(ctx context.Context, repo, path string) (*core.RepoFS, error) {
+	if err := c.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	fs, err := core.NewRepoFS(ctx, repo, c.metaStore, c.blobStore)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err = fs.MountRepo(path); err != nil {
+		return nil, wrap(err)
+	}
+	return fs, nil
+}
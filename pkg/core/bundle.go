@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"time"
 
 	"github.com/oneconcern/datamon/pkg/cafs"
@@ -13,6 +14,7 @@ import (
 	"github.com/segmentio/ksuid"
 
 	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/progress"
 	"github.com/oneconcern/datamon/pkg/storage"
 )
 
@@ -25,6 +27,7 @@ type Bundle struct {
 	BlobStore        storage.Store
 	BundleDescriptor model.BundleDescriptor
 	BundleEntries    []model.BundleEntry
+	progress         *progress.Tracker
 }
 
 // SetBundleID for the bundle
@@ -68,6 +71,40 @@ func Parents(p []string) BundleDescriptorOption {
 	}
 }
 
+// Compression compresses the blobs uploaded with the bundle, see cafs.CompressionCodecs
+func Compression(codec string) BundleDescriptorOption {
+	return func(b *model.BundleDescriptor) {
+		b.Compression = codec
+	}
+}
+
+// ContentDefinedChunking splits the files of the bundle with FastCDC, see cafs.ContentDefinedChunking
+func ContentDefinedChunking(min, avg, max uint32) BundleDescriptorOption {
+	return func(b *model.BundleDescriptor) {
+		b.Chunker = &model.Chunker{
+			Algorithm: cafs.FastCDCChunker,
+			Min:       min,
+			Avg:       avg,
+			Max:       max,
+		}
+	}
+}
+
+// blobWriteOptions configures cafs to write blobs as recorded in the bundle descriptor
+func blobWriteOptions(bd *model.BundleDescriptor) ([]cafs.Option, error) {
+	opts := []cafs.Option{
+		cafs.LeafSize(bd.LeafSize),
+		cafs.Compression(bd.Compression),
+	}
+	if c := bd.Chunker; c != nil {
+		if c.Algorithm != cafs.FastCDCChunker {
+			return nil, fmt.Errorf("unsupported chunker %q", c.Algorithm)
+		}
+		opts = append(opts, cafs.ContentDefinedChunking(c.Min, c.Avg, c.Max))
+	}
+	return opts, nil
+}
+
 func NewBDescriptor(descriptorOps ...BundleDescriptorOption) *model.BundleDescriptor {
 	bd := model.BundleDescriptor{
 		LeafSize:               cafs.DefaultLeafSize, // For now, fixed leaf size
@@ -113,6 +150,14 @@ func BundleID(bID string) BundleOption {
 	}
 }
 
+// Progress reports files and bytes transferred by Upload and Publish to the tracker.
+// The caller owns the tracker and is expected to call Finish on it.
+func Progress(t *progress.Tracker) BundleOption {
+	return func(b *Bundle) {
+		b.progress = t
+	}
+}
+
 func New(bd *model.BundleDescriptor, bundleOps ...BundleOption) *Bundle {
 	b := Bundle{
 		RepoID:           "",
@@ -159,7 +204,7 @@ func PublishMetadata(ctx context.Context, bundle *Bundle) error {
 
 // Upload an bundle to archive
 func Upload(ctx context.Context, bundle *Bundle) error {
-	err := RepoExists(bundle.RepoID, bundle.MetaStore)
+	err := repoWritable(ctx, bundle.MetaStore, bundle.RepoID)
 	if err != nil {
 		return err
 	}
@@ -167,25 +212,31 @@ func Upload(ctx context.Context, bundle *Bundle) error {
 }
 
 func PopulateFiles(ctx context.Context, bundle *Bundle) error {
-	e := RepoExists(bundle.RepoID, bundle.MetaStore)
+	e := RepoExists(ctx, bundle.RepoID, bundle.MetaStore)
 	if e != nil {
 		return e
 	}
+	return populateBundleFiles(ctx, bundle)
+}
+
+// populateBundleFiles reads the descriptor and file lists of a bundle, whether its repo exists or not
+func populateBundleFiles(ctx context.Context, bundle *Bundle) error {
 	reader, err := bundle.MetaStore.Get(ctx, model.GetArchivePathToBundle(bundle.RepoID, bundle.BundleID))
 	if err != nil {
-		fmt.Printf("Failed to download the bundle descriptor: %s", err)
+		log.Printf("Failed to download the bundle descriptor: %s", err)
 		return err
 	}
 	defer reader.Close()
 	object, err := ioutil.ReadAll(reader)
 	if err != nil {
-		fmt.Printf("Failed to read the bundle descriptor: %s", err)
+		log.Printf("Failed to read the bundle descriptor: %s", err)
 		return err
 	}
-	// Unmarshal the file
+	// Unmarshal the file, descriptors of version 0 have no version
+	bundle.BundleDescriptor.Version = 0
 	err = yaml.Unmarshal(object, &bundle.BundleDescriptor)
 	if err != nil {
-		fmt.Printf("Failed to unmarshal the bundle descriptor: %s", err)
+		log.Printf("Failed to unmarshal the bundle descriptor: %s", err)
 		return err
 	}
 
@@ -194,12 +245,12 @@ func PopulateFiles(ctx context.Context, bundle *Bundle) error {
 	for i = 0; i < bundle.BundleDescriptor.BundleEntriesFileCount; i++ {
 		r, err := bundle.MetaStore.Get(ctx, model.GetArchivePathToBundleFileList(bundle.RepoID, bundle.BundleID, i))
 		if err != nil {
-			fmt.Printf("Failed to download the bundle files: %s", err)
+			log.Printf("Failed to download the bundle files: %s", err)
 			return err
 		}
 		object, err = ioutil.ReadAll(r)
 		if err != nil {
-			fmt.Printf("Failed to read the bundle files: %s", err)
+			log.Printf("Failed to read the bundle files: %s", err)
 			return err
 		}
 		var bundleEntries model.BundleEntries
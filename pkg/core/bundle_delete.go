@@ -0,0 +1,251 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// DeleteOption configures the deletion of a bundle
+type DeleteOption func(*deleteOpts)
+
+type deleteOpts struct {
+	force  bool
+	dryRun bool
+}
+
+// DeleteForce deletes the bundle even when it is labeled or the parent of other bundles.
+// The labels pointing to it are deleted as well.
+func DeleteForce(force bool) DeleteOption {
+	return func(o *deleteOpts) {
+		o.force = force
+	}
+}
+
+// DeleteDryRun only checks that the bundle can be deleted
+func DeleteDryRun(dryRun bool) DeleteOption {
+	return func(o *deleteOpts) {
+		o.dryRun = dryRun
+	}
+}
+
+// DeleteBundle deletes the descriptor and the file lists of a bundle.
+//
+// Labeled bundles and the parents of other bundles are protected, unless forced.
+// The repo is locked while the bundle is checked and deleted.
+// The blobs of the bundle are left in the blob store, to be deleted by CollectGarbage.
+func DeleteBundle(ctx context.Context, store storage.Store, repo, bundleID string, opts ...DeleteOption) error {
+	var o deleteOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	l, err := newRepoLock("delete bundle " + bundleID)
+	if err != nil {
+		return err
+	}
+	if _, err = l.lock(ctx, store, repo); err != nil {
+		return err
+	}
+	defer l.unlock(ctx, store, repo) // nolint:errcheck
+
+	if err = RepoExists(ctx, repo, store); err != nil {
+		return err
+	}
+	if err = bundleExists(ctx, store, repo, bundleID); err != nil {
+		return err
+	}
+	labels, err := labelsByBundle(ctx, store, repo)
+	if err != nil {
+		return err
+	}
+	bundles, err := listBundleDescriptors(ctx, store, repo)
+	if err != nil {
+		return err
+	}
+	var children []string
+	for _, bd := range bundles {
+		for _, parent := range bd.Parents {
+			if parent == bundleID {
+				children = append(children, bd.ID)
+			}
+		}
+	}
+	if !o.force {
+		if len(labels[bundleID]) > 0 {
+			return fmt.Errorf("bundle %s is labeled %s, deleting it must be forced", bundleID, strings.Join(labels[bundleID], ", "))
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("bundle %s is the parent of %s, deleting it must be forced", bundleID, strings.Join(children, ", "))
+		}
+	}
+	if o.dryRun {
+		return nil
+	}
+	return deleteBundleMetadata(ctx, store, repo, bundleID, labels[bundleID])
+}
+
+// SkippedBundle is a bundle which is not kept by the retention policy, but is protected from pruning
+type SkippedBundle struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// PruneBundles deletes the bundles of a repo which are not kept by its retention policy, and returns their IDs.
+// Like DeleteBundle, it skips the labeled bundles and the parents of the bundles it keeps, and returns them
+// with the reason they were skipped.
+//
+// Repos without a retention policy can't be pruned. The repo is locked while it is pruned.
+func PruneBundles(ctx context.Context, store storage.Store, repo string, dryRun bool) ([]string, []SkippedBundle, error) {
+	l, err := newRepoLock("prune")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = l.lock(ctx, store, repo); err != nil {
+		return nil, nil, err
+	}
+	defer l.unlock(ctx, store, repo) // nolint:errcheck
+
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, store)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rd.Retention.IsEmpty() {
+		return nil, nil, fmt.Errorf("repo %s has no retention policy", repo)
+	}
+	policy := rd.Retention
+	labels, err := labelsByBundle(ctx, store, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	bundles, err := listBundleDescriptors(ctx, store, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	youngest := time.Now().AddDate(0, 0, -policy.KeepDays)
+	kept := make(map[string]bool, len(bundles))
+	reasons := make(map[string]string)
+	for i, bd := range bundles {
+		switch {
+		case policy.KeepLast > 0 && i >= len(bundles)-policy.KeepLast:
+		case policy.KeepDays > 0 && bd.Timestamp.After(youngest):
+		case len(labels[bd.ID]) > 0:
+			reasons[bd.ID] = "labeled " + strings.Join(labels[bd.ID], ", ")
+		default:
+			continue
+		}
+		kept[bd.ID] = true
+	}
+	// the parents of kept bundles are kept too, up to the oldest ancestor
+	for changed := true; changed; {
+		changed = false
+		for _, bd := range bundles {
+			if !kept[bd.ID] {
+				continue
+			}
+			for _, parent := range bd.Parents {
+				if !kept[parent] {
+					reasons[parent] = "parent of " + bd.ID
+					kept[parent] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	var (
+		pruned  []string
+		skipped []SkippedBundle
+	)
+	for _, bd := range bundles {
+		switch {
+		case !kept[bd.ID]:
+			pruned = append(pruned, bd.ID)
+		case reasons[bd.ID] != "":
+			skipped = append(skipped, SkippedBundle{ID: bd.ID, Reason: reasons[bd.ID]})
+		}
+	}
+	if dryRun {
+		return pruned, skipped, nil
+	}
+	for _, bundleID := range pruned {
+		if err = deleteBundleMetadata(ctx, store, repo, bundleID, nil); err != nil {
+			return nil, nil, fmt.Errorf("deleting bundle %s: %v", bundleID, err)
+		}
+	}
+	return pruned, skipped, nil
+}
+
+// deleteBundleMetadata deletes a bundle and its labels.
+// The descriptor goes first, so the bundle is not listed anymore when the deletion is interrupted.
+func deleteBundleMetadata(ctx context.Context, store storage.Store, repo, bundleID string, labels []string) error {
+	bundle := New(NewBDescriptor(), Repo(repo), BundleID(bundleID), MetaStore(store))
+	// the repo descriptor is missing when resuming an interrupted repo deletion
+	if err := populateBundleFiles(ctx, bundle); err != nil {
+		return err
+	}
+	if err := store.Delete(ctx, model.GetArchivePathToBundle(repo, bundleID)); err != nil {
+		return err
+	}
+	stale, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToBundle(repo, bundleID))
+	if err != nil {
+		return err
+	}
+	roots := make(map[string]bool)
+	for _, e := range bundle.BundleEntries {
+		if e.Symlink != "" {
+			continue
+		}
+		if !roots[e.Hash] {
+			roots[e.Hash] = true
+			stale = append(stale, model.GetArchivePathToRootReference(e.Hash, repo, bundleID))
+		}
+	}
+	for _, label := range labels {
+		stale = append(stale, model.GetArchivePathToLabel(repo, label))
+	}
+	return forEach(len(stale), func(i int) error {
+		return store.Delete(ctx, stale[i])
+	})
+}
+
+// labelsByBundle returns the names of the labels of a repo, by bundle ID
+func labelsByBundle(ctx context.Context, store storage.Store, repo string) (map[string][]string, error) {
+	labels, err := listLabels(ctx, store, repo)
+	if err != nil {
+		return nil, err
+	}
+	byBundle := make(map[string][]string)
+	for _, label := range labels {
+		byBundle[label.BundleID] = append(byBundle[label.BundleID], label.Name)
+	}
+	return byBundle, nil
+}
+
+// listBundleDescriptors returns the descriptors of all the bundles of a repo, oldest first
+func listBundleDescriptors(ctx context.Context, store storage.Store, repo string) ([]model.BundleDescriptor, error) {
+	ids, err := listBundleIDs(ctx, repo, store)
+	if err != nil {
+		return nil, err
+	}
+	bundles := make([]model.BundleDescriptor, len(ids))
+	err = forEach(len(ids), func(i int) error {
+		if err := getYaml(ctx, store, model.GetArchivePathToBundle(repo, ids[i]), &bundles[i]); err != nil {
+			return err
+		}
+		bundles[i].ID = ids[i]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(bundles, func(i, j int) bool {
+		return bundles[i].Timestamp.Before(bundles[j].Timestamp)
+	})
+	return bundles, nil
+}
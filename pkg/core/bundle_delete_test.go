@@ -0,0 +1,148 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestDeleteBundle(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	contributor := model.Contributor{Name: "test", Email: "t@test.com"}
+
+	parent := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": testContent(2, 0), "shared": testContent(1, 1)})
+	child := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"b": testContent(2, 2), "shared": testContent(1, 1)})
+	// record the lineage of the child
+	child.BundleDescriptor.Parents = []string{parent.BundleID}
+	require.NoError(t, metaStore.Delete(ctx, model.GetArchivePathToBundle(repo, child.BundleID)))
+	require.NoError(t, uploadBundleDescriptor(ctx, child))
+
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "release-1.0", child.BundleID, contributor))
+	require.Error(t, SetLabel(ctx, metaStore, repo, "release 1.0", child.BundleID, contributor))
+	require.Error(t, SetLabel(ctx, metaStore, repo, "missing", "nobundle", contributor))
+	label, err := GetLabel(ctx, metaStore, repo, "release-1.0")
+	require.NoError(t, err)
+	require.Equal(t, child.BundleID, label.BundleID)
+
+	// protected bundles
+	err = DeleteBundle(ctx, metaStore, repo, parent.BundleID)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "parent of "+child.BundleID)
+	err = DeleteBundle(ctx, metaStore, repo, child.BundleID)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "labeled release-1.0")
+	require.NoError(t, DeleteBundle(ctx, metaStore, repo, child.BundleID, DeleteForce(true), DeleteDryRun(true)))
+	require.NoError(t, bundleExists(ctx, metaStore, repo, child.BundleID))
+
+	require.NoError(t, DeleteBundle(ctx, metaStore, repo, child.BundleID, DeleteForce(true)))
+	require.Error(t, bundleExists(ctx, metaStore, repo, child.BundleID))
+	keys, err := listKeysPrefix(ctx, metaStore, model.GetArchivePathPrefixToBundle(repo, child.BundleID))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	labels, err := ListLabels(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.Empty(t, labels)
+	refs, err := FindBlobReferences(ctx, child.BundleEntries[0].Hash, metaStore)
+	require.NoError(t, err)
+	for _, ref := range refs {
+		require.NotEqual(t, child.BundleID, ref.BundleID)
+	}
+
+	// the blobs of the child are garbage, except the shared file
+	var (
+		lock    sync.Mutex
+		garbage []cafs.Key
+	)
+	collect := func(k cafs.Key) {
+		lock.Lock()
+		garbage = append(garbage, k)
+		lock.Unlock()
+	}
+	require.NoError(t, CollectGarbage(ctx, metaStore, blobStore, true, collect))
+	require.Len(t, garbage, 3)
+	garbage = nil
+	require.NoError(t, CollectGarbage(ctx, metaStore, blobStore, false, collect))
+	require.Len(t, garbage, 3)
+	garbage = nil
+	require.NoError(t, CollectGarbage(ctx, metaStore, blobStore, false, collect))
+	require.Empty(t, garbage)
+
+	require.NoError(t, Publish(ctx, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(parent.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+		ConsumableStore(localfs.New(afero.NewMemMapFs())),
+	)))
+}
+
+func TestPruneBundles(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+
+	var bundles []*Bundle
+	for i := 0; i < 5; i++ {
+		bundles = append(bundles, uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": {byte(i)}}))
+	}
+	ids := make([]string, len(bundles))
+	for i, b := range bundles {
+		ids[i] = b.BundleID
+	}
+	_, _, err := PruneBundles(ctx, metaStore, repo, true)
+	require.Error(t, err, "no retention policy")
+
+	// the third bundle is the parent of the fourth
+	child := bundles[3]
+	child.BundleDescriptor.Parents = []string{ids[2]}
+	require.NoError(t, metaStore.Delete(ctx, model.GetArchivePathToBundle(repo, child.BundleID)))
+	require.NoError(t, uploadBundleDescriptor(ctx, child))
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "first", ids[0], model.Contributor{}))
+
+	require.NoError(t, UpdateRepo(ctx, metaStore, repo, RepoRetention(&model.Retention{KeepLast: 2})))
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, metaStore)
+	require.NoError(t, err)
+	require.Equal(t, 2, rd.Retention.KeepLast)
+
+	pruned, skipped, err := PruneBundles(ctx, metaStore, repo, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[1]}, pruned)
+	require.Equal(t, []SkippedBundle{
+		{ID: ids[0], Reason: "labeled first"},
+		{ID: ids[2], Reason: "parent of " + ids[3]},
+	}, skipped)
+	require.NoError(t, bundleExists(ctx, metaStore, repo, ids[1]))
+
+	// younger bundles are kept
+	require.NoError(t, UpdateRepo(ctx, metaStore, repo, RepoRetention(&model.Retention{KeepLast: 1, KeepDays: 1})))
+	pruned, _, err = PruneBundles(ctx, metaStore, repo, true)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	// the parents of skipped bundles are skipped too
+	require.NoError(t, UpdateRepo(ctx, metaStore, repo, RepoRetention(&model.Retention{KeepLast: 1})))
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "child", ids[3], model.Contributor{}))
+	pruned, skipped, err = PruneBundles(ctx, metaStore, repo, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[1]}, pruned)
+	require.Equal(t, []SkippedBundle{
+		{ID: ids[0], Reason: "labeled first"},
+		{ID: ids[2], Reason: "parent of " + ids[3]},
+		{ID: ids[3], Reason: "labeled child"},
+	}, skipped)
+	remaining, err := listBundleIDs(ctx, repo, metaStore)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{ids[0], ids[2], ids[3], ids[4]}, remaining)
+	labels, err := ListLabels(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// bundleFile reads a file of a bundle from the blob store.
+// Seeking is deferred to the next read, so that finding the size of the file costs nothing.
+type bundleFile struct {
+	reader io.ReadCloser
+	seeker io.Seeker
+	size   int64
+	offset int64
+	seek   bool
+}
+
+func (f *bundleFile) Read(p []byte) (int, error) {
+	if f.seek {
+		if _, err := f.seeker.Seek(f.offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		f.seek = false
+	}
+	n, err := f.reader.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *bundleFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seeking before the start of the file: %d", offset)
+	}
+	if offset != f.offset {
+		f.offset = offset
+		f.seek = true
+	}
+	return offset, nil
+}
+
+func (f *bundleFile) Close() error {
+	return f.reader.Close()
+}
+
+// OpenFile opens a file of a bundle for reading, without downloading the bundle.
+// The file lists of the bundle are populated when they are not already.
+func OpenFile(ctx context.Context, bundle *Bundle, file string) (io.ReadSeekCloser, error) {
+	if len(bundle.BundleEntries) == 0 {
+		if err := PopulateFiles(ctx, bundle); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range bundle.BundleEntries {
+		if e.NameWithPath == file {
+			return openBundleEntry(ctx, bundle, e)
+		}
+	}
+	return nil, storage.NotFoundf("file %s not found in bundle %s of repo %s", file, bundle.BundleID, bundle.RepoID)
+}
+
+// OpenEntry opens a file listed in the entries of a bundle for reading, without reading the metadata
+// of the bundle. The descriptor of the bundle must be set.
+func OpenEntry(ctx context.Context, bundle *Bundle, e model.BundleEntry) (io.ReadSeekCloser, error) {
+	f, err := openBundleEntry(ctx, bundle, e)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// openBundleEntry opens a file of a bundle for reading from the blob store
+func openBundleEntry(ctx context.Context, bundle *Bundle, e model.BundleEntry) (*bundleFile, error) {
+	if err := contentError(e); err != nil {
+		return nil, err
+	}
+	key, err := cafs.KeyFromString(e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := cafs.New(
+		cafs.LeafSize(bundle.BundleDescriptor.LeafSize),
+		cafs.LeafTruncation(bundle.BundleDescriptor.Version < 1),
+		cafs.Compression(bundle.BundleDescriptor.Compression),
+		cafs.Backend(bundle.BlobStore),
+	)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := fs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		_ = reader.Close()
+		return nil, fmt.Errorf("reader of %s can't seek", e.NameWithPath)
+	}
+	return &bundleFile{reader: reader, seeker: seeker, size: int64(e.Size)}, nil
+}
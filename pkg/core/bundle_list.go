@@ -2,66 +2,77 @@ package core
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
-
-	"gopkg.in/yaml.v2"
 
 	"github.com/oneconcern/datamon/pkg/model"
 	"github.com/oneconcern/datamon/pkg/storage"
 )
 
-func ListBundles(repo string, store storage.Store) ([]string, error) {
-	// TODO: Don;t format string here, return a paginated list of id<->bd
-	// Get a list
-	e := RepoExists(repo, store)
-	if e != nil {
-		return nil, e
+// ListBundles returns the descriptors of the bundles of a repo, oldest first, and the token of the next page.
+// The token is empty on the last page.
+func ListBundles(ctx context.Context, repo string, store storage.Store, opts ...ListOption) ([]model.BundleDescriptor, string, error) {
+	o := newListOpts(opts)
+	if err := RepoExists(ctx, repo, store); err != nil {
+		return nil, "", err
 	}
-	ks, _, err := store.KeysPrefix(context.Background(), "", model.GetArchivePathPrefixToBundles(repo), "", 1000000)
+	bundles, err := listBundleDescriptors(ctx, store, repo)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	var keys = make([]string, 0)
-	for _, k := range ks {
-		apc, err := model.GetArchivePathComponents(k)
-		if err != nil {
-			return nil, err
-		}
-		if apc.ArchiveFileName != "bundle.json" {
-			continue
+	matched := make([]model.BundleDescriptor, 0, len(bundles))
+	for _, bd := range bundles {
+		if o.match(bd.Timestamp, bd.Message, bd.Contributors...) {
+			matched = append(matched, bd)
 		}
-		c := apc.BundleID
-		r, err := store.Get(context.Background(), model.GetArchivePathToBundle(repo, c))
-		if err != nil {
-			return nil, err
-		}
-		o, err := ioutil.ReadAll(r)
-		if err != nil {
-			return nil, err
-		}
-		var bd model.BundleDescriptor
-		err = yaml.Unmarshal(o, &bd)
-		if err != nil {
-			return nil, err
+	}
+	if o.descending {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
 		}
-		keys = append(keys, c+" , "+bd.Timestamp.String()+" , "+bd.Message)
 	}
+	ids := make([]string, len(matched))
+	for i, bd := range matched {
+		ids[i] = bd.ID
+	}
+	// bundles are listed by time, not by ID
+	start, end, next, err := o.page(ids, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return matched[start:end], next, nil
+}
 
-	return keys, nil
+// GetBundle returns the descriptor of a bundle of a repo
+func GetBundle(ctx context.Context, repo, bundleID string, store storage.Store) (model.BundleDescriptor, error) {
+	var bd model.BundleDescriptor
+	if err := RepoExists(ctx, repo, store); err != nil {
+		return bd, err
+	}
+	key := model.GetArchivePathToBundle(repo, bundleID)
+	has, err := store.Has(ctx, key)
+	if err != nil {
+		return bd, err
+	}
+	if !has {
+		return bd, storage.NotFoundf("bundle %s not found in repo %s", bundleID, repo)
+	}
+	if err = getYaml(ctx, store, key, &bd); err != nil {
+		return bd, err
+	}
+	bd.ID = bundleID
+	return bd, nil
 }
 
-func GetLatestBundle(repo string, store storage.Store) (string, error) {
-	e := RepoExists(repo, store)
+func GetLatestBundle(ctx context.Context, repo string, store storage.Store) (string, error) {
+	e := RepoExists(ctx, repo, store)
 	if e != nil {
 		return "", e
 	}
-	ks, _, err := store.KeysPrefix(context.Background(), "", model.GetArchivePathPrefixToBundles(repo), "", 1000000)
+	ks, _, err := store.KeysPrefix(ctx, "", model.GetArchivePathPrefixToBundles(repo), "", 1000000)
 	if err != nil {
 		return "", err
 	}
 	if len(ks) == 0 {
-		return "", fmt.Errorf("no bundles uploaded to repo: %s", repo)
+		return "", storage.NotFoundf("no bundles uploaded to repo: %s", repo)
 	}
 
 	apc, err := model.GetArchivePathComponents(ks[len(ks)-1])
@@ -71,3 +82,22 @@ func GetLatestBundle(repo string, store storage.Store) (string, error) {
 
 	return apc.BundleID, nil
 }
+
+// listBundleIDs returns the IDs of all the bundles of a repo, oldest first
+func listBundleIDs(ctx context.Context, repo string, store storage.Store) ([]string, error) {
+	ks, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToBundles(repo))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(ks))
+	for _, k := range ks {
+		apc, err := model.GetArchivePathComponents(k)
+		if err != nil {
+			return nil, err
+		}
+		if apc.ArchiveFileName == "bundle.json" {
+			ids = append(ids, apc.BundleID)
+		}
+	}
+	return ids, nil
+}
@@ -5,7 +5,6 @@ package core
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"hash/crc32"
 	"io"
 	"log"
@@ -26,6 +25,7 @@ type filePacked struct {
 	hash      string
 	name      string
 	keys      []byte
+	leaves    []cafs.Key
 	size      uint64
 	duplicate bool
 }
@@ -68,15 +68,20 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 	if err != nil {
 		return err
 	}
-	cafsArchive, err := cafs.New(
-		cafs.LeafSize(bundle.BundleDescriptor.LeafSize),
+	opts, err := blobWriteOptions(&bundle.BundleDescriptor)
+	if err != nil {
+		return err
+	}
+	cafsArchive, err := cafs.New(append(opts,
 		cafs.Backend(bundle.BlobStore),
-	)
+		cafs.Progress(bundle.progress),
+	)...)
 	if err != nil {
 		return err
 	}
 
 	fileList := make([]model.BundleEntry, 0)
+	leaves := make(map[cafs.Key][]cafs.Key)
 	var firstUnuploadBundleEntryIndex uint
 	// Upload the files and the bundle list
 	err = bundle.InitializeBundleID()
@@ -99,6 +104,7 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 			return err
 		}
 		count++
+		bundle.progress.AddFiles(1)
 		go func(file string) {
 			written, key, keys, duplicate, e := cafsArchive.Put(ctx, fileReader)
 			if e != nil {
@@ -108,10 +114,19 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 				}
 				return
 			}
+			fileLeaves, e := cafs.LeafKeys(key, append(keys[:len(keys):len(keys)], key[:]...), bundle.BundleDescriptor.LeafSize)
+			if e != nil {
+				eC <- errorHit{
+					error: e,
+					file:  file,
+				}
+				return
+			}
 
 			fC <- filePacked{
 				hash:      key.String(),
 				keys:      keys,
+				leaves:    fileLeaves,
 				name:      file,
 				size:      uint64(written),
 				duplicate: duplicate,
@@ -124,7 +139,11 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 			log.Printf("Uploaded file:%s, duplicate:%t, key:%s, keys:%d", f.name, f.duplicate, f.hash, len(f.keys))
 
 			count--
+			bundle.progress.FileDone()
 
+			if key, e := cafs.KeyFromString(f.hash); e == nil {
+				leaves[key] = f.leaves
+			}
 			fileList = append(fileList, model.BundleEntry{
 				Hash:         f.hash,
 				NameWithPath: f.name,
@@ -138,10 +157,17 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 			}
 		case e := <-eC:
 			count--
-			fmt.Printf("Bundle upload failed. Failed to upload file %s err: %s", e.file, e.error)
+			log.Printf("Bundle upload failed. Failed to upload file %s err: %s", e.file, e.error)
 			return e.error
 		}
 	}
+	// index before publishing the bundle, so it is never visible without its references
+	err = indexUploadedBundle(ctx, bundle, fileList, func(k cafs.Key) ([]cafs.Key, error) {
+		return leaves[k], nil
+	})
+	if err != nil {
+		return err
+	}
 	err = uploadBundleDescriptor(ctx, bundle)
 	if err != nil {
 		return err
@@ -151,7 +177,11 @@ func uploadBundle(ctx context.Context, bundle *Bundle) error {
 }
 
 func uploadBundleDescriptor(ctx context.Context, bundle *Bundle) error {
-
+	// the repo may have been deleted or locked since the upload started
+	err := repoWritable(ctx, bundle.MetaStore, bundle.RepoID)
+	if err != nil {
+		return err
+	}
 	buffer, err := yaml.Marshal(bundle.BundleDescriptor)
 	if err != nil {
 		return err
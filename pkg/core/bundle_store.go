@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// bundleStore is a read only store of the files of a bundle, read from the blob store.
+// The file lists of the bundle must be populated.
+type bundleStore struct {
+	bundle  *Bundle
+	entries map[string]model.BundleEntry
+}
+
+func newBundleStore(bundle *Bundle) *bundleStore {
+	entries := make(map[string]model.BundleEntry, len(bundle.BundleEntries))
+	for _, e := range bundle.BundleEntries {
+		entries[e.NameWithPath] = e
+	}
+	return &bundleStore{bundle: bundle, entries: entries}
+}
+
+func (s *bundleStore) String() string {
+	return "bundle@" + s.bundle.RepoID + "/" + s.bundle.BundleID
+}
+
+func (s *bundleStore) entry(name string) (model.BundleEntry, error) {
+	e, ok := s.entries[name]
+	if !ok {
+		return e, storage.NotFoundf("file %s not found in bundle %s of repo %s", name, s.bundle.BundleID, s.bundle.RepoID)
+	}
+	return e, nil
+}
+
+func (s *bundleStore) Has(ctx context.Context, name string) (bool, error) {
+	_, ok := s.entries[name]
+	return ok, nil
+}
+
+func (s *bundleStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	e, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return openBundleEntry(ctx, s.bundle, e)
+}
+
+func (s *bundleStore) GetAt(ctx context.Context, name string) (io.ReaderAt, error) {
+	e, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openBundleEntry(ctx, s.bundle, e)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleFileReaderAt{file: f}, nil
+}
+
+func (s *bundleStore) Put(context.Context, string, io.Reader, bool) error {
+	return storage.ErrNotSupported
+}
+
+func (s *bundleStore) Delete(context.Context, string) error {
+	return storage.ErrNotSupported
+}
+
+func (s *bundleStore) Clear(context.Context) error {
+	return storage.ErrNotSupported
+}
+
+func (s *bundleStore) Keys(ctx context.Context) ([]string, error) {
+	keys := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *bundleStore) KeysPrefix(ctx context.Context, pageToken string, prefix string, delimiter string, count int) ([]string, string, error) {
+	keys, _ := s.Keys(ctx)
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) && key > pageToken {
+			matched = append(matched, key)
+		}
+	}
+	if len(matched) > count {
+		return matched[:count], matched[count-1], nil
+	}
+	return matched, "", nil
+}
+
+// bundleFileReaderAt reads a file of a bundle at offsets, seeking before each read
+type bundleFileReaderAt struct {
+	lock sync.Mutex
+	file *bundleFile
+}
+
+func (r *bundleFileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off >= r.file.size {
+		return 0, io.EOF
+	}
+	if _, err := r.file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.file, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
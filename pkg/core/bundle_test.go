@@ -51,7 +51,7 @@ func TestBundle(t *testing.T) {
 	blobStore := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), blobDir))
 	reArchiveBlob := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), reArchiveBlobDir))
 	reArchive := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), reArchiveMetaDir))
-	require.NoError(t, CreateRepo(model.RepoDescriptor{
+	require.NoError(t, CreateRepo(context.Background(), model.RepoDescriptor{
 		Name:        repo,
 		Description: "test",
 		Timestamp:   time.Time{},
@@ -60,7 +60,7 @@ func TestBundle(t *testing.T) {
 			Email: "t@test.com",
 		},
 	}, metaStore))
-	require.NoError(t, CreateRepo(model.RepoDescriptor{
+	require.NoError(t, CreateRepo(context.Background(), model.RepoDescriptor{
 		Name:        repo,
 		Description: "test",
 		Timestamp:   time.Time{},
@@ -99,6 +99,48 @@ func TestBundle(t *testing.T) {
 	require.True(t, validateUpload(t))
 }
 
+func TestBundle_Compression(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	data := testContent(2, 0)
+	files := map[string][]byte{"data": data}
+
+	requireContent := func(bundle *Bundle) {
+		require.Len(t, bundle.BundleEntries, 1)
+		require.Equal(t, data, readEntry(t, bundle, bundle.BundleEntries[0]))
+
+		// the leaves are written in parallel, at offsets the files of the memory fs don't keep apart
+		destinationDir, err := ioutil.TempDir("", "publish")
+		require.NoError(t, err)
+		defer os.RemoveAll(destinationDir)
+		consumableStore := localfs.New(afero.NewBasePathFs(afero.NewOsFs(), destinationDir))
+		require.NoError(t, Publish(ctx, New(NewBDescriptor(),
+			Repo(repo),
+			BundleID(bundle.BundleID),
+			MetaStore(metaStore),
+			BlobStore(blobStore),
+			ConsumableStore(consumableStore),
+		)))
+		rdr, err := consumableStore.Get(ctx, "data")
+		require.NoError(t, err)
+		published, err := ioutil.ReadAll(rdr)
+		require.NoError(t, err)
+		require.NoError(t, rdr.Close())
+		require.Equal(t, data, published)
+	}
+
+	compressed := uploadTestBundle(t, metaStore, blobStore, files, Compression(cafs.GzipCompression))
+	require.Equal(t, cafs.GzipCompression, compressed.BundleDescriptor.Compression)
+	requireContent(compressed)
+
+	// the same content uploaded without compression shares the blob store
+	plain := uploadTestBundle(t, metaStore, blobStore, files)
+	require.Empty(t, plain.BundleDescriptor.Compression)
+	requireContent(plain)
+	requireContent(compressed)
+}
+
 func validatePublish(t *testing.T, store storage.Store) {
 	// Check Bundle File
 	reader, err := store.Get(context.Background(), model.GetConsumablePathToBundle(bundleID))
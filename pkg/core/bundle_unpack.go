@@ -5,6 +5,7 @@ package core
 import (
 	"context"
 	"fmt"
+	"log"
 	"sync"
 
 	"github.com/oneconcern/datamon/pkg/cafs"
@@ -51,6 +52,17 @@ func unpackBundleFileList(ctx context.Context, bundle *Bundle) error {
 	return nil
 }
 
+// contentError is returned when downloading a file without content: its content was purged, or it is a symbolic link
+func contentError(e model.BundleEntry) error {
+	switch {
+	case e.Purged != "":
+		return fmt.Errorf("the content of %s was purged (purge %s), it can't be downloaded", e.NameWithPath, e.Purged)
+	case e.Symlink != "":
+		return fmt.Errorf("%s is a symbolic link to %s, it has no content to download", e.NameWithPath, e.Symlink)
+	}
+	return nil
+}
+
 type errorHit struct {
 	error error
 	file  string
@@ -61,7 +73,9 @@ func unpackDataFiles(ctx context.Context, bundle *Bundle, file string) error {
 	fs, err := cafs.New(
 		cafs.LeafSize(ls),
 		cafs.LeafTruncation(bundle.BundleDescriptor.Version < 1),
+		cafs.Compression(bundle.BundleDescriptor.Compression),
 		cafs.Backend(bundle.BlobStore),
+		cafs.Progress(bundle.progress),
 	)
 
 	if err != nil {
@@ -75,8 +89,22 @@ func unpackDataFiles(ctx context.Context, bundle *Bundle, file string) error {
 			wg.Done()
 			continue
 		}
+		if err := contentError(b); err != nil {
+			if file != "" {
+				errC <- errorHit{
+					err,
+					b.NameWithPath,
+				}
+			} else {
+				log.Printf("skipped %s: %v", b.NameWithPath, err)
+			}
+			wg.Done()
+			continue
+		}
+		bundle.progress.AddFiles(1)
+		bundle.progress.AddBytes(int64(b.Size))
 		go func(bundleEntry model.BundleEntry) {
-			fmt.Println("started " + bundleEntry.NameWithPath)
+			log.Println("started " + bundleEntry.NameWithPath)
 			key, err := cafs.KeyFromString(bundleEntry.Hash)
 			if err != nil {
 				errC <- errorHit{
@@ -97,7 +125,7 @@ func unpackDataFiles(ctx context.Context, bundle *Bundle, file string) error {
 			}
 			err = bundle.ConsumableStore.Put(ctx, bundleEntry.NameWithPath, reader, storage.IfNotPresent)
 			if err != nil {
-				fmt.Printf("Failed to download %s error %s", bundleEntry.NameWithPath, err)
+				log.Printf("Failed to download %s error %s", bundleEntry.NameWithPath, err)
 				errC <- errorHit{
 					err,
 					bundleEntry.NameWithPath,
@@ -105,7 +133,8 @@ func unpackDataFiles(ctx context.Context, bundle *Bundle, file string) error {
 				wg.Done()
 				return
 			}
-			fmt.Printf("downloaded %s\n", bundleEntry.NameWithPath)
+			log.Printf("downloaded %s", bundleEntry.NameWithPath)
+			bundle.progress.FileDone()
 			wg.Done()
 		}(b)
 	}
@@ -2,20 +2,27 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 
 	iradix "github.com/hashicorp/go-immutable-radix"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseutil"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
 )
 
 const (
@@ -41,15 +48,53 @@ type ReadOnlyFS struct {
 	server     fuse.Server             // Fuse server
 }
 
-// ReadOnlyFS is the virtual filesystem created on top of a bundle.
+// MutableFS is the writable filesystem committed as new bundles.
 type MutableFS struct {
 	mfs        *fuse.MountedFileSystem // The mounted filesystem
 	fsInternal *fsMutable              // The core of the filesystem
 	server     fuse.Server             // Fuse server
+
+	lock      sync.Mutex // Serializes the commits
+	path      string     // The path the filesystem is mounted at
+	commits   int        // The number of commits attempted
+	committed uint64     // The changes to the files when they were last committed
+	bundles   []string   // The bundles committed
+	lastError error      // The failure of the last commit
+	failed    []string   // The failed commits saved to the staging directory
+}
+
+// MutableStatus is the state of a mutable filesystem
+type MutableStatus struct {
+	Repo          string   `json:"repo" yaml:"repo"`
+	Path          string   `json:"path,omitempty" yaml:"path,omitempty"`
+	Parents       []string `json:"parents,omitempty" yaml:"parents,omitempty"`
+	Bundles       []string `json:"bundles,omitempty" yaml:"bundles,omitempty"`
+	Dirty         bool     `json:"dirty" yaml:"dirty"`
+	LastError     string   `json:"lastError,omitempty" yaml:"lastError,omitempty"`
+	FailedCommits []string `json:"failedCommits,omitempty" yaml:"failedCommits,omitempty"`
+}
+
+// FailedCommit is saved to the staging directory of a mutable filesystem when a commit fails,
+// with the files uploaded before the failure, to recover the bundle
+type FailedCommit struct {
+	Repo    string                 `json:"repo" yaml:"repo"`
+	Error   string                 `json:"error" yaml:"error"`
+	Bundle  model.BundleDescriptor `json:"bundle" yaml:"bundle"`
+	Entries []model.BundleEntry    `json:"entries,omitempty" yaml:"entries,omitempty"`
+}
+
+// failedCommitsDir is the directory of the failed commits in the staging directory
+const failedCommitsDir = "failed-commits"
+
+// RepoFS is the virtual filesystem browsing the bundles and labels of a repo.
+type RepoFS struct {
+	mfs        *fuse.MountedFileSystem // The mounted filesystem
+	fsInternal *repoFsInternal         // The core of the filesystem
+	server     fuse.Server             // Fuse server
 }
 
 // NewReadOnlyFS creates a new instance of the datamon filesystem.
-func NewReadOnlyFS(bundle *Bundle) (*ReadOnlyFS, error) {
+func NewReadOnlyFS(ctx context.Context, bundle *Bundle) (*ReadOnlyFS, error) {
 
 	fs := &readOnlyFsInternal{
 		bundle:       bundle,
@@ -60,7 +105,7 @@ func NewReadOnlyFS(bundle *Bundle) (*ReadOnlyFS, error) {
 	}
 
 	// Extract the meta information needed.
-	err := Publish(context.Background(), fs.bundle)
+	err := Publish(ctx, fs.bundle)
 	if err != nil {
 		return nil, err
 	}
@@ -69,12 +114,10 @@ func NewReadOnlyFS(bundle *Bundle) (*ReadOnlyFS, error) {
 	return fs.populateFS(bundle)
 }
 
-// NewMutableFS creates a new instance of the datamon filesystem.
-func NewMutableFS(bundle *Bundle, pathToStaging string) (*MutableFS, error) {
-	logger, _ := zap.NewProduction()
-	fs := &fsMutable{
+func newFsMutable(bundle *Bundle, pathToStaging string, l *zap.Logger) *fsMutable {
+	return &fsMutable{
 		bundle:       bundle,
-		readDirMap:   make(map[fuseops.InodeID]map[fuseops.InodeID]*fuseutil.Dirent),
+		readDirMap:   make(map[fuseops.InodeID]map[string]*fuseutil.Dirent),
 		iNodeStore:   iradix.New(),
 		lookupTree:   iradix.New(),
 		backingFiles: make(map[fuseops.InodeID]*afero.File),
@@ -85,12 +128,23 @@ func NewMutableFS(bundle *Bundle, pathToStaging string) (*MutableFS, error) {
 			freeInodes:   make([]fuseops.InodeID, 0, 65536),
 		},
 		localCache: afero.NewBasePathFs(afero.NewOsFs(), pathToStaging),
-		l:          logger.With(zap.String("bundle", bundle.BundleID)),
+		l:          l,
 	}
+}
+
+// NewMutableFS creates a new instance of the datamon filesystem. The namespace is journaled to the staging directory
+// with the files, to recover the filesystem when the process dies.
+func NewMutableFS(bundle *Bundle, pathToStaging string) (*MutableFS, error) {
+	logger, _ := zap.NewProduction()
+	fs := newFsMutable(bundle, pathToStaging, logger.With(zap.String("bundle", bundle.BundleID)))
 	err := fs.initRoot()
 	if err != nil {
 		return nil, err
 	}
+	if fs.journal, err = newJournal(fs.localCache, fs.l); err != nil {
+		return nil, err
+	}
+	fs.journal.append(journalEntry{Op: journalBundle, Repo: bundle.RepoID, Bundle: &bundle.BundleDescriptor})
 	return &MutableFS{
 		mfs:        nil,
 		fsInternal: fs,
@@ -98,6 +152,88 @@ func NewMutableFS(bundle *Bundle, pathToStaging string) (*MutableFS, error) {
 	}, err
 }
 
+// NewMutableFSFrom creates a new instance of the datamon filesystem starting with the files of a parent bundle.
+// The files of the parent are read from the blob store until they are written. The blobs of the bundle are
+// written like those of the parent, and the files left untouched are committed without being uploaded again,
+// unless the parent is a bundle of another version.
+func NewMutableFSFrom(ctx context.Context, bundle, parent *Bundle, pathToStaging string) (*MutableFS, error) {
+	if len(parent.BundleEntries) == 0 {
+		if err := PopulateFiles(ctx, parent); err != nil {
+			return nil, err
+		}
+	}
+	found := false
+	for _, p := range bundle.BundleDescriptor.Parents {
+		found = found || p == parent.BundleID
+	}
+	if !found {
+		bundle.BundleDescriptor.Parents = append(bundle.BundleDescriptor.Parents, parent.BundleID)
+	}
+	bd, pd := &bundle.BundleDescriptor, &parent.BundleDescriptor
+	bd.LeafSize, bd.Compression, bd.Chunker = pd.LeafSize, pd.Compression, pd.Chunker
+	dfs, err := NewMutableFS(bundle, pathToStaging)
+	if err != nil {
+		return nil, err
+	}
+	if err = dfs.fsInternal.seed(parent); err != nil {
+		return nil, err
+	}
+	return dfs, nil
+}
+
+// RecoverMutableFS recovers the filesystem staged in a directory by a process that died, from the journal
+// of its namespace. The files are committed with the stores of the bundle journaled. The recovered filesystem
+// is committed or mounted again. The error is a storage.ErrNotFound when there is no journal to recover from.
+func RecoverMutableFS(ctx context.Context, pathToStaging string, metaStore, blobStore storage.Store) (*MutableFS, error) {
+	logger, _ := zap.NewProduction()
+	fs := newFsMutable(nil, pathToStaging, logger.With(zap.String("staging", pathToStaging)))
+	if _, err := fs.localCache.Stat(journalFile); os.IsNotExist(err) {
+		return nil, storage.NotFoundf("%s holds no mutable filesystem to recover", pathToStaging)
+	}
+	err := fs.initRoot()
+	if err != nil {
+		return nil, err
+	}
+	state, err := fs.replay(ctx, metaStore, blobStore)
+	if err != nil {
+		return nil, fmt.Errorf("recover %s: %v", pathToStaging, err)
+	}
+	fs.bundle.BundleDescriptor.Timestamp = time.Now()
+	if fs.journal, err = openJournal(fs.localCache, fs.l); err != nil {
+		return nil, err
+	}
+	dfs := &MutableFS{
+		fsInternal: fs,
+		server:     fuseutil.NewFileSystemServer(fs),
+		commits:    len(state.bundles),
+		committed:  state.changes,
+		bundles:    state.bundles,
+	}
+	failed, err := afero.ReadDir(fs.localCache, failedCommitsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range failed {
+		dfs.failed = append(dfs.failed, filepath.Join(failedCommitsDir, info.Name()))
+	}
+	return dfs, nil
+}
+
+// NewRepoFS creates a filesystem with the bundles of a repo under bundles/, the labels of the repo
+// as symlinks under labels/, and the latest bundle as latest. The files of bundles are read from the blob store
+// when they are read.
+func NewRepoFS(ctx context.Context, repo string, metaStore, blobStore storage.Store) (*RepoFS, error) {
+	if err := RepoExists(ctx, repo, metaStore); err != nil {
+		return nil, err
+	}
+	logger, _ := zap.NewProduction()
+	fs := newRepoFsInternal(repo, metaStore, blobStore, logger.With(zap.String("repo", repo)))
+	return &RepoFS{
+		fsInternal: fs,
+		server:     fuseutil.NewFileSystemServer(fs),
+	}, nil
+}
+
 func (dfs *ReadOnlyFS) MountReadOnly(path string) error {
 	// TODO plumb additional mount options
 	mountCfg := &fuse.MountConfig{
@@ -119,19 +255,159 @@ func (dfs *MutableFS) MountMutable(path string) error {
 	}
 	var err error
 	dfs.mfs, err = fuse.Mount(path, dfs.server, mountCfg)
+	if err == nil {
+		dfs.path = path
+	}
 	return err
 }
 
+func (dfs *RepoFS) MountRepo(path string) error {
+	mountCfg := &fuse.MountConfig{
+		FSName:      dfs.fsInternal.repo,
+		VolumeName:  dfs.fsInternal.repo,
+		ReadOnly:    true,
+		ErrorLogger: log.New(os.Stderr, "fuse: ", log.Flags()),
+	}
+	var err error
+	dfs.mfs, err = fuse.Mount(path, dfs.server, mountCfg)
+	return err
+}
+
+func (dfs *RepoFS) Unmount(path string) error {
+	return fuse.Unmount(path)
+}
+
 func (dfs *ReadOnlyFS) Unmount(path string) error {
 	// On unmount, walk the FS and create a bundle
 	return fuse.Unmount(path)
 }
 
+// Commit uploads the files of the filesystem as a new bundle. Each commit creates a new bundle,
+// with the message and contributors of the first one, and the bundle of the previous commit as parent.
+func (dfs *MutableFS) Commit() error {
+	return dfs.CommitMessage("")
+}
+
+// CommitMessage commits the files with a message, the message of the last commit when empty.
+// The metadata of failed commits is saved to the staging directory.
+func (dfs *MutableFS) CommitMessage(message string) error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	bundle := dfs.fsInternal.bundle
+	if dfs.commits > 0 {
+		bundle.setBundleID("")
+		bundle.BundleDescriptor.BundleEntriesFileCount = 0
+		bundle.BundleDescriptor.Timestamp = time.Now()
+	}
+	if len(dfs.bundles) > 0 {
+		bundle.BundleDescriptor.Parents = []string{dfs.bundles[len(dfs.bundles)-1]}
+	}
+	if message != "" {
+		bundle.BundleDescriptor.Message = message
+	}
+	dfs.commits++
+	changes := atomic.LoadUint64(&dfs.fsInternal.changes)
+	entries, err := dfs.fsInternal.Commit()
+	dfs.lastError = err
+	if err != nil {
+		if path, saveErr := dfs.saveFailedCommit(entries, err); saveErr != nil {
+			dfs.fsInternal.l.Error("failed to save the failed commit", zap.Error(saveErr))
+		} else {
+			dfs.failed = append(dfs.failed, path)
+		}
+		return err
+	}
+	dfs.committed = changes
+	dfs.bundles = append(dfs.bundles, bundle.BundleID)
+	dfs.fsInternal.journal.append(journalEntry{
+		Op:       journalCommit,
+		BundleID: bundle.BundleID,
+		Message:  bundle.BundleDescriptor.Message,
+	})
+	return nil
+}
+
+// saveFailedCommit saves the descriptor of the bundle and the files uploaded by a failed commit
+func (dfs *MutableFS) saveFailedCommit(entries []model.BundleEntry, cause error) (string, error) {
+	bundle := dfs.fsInternal.bundle
+	data, err := yaml.Marshal(FailedCommit{
+		Repo:    bundle.RepoID,
+		Error:   cause.Error(),
+		Bundle:  bundle.BundleDescriptor,
+		Entries: entries,
+	})
+	if err != nil {
+		return "", err
+	}
+	staging := dfs.fsInternal.localCache
+	if err = staging.MkdirAll(failedCommitsDir, dirDefaultMode); err != nil {
+		return "", err
+	}
+	path := filepath.Join(failedCommitsDir, bundle.BundleID+".yaml")
+	if err = afero.WriteFile(staging, path, data, fileDefaultMode); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// BundleID is the ID of the bundle of the last commit
+func (dfs *MutableFS) BundleID() string {
+	return dfs.fsInternal.bundle.BundleID
+}
+
+// Dirty tells whether the files changed since the last commit
+func (dfs *MutableFS) Dirty() bool {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	return atomic.LoadUint64(&dfs.fsInternal.changes) != dfs.committed
+}
+
+// Status returns the bundles committed, and whether the files changed since
+func (dfs *MutableFS) Status() MutableStatus {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	status := MutableStatus{
+		Repo:          dfs.fsInternal.bundle.RepoID,
+		Path:          dfs.path,
+		Parents:       append([]string{}, dfs.fsInternal.bundle.BundleDescriptor.Parents...),
+		Bundles:       append([]string{}, dfs.bundles...),
+		Dirty:         atomic.LoadUint64(&dfs.fsInternal.changes) != dfs.committed,
+		FailedCommits: append([]string{}, dfs.failed...),
+	}
+	if dfs.lastError != nil {
+		status.LastError = dfs.lastError.Error()
+	}
+	return status
+}
+
+// Unmount commits the files when they changed since the last commit, and unmounts the filesystem.
+// The filesystem stays mounted when the commit fails.
 func (dfs *MutableFS) Unmount(path string) error {
-	// On unmount, walk the FS and create a bundle
-	_ = dfs.fsInternal.Commit()
-	//if err != nil {
-	// dump the metadata to the local FS to manually recover.
-	//}
-	return fuse.Unmount(path)
+	if dfs.Dirty() {
+		if err := dfs.Commit(); err != nil {
+			return err
+		}
+	}
+	if err := fuse.Unmount(path); err != nil {
+		return err
+	}
+	return dfs.Close()
+}
+
+// Abort unmounts the filesystem, without committing the changes since the last commit
+func (dfs *MutableFS) Abort(path string) error {
+	if err := fuse.Unmount(path); err != nil {
+		return err
+	}
+	return dfs.Close()
+}
+
+// Close removes the journal of a filesystem that is not mounted, it can't be recovered anymore.
+// The files stay in the staging directory.
+func (dfs *MutableFS) Close() error {
+	dfs.lock.Lock()
+	defer dfs.lock.Unlock()
+	err := dfs.fsInternal.journal.close(dfs.fsInternal.localCache, true)
+	dfs.fsInternal.journal = nil
+	return err
 }
@@ -4,7 +4,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -14,6 +19,7 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 
+	"github.com/oneconcern/datamon/pkg/filetracker"
 	"github.com/oneconcern/datamon/pkg/model"
 )
 
@@ -77,9 +83,9 @@ func (fs *fsMutable) preCreateCheck(parentInode fuseops.InodeID, lk []byte) erro
 func (fs *fsMutable) insertReadDirEntry(id fuseops.InodeID, dirEnt *fuseutil.Dirent) {
 
 	if fs.readDirMap[id] == nil {
-		fs.readDirMap[id] = make(map[fuseops.InodeID]*fuseutil.Dirent)
+		fs.readDirMap[id] = make(map[string]*fuseutil.Dirent)
 	}
-	fs.readDirMap[id][dirEnt.Inode] = dirEnt
+	fs.readDirMap[id][dirEnt.Name] = dirEnt
 }
 
 func (fs *fsMutable) insertLookupEntry(id fuseops.InodeID, child string, entry lookupEntry) {
@@ -102,6 +108,40 @@ func (fs *fsMutable) createNode(lk []byte, parentINode fuseops.InodeID, childNam
 		iNodeID = parentINode
 	}
 
+	if nodeType != fuseutil.DT_Directory {
+		// dont return error as open file will retry this.
+		file, err := fs.localCache.Create(fmt.Sprint(iNodeID))
+		if err != nil {
+			fs.backingFiles[iNodeID] = &file
+		} else {
+			fs.l.Error("failed to create backing file",
+				zap.Error(err),
+				zap.String("child", childName),
+				zap.Uint64("parent", uint64(parentINode)))
+		}
+	}
+	fs.addNode(lk, parentINode, childName, iNodeID, entry, nodeType, isRoot)
+	if !isRoot {
+		fs.journal.append(journalEntry{
+			Op:     journalCreate,
+			Parent: parentINode,
+			Name:   childName,
+			INode:  iNodeID,
+			Dir:    nodeType == fuseutil.DT_Directory,
+		})
+	}
+	return nil
+}
+
+// Add a node to the namespace, its backing file is created by the caller. Need to hold the locks before calling.
+func (fs *fsMutable) addNode(lk []byte, parentINode fuseops.InodeID, childName string, iNodeID fuseops.InodeID,
+	entry *fuseops.ChildInodeEntry, nodeType fuseutil.DirentType, isRoot bool) {
+
+	// Create lookup key if not already created.
+	if lk == nil {
+		lk = formLookupKey(parentINode, childName)
+	}
+
 	// lookup
 	fs.lookupTree, _, _ = fs.lookupTree.Insert(lk, lookupEntry{iNode: iNodeID})
 
@@ -114,18 +154,7 @@ func (fs *fsMutable) createNode(lk []byte, parentINode fuseops.InodeID, childNam
 		linkCount = dirLinkCount
 		defaultMode = dirDefaultMode
 		defaultSize = dirInitialSize
-		fs.readDirMap[iNodeID] = make(map[fuseops.InodeID]*fuseutil.Dirent)
-	} else {
-		// dont return error as open file will retry this.
-		file, err := fs.localCache.Create(fmt.Sprint(iNodeID))
-		if err != nil {
-			fs.backingFiles[iNodeID] = &file
-		} else {
-			fs.l.Error("failed to create backing file",
-				zap.Error(err),
-				zap.String("child", childName),
-				zap.Uint64("parent", uint64(parentINode)))
-		}
+		fs.readDirMap[iNodeID] = make(map[string]*fuseutil.Dirent)
 	}
 
 	d := &fuseutil.Dirent{
@@ -172,7 +201,6 @@ func (fs *fsMutable) createNode(lk []byte, parentINode fuseops.InodeID, childNam
 		entry.AttributesExpiration = time.Now().Add(cacheYearLong)
 		entry.Child = iNodeID
 	}
-	return nil
 }
 
 func getPathToBackingFile(iNode fuseops.InodeID) string {
@@ -192,3 +220,358 @@ func shouldDelete(n *nodeEntry) bool {
 	}
 	return false
 }
+
+// Add the files of a parent bundle to the FS. Their content is read from the blob store until they are written.
+func (fs *fsMutable) seed(parent *Bundle) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.parent = newBundleStore(parent)
+	ts := parent.BundleDescriptor.Timestamp
+	var links []model.BundleEntry
+	iNodes := make(map[string]fuseops.InodeID, len(parent.BundleEntries))
+	for _, e := range parent.BundleEntries {
+		if e.Purged != "" {
+			// the content of the file was purged, it can't be read
+			continue
+		}
+		if e.Link != "" {
+			// hard links are added once the files they link to are
+			links = append(links, e)
+			continue
+		}
+		e := e
+		dir, name, err := fs.seedDir(e.NameWithPath)
+		if err != nil {
+			return err
+		}
+		iNodeID := fs.iNodeGenerator.allocINode()
+		fs.seedFile(dir, name, iNodeID, &e, ts)
+		fs.journal.append(journalEntry{Op: journalBase, Parent: dir, Name: name, INode: iNodeID, Entry: &e})
+		iNodes[e.NameWithPath] = iNodeID
+	}
+	for _, e := range links {
+		iNodeID, found := iNodes[e.Link]
+		if !found {
+			fs.l.Warn("skipping a hard link to a missing file", zap.String("name", e.NameWithPath), zap.String("link", e.Link))
+			continue
+		}
+		dir, name, err := fs.seedDir(e.NameWithPath)
+		if err != nil {
+			return err
+		}
+		if _, err = fs.addLink(dir, name, iNodeID); err != nil {
+			return err
+		}
+		fs.journal.append(journalEntry{Op: journalLink, Parent: dir, Name: name, INode: iNodeID})
+	}
+	// journaled once the files are added, they are not changes to commit
+	fs.journal.append(journalEntry{Op: journalParent, BundleID: parent.BundleID})
+	return nil
+}
+
+// Get the directory and the name of a file of the parent bundle, creating the missing directories.
+// Need to hold the locks before calling.
+func (fs *fsMutable) seedDir(nameWithPath string) (fuseops.InodeID, string, error) {
+	var dir fuseops.InodeID = fuseops.RootInodeID
+	names := strings.Split(strings.Trim(nameWithPath, "/"), "/")
+	for _, name := range names[:len(names)-1] {
+		le, found, lk := fs.lookup(dir, name)
+		if found {
+			dir = le.iNode
+			continue
+		}
+		var entry fuseops.ChildInodeEntry
+		if err := fs.createNode(lk, dir, name, &entry, fuseutil.DT_Directory, false); err != nil {
+			return 0, "", err
+		}
+		dir = entry.Child
+	}
+	return dir, names[len(names)-1], nil
+}
+
+// Add a file or a symbolic link of the parent bundle. Need to hold the locks before calling.
+func (fs *fsMutable) seedFile(parentINode fuseops.InodeID, name string, iNodeID fuseops.InodeID, e *model.BundleEntry,
+	ts time.Time) {
+	if e.Symlink != "" {
+		n := fs.addSymlink(parentINode, name, iNodeID, e.Symlink, nil, ts)
+		n.xattrs = copyXattrs(e.Xattrs)
+		return
+	}
+	fs.insertLookupEntry(parentINode, name, lookupEntry{iNode: iNodeID})
+	fs.insertReadDirEntry(parentINode, &fuseutil.Dirent{
+		Inode: iNodeID,
+		Name:  name,
+		Type:  fuseutil.DT_File,
+	})
+	fs.iNodeStore, _, _ = fs.iNodeStore.Insert(formKey(iNodeID), &nodeEntry{
+		refCount:          1,
+		pathToBackingFile: getPathToBackingFile(iNodeID),
+		attr: fuseops.InodeAttributes{
+			Size:   e.Size,
+			Nlink:  fileLinkCount,
+			Mode:   fileDefaultMode,
+			Atime:  ts,
+			Mtime:  ts,
+			Ctime:  ts,
+			Crtime: ts,
+			Uid:    defaultUID,
+			Gid:    defaultGID,
+		},
+		base:   e,
+		xattrs: copyXattrs(e.Xattrs),
+	})
+}
+
+// Add a symbolic link. Need to hold the locks before calling.
+func (fs *fsMutable) addSymlink(parentINode fuseops.InodeID, name string, iNodeID fuseops.InodeID, target string,
+	entry *fuseops.ChildInodeEntry, ts time.Time) *nodeEntry {
+	fs.insertLookupEntry(parentINode, name, lookupEntry{iNode: iNodeID})
+	fs.insertReadDirEntry(parentINode, &fuseutil.Dirent{
+		Inode: iNodeID,
+		Name:  name,
+		Type:  fuseutil.DT_Link,
+	})
+	n := &nodeEntry{
+		refCount: 1,
+		attr: fuseops.InodeAttributes{
+			Size:   uint64(len(target)),
+			Nlink:  symlinkLinkCount,
+			Mode:   symlinkMode,
+			Atime:  ts,
+			Mtime:  ts,
+			Ctime:  ts,
+			Crtime: ts,
+			Uid:    defaultUID,
+			Gid:    defaultGID,
+		},
+		target: target,
+	}
+	fs.iNodeStore, _, _ = fs.iNodeStore.Insert(formKey(iNodeID), n)
+	if entry != nil {
+		entry.Attributes = n.attr
+		entry.EntryExpiration = time.Now().Add(cacheYearLong)
+		entry.AttributesExpiration = entry.EntryExpiration
+		entry.Child = iNodeID
+	}
+	return n
+}
+
+// Add a hard link to a file or a symbolic link. Need to hold the locks before calling.
+func (fs *fsMutable) addLink(parentINode fuseops.InodeID, name string, iNodeID fuseops.InodeID) (*nodeEntry, error) {
+	e, found := fs.iNodeStore.Get(formKey(iNodeID))
+	if !found {
+		return nil, fuse.ENOENT
+	}
+	n := e.(*nodeEntry)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.attr.Mode.IsDir() {
+		return nil, syscall.EPERM
+	}
+	nodeType := fuseutil.DT_File
+	if n.attr.Mode&os.ModeSymlink != 0 {
+		nodeType = fuseutil.DT_Link
+	}
+	fs.insertLookupEntry(parentINode, name, lookupEntry{iNode: iNodeID})
+	fs.insertReadDirEntry(parentINode, &fuseutil.Dirent{
+		Inode: iNodeID,
+		Name:  name,
+		Type:  nodeType,
+	})
+	n.attr.Nlink++
+	return n, nil
+}
+
+// Get a copy of the entries of the directories, to walk them without holding the lock of the FS.
+func (fs *fsMutable) namespace() map[fuseops.InodeID][]fuseutil.Dirent {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	dirs := make(map[fuseops.InodeID][]fuseutil.Dirent, len(fs.readDirMap))
+	for dir, entries := range fs.readDirMap {
+		dirs[dir] = make([]fuseutil.Dirent, 0, len(entries))
+		for _, d := range entries {
+			dirs[dir] = append(dirs[dir], *d)
+		}
+	}
+	return dirs
+}
+
+// Get the names of the files with several hard links, sorted, walking the directories from the root.
+func hardLinks(dirs map[fuseops.InodeID][]fuseutil.Dirent) map[fuseops.InodeID][]string {
+	links := make(map[fuseops.InodeID][]string)
+	var walk func(dir fuseops.InodeID, dirName string)
+	walk = func(dir fuseops.InodeID, dirName string) {
+		for _, d := range dirs[dir] {
+			name := path.Join(dirName, d.Name)
+			if d.Type == fuseutil.DT_Directory {
+				walk(d.Inode, name)
+				continue
+			}
+			links[d.Inode] = append(links[d.Inode], name)
+		}
+	}
+	walk(fuseops.RootInodeID, "")
+	for iNode, names := range links {
+		if len(names) < 2 {
+			delete(links, iNode)
+			continue
+		}
+		sort.Strings(names)
+	}
+	return links
+}
+
+// Get a node, nil when it does not exist.
+func (fs *fsMutable) node(iNode fuseops.InodeID) *nodeEntry {
+	nodeStore, _ := fs.atomicGetReferences()
+	e, found := nodeStore.Get(formKey(iNode))
+	if !found {
+		return nil
+	}
+	return e.(*nodeEntry)
+}
+
+// Get the extended attributes of a node to commit them, nil without attributes.
+func (fs *fsMutable) xattrs(iNode fuseops.InodeID) map[string][]byte {
+	n := fs.node(iNode)
+	if n == nil {
+		return nil
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return copyXattrs(n.xattrs)
+}
+
+func copyXattrs(xattrs map[string][]byte) map[string][]byte {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	c := make(map[string][]byte, len(xattrs))
+	for name, value := range xattrs {
+		c[name] = append([]byte(nil), value...)
+	}
+	return c
+}
+
+// Flags of setxattr(2)
+const (
+	xattrCreate  = 0x1 // fail when the attribute exists
+	xattrReplace = 0x2 // fail when the attribute does not exist
+)
+
+// Set an extended attribute of a node. Need to hold the lock of the node before calling.
+// Bundles only keep the attributes of files and links, directories refuse them.
+func setXattr(n *nodeEntry, name string, value []byte, flags uint32) error {
+	if n.attr.Mode.IsDir() {
+		return syscall.ENOTSUP
+	}
+	_, found := n.xattrs[name]
+	if found && flags&xattrCreate != 0 {
+		return fuse.EEXIST
+	}
+	if !found && flags&xattrReplace != 0 {
+		return fuse.ENOATTR
+	}
+	if n.xattrs == nil {
+		n.xattrs = make(map[string][]byte)
+	}
+	// the value is not kept by the caller
+	n.xattrs[name] = append([]byte(nil), value...)
+	return nil
+}
+
+// Remove an extended attribute of a node. Need to hold the lock of the node before calling.
+func removeXattr(n *nodeEntry, name string) error {
+	if _, found := n.xattrs[name]; !found {
+		return fuse.ENOATTR
+	}
+	delete(n.xattrs, name)
+	return nil
+}
+
+// Virtual extended attributes of the files and directories of read only mounts, with the provenance of their content
+const (
+	xattrHash     = "user.datamon.hash"     // the hash of the content of a file
+	xattrBundle   = "user.datamon.bundle"   // the ID of the bundle
+	xattrRepo     = "user.datamon.repo"     // the repo of the bundle
+	xattrSize     = "user.datamon.size"     // the size of the content of a file
+	xattrLeafSize = "user.datamon.leafsize" // the leaf size of the blobs of the bundle
+)
+
+// Get the extended attributes of a file or a directory of a bundle: the virtual attributes with the provenance
+// of its content, and the attributes of its bundle entry. Directories and symbolic links have no hash nor size.
+func bundleXattrs(bundle *Bundle, hash string, size uint64, entryXattrs map[string][]byte) map[string][]byte {
+	xattrs := make(map[string][]byte, len(entryXattrs)+5)
+	for name, value := range entryXattrs {
+		xattrs[name] = value
+	}
+	xattrs[xattrBundle] = []byte(bundle.BundleID)
+	xattrs[xattrRepo] = []byte(bundle.RepoID)
+	xattrs[xattrLeafSize] = []byte(strconv.FormatUint(uint64(bundle.BundleDescriptor.LeafSize), 10))
+	if hash != "" {
+		xattrs[xattrHash] = []byte(hash)
+		xattrs[xattrSize] = []byte(strconv.FormatUint(size, 10))
+	}
+	return xattrs
+}
+
+// Copy the value of an extended attribute to the destination of a read. When it doesn't fit, ERANGE is returned
+// with the size of the value, which is how the size is queried with an empty destination.
+func readXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+	return copy(dst, value), nil
+}
+
+// Copy the names of extended attributes to the destination of a list, as NUL terminated strings sorted by name
+func listXattrs(dst []byte, names []string) (int, error) {
+	sort.Strings(names)
+	var list []byte
+	for _, name := range names {
+		list = append(append(list, name...), 0)
+	}
+	return readXattr(dst, list)
+}
+
+// Get the overlay of writes on top of the base file of a node, creating its backing file on first use.
+// Need to hold the lock of the node before calling.
+func (fs *fsMutable) overlay(iNode fuseops.InodeID, n *nodeEntry) (*filetracker.TFile, error) {
+	if n.tFile != nil {
+		return n.tFile, nil
+	}
+	file, err := fs.localCache.OpenFile(n.pathToBackingFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileDefaultMode)
+	if err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	fs.backingFiles[iNode] = &file
+	fs.lock.Unlock()
+	n.tFile = filetracker.NewTFile(fs.parent, &file, n.base.NameWithPath, int64(n.base.Size))
+	return n.tFile, nil
+}
+
+// Truncate the file of a node, through its overlay when it starts from the file of the parent bundle.
+// Need to hold the lock of the node before calling.
+func (fs *fsMutable) truncate(iNode fuseops.InodeID, n *nodeEntry, size int64) error {
+	if n.base != nil {
+		t, err := fs.overlay(iNode, n)
+		if err != nil {
+			return err
+		}
+		if err = t.Truncate(size); err != nil {
+			return err
+		}
+		fs.journal.append(journalEntry{Op: journalTruncate, INode: iNode, Size: size})
+		return nil
+	}
+	file, err := fs.localCache.OpenFile(getPathToBackingFile(iNode), os.O_WRONLY|os.O_SYNC, fileDefaultMode)
+	if err != nil {
+		return err
+	}
+	if err = file.Truncate(size); err != nil {
+		return err
+	}
+	fs.journal.append(journalEntry{Op: journalTruncate, INode: iNode, Size: size})
+	return nil
+}
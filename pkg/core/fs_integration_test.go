@@ -36,7 +36,7 @@ func TestMount(t *testing.T) {
 		ConsumableStore(consumableStore),
 		BlobStore(blobStore),
 	)
-	fs, err := NewReadOnlyFS(bundle)
+	fs, err := NewReadOnlyFS(context.Background(), bundle)
 	require.NoError(t, err)
 	_ = os.Mkdir(pathToMount, 0777|os.ModeDir)
 	err = fs.MountReadOnly(pathToMount)
@@ -226,7 +226,7 @@ func TestMutableMountCommitError(t *testing.T) {
 	randErrData := internal.RandStringBytesMaskImprSrc(15)
 	caFs := &testErrCaFs{fsImpl: caFsImpl, errMsg: randErrData}
 	// ensure error data returned properly
-	err = fs.fsInternal.commitImpl(caFs)
+	_, err = fs.fsInternal.commitImpl(caFs)
 	require.NotNil(t, err)
 	require.Equal(t, randErrData, err.Error())
 	// cleanup
@@ -269,6 +269,10 @@ func (fs *testErrCaFs) Has(ctx context.Context, key cafs.Key, cfgs ...cafs.HasOp
 	return fs.fsImpl.Has(ctx, key, cfgs...)
 }
 
+func (fs *testErrCaFs) Leaves(ctx context.Context, key cafs.Key) ([]cafs.Key, error) {
+	return fs.fsImpl.Leaves(ctx, key)
+}
+
 /* os x fuse workarounds */
 func afero_Mkdir(afs afero.Fs, name string, mode os.FileMode) (err error) {
 	rc := 2
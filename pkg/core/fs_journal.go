@@ -0,0 +1,285 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"github.com/oneconcern/datamon/pkg/filetracker"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// journalFile is the journal of the namespace of a mutable filesystem, in its staging directory.
+// The content of new files is in the backing files named by their iNode, next to the journal.
+const journalFile = "journal"
+
+// Operations of the journal
+const (
+	journalBundle      = "bundle"      // the bundle to commit
+	journalParent      = "parent"      // the parent bundle the files start from
+	journalCreate      = "create"      // a new file or directory
+	journalBase        = "base"        // a file or a symbolic link of the parent bundle
+	journalSymlink     = "symlink"     // a new symbolic link
+	journalLink        = "link"        // a new hard link to a file
+	journalRename      = "rename"      // a file or directory moved
+	journalUnlink      = "unlink"      // a file or directory removed
+	journalWrite       = "write"       // a range written to a file
+	journalTruncate    = "truncate"    // a file truncated
+	journalSetXattr    = "setxattr"    // an extended attribute set
+	journalRemoveXattr = "removexattr" // an extended attribute removed
+	journalCommit      = "commit"      // the files committed as a bundle
+)
+
+// journalEntry is a line of the journal
+type journalEntry struct {
+	Op        string                  `json:"op"`
+	Repo      string                  `json:"repo,omitempty"`
+	Bundle    *model.BundleDescriptor `json:"bundle,omitempty"`
+	BundleID  string                  `json:"bundleID,omitempty"`
+	Parent    fuseops.InodeID         `json:"parent,omitempty"`
+	Name      string                  `json:"name,omitempty"`
+	INode     fuseops.InodeID         `json:"inode,omitempty"`
+	Dir       bool                    `json:"dir,omitempty"`
+	NewParent fuseops.InodeID         `json:"newParent,omitempty"`
+	NewName   string                  `json:"newName,omitempty"`
+	Entry     *model.BundleEntry      `json:"entry,omitempty"`
+	Offset    int64                   `json:"offset,omitempty"`
+	Length    int64                   `json:"length,omitempty"`
+	Size      int64                   `json:"size,omitempty"`
+	Target    string                  `json:"target,omitempty"`
+	Value     []byte                  `json:"value,omitempty"`
+	Message   string                  `json:"message,omitempty"`
+}
+
+// journal appends the changes to the namespace of a mutable filesystem to its staging directory.
+// Writes are not synced: the journal survives the crash of the process, not of the host.
+type journal struct {
+	lock sync.Mutex
+	file afero.File
+	enc  *json.Encoder
+	l    *zap.Logger
+}
+
+// Create the journal of a new filesystem. A staging directory holding a journal holds a filesystem to recover.
+func newJournal(staging afero.Fs, l *zap.Logger) (*journal, error) {
+	file, err := staging.OpenFile(journalFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileDefaultMode)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("the staging directory holds a mutable filesystem to recover: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file, enc: json.NewEncoder(file), l: l}, nil
+}
+
+// Open the journal of a recovered filesystem, to append to it
+func openJournal(staging afero.Fs, l *zap.Logger) (*journal, error) {
+	file, err := staging.OpenFile(journalFile, os.O_WRONLY|os.O_APPEND, fileDefaultMode)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{file: file, enc: json.NewEncoder(file), l: l}, nil
+}
+
+// Append an entry. Failures are logged, the filesystem can't be recovered past them.
+func (j *journal) append(e journalEntry) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.enc.Encode(e); err != nil {
+		j.l.Error("failed to journal", zap.String("op", e.Op), zap.Error(err))
+	}
+}
+
+// Close the journal, and remove it when the filesystem needs no recovery
+func (j *journal) close(staging afero.Fs, remove bool) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	err := j.file.Close()
+	if remove {
+		if rmErr := staging.Remove(journalFile); err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// Replay the journal of a staging directory into a filesystem, with the stores of the bundle.
+// The files of the parent bundle are read from the blob store again, and the ranges written on top of them
+// are tracked again from the journal.
+func (fs *fsMutable) replay(ctx context.Context, metaStore, blobStore storage.Store) (*mutableState, error) {
+	file, err := fs.localCache.Open(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	state := &mutableState{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e journalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line is cut when the process died writing it
+			fs.l.Warn("skipping the journal past an invalid entry", zap.Int("line", line), zap.Error(err))
+			break
+		}
+		if err = fs.replayEntry(ctx, e, state, metaStore, blobStore); err != nil {
+			return nil, fmt.Errorf("journal line %d: %v", line, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if fs.bundle == nil {
+		return nil, fmt.Errorf("the journal does not record the bundle to commit")
+	}
+	return state, fs.recoverSizes()
+}
+
+// mutableState is the state of a mutable filesystem recovered from its journal
+type mutableState struct {
+	bundles []string // the bundles committed
+	changes uint64   // the changes to the files when they were last committed
+}
+
+func (fs *fsMutable) replayEntry(ctx context.Context, e journalEntry, state *mutableState,
+	metaStore, blobStore storage.Store) error {
+	switch e.Op {
+	case journalCreate, journalSymlink, journalLink, journalUnlink, journalWrite, journalTruncate,
+		journalSetXattr, journalRemoveXattr:
+		fs.changes++
+	}
+	switch e.Op {
+	case journalBundle:
+		if e.Bundle == nil {
+			return fmt.Errorf("missing bundle")
+		}
+		fs.bundle = New(e.Bundle, Repo(e.Repo), MetaStore(metaStore), BlobStore(blobStore))
+	case journalParent:
+		parent := New(NewBDescriptor(), Repo(fs.bundle.RepoID), BundleID(e.BundleID),
+			MetaStore(metaStore), BlobStore(blobStore))
+		if err := PopulateFiles(ctx, parent); err != nil {
+			return err
+		}
+		fs.parent = newBundleStore(parent)
+		// the directories of the files of the parent are not changes
+		fs.changes = 0
+	case journalCreate:
+		nodeType := fuseutil.DT_File
+		if e.Dir {
+			nodeType = fuseutil.DT_Directory
+		}
+		fs.addNode(nil, e.Parent, e.Name, e.INode, nil, nodeType, false)
+		fs.iNodeGenerator.recoverINode(e.INode)
+	case journalBase:
+		if e.Entry == nil {
+			return fmt.Errorf("missing entry of %s", e.Name)
+		}
+		fs.seedFile(e.Parent, e.Name, e.INode, e.Entry, fs.bundle.BundleDescriptor.Timestamp)
+		fs.iNodeGenerator.recoverINode(e.INode)
+	case journalSymlink:
+		fs.addSymlink(e.Parent, e.Name, e.INode, e.Target, nil, time.Now())
+		fs.iNodeGenerator.recoverINode(e.INode)
+	case journalLink:
+		_, err := fs.addLink(e.Parent, e.Name, e.INode)
+		return err
+	case journalRename:
+		return fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: e.Parent,
+			OldName:   e.Name,
+			NewParent: e.NewParent,
+			NewName:   e.NewName,
+		})
+	case journalUnlink:
+		return fs.deleteNSEntry(e.Parent, e.Name)
+	case journalWrite, journalTruncate:
+		n := fs.baseNode(e.INode)
+		if n == nil {
+			// the content of new files is in their backing files
+			return nil
+		}
+		t, err := fs.recoverOverlay(e.INode, n)
+		if err != nil {
+			return err
+		}
+		if e.Op == journalWrite {
+			t.TrackWrite(e.Offset, e.Length)
+		} else {
+			t.TrackTruncate(e.Size)
+		}
+		n.attr.Size = uint64(t.Size())
+	case journalSetXattr, journalRemoveXattr:
+		n := fs.node(e.INode)
+		if n == nil {
+			return fmt.Errorf("missing node %d", e.INode)
+		}
+		if e.Op == journalSetXattr {
+			return setXattr(n, e.Name, e.Value, 0)
+		}
+		return removeXattr(n, e.Name)
+	case journalCommit:
+		state.bundles = append(state.bundles, e.BundleID)
+		state.changes = fs.changes
+		if e.Message != "" {
+			fs.bundle.BundleDescriptor.Message = e.Message
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", e.Op)
+	}
+	return nil
+}
+
+// Get the overlay of a file of the parent bundle, on top of the backing file written before the recovery
+func (fs *fsMutable) recoverOverlay(iNode fuseops.InodeID, n *nodeEntry) (*filetracker.TFile, error) {
+	if n.tFile != nil {
+		return n.tFile, nil
+	}
+	file, err := fs.localCache.OpenFile(n.pathToBackingFile, os.O_RDWR|os.O_CREATE, fileDefaultMode)
+	if err != nil {
+		return nil, err
+	}
+	fs.backingFiles[iNode] = &file
+	n.tFile = filetracker.NewTFile(fs.parent, &file, n.base.NameWithPath, int64(n.base.Size))
+	return n.tFile, nil
+}
+
+// Set the size of the new files from their backing files
+func (fs *fsMutable) recoverSizes() error {
+	var err error
+	fs.iNodeStore.Root().Walk(func(k []byte, v interface{}) bool {
+		n := v.(*nodeEntry)
+		if n.attr.Mode.IsDir() || n.attr.Mode&os.ModeSymlink != 0 || n.base != nil {
+			return false
+		}
+		var info os.FileInfo
+		info, err = fs.localCache.Stat(n.pathToBackingFile)
+		if os.IsNotExist(err) {
+			// the file was removed
+			err = nil
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		n.attr.Size = uint64(info.Size())
+		return false
+	})
+	return err
+}
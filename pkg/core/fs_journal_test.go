@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestRecoverMutableFS(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	keep := testContent(1, 0)
+	edit := testContent(1, 1)
+	parent := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"a/keep": keep,
+		"a/edit": edit,
+		"gone":   []byte("removed"),
+	})
+	staging, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	bundle := New(NewBDescriptor(Message("mounted")), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+	dfs, err := NewMutableFSFrom(ctx, bundle, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(parent.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	), staging)
+	require.NoError(t, err)
+	fs := dfs.fsInternal
+
+	a := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	require.NoError(t, fs.LookUpInode(ctx, &a))
+	file := fuseops.LookUpInodeOp{Parent: a.Entry.Child, Name: "edit"}
+	require.NoError(t, fs.LookUpInode(ctx, &file))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file.Entry.Child, Offset: 4, Data: []byte("patch")}))
+	size := uint64(100)
+	require.NoError(t, fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: file.Entry.Child, Size: &size}))
+	expected := append(append([]byte{}, edit[:4]...), "patch"...)
+	expected = append(expected, edit[9:100]...)
+
+	dir := fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "d"}
+	require.NoError(t, fs.MkDir(ctx, &dir))
+	create := fuseops.CreateFileOp{Parent: dir.Entry.Child, Name: "new"}
+	require.NoError(t, fs.CreateFile(ctx, &create))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("new")}))
+	require.NoError(t, fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: a.Entry.Child,
+		OldName:   "keep",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "kept",
+	}))
+	require.NoError(t, fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "gone"}))
+	require.NoError(t, dfs.CommitMessage("first"))
+	first := dfs.BundleID()
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Offset: 3, Data: []byte(" content")}))
+
+	// the process dies, leaving a journal cut in the middle of a line
+	_, err = NewMutableFS(New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore)), staging)
+	require.Error(t, err)
+	journal, err := os.OpenFile(filepath.Join(staging, journalFile), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = journal.WriteString(`{"op":"create","par`)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	recovered, err := RecoverMutableFS(ctx, staging, metaStore, blobStore)
+	require.NoError(t, err)
+	status := recovered.Status()
+	require.Equal(t, repo, status.Repo)
+	require.Equal(t, []string{parent.BundleID}, status.Parents)
+	require.Equal(t, []string{first}, status.Bundles)
+	require.True(t, status.Dirty)
+
+	require.NoError(t, recovered.CommitMessage("recovered"))
+	require.NotEqual(t, first, recovered.BundleID())
+	committed := New(NewBDescriptor(), Repo(repo), BundleID(recovered.BundleID()), MetaStore(metaStore), BlobStore(blobStore))
+	require.NoError(t, PopulateFiles(ctx, committed))
+	require.Equal(t, "recovered", committed.BundleDescriptor.Message)
+	require.Equal(t, []string{first}, committed.BundleDescriptor.Parents)
+	entries := make(map[string]model.BundleEntry)
+	for _, e := range committed.BundleEntries {
+		entries[e.NameWithPath] = e
+	}
+	require.Len(t, entries, 3)
+	require.Equal(t, keep, readEntry(t, committed, entries["kept"]))
+	require.Equal(t, expected, readEntry(t, committed, entries["a/edit"]))
+	require.Equal(t, []byte("new content"), readEntry(t, committed, entries["d/new"]))
+
+	// closing the filesystem removes the journal, the staging directory can be used again
+	require.NoError(t, recovered.Close())
+	_, err = RecoverMutableFS(ctx, staging, metaStore, blobStore)
+	require.True(t, errors.Is(err, storage.ErrNotFound), "%v", err)
+	_, err = NewMutableFS(New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore)), staging)
+	require.NoError(t, err)
+}
@@ -0,0 +1,586 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+const (
+	bundlesDir                       = "bundles"
+	labelsDir                        = "labels"
+	latestLink                       = "latest"
+	bundlesINode     fuseops.InodeID = fuseops.RootInodeID + 1
+	labelsINode      fuseops.InodeID = fuseops.RootInodeID + 2
+	latestINode      fuseops.InodeID = fuseops.RootInodeID + 3
+	symlinkMode                      = 0777 | os.ModeSymlink
+	symlinkLinkCount uint32          = 1
+)
+
+// repoFsInternal serves the bundles and the labels of a repo as a read only tree:
+//
+//	bundles/<id>/  the files of a bundle, loaded on the first lookup in the bundle
+//	labels/<name>  symlinks to the bundles of the labels
+//	latest         a symlink to the latest bundle
+//
+// Bundles and labels are listed from the metadata store each time their directory is read,
+// so that new ones show up without remounting.
+type repoFsInternal struct {
+	fuseutil.NotImplementedFileSystem
+
+	repo      string
+	metaStore storage.Store
+	blobStore storage.Store
+	mounted   time.Time
+	l         *zap.Logger
+
+	lock sync.Mutex
+	// Nodes by iNode. Nodes are kept while mounted, bundles loaded once are not loaded again.
+	nodes map[fuseops.InodeID]*repoNode
+	// iNodes of the bundle directories by bundle ID, and of the label symlinks by label name.
+	// They are allocated when listed, the nodes are created on lookup.
+	bundles   map[string]fuseops.InodeID
+	labels    map[string]fuseops.InodeID
+	nextINode fuseops.InodeID
+	// Open directories and files
+	dirHandles  map[fuseops.HandleID][]fuseutil.Dirent
+	fileHandles map[fuseops.HandleID]*bundleFileReaderAt
+	nextHandle  fuseops.HandleID
+}
+
+// repoNode is a directory, a file or a symlink of the tree of a repo
+type repoNode struct {
+	attr fuseops.InodeAttributes
+	// The bundle of the directories and files under bundles/
+	bundle *repoBundle
+	// The entry of a file, or of a symlink of a bundle
+	entry model.BundleEntry
+	// The children of the directories of bundles, by name
+	children map[string]fuseops.InodeID
+	// The label of a label symlink
+	label string
+}
+
+// repoBundle is a bundle of the tree, its files are loaded on the first lookup in its directory
+type repoBundle struct {
+	lock   sync.Mutex
+	iNode  fuseops.InodeID
+	bundle *Bundle
+	loaded bool
+}
+
+func newRepoFsInternal(repo string, metaStore, blobStore storage.Store, l *zap.Logger) *repoFsInternal {
+	fs := &repoFsInternal{
+		repo:        repo,
+		metaStore:   metaStore,
+		blobStore:   blobStore,
+		mounted:     time.Now(),
+		l:           l,
+		nodes:       make(map[fuseops.InodeID]*repoNode),
+		bundles:     make(map[string]fuseops.InodeID),
+		labels:      make(map[string]fuseops.InodeID),
+		nextINode:   firstINode,
+		dirHandles:  make(map[fuseops.HandleID][]fuseutil.Dirent),
+		fileHandles: make(map[fuseops.HandleID]*bundleFileReaderAt),
+	}
+	for _, iNode := range []fuseops.InodeID{fuseops.RootInodeID, bundlesINode, labelsINode} {
+		fs.nodes[iNode] = &repoNode{attr: fs.attributes(dirReadOnlyMode, dirLinkCount, dirInitialSize, fs.mounted)}
+	}
+	fs.nodes[latestINode] = &repoNode{attr: fs.attributes(symlinkMode, symlinkLinkCount, 0, fs.mounted)}
+	return fs
+}
+
+func (fs *repoFsInternal) attributes(mode os.FileMode, linkCount uint32, size uint64, ts time.Time) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:   size,
+		Nlink:  linkCount,
+		Mode:   mode,
+		Atime:  ts,
+		Mtime:  ts,
+		Ctime:  ts,
+		Crtime: ts,
+		Uid:    defaultUID,
+		Gid:    defaultGID,
+	}
+}
+
+// allocINode returns the iNode of a name in a map of iNodes, allocating it on first use. Need to hold the lock.
+func (fs *repoFsInternal) allocINode(iNodes map[string]fuseops.InodeID, name string) fuseops.InodeID {
+	iNode, ok := iNodes[name]
+	if !ok {
+		fs.nextINode++
+		iNode = fs.nextINode
+		iNodes[name] = iNode
+	}
+	return iNode
+}
+
+// fuseError converts the errors of the stores to the errors of the filesystem
+func (fs *repoFsInternal) fuseError(err error, msg string) error {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, storage.ErrNotFound):
+		return fuse.ENOENT
+	}
+	fs.l.Error(msg, zap.Error(err))
+	return fuse.EIO
+}
+
+func (fs *repoFsInternal) node(iNode fuseops.InodeID) (*repoNode, bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n, found := fs.nodes[iNode]
+	return n, found
+}
+
+// bundleNode returns the directory of a bundle, reading its descriptor on first use
+func (fs *repoFsInternal) bundleNode(ctx context.Context, bundleID string) (fuseops.InodeID, *repoNode, error) {
+	fs.lock.Lock()
+	iNode, ok := fs.bundles[bundleID]
+	n := fs.nodes[iNode]
+	fs.lock.Unlock()
+	if ok && n != nil {
+		return iNode, n, nil
+	}
+	bd, err := GetBundle(ctx, fs.repo, bundleID, fs.metaStore)
+	if err != nil {
+		return 0, nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	iNode = fs.allocINode(fs.bundles, bundleID)
+	if n = fs.nodes[iNode]; n == nil {
+		n = &repoNode{
+			attr:     fs.attributes(dirReadOnlyMode, dirLinkCount, dirInitialSize, bd.Timestamp),
+			children: make(map[string]fuseops.InodeID),
+			bundle: &repoBundle{
+				iNode: iNode,
+				bundle: New(&bd,
+					Repo(fs.repo),
+					BundleID(bundleID),
+					MetaStore(fs.metaStore),
+					BlobStore(fs.blobStore),
+				),
+			},
+		}
+		fs.nodes[iNode] = n
+	}
+	return iNode, n, nil
+}
+
+// loadBundle adds the files of a bundle to the tree, the first time it is called for the bundle
+func (fs *repoFsInternal) loadBundle(ctx context.Context, b *repoBundle) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.loaded {
+		return nil
+	}
+	if err := PopulateFiles(ctx, b.bundle); err != nil {
+		b.bundle.BundleEntries = nil
+		return err
+	}
+	ts := b.bundle.BundleDescriptor.Timestamp
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for _, e := range b.bundle.BundleEntries {
+		if e.Purged != "" {
+			// the content of the file was purged, it can't be read
+			continue
+		}
+		parent := fs.nodes[b.iNode]
+		names := strings.Split(strings.Trim(e.NameWithPath, "/"), "/")
+		for _, name := range names[:len(names)-1] {
+			iNode, ok := parent.children[name]
+			if !ok {
+				fs.nextINode++
+				iNode = fs.nextINode
+				parent.children[name] = iNode
+				parent.attr.Nlink++
+				fs.nodes[iNode] = &repoNode{
+					attr:     fs.attributes(dirReadOnlyMode, dirLinkCount, dirInitialSize, ts),
+					bundle:   b,
+					children: make(map[string]fuseops.InodeID),
+				}
+			}
+			parent = fs.nodes[iNode]
+		}
+		var mode os.FileMode = fileReadOnlyMode
+		if e.Symlink != "" {
+			mode = symlinkMode
+		}
+		fs.nextINode++
+		parent.children[names[len(names)-1]] = fs.nextINode
+		fs.nodes[fs.nextINode] = &repoNode{
+			attr:   fs.attributes(mode, fileLinkCount, e.Size, ts),
+			bundle: b,
+			entry:  e,
+		}
+	}
+	b.loaded = true
+	return nil
+}
+
+// loadedNode returns a node of a bundle, with the files of the bundle loaded when it's a bundle directory
+func (fs *repoFsInternal) loadedNode(ctx context.Context, iNode fuseops.InodeID) (*repoNode, error) {
+	n, found := fs.node(iNode)
+	if !found {
+		return nil, fuse.ENOENT
+	}
+	if n.bundle != nil {
+		if err := fs.loadBundle(ctx, n.bundle); err != nil {
+			return nil, fs.fuseError(err, "failed to load bundle")
+		}
+	}
+	return n, nil
+}
+
+// target returns the target of a symlink, resolving labels and the latest bundle when called
+func (fs *repoFsInternal) target(ctx context.Context, iNode fuseops.InodeID, n *repoNode) (string, error) {
+	if n.entry.Symlink != "" {
+		return n.entry.Symlink, nil
+	}
+	if iNode == latestINode {
+		bundleID, err := GetLatestBundle(ctx, fs.repo, fs.metaStore)
+		if err != nil {
+			return "", err
+		}
+		return bundlesDir + "/" + bundleID, nil
+	}
+	label, err := GetLabel(ctx, fs.metaStore, fs.repo, n.label)
+	if err != nil {
+		return "", err
+	}
+	return "../" + bundlesDir + "/" + label.BundleID, nil
+}
+
+func (fs *repoFsInternal) lookUp(ctx context.Context, parent fuseops.InodeID, name string) (fuseops.InodeID, *repoNode, error) {
+	switch parent {
+	case fuseops.RootInodeID:
+		iNode, ok := map[string]fuseops.InodeID{
+			bundlesDir: bundlesINode,
+			labelsDir:  labelsINode,
+			latestLink: latestINode,
+		}[name]
+		if !ok {
+			return 0, nil, fuse.ENOENT
+		}
+		n, _ := fs.node(iNode)
+		if iNode == latestINode {
+			if _, err := fs.target(ctx, iNode, n); err != nil {
+				return 0, nil, err
+			}
+		}
+		return iNode, n, nil
+	case bundlesINode:
+		return fs.bundleNode(ctx, name)
+	case labelsINode:
+		label, err := GetLabel(ctx, fs.metaStore, fs.repo, name)
+		if err != nil {
+			return 0, nil, err
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		iNode := fs.allocINode(fs.labels, name)
+		n := &repoNode{
+			attr:  fs.attributes(symlinkMode, symlinkLinkCount, 0, label.Timestamp),
+			label: name,
+		}
+		fs.nodes[iNode] = n
+		return iNode, n, nil
+	}
+	n, err := fs.loadedNode(ctx, parent)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n.children == nil {
+		return 0, nil, fuse.ENOTDIR
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	iNode, ok := n.children[name]
+	if !ok {
+		return 0, nil, fuse.ENOENT
+	}
+	return iNode, fs.nodes[iNode], nil
+}
+
+// dirents lists the entries of a directory
+func (fs *repoFsInternal) dirents(ctx context.Context, iNode fuseops.InodeID) ([]fuseutil.Dirent, error) {
+	var entries []fuseutil.Dirent
+	add := func(iNode fuseops.InodeID, name string, t fuseutil.DirentType) {
+		entries = append(entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(entries) + 1),
+			Inode:  iNode,
+			Name:   name,
+			Type:   t,
+		})
+	}
+	switch iNode {
+	case fuseops.RootInodeID:
+		add(bundlesINode, bundlesDir, fuseutil.DT_Directory)
+		add(labelsINode, labelsDir, fuseutil.DT_Directory)
+		if _, err := GetLatestBundle(ctx, fs.repo, fs.metaStore); err == nil {
+			add(latestINode, latestLink, fuseutil.DT_Link)
+		}
+	case bundlesINode:
+		ids, err := listBundleIDs(ctx, fs.repo, fs.metaStore)
+		if err != nil {
+			return nil, err
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		for _, id := range ids {
+			add(fs.allocINode(fs.bundles, id), id, fuseutil.DT_Directory)
+		}
+	case labelsINode:
+		labels, err := ListLabels(ctx, fs.metaStore, fs.repo)
+		if err != nil {
+			return nil, err
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		for _, label := range labels {
+			add(fs.allocINode(fs.labels, label.Name), label.Name, fuseutil.DT_Link)
+		}
+	default:
+		n, err := fs.loadedNode(ctx, iNode)
+		if err != nil {
+			return nil, err
+		}
+		if n.children == nil {
+			return nil, fuse.ENOTDIR
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := n.children[name]
+			t := fuseutil.DT_File
+			switch {
+			case fs.nodes[child].children != nil:
+				t = fuseutil.DT_Directory
+			case fs.nodes[child].attr.Mode&os.ModeSymlink != 0:
+				t = fuseutil.DT_Link
+			}
+			add(child, name, t)
+		}
+	}
+	return entries, nil
+}
+
+func (fs *repoFsInternal) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return statFS()
+}
+
+func (fs *repoFsInternal) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	iNode, n, err := fs.lookUp(ctx, op.Parent, op.Name)
+	if err != nil {
+		return fs.fuseError(err, "failed to look up "+op.Name)
+	}
+	op.Entry.Child = iNode
+	op.Entry.Attributes = n.attr
+	op.Entry.Generation = 1
+	if n.bundle != nil {
+		// the files of bundles don't change
+		op.Entry.AttributesExpiration = time.Now().Add(cacheYearLong)
+		op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	}
+	return nil
+}
+
+func (fs *repoFsInternal) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	n, found := fs.node(op.Inode)
+	if !found {
+		return fuse.ENOENT
+	}
+	op.Attributes = n.attr
+	if n.bundle != nil {
+		op.AttributesExpiration = time.Now().Add(cacheYearLong)
+	}
+	return nil
+}
+
+func (fs *repoFsInternal) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	return
+}
+
+func (fs *repoFsInternal) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	entries, err := fs.dirents(ctx, op.Inode)
+	if err != nil {
+		return fs.fuseError(err, "failed to list directory")
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	fs.dirHandles[op.Handle] = entries
+	return nil
+}
+
+func (fs *repoFsInternal) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	fs.lock.Lock()
+	entries, found := fs.dirHandles[op.Handle]
+	fs.lock.Unlock()
+	if !found {
+		return fuse.EIO
+	}
+	offset := int(op.Offset)
+	if offset > len(entries) {
+		return fuse.EIO
+	}
+	for i := offset; i < len(entries); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], entries[i])
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+	return nil
+}
+
+func (fs *repoFsInternal) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	fs.lock.Lock()
+	delete(fs.dirHandles, op.Handle)
+	fs.lock.Unlock()
+	return
+}
+
+func (fs *repoFsInternal) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	n, found := fs.node(op.Inode)
+	if !found {
+		return fuse.ENOENT
+	}
+	if n.bundle == nil || n.children != nil {
+		return fuse.EINVAL
+	}
+	// the reader outlives the operation
+	file, err := openBundleEntry(context.Background(), n.bundle.bundle, n.entry)
+	if err != nil {
+		return fs.fuseError(err, "failed to open "+n.entry.NameWithPath)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.nextHandle++
+	op.Handle = fs.nextHandle
+	op.KeepPageCache = true
+	fs.fileHandles[op.Handle] = &bundleFileReaderAt{file: file}
+	return nil
+}
+
+func (fs *repoFsInternal) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.lock.Lock()
+	h, found := fs.fileHandles[op.Handle]
+	fs.lock.Unlock()
+	if !found {
+		return fuse.EIO
+	}
+	op.BytesRead, err = h.ReadAt(op.Dst, op.Offset)
+	if err != nil && err != io.EOF {
+		return fs.fuseError(err, "failed to read")
+	}
+	return nil
+}
+
+func (fs *repoFsInternal) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.lock.Lock()
+	h, found := fs.fileHandles[op.Handle]
+	delete(fs.fileHandles, op.Handle)
+	fs.lock.Unlock()
+	if found {
+		_ = h.file.Close()
+	}
+	return
+}
+
+func (fs *repoFsInternal) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	n, found := fs.node(op.Inode)
+	if !found || n.attr.Mode&os.ModeSymlink == 0 {
+		return fuse.ENOENT
+	}
+	op.Target, err = fs.target(ctx, op.Inode, n)
+	if err != nil {
+		return fs.fuseError(err, "failed to resolve link")
+	}
+	return nil
+}
+
+// xattrs returns the extended attributes of the files and directories of bundles, with the provenance of their content.
+// The nodes outside of bundles only have the repo.
+func (fs *repoFsInternal) xattrs(iNode fuseops.InodeID) (map[string][]byte, error) {
+	n, found := fs.node(iNode)
+	if !found {
+		return nil, fuse.ENOENT
+	}
+	if n.bundle == nil {
+		return map[string][]byte{xattrRepo: []byte(fs.repo)}, nil
+	}
+	return bundleXattrs(n.bundle.bundle, n.entry.Hash, n.entry.Size, n.entry.Xattrs), nil
+}
+
+func (fs *repoFsInternal) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	xattrs, err := fs.xattrs(op.Inode)
+	if err != nil {
+		return err
+	}
+	value, found := xattrs[op.Name]
+	if !found {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = readXattr(op.Dst, value)
+	return
+}
+
+func (fs *repoFsInternal) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	xattrs, err := fs.xattrs(op.Inode)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	op.BytesRead, err = listXattrs(op.Dst, names)
+	return
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func direntNames(t *testing.T, fs *repoFsInternal, iNode fuseops.InodeID) []string {
+	entries, err := fs.dirents(context.Background(), iNode)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func lookUp(t *testing.T, fs *repoFsInternal, parent fuseops.InodeID, names ...string) fuseops.ChildInodeEntry {
+	var op fuseops.LookUpInodeOp
+	for _, name := range names {
+		op = fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		require.NoError(t, fs.LookUpInode(context.Background(), &op), name)
+		parent = op.Entry.Child
+	}
+	return op.Entry
+}
+
+func readSymlink(t *testing.T, fs *repoFsInternal, iNode fuseops.InodeID) string {
+	op := fuseops.ReadSymlinkOp{Inode: iNode}
+	require.NoError(t, fs.ReadSymlink(context.Background(), &op))
+	return op.Target
+}
+
+func TestRepoFS(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	data := testContent(2, 0)
+	bundle1 := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"a/b/file": data,
+		"top":      []byte("top content"),
+	})
+	fs := newRepoFsInternal(repo, metaStore, blobStore, zap.NewNop())
+
+	require.Equal(t, []string{bundlesDir, labelsDir, latestLink}, direntNames(t, fs, fuseops.RootInodeID))
+	require.Equal(t, []string{bundle1.BundleID}, direntNames(t, fs, bundlesINode))
+	require.Empty(t, direntNames(t, fs, labelsINode))
+	latest := lookUp(t, fs, fuseops.RootInodeID, latestLink)
+	require.Equal(t, bundlesDir+"/"+bundle1.BundleID, readSymlink(t, fs, latest.Child))
+
+	// the files of the bundle are loaded on the first lookup
+	dir := lookUp(t, fs, bundlesINode, bundle1.BundleID)
+	require.True(t, dir.Attributes.Mode.IsDir())
+	require.Equal(t, []string{"a", "top"}, direntNames(t, fs, dir.Child))
+	file := lookUp(t, fs, dir.Child, "a", "b", "file")
+	require.Equal(t, uint64(len(data)), file.Attributes.Size)
+	require.Equal(t, dir.Child, lookUp(t, fs, bundlesINode, bundle1.BundleID).Child)
+
+	// the files and directories of bundles have the provenance of their content as extended attributes
+	getXattr := fuseops.GetXattrOp{Inode: file.Child, Name: xattrHash, Dst: make([]byte, 256)}
+	require.NoError(t, fs.GetXattr(ctx, &getXattr))
+	for _, e := range bundle1.BundleEntries {
+		if e.NameWithPath == "a/b/file" {
+			require.Equal(t, e.Hash, string(getXattr.Dst[:getXattr.BytesRead]))
+		}
+	}
+	getXattr = fuseops.GetXattrOp{Inode: dir.Child, Name: xattrBundle, Dst: make([]byte, 256)}
+	require.NoError(t, fs.GetXattr(ctx, &getXattr))
+	require.Equal(t, bundle1.BundleID, string(getXattr.Dst[:getXattr.BytesRead]))
+	require.Equal(t, fuse.ENOATTR, fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: dir.Child, Name: xattrHash}))
+	require.Equal(t, fuse.ENOATTR, fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: bundlesINode, Name: xattrBundle}))
+	// the directories outside of bundles only have the repo
+	for _, iNode := range []fuseops.InodeID{fuseops.RootInodeID, bundlesINode, labelsINode} {
+		getXattr = fuseops.GetXattrOp{Inode: iNode, Name: xattrRepo, Dst: make([]byte, 256)}
+		require.NoError(t, fs.GetXattr(ctx, &getXattr))
+		require.Equal(t, repo, string(getXattr.Dst[:getXattr.BytesRead]))
+		listXattr := fuseops.ListXattrOp{Inode: iNode, Dst: make([]byte, 256)}
+		require.NoError(t, fs.ListXattr(ctx, &listXattr))
+		require.Equal(t, "user.datamon.repo\x00", string(listXattr.Dst[:listXattr.BytesRead]))
+	}
+	listXattr := fuseops.ListXattrOp{Inode: file.Child, Dst: make([]byte, 256)}
+	require.NoError(t, fs.ListXattr(ctx, &listXattr))
+	require.Equal(t, "user.datamon.bundle\x00user.datamon.hash\x00user.datamon.leafsize\x00user.datamon.repo\x00user.datamon.size\x00",
+		string(listXattr.Dst[:listXattr.BytesRead]))
+
+	open := fuseops.OpenFileOp{Inode: file.Child}
+	require.NoError(t, fs.OpenFile(ctx, &open))
+	read := fuseops.ReadFileOp{Handle: open.Handle, Offset: int64(len(data) / 2), Dst: make([]byte, len(data))}
+	require.NoError(t, fs.ReadFile(ctx, &read))
+	require.Equal(t, data[len(data)/2:], read.Dst[:read.BytesRead])
+	read = fuseops.ReadFileOp{Handle: open.Handle, Offset: 10, Dst: make([]byte, 10)}
+	require.NoError(t, fs.ReadFile(ctx, &read))
+	require.Equal(t, data[10:20], read.Dst[:read.BytesRead])
+	require.NoError(t, fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle}))
+
+	openDir := fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	require.NoError(t, fs.OpenDir(ctx, &openDir))
+	readDir := fuseops.ReadDirOp{Handle: openDir.Handle, Dst: make([]byte, 1024)}
+	require.NoError(t, fs.ReadDir(ctx, &readDir))
+	require.NotZero(t, readDir.BytesRead)
+	require.NoError(t, fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{Handle: openDir.Handle}))
+
+	require.Equal(t, fuse.ENOENT, fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: bundlesINode, Name: "missing"}))
+	require.Equal(t, fuse.ENOENT, fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: dir.Child, Name: "missing"}))
+	require.Equal(t, fuse.ENOENT, fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: labelsINode, Name: "prod"}))
+
+	// new bundles and labels show up, and labels follow the bundles they point to
+	contributor := model.Contributor{Name: "test", Email: "t@test.com"}
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "prod", bundle1.BundleID, contributor))
+	require.Equal(t, []string{"prod"}, direntNames(t, fs, labelsINode))
+	label := lookUp(t, fs, labelsINode, "prod")
+	require.Equal(t, "../"+bundlesDir+"/"+bundle1.BundleID, readSymlink(t, fs, label.Child))
+
+	bundle2 := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"other": []byte("other content")})
+	require.ElementsMatch(t, []string{bundle1.BundleID, bundle2.BundleID}, direntNames(t, fs, bundlesINode))
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "prod", bundle2.BundleID, contributor))
+	require.Equal(t, "../"+bundlesDir+"/"+bundle2.BundleID, readSymlink(t, fs, label.Child))
+	entries, err := fs.dirents(ctx, lookUp(t, fs, bundlesINode, bundle2.BundleID).Child)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "other", entries[0].Name)
+	require.Equal(t, fuseutil.DT_File, entries[0].Type)
+}
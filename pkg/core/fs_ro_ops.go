@@ -3,7 +3,6 @@ package core
 import (
 	"context"
 	"errors"
-	"fmt"
 	"log"
 	"os"
 	"path"
@@ -25,7 +24,7 @@ func (fs *readOnlyFsInternal) StatFS(
 }
 
 func (fs *readOnlyFsInternal) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
-	log.Print(fmt.Printf("lookup parent id:%d, child: %s ", op.Parent, op.Name))
+	log.Printf("lookup parent id:%d, child: %s ", op.Parent, op.Name)
 	lookupKey := formLookupKey(op.Parent, op.Name)
 	val, found := fs.lookupTree.Get(lookupKey)
 	if found {
@@ -46,7 +45,7 @@ func (fs *readOnlyFsInternal) LookUpInode(ctx context.Context, op *fuseops.LookU
 func (fs *readOnlyFsInternal) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
-	log.Print(fmt.Printf("iNode attr id:%d ", op.Inode))
+	log.Printf("iNode attr id:%d ", op.Inode)
 	key := formKey(op.Inode)
 	e, found := fs.fsEntryStore.Get(key)
 	if !found {
@@ -61,7 +60,7 @@ func (fs *readOnlyFsInternal) GetInodeAttributes(
 func (fs *readOnlyFsInternal) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
-	log.Print(fmt.Printf("SetInodeAttributes iNode id:%d ", op.Inode))
+	log.Printf("SetInodeAttributes iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
@@ -69,7 +68,7 @@ func (fs *readOnlyFsInternal) SetInodeAttributes(
 func (fs *readOnlyFsInternal) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) (err error) {
-	log.Print(fmt.Printf("ForgetInode iNode id:%d ", op.Inode))
+	log.Printf("ForgetInode iNode id:%d ", op.Inode)
 	return
 }
 
@@ -77,7 +76,7 @@ func (fs *readOnlyFsInternal) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
 
-	log.Print(fmt.Printf("Mkdir parent iNode id:%d ", op.Parent))
+	log.Printf("Mkdir parent iNode id:%d ", op.Parent)
 	err = fuse.ENOSYS
 	return
 }
@@ -85,7 +84,7 @@ func (fs *readOnlyFsInternal) MkDir(
 func (fs *readOnlyFsInternal) MkNode(
 	ctx context.Context,
 	op *fuseops.MkNodeOp) (err error) {
-	log.Print(fmt.Printf("MkNode parent iNode id:%d ", op.Parent))
+	log.Printf("MkNode parent iNode id:%d ", op.Parent)
 	err = fuse.ENOSYS
 	return
 }
@@ -93,7 +92,7 @@ func (fs *readOnlyFsInternal) MkNode(
 func (fs *readOnlyFsInternal) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
-	log.Print(fmt.Printf("CreateFile parent iNode id:%d name: %s ", op.Parent, op.Name))
+	log.Printf("CreateFile parent iNode id:%d name: %s ", op.Parent, op.Name)
 	// Take RW lock.
 	// Check if the child exists
 	// Create child
@@ -104,16 +103,16 @@ func (fs *readOnlyFsInternal) CreateFile(
 func (fs *readOnlyFsInternal) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) (err error) {
-	log.Print(fmt.Printf("CreateSymLink"))
+	log.Printf("CreateSymLink")
 	err = fuse.ENOSYS
 	return
 }
 
-// Hard links are not supported in datamon.
+// Hard links of the bundle are exposed, new ones can't be created.
 func (fs *readOnlyFsInternal) CreateLink(
 	ctx context.Context,
 	op *fuseops.CreateLinkOp) (err error) {
-	log.Print(fmt.Printf("CreateLink"))
+	log.Printf("CreateLink")
 	err = fuse.ENOSYS
 	return
 }
@@ -121,7 +120,7 @@ func (fs *readOnlyFsInternal) CreateLink(
 func (fs *readOnlyFsInternal) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
-	log.Print(fmt.Printf("Rename new name:"+op.NewName+" oldname:"+op.OldName+" new parent %d, old parent %d ", op.NewParent, op.OldParent))
+	log.Printf("Rename new name:"+op.NewName+" oldname:"+op.OldName+" new parent %d, old parent %d ", op.NewParent, op.OldParent)
 	err = fuse.ENOSYS
 	return
 }
@@ -129,7 +128,7 @@ func (fs *readOnlyFsInternal) Rename(
 func (fs *readOnlyFsInternal) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
-	log.Print(fmt.Printf("RmDir iNode id:%d ", op.Parent))
+	log.Printf("RmDir iNode id:%d ", op.Parent)
 	err = fuse.ENOSYS
 	return
 }
@@ -137,13 +136,13 @@ func (fs *readOnlyFsInternal) RmDir(
 func (fs *readOnlyFsInternal) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
-	log.Print(fmt.Printf("Unlink child: "+op.Name+" parent: %d ", op.Parent))
+	log.Printf("Unlink child: "+op.Name+" parent: %d ", op.Parent)
 	err = fuse.ENOSYS
 	return
 }
 
 func (fs *readOnlyFsInternal) OpenDir(ctx context.Context, openDirOp *fuseops.OpenDirOp) error {
-	log.Print(fmt.Printf("openDir iNode id:%d ", openDirOp.Inode))
+	log.Printf("openDir iNode id:%d ", openDirOp.Inode)
 	p, found := fs.fsEntryStore.Get(formKey(openDirOp.Inode))
 	if !found {
 		return fuse.ENOENT
@@ -177,28 +176,28 @@ func (fs *readOnlyFsInternal) ReadDir(ctx context.Context, readDirOp *fuseops.Re
 		}
 		readDirOp.BytesRead += n
 	}
-	log.Print(fmt.Printf("readDir iNode id:%d offset: %d bytes: %d ", readDirOp.Inode, readDirOp.Offset, readDirOp.BytesRead))
+	log.Printf("readDir iNode id:%d offset: %d bytes: %d ", readDirOp.Inode, readDirOp.Offset, readDirOp.BytesRead)
 	return nil
 }
 
 func (fs *readOnlyFsInternal) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
-	log.Print(fmt.Printf("ReleaseDirHandle iNode id:%d ", op.Handle))
+	log.Printf("ReleaseDirHandle iNode id:%d ", op.Handle)
 	return
 }
 
 func (fs *readOnlyFsInternal) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	log.Print(fmt.Printf("OpenFile iNode id:%d handle:%d ", op.Inode, op.Handle))
+	log.Printf("OpenFile iNode id:%d handle:%d ", op.Inode, op.Handle)
 	return
 }
 
 func (fs *readOnlyFsInternal) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
-	log.Print(fmt.Printf("ReadFile iNode id:%d, offset: %d ", op.Inode, op.Offset))
+	log.Printf("ReadFile iNode id:%d, offset: %d ", op.Inode, op.Offset)
 
 	// If file has not been mutated.
 	p, found := fs.fsEntryStore.Get(formKey(op.Inode))
@@ -216,7 +215,7 @@ func (fs *readOnlyFsInternal) ReadFile(
 		log.Print(err)
 		return fuse.EIO
 	}
-	log.Print(fmt.Printf("Read: %d of %s ", n, fe.fullPath))
+	log.Printf("Read: %d of %s ", n, fe.fullPath)
 	op.BytesRead = n
 	return nil
 }
@@ -224,7 +223,7 @@ func (fs *readOnlyFsInternal) ReadFile(
 func (fs *readOnlyFsInternal) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
-	log.Print(fmt.Printf("WriteFile iNode id:%d ", op.Inode))
+	log.Printf("WriteFile iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
@@ -232,7 +231,7 @@ func (fs *readOnlyFsInternal) WriteFile(
 func (fs *readOnlyFsInternal) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
-	log.Print(fmt.Printf("SyncFile iNode id:%d ", op.Inode))
+	log.Printf("SyncFile iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
@@ -240,7 +239,7 @@ func (fs *readOnlyFsInternal) SyncFile(
 func (fs *readOnlyFsInternal) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
-	log.Print(fmt.Printf("FlushFile iNode id:%d ", op.Inode))
+	log.Printf("FlushFile iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
@@ -248,22 +247,30 @@ func (fs *readOnlyFsInternal) FlushFile(
 func (fs *readOnlyFsInternal) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
-	log.Print(fmt.Printf("ReleaseFileHandle iNode id:%d ", op.Handle))
+	log.Printf("ReleaseFileHandle iNode id:%d ", op.Handle)
 	return
 }
 
 func (fs *readOnlyFsInternal) ReadSymlink(
 	ctx context.Context,
 	op *fuseops.ReadSymlinkOp) (err error) {
-	log.Print(fmt.Printf("ReadSymlink iNode id:%d ", op.Inode))
-	err = fuse.ENOSYS
-	return
+	log.Printf("ReadSymlink iNode id:%d ", op.Inode)
+	p, found := fs.fsEntryStore.Get(formKey(op.Inode))
+	if !found {
+		return fuse.ENOENT
+	}
+	fe := p.(fsEntry)
+	if fe.attributes.Mode&os.ModeSymlink == 0 {
+		return fuse.EINVAL
+	}
+	op.Target = fe.target
+	return nil
 }
 
 func (fs *readOnlyFsInternal) RemoveXattr(
 	ctx context.Context,
 	op *fuseops.RemoveXattrOp) (err error) {
-	log.Print(fmt.Printf("RemoveXattr iNode id:%d ", op.Inode))
+	log.Printf("RemoveXattr iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
@@ -271,29 +278,51 @@ func (fs *readOnlyFsInternal) RemoveXattr(
 func (fs *readOnlyFsInternal) GetXattr(
 	ctx context.Context,
 	op *fuseops.GetXattrOp) (err error) {
-	log.Print(fmt.Printf("GetXattr iNode id:%d ", op.Inode))
-	err = fuse.ENOSYS
+	log.Printf("GetXattr iNode id:%d name: %s ", op.Inode, op.Name)
+	p, found := fs.fsEntryStore.Get(formKey(op.Inode))
+	if !found {
+		return fuse.ENOENT
+	}
+	value, found := fs.xattrs(p.(fsEntry))[op.Name]
+	if !found {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = readXattr(op.Dst, value)
 	return
 }
 
 func (fs *readOnlyFsInternal) ListXattr(
 	ctx context.Context,
 	op *fuseops.ListXattrOp) (err error) {
-	log.Print(fmt.Printf("ListXattr iNode id:%d ", op.Inode))
-	err = fuse.ENOSYS
+	log.Printf("ListXattr iNode id:%d ", op.Inode)
+	p, found := fs.fsEntryStore.Get(formKey(op.Inode))
+	if !found {
+		return fuse.ENOENT
+	}
+	xattrs := fs.xattrs(p.(fsEntry))
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	op.BytesRead, err = listXattrs(op.Dst, names)
 	return
 }
 
+// Get the extended attributes of an entry, with the provenance of its content
+func (fs *readOnlyFsInternal) xattrs(fe fsEntry) map[string][]byte {
+	return bundleXattrs(fs.bundle, fe.hash, fe.attributes.Size, fe.xattrs)
+}
+
 func (fs *readOnlyFsInternal) SetXattr(
 	ctx context.Context,
 	op *fuseops.SetXattrOp) (err error) {
-	log.Print(fmt.Printf("SetXattr iNode id:%d ", op.Inode))
+	log.Printf("SetXattr iNode id:%d ", op.Inode)
 	err = fuse.ENOSYS
 	return
 }
 
 func (fs *readOnlyFsInternal) Destroy() {
-	log.Print(fmt.Printf("Destroy"))
+	log.Printf("Destroy")
 }
 
 func isDir(fsEntry fsEntry) bool {
@@ -302,12 +331,17 @@ func isDir(fsEntry fsEntry) bool {
 
 func newDatamonFSEntry(bundleEntry *model.BundleEntry, time time.Time, id fuseops.InodeID, linkCount uint32) *fsEntry {
 	var mode os.FileMode = fileReadOnlyMode
-	if bundleEntry.Hash == "" {
+	switch {
+	case bundleEntry.Symlink != "":
+		mode = symlinkMode
+	case bundleEntry.Hash == "":
 		mode = dirReadOnlyMode
 	}
 	return &fsEntry{
 		fullPath: bundleEntry.NameWithPath,
 		hash:     bundleEntry.Hash,
+		target:   bundleEntry.Symlink,
+		xattrs:   bundleEntry.Xattrs,
 		iNode:    id,
 		attributes: fuseops.InodeAttributes{
 			Size:   bundleEntry.Size,
@@ -359,10 +393,42 @@ func (fs *readOnlyFsInternal) populateFS(bundle *Bundle) (*ReadOnlyFS, error) {
 		return *iNode
 	}
 
+	// Hard links share the iNode of the file they link to, they are added once the files are.
+	var files, links []model.BundleEntry
+	linkCounts := make(map[string]uint32)
 	for _, bundleEntry := range fs.bundle.GetBundleEntries() {
+		if bundleEntry.Link != "" {
+			links = append(links, bundleEntry)
+			linkCounts[bundleEntry.Link]++
+			continue
+		}
+		files = append(files, bundleEntry)
+	}
+	iNodes := make(map[string]fuseops.InodeID, len(files))
+
+	for _, bundleEntry := range append(files, links...) {
 		bundleEntry := bundleEntry
+		if bundleEntry.Purged != "" {
+			// the content of the file was purged, it is not downloaded
+			continue
+		}
 		// Generate the fsEntry
-		newFsEntry := newDatamonFSEntry(&bundleEntry, bundle.BundleDescriptor.Timestamp, generateNextINode(&iNode), fileLinkCount)
+		var newFsEntry *fsEntry
+		if bundleEntry.Link != "" {
+			linked, found := iNodes[bundleEntry.Link]
+			if !found {
+				log.Printf("skipped hard link %s to missing %s ", bundleEntry.NameWithPath, bundleEntry.Link)
+				continue
+			}
+			p, _ := fsEntryStoreTxn.Get(formKey(linked))
+			linkFsEntry := p.(fsEntry)
+			linkFsEntry.fullPath = bundleEntry.NameWithPath
+			newFsEntry = &linkFsEntry
+		} else {
+			newFsEntry = newDatamonFSEntry(&bundleEntry, bundle.BundleDescriptor.Timestamp, generateNextINode(&iNode),
+				fileLinkCount+linkCounts[bundleEntry.NameWithPath])
+			iNodes[bundleEntry.NameWithPath] = newFsEntry.iNode
+		}
 
 		// Add parents if first visit
 		// If a parent has been visited, all the parent's parents in the path have been visited
@@ -411,7 +477,9 @@ func (fs *readOnlyFsInternal) populateFS(bundle *Bundle) (*ReadOnlyFS, error) {
 		}
 
 		for _, nodeToAdd := range nodesToAdd {
-			if nodeToAdd.fsEntry.attributes.Nlink == dirLinkCount {
+			_, linked := fsEntryStoreTxn.Get(formKey(nodeToAdd.fsEntry.iNode))
+			switch {
+			case nodeToAdd.fsEntry.attributes.Mode.IsDir():
 				err = fs.insertDatamonFSDirEntry(
 					dirStoreTxn,
 					lookupTreeTxn,
@@ -419,8 +487,13 @@ func (fs *readOnlyFsInternal) populateFS(bundle *Bundle) (*ReadOnlyFS, error) {
 					nodeToAdd.parentINode,
 					nodeToAdd.fsEntry,
 				)
-
-			} else {
+			case linked:
+				fs.insertDatamonFSLink(
+					lookupTreeTxn,
+					nodeToAdd.parentINode,
+					nodeToAdd.fsEntry,
+				)
+			default:
 				err = fs.insertDatamonFSEntry(
 					lookupTreeTxn,
 					fsEntryStoreTxn,
@@ -506,16 +579,32 @@ func (fs *readOnlyFsInternal) insertDatamonFSEntry(
 		return errors.New("lookupTree updates are not expected: " + fsEntry.fullPath)
 	}
 
+	fs.insertDatamonFSDirent(parentInode, fsEntry)
+	return nil
+}
+
+// Insert a hard link to a file already in the fsEntryStore.
+func (fs *readOnlyFsInternal) insertDatamonFSLink(
+	lookupTreeTxn *iradix.Txn,
+	parentInode fuseops.InodeID,
+	fsEntry fsEntry) {
+	lookupTreeTxn.Insert(formLookupKey(parentInode, path.Base(fsEntry.fullPath)), fsEntry)
+	fs.insertDatamonFSDirent(parentInode, fsEntry)
+}
+
+func (fs *readOnlyFsInternal) insertDatamonFSDirent(parentInode fuseops.InodeID, fsEntry fsEntry) {
+	direntType := fuseutil.DT_File
+	if fsEntry.attributes.Mode&os.ModeSymlink != 0 {
+		direntType = fuseutil.DT_Link
+	}
 	childEntries := fs.readDirMap[parentInode]
 	childEntries = append(childEntries, fuseutil.Dirent{
 		Offset: fuseops.DirOffset(len(childEntries) + 1),
 		Inode:  fsEntry.iNode,
 		Name:   path.Base(fsEntry.fullPath),
-		Type:   fuseutil.DT_File,
+		Type:   direntType,
 	})
 	fs.readDirMap[parentInode] = childEntries
-
-	return nil
 }
 
 type readOnlyFsInternal struct {
@@ -551,6 +640,8 @@ type fsEntry struct {
 	iNode      fuseops.InodeID         // Unique ID for Fuse
 	attributes fuseops.InodeAttributes // Fuse Attributes
 	fullPath   string
+	target     string            // Target of a symbolic link
+	xattrs     map[string][]byte // Extended attributes
 }
 
 type fsNodeToAdd struct {
@@ -3,9 +3,12 @@ package core
 import (
 	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -34,9 +37,9 @@ type fsMutable struct {
 	// important.
 	lookupTree *iradix.Tree
 
-	// List of children for a given iNode. Maps inode id to list of children. This stitches the fuse FS together.
+	// List of children for a given iNode. Maps inode id to the children by name. This stitches the fuse FS together.
 	// TODO: This can be based on radix tree as well. Test performance (with locking simplification) and make the change.
-	readDirMap map[fuseops.InodeID]map[fuseops.InodeID]*fuseutil.Dirent
+	readDirMap map[fuseops.InodeID]map[string]*fuseutil.Dirent
 
 	// Cache of backing files.
 	backingFiles map[fuseops.InodeID]*afero.File
@@ -48,10 +51,26 @@ type fsMutable struct {
 	// local fs cache that mirrors the files.
 	localCache afero.Fs
 
+	// The files of the parent bundle, nil without parent.
+	parent *bundleStore
+
+	// The number of changes to the files, to tell whether they changed since a commit.
+	changes uint64
+
+	// Journal of the namespace in the staging directory, to recover the files.
+	journal *journal
+
 	// Logger
 	l *zap.Logger
 }
 
+// Count a change to the files when an operation succeeds.
+func (fs *fsMutable) changed(err *error) {
+	if *err == nil {
+		atomic.AddUint64(&fs.changes, 1)
+	}
+}
+
 func (fs *fsMutable) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
@@ -115,12 +134,16 @@ func (fs *fsMutable) deleteNSEntry(p fuseops.InodeID, c string) error {
 		// Delete the child dir
 		delete(fs.readDirMap, cLE.iNode)
 		pNode.attr.Nlink--
+	} else {
+		cNode.lock.Lock()
+		cNode.attr.Nlink--
+		cNode.lock.Unlock()
 	}
 
 	fs.lookupTree, _, _ = fs.lookupTree.Delete(lk)
 	children := fs.readDirMap[p]
 	// Delete from parent read dir
-	delete(children, cLE.iNode)
+	delete(children, c)
 	return nil
 }
 
@@ -199,21 +222,17 @@ func (fs *fsMutable) SetInodeAttributes(ctx context.Context, op *fuseops.SetInod
 
 	// Set the values
 	if op.Size != nil {
-		// File size can be truncated.
-		file, err := fs.localCache.OpenFile(fmt.Sprint(op.Inode), os.O_WRONLY|os.O_SYNC, fileDefaultMode)
-		if err != nil {
-			fs.l.Error("error", zap.Error(err))
-			return fuse.EIO
-		}
 		if *op.Size > math.MaxInt64 {
 			fs.l.Error("Received size greater than MaxInt64", zap.Uint64("size", *op.Size), zap.Uint64("inode", uint64(op.Inode)))
 			return fuse.EINVAL
 		}
-		err = file.Truncate(int64(*op.Size))
+		// File size can be truncated.
+		err = fs.truncate(op.Inode, n, int64(*op.Size))
 		if err != nil {
 			fs.l.Error("error", zap.Error(err))
 			return fuse.EIO
 		}
+		fs.changed(&err)
 		n.attr.Size = *op.Size
 	}
 
@@ -285,6 +304,7 @@ func (fs *fsMutable) ForgetInode(
 func (fs *fsMutable) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
+	defer fs.changed(&err)
 	fs.l.Info("mkdir", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
 
 	fs.lock.Lock()
@@ -314,6 +334,7 @@ func (fs *fsMutable) MkNode(
 func (fs *fsMutable) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
+	defer fs.changed(&err)
 
 	fs.l.Info("createFile", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
 
@@ -336,28 +357,64 @@ func (fs *fsMutable) CreateFile(
 	return
 }
 
-// No sym link support in datamon
+// Symbolic links are committed with their target, and no content.
 func (fs *fsMutable) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) (err error) {
+	defer fs.changed(&err)
 	fs.l.Info("createSymLink", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
-	err = fuse.ENOSYS
-	return
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lk := formLookupKey(op.Parent, op.Name)
+	if err = fs.preCreateCheck(op.Parent, lk); err != nil {
+		return
+	}
+
+	iNodeID := fs.iNodeGenerator.allocINode()
+	fs.addSymlink(op.Parent, op.Name, iNodeID, op.Target, &op.Entry, time.Now())
+	fs.journal.append(journalEntry{Op: journalSymlink, Parent: op.Parent, Name: op.Name, INode: iNodeID, Target: op.Target})
+	return nil
 }
 
-// no create link support in datamon
+// Hard links are committed as files with the hash of the file they link to.
 func (fs *fsMutable) CreateLink(
 	ctx context.Context,
 	op *fuseops.CreateLinkOp) (err error) {
-	fs.l.Info("createLink", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
-	err = fuse.ENOSYS
-	return
+	defer fs.changed(&err)
+	fs.l.Info("createLink", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name),
+		zap.Uint64("target", uint64(op.Target)))
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	lk := formLookupKey(op.Parent, op.Name)
+	if err = fs.preCreateCheck(op.Parent, lk); err != nil {
+		return
+	}
+
+	n, err := fs.addLink(op.Parent, op.Name, op.Target)
+	if err != nil {
+		return
+	}
+	fs.journal.append(journalEntry{Op: journalLink, Parent: op.Parent, Name: op.Name, INode: op.Target})
+
+	n.lock.Lock()
+	n.refCount++ // As per CreateLinkOp spec
+	op.Entry.Attributes = n.attr
+	n.lock.Unlock()
+	op.Entry.Child = op.Target
+	op.Entry.EntryExpiration = time.Now().Add(cacheYearLong)
+	op.Entry.AttributesExpiration = op.Entry.EntryExpiration
+	return nil
 }
 
 // From man 2 rename:
 // If newpath exists but the operation fails for some reason, rename() guarantees to leave an instance of newpath in place.
 // oldpath can specify a directory.  In this case, newpath must either not exist, or it must specify an empty directory.
 func (fs *fsMutable) Rename(ctx context.Context, op *fuseops.RenameOp) (err error) {
+	defer fs.changed(&err)
 
 	fs.l.Info("rename", zap.Uint64("oldP", uint64(op.OldParent)), zap.String("oldN", op.OldName),
 		zap.Uint64("nP", uint64(op.NewParent)), zap.String("nN", op.NewName))
@@ -366,7 +423,7 @@ func (fs *fsMutable) Rename(ctx context.Context, op *fuseops.RenameOp) (err erro
 	defer fs.lock.Unlock()
 
 	// Find the old child
-	oldChild, found, _ := fs.lookup(op.OldParent, op.OldName)
+	_, found, _ := fs.lookup(op.OldParent, op.OldName)
 	if !found {
 		return fuse.ENOENT
 	}
@@ -380,7 +437,7 @@ func (fs *fsMutable) Rename(ctx context.Context, op *fuseops.RenameOp) (err erro
 	}
 
 	// Insert iNode into new readDir and lookup and remove from old.
-	rC := fs.readDirMap[op.OldParent][oldChild.iNode]
+	rC := fs.readDirMap[op.OldParent][op.OldName]
 
 	newRC := fuseutil.Dirent{
 		Inode: rC.Inode,
@@ -389,31 +446,45 @@ func (fs *fsMutable) Rename(ctx context.Context, op *fuseops.RenameOp) (err erro
 	}
 
 	// Delete from old parent
-	delete(fs.readDirMap[op.OldParent], rC.Inode)
+	delete(fs.readDirMap[op.OldParent], op.OldName)
 	var l interface{}
 	fs.lookupTree, l, _ = fs.lookupTree.Delete(formLookupKey(op.OldParent, op.OldName)) // lookupEntry remains the same
 
 	// Insert into new.
 	fs.insertReadDirEntry(op.NewParent, &newRC)
 	fs.insertLookupEntry(op.NewParent, op.NewName, l.(lookupEntry))
-
+	fs.journal.append(journalEntry{
+		Op:        journalRename,
+		Parent:    op.OldParent,
+		Name:      op.OldName,
+		NewParent: op.NewParent,
+		NewName:   op.NewName,
+	})
 	return nil
 }
 
 func (fs *fsMutable) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
+	defer fs.changed(&err)
 	fs.l.Info("rmdir", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
 
-	return fs.deleteNSEntry(op.Parent, op.Name)
+	if err = fs.deleteNSEntry(op.Parent, op.Name); err == nil {
+		fs.journal.append(journalEntry{Op: journalUnlink, Parent: op.Parent, Name: op.Name})
+	}
+	return
 }
 
 func (fs *fsMutable) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
+	defer fs.changed(&err)
 	fs.l.Info("unlink", zap.Uint64("id", uint64(op.Parent)), zap.String("name", op.Name))
 	// TODO: remove from lookup and readdir
-	return fs.deleteNSEntry(op.Parent, op.Name)
+	if err = fs.deleteNSEntry(op.Parent, op.Name); err == nil {
+		fs.journal.append(journalEntry{Op: journalUnlink, Parent: op.Parent, Name: op.Name})
+	}
+	return
 }
 
 func (fs *fsMutable) OpenDir(
@@ -460,6 +531,22 @@ func (fs *fsMutable) ReadDir(
 	return nil
 }
 
+// Get a node starting from a file of the parent bundle, nil for other nodes.
+func (fs *fsMutable) baseNode(iNode fuseops.InodeID) *nodeEntry {
+	nodeStore, _ := fs.atomicGetReferences()
+	e, found := nodeStore.Get(formKey(iNode))
+	if !found {
+		return nil
+	}
+	n := e.(*nodeEntry)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.base == nil {
+		return nil
+	}
+	return n
+}
+
 func (fs *fsMutable) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
@@ -478,22 +565,59 @@ func (fs *fsMutable) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
 	fs.l.Info("readFile", zap.Uint64("id", uint64(op.Inode)))
+	if n := fs.baseNode(op.Inode); n != nil {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if n.base != nil {
+			t, err := fs.overlay(op.Inode, n)
+			if err != nil {
+				fs.l.Error("error", zap.Error(err))
+				return fuse.EIO
+			}
+			op.BytesRead, err = t.ReadAt(op.Dst, op.Offset)
+			if err != nil && err != io.EOF {
+				fs.l.Error("error", zap.Error(err))
+				return fuse.EIO
+			}
+			return nil
+		}
+	}
 	file, err := fs.localCache.OpenFile(getPathToBackingFile(op.Inode), os.O_RDONLY|os.O_SYNC, fileDefaultMode)
 	if err != nil {
 		return fuse.EIO
 	}
 	fs.backingFiles[op.Inode] = &file
 	op.BytesRead, err = file.ReadAt(op.Dst, op.Offset)
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return fuse.EIO
 	}
-	return
+	return nil
 }
 
 func (fs *fsMutable) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
+	defer fs.changed(&err)
 	fs.l.Info("writeFile", zap.Uint64("id", uint64(op.Inode)))
+	if n := fs.baseNode(op.Inode); n != nil {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if n.base != nil {
+			// Writes go on top of the file of the parent bundle.
+			t, err := fs.overlay(op.Inode, n)
+			if err != nil {
+				fs.l.Error("error", zap.Error(err))
+				return fuse.EIO
+			}
+			if _, err = t.WriteAt(op.Data, op.Offset); err != nil {
+				fs.l.Error("error", zap.Error(err))
+				return fuse.EIO
+			}
+			fs.journal.append(journalEntry{Op: journalWrite, INode: op.Inode, Offset: op.Offset, Length: int64(len(op.Data))})
+			n.attr.Size = uint64(t.Size())
+			return nil
+		}
+	}
 	file, err := fs.localCache.OpenFile(getPathToBackingFile(op.Inode), os.O_WRONLY|os.O_SYNC, fileDefaultMode)
 	if err != nil {
 		return fuse.EIO
@@ -503,6 +627,7 @@ func (fs *fsMutable) WriteFile(
 	if err != nil {
 		return fuse.EIO
 	}
+	fs.journal.append(journalEntry{Op: journalWrite, INode: op.Inode, Offset: op.Offset, Length: int64(len(op.Data))})
 	ne, found := fs.iNodeStore.Get(formKey(op.Inode))
 	if !found {
 		panic("Invalid state inode: not found" + fmt.Sprint(uint64(op.Inode)))
@@ -554,36 +679,90 @@ func (fs *fsMutable) ReleaseFileHandle(
 func (fs *fsMutable) ReadSymlink(
 	ctx context.Context,
 	op *fuseops.ReadSymlinkOp) (err error) {
-	err = fuse.ENOSYS
-	return
+	fs.l.Debug("readSymlink", zap.Uint64("id", uint64(op.Inode)))
+	n := fs.node(op.Inode)
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.attr.Mode&os.ModeSymlink == 0 {
+		return fuse.EINVAL
+	}
+	op.Target = n.target
+	return nil
 }
 
 func (fs *fsMutable) RemoveXattr(
 	ctx context.Context,
 	op *fuseops.RemoveXattrOp) (err error) {
-	err = fuse.ENOSYS
-	return
+	defer fs.changed(&err)
+	fs.l.Debug("removeXattr", zap.Uint64("id", uint64(op.Inode)), zap.String("name", op.Name))
+	n := fs.node(op.Inode)
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err = removeXattr(n, op.Name); err != nil {
+		return
+	}
+	fs.journal.append(journalEntry{Op: journalRemoveXattr, INode: op.Inode, Name: op.Name})
+	return nil
 }
 
 func (fs *fsMutable) GetXattr(
 	ctx context.Context,
 	op *fuseops.GetXattrOp) (err error) {
-	err = fuse.ENOSYS
+	fs.l.Debug("getXattr", zap.Uint64("id", uint64(op.Inode)), zap.String("name", op.Name))
+	n := fs.node(op.Inode)
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	value, found := n.xattrs[op.Name]
+	if !found {
+		return fuse.ENOATTR
+	}
+	op.BytesRead, err = readXattr(op.Dst, value)
 	return
 }
 
 func (fs *fsMutable) ListXattr(
 	ctx context.Context,
 	op *fuseops.ListXattrOp) (err error) {
-	err = fuse.ENOSYS
+	fs.l.Debug("listXattr", zap.Uint64("id", uint64(op.Inode)))
+	n := fs.node(op.Inode)
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	names := make([]string, 0, len(n.xattrs))
+	for name := range n.xattrs {
+		names = append(names, name)
+	}
+	op.BytesRead, err = listXattrs(op.Dst, names)
 	return
 }
 
 func (fs *fsMutable) SetXattr(
 	ctx context.Context,
 	op *fuseops.SetXattrOp) (err error) {
-	err = fuse.ENOSYS
-	return
+	defer fs.changed(&err)
+	fs.l.Debug("setXattr", zap.Uint64("id", uint64(op.Inode)), zap.String("name", op.Name))
+	n := fs.node(op.Inode)
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err = setXattr(n, op.Name, op.Value, op.Flags); err != nil {
+		return
+	}
+	fs.journal.append(journalEntry{Op: journalSetXattr, INode: op.Inode, Name: op.Name, Value: op.Value})
+	return nil
 }
 
 func (fs *fsMutable) Destroy() {
@@ -597,6 +776,38 @@ type commitChans struct {
 	done <-chan struct{}
 }
 
+// Get the content of a file to upload, or the file of the parent bundle it starts from when it was not written.
+func (fs *fsMutable) commitReader(ctx context.Context, iNode fuseops.InodeID) (io.Reader, *model.BundleEntry, error) {
+	if n := fs.baseNode(iNode); n != nil {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if n.base != nil {
+			if n.tFile == nil || !n.tFile.Modified() {
+				if !fs.reusesBlobs() {
+					r, err := fs.parent.Get(ctx, n.base.NameWithPath)
+					return r, nil, err
+				}
+				return nil, n.base, nil
+			}
+			return io.NewSectionReader(n.tFile, 0, n.tFile.Size()), nil, nil
+		}
+	}
+	file, err := fs.localCache.OpenFile(getPathToBackingFile(iNode), os.O_RDONLY|os.O_SYNC, fileDefaultMode)
+	return file, nil, err
+}
+
+// The blobs of the parent bundle are read as blobs of the bundle when they are written alike.
+func (fs *fsMutable) reusesBlobs() bool {
+	bd, pd := &fs.bundle.BundleDescriptor, &fs.parent.bundle.BundleDescriptor
+	if bd.Version != pd.Version || bd.LeafSize != pd.LeafSize || bd.Compression != pd.Compression {
+		return false
+	}
+	if bd.Chunker == nil || pd.Chunker == nil {
+		return bd.Chunker == pd.Chunker
+	}
+	return *bd.Chunker == *pd.Chunker
+}
+
 type commitUploadTask struct {
 	inodeID fuseops.InodeID
 	name    string
@@ -611,8 +822,24 @@ func commitFileUpload(
 	caFs cafs.Fs,
 	uploadTask commitUploadTask) {
 	defer bundleUploadWaitGroup.Done()
-	file, err := fs.localCache.OpenFile(getPathToBackingFile(uploadTask.inodeID),
-		os.O_RDONLY|os.O_SYNC, fileDefaultMode)
+	reader, base, err := fs.commitReader(ctx, uploadTask.inodeID)
+	if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	if base != nil {
+		// The file of the parent bundle was not written, its content is already uploaded.
+		select {
+		case chans.bundleEntry <- model.BundleEntry{
+			Hash:         base.Hash,
+			NameWithPath: uploadTask.name,
+			FileMode:     base.FileMode,
+			Size:         base.Size,
+			Xattrs:       fs.xattrs(uploadTask.inodeID),
+		}:
+		case <-chans.done:
+		}
+		return
+	}
 	if err != nil {
 		select {
 		case chans.error <- err:
@@ -624,7 +851,7 @@ func commitFileUpload(
 		return
 	}
 	// written, key, keys, duplicate, err =
-	written, key, _, _, err := caFs.Put(ctx, file)
+	written, key, _, _, err := caFs.Put(ctx, reader)
 	if err != nil {
 		select {
 		case chans.error <- err:
@@ -640,6 +867,7 @@ func commitFileUpload(
 		NameWithPath: uploadTask.name,
 		FileMode:     0, // #TODO: #35 file mode support
 		Size:         uint64(written),
+		Xattrs:       fs.xattrs(uploadTask.inodeID),
 	}
 	select {
 	case chans.bundleEntry <- be:
@@ -648,6 +876,62 @@ func commitFileUpload(
 
 }
 
+// Commit a symbolic link, it has a target and no content
+func commitSymlink(
+	fs *fsMutable,
+	chans commitChans,
+	bundleUploadWaitGroup *sync.WaitGroup,
+	uploadTask commitUploadTask) {
+	defer bundleUploadWaitGroup.Done()
+	n := fs.node(uploadTask.inodeID)
+	if n == nil {
+		select {
+		case chans.error <- fmt.Errorf("missing node of symbolic link %s", uploadTask.name):
+		case <-chans.done:
+		}
+		return
+	}
+	n.lock.Lock()
+	be := model.BundleEntry{
+		NameWithPath: uploadTask.name,
+		FileMode:     n.attr.Mode,
+		Size:         n.attr.Size,
+		Symlink:      n.target,
+		Xattrs:       copyXattrs(n.xattrs),
+	}
+	n.lock.Unlock()
+	select {
+	case chans.bundleEntry <- be:
+	case <-chans.done:
+	}
+}
+
+// Add the hard links to the files committed, they share the hash of the file they link to
+func commitHardLinks(entries []model.BundleEntry, links map[fuseops.InodeID][]string) []model.BundleEntry {
+	committed := make(map[string]int, len(links))
+	for _, names := range links {
+		committed[names[0]] = -1
+	}
+	for i, e := range entries {
+		if _, ok := committed[e.NameWithPath]; ok {
+			committed[e.NameWithPath] = i
+		}
+	}
+	for _, names := range links {
+		i := committed[names[0]]
+		if i < 0 {
+			continue
+		}
+		for _, name := range names[1:] {
+			e := entries[i]
+			e.NameWithPath = name
+			e.Link = names[0]
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
 /* these are the concurrency primitives used to get bounded concurrency in the
  * directory upload.  the idea of using a buffered channel to set a bounds on concurrency is
  * from, for example, TestTCPSpuriousConnSetupCompletionWithCancel in the stdlib net package.
@@ -688,14 +972,20 @@ func commitUploadDir(
 	bundleUploadWaitGroup *sync.WaitGroup,
 	caFs cafs.Fs,
 	dirUploadSync commitDirUploadSync,
+	dirs map[fuseops.InodeID][]fuseutil.Dirent,
+	links map[fuseops.InodeID][]string,
 	uploadTask commitUploadTask) {
 	defer dirUploadSync.waitGroup.Done()
 	var directoryUploadTasks []commitUploadTask
 	func() {
 		defer func() { <-dirUploadSync.bufferedChanSem }()
 		directoryUploadTasks = make([]commitUploadTask, 0)
-		for currInode, currEnt := range fs.readDirMap[uploadTask.inodeID] {
-			tsk := commitUploadTask{inodeID: currInode, name: uploadTask.name + "/" + currEnt.Name}
+		for _, currEnt := range dirs[uploadTask.inodeID] {
+			tsk := commitUploadTask{inodeID: currEnt.Inode, name: path.Join(uploadTask.name, currEnt.Name)}
+			if names := links[currEnt.Inode]; len(names) > 0 && names[0] != tsk.name {
+				// the other hard links are added with the file they link to
+				continue
+			}
 			switch currEnt.Type {
 			case fuseutil.DT_File:
 				bundleUploadWaitGroup.Add(1)
@@ -706,6 +996,13 @@ func commitUploadDir(
 					bundleUploadWaitGroup,
 					caFs,
 					tsk)
+			case fuseutil.DT_Link:
+				bundleUploadWaitGroup.Add(1)
+				go commitSymlink(
+					fs,
+					chans,
+					bundleUploadWaitGroup,
+					tsk)
 			case fuseutil.DT_Directory:
 				directoryUploadTasks = append(directoryUploadTasks, tsk)
 			default:
@@ -727,6 +1024,8 @@ func commitUploadDir(
 			bundleUploadWaitGroup,
 			caFs,
 			dirUploadSync,
+			dirs,
+			links,
 			dutsk,
 		)
 	}
@@ -737,7 +1036,9 @@ func commitWalkReadDirMap(
 	ctx context.Context,
 	fs *fsMutable,
 	chans commitChans,
-	caFs cafs.Fs) {
+	caFs cafs.Fs,
+	dirs map[fuseops.InodeID][]fuseutil.Dirent,
+	links map[fuseops.InodeID][]string) {
 	// bundle upload wait group: used to wait for all file upload operations to complete
 	bundleUploadWaitGroup := new(sync.WaitGroup)
 	// directory upload wait group: used to wait for all directory upload operations to complete
@@ -759,16 +1060,18 @@ func commitWalkReadDirMap(
 		bundleUploadWaitGroup,
 		caFs,
 		dirUploadSync,
+		dirs,
+		links,
 		commitUploadTask{inodeID: fuseops.RootInodeID, name: ""})
 }
 
-// starting from root, find each file and upload using go routines.
-func (fs *fsMutable) commitImpl(caFs cafs.Fs) error {
+// starting from root, find each file and upload using go routines. Returns the files uploaded, until a failure.
+func (fs *fsMutable) commitImpl(caFs cafs.Fs) ([]model.BundleEntry, error) {
 	fs.l.Info("Commit")
 	/* some sync setup */
 	if fs.bundle.BundleID == "" {
 		if err := fs.bundle.InitializeBundleID(); err != nil {
-			return err
+			return nil, err
 		}
 	}
 	ctx := context.Background() // ??? is this the correct context?
@@ -795,11 +1098,14 @@ func (fs *fsMutable) commitImpl(caFs cafs.Fs) error {
 	 * this thread can use reading from the bundle entry channel to detect whether the walk is finished.
 	 */
 	fs.l.Info("Commit: spinning off goroutines")
+	// the files are committed as they are in the namespace when the commit starts
+	dirs := fs.namespace()
+	links := hardLinks(dirs)
 	go commitWalkReadDirMap(ctx, fs, commitChans{
 		bundleEntry: bundleEntryC,
 		error:       errorC,
 		done:        doneC,
-	}, caFs)
+	}, caFs, dirs, links)
 	fileList := make([]model.BundleEntry, 0)
 	for {
 		var bundleEntry model.BundleEntry
@@ -808,41 +1114,48 @@ func (fs *fsMutable) commitImpl(caFs cafs.Fs) error {
 		case bundleEntry, moreBundleEntries = <-bundleEntryC:
 		case err := <-errorC:
 			// one of the threads has had an error.
-			return err
+			return fileList, err
 		}
 		if !moreBundleEntries {
 			break
 		}
 		fileList = append(fileList, bundleEntry)
 	}
+	fileList = commitHardLinks(fileList, links)
 	fs.l.Info("Commit: goroutines ok.  uploading metadata.")
 	for i := 0; i*bundleEntriesPerFile < len(fileList); i++ {
 		firstIdx := i * bundleEntriesPerFile
 		nextFirstIdx := (i + 1) * bundleEntriesPerFile
 		if nextFirstIdx < len(fileList) {
 			if err := uploadBundleEntriesFileList(ctx, fs.bundle, fileList[firstIdx:nextFirstIdx]); err != nil {
-				return err
+				return fileList, err
 			}
 		} else {
 			if err := uploadBundleEntriesFileList(ctx, fs.bundle, fileList[firstIdx:]); err != nil {
-				return err
+				return fileList, err
 			}
 		}
 	}
+	if err := indexUploadedBundle(ctx, fs.bundle, fileList, func(k cafs.Key) ([]cafs.Key, error) {
+		return caFs.Leaves(ctx, k)
+	}); err != nil {
+		return fileList, err
+	}
 	if err := uploadBundleDescriptor(ctx, fs.bundle); err != nil {
-		return err
+		return fileList, err
 	}
 	fs.l.Info("Commit: ok.")
-	return nil
+	return fileList, nil
 }
 
-func (fs *fsMutable) Commit() error {
-	caFs, err := cafs.New(
-		cafs.LeafSize(fs.bundle.BundleDescriptor.LeafSize),
-		cafs.Backend(fs.bundle.BlobStore),
-	)
+func (fs *fsMutable) Commit() ([]model.BundleEntry, error) {
+	opts, err := blobWriteOptions(&fs.bundle.BundleDescriptor)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	caFs, err := cafs.New(append(opts, cafs.Backend(fs.bundle.BlobStore))...)
+	if err != nil {
+		return nil, err
 	}
 	return fs.commitImpl(caFs)
 }
@@ -1,8 +1,13 @@
 package core
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -11,11 +16,17 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 
 	"github.com/jacobsa/fuse/fuseutil"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
 )
 
 type LookupKeys struct {
@@ -45,7 +56,7 @@ func TestCreate(t *testing.T) {
 		bundle:     nil,
 		iNodeStore: iradix.New(),
 		lookupTree: iradix.New(),
-		readDirMap: make(map[fuseops.InodeID]map[fuseops.InodeID]*fuseutil.Dirent),
+		readDirMap: make(map[fuseops.InodeID]map[string]*fuseutil.Dirent),
 		lock:       sync.Mutex{},
 		iNodeGenerator: iNodeGenerator{
 			lock:         sync.Mutex{},
@@ -139,7 +150,7 @@ func validateChild(t *testing.T, name string, fs *fsMutable, parent fuseops.Inod
 		Name:   name,
 		Type:   nodeType,
 	}
-	child := fs.readDirMap[firstINode][childID]
+	child := fs.readDirMap[firstINode][name]
 	assert.Equal(t, childCount, len(fs.readDirMap[firstINode]))
 	assert.Equal(t, exDE.Inode, child.Inode)
 	assert.Equal(t, exDE.Name, child.Name)
@@ -152,3 +163,462 @@ func validateChild(t *testing.T, name string, fs *fsMutable, parent fuseops.Inod
 
 	// TODO: Add timestamp checks
 }
+
+func readEntry(t *testing.T, bundle *Bundle, e model.BundleEntry) []byte {
+	f, err := openBundleEntry(context.Background(), bundle, e)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return data
+}
+
+func TestMutableFSFrom(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	keep := testContent(2, 0)
+	edit := testContent(2, 1)
+	parent := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"a/b/keep": keep,
+		"a/edit":   edit,
+		"cut":      []byte("content to cut"),
+	})
+	staging, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	bundle := New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+	dfs, err := NewMutableFSFrom(ctx, bundle, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(parent.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	), staging)
+	require.NoError(t, err)
+	fs := dfs.fsInternal
+
+	// the files of the parent are read from the blob store until they are written
+	lookUp := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	require.NoError(t, fs.LookUpInode(ctx, &lookUp))
+	lookUp = fuseops.LookUpInodeOp{Parent: lookUp.Entry.Child, Name: "edit"}
+	require.NoError(t, fs.LookUpInode(ctx, &lookUp))
+	file := lookUp.Entry.Child
+	require.Equal(t, uint64(len(edit)), lookUp.Entry.Attributes.Size)
+	read := fuseops.ReadFileOp{Inode: file, Offset: 5, Dst: make([]byte, 10)}
+	require.NoError(t, fs.ReadFile(ctx, &read))
+	require.Equal(t, edit[5:15], read.Dst[:read.BytesRead])
+
+	patch := []byte("patched")
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file, Offset: 10, Data: patch}))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: file, Offset: int64(len(edit)), Data: patch}))
+	expected := append(append([]byte{}, edit...), patch...)
+	copy(expected[10:], patch)
+	read = fuseops.ReadFileOp{Inode: file, Offset: 0, Dst: make([]byte, len(expected)+10)}
+	require.NoError(t, fs.ReadFile(ctx, &read))
+	require.Equal(t, expected, read.Dst[:read.BytesRead])
+
+	create := fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "new"}
+	require.NoError(t, fs.CreateFile(ctx, &create))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("new content")}))
+
+	// files of the parent are truncated through their overlay, extending them leaves a hole of zeros
+	lookUp = fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "cut"}
+	require.NoError(t, fs.LookUpInode(ctx, &lookUp))
+	for _, size := range []uint64{7, 9} {
+		size := size
+		require.NoError(t, fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{Inode: lookUp.Entry.Child, Size: &size}))
+	}
+
+	require.NoError(t, dfs.Commit())
+	require.Equal(t, []string{parent.BundleID}, bundle.BundleDescriptor.Parents)
+	committed := New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(dfs.BundleID()),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	)
+	require.NoError(t, PopulateFiles(ctx, committed))
+	require.Equal(t, []string{parent.BundleID}, committed.BundleDescriptor.Parents)
+	entries := make(map[string]model.BundleEntry)
+	for _, e := range committed.BundleEntries {
+		entries[e.NameWithPath] = e
+	}
+	require.Len(t, entries, 4)
+	for _, e := range parent.BundleEntries {
+		if e.NameWithPath == "a/b/keep" {
+			// untouched files keep the content of the parent
+			require.Equal(t, e.Hash, entries["a/b/keep"].Hash)
+		}
+	}
+	require.Equal(t, keep, readEntry(t, committed, entries["a/b/keep"]))
+	require.Equal(t, uint64(len(expected)), entries["a/edit"].Size)
+	require.Equal(t, expected, readEntry(t, committed, entries["a/edit"]))
+	require.Equal(t, []byte("new content"), readEntry(t, committed, entries["new"]))
+	require.Equal(t, []byte("content\x00\x00"), readEntry(t, committed, entries["cut"]))
+}
+
+func TestMutableFSFrom_BlobParameters(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	keep := testContent(2, 3)
+	commit := func(parent *Bundle) (*Bundle, bool) {
+		staging, err := ioutil.TempDir("", "staging")
+		require.NoError(t, err)
+		defer os.RemoveAll(staging)
+		bundle := New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+		dfs, err := NewMutableFSFrom(ctx, bundle, New(NewBDescriptor(),
+			Repo(repo),
+			BundleID(parent.BundleID),
+			MetaStore(metaStore),
+			BlobStore(blobStore),
+		), staging)
+		require.NoError(t, err)
+		reused := dfs.fsInternal.reusesBlobs()
+		require.NoError(t, dfs.Commit())
+		committed := New(NewBDescriptor(),
+			Repo(repo),
+			BundleID(dfs.BundleID()),
+			MetaStore(metaStore),
+			BlobStore(blobStore),
+		)
+		require.NoError(t, PopulateFiles(ctx, committed))
+		require.Len(t, committed.BundleEntries, 1)
+		require.Equal(t, keep, readEntry(t, committed, committed.BundleEntries[0]))
+		return committed, reused
+	}
+
+	// the blobs are written like those of the parent, untouched files keep them
+	compressed := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"keep": keep}, Compression(cafs.GzipCompression))
+	committed, reused := commit(compressed)
+	require.True(t, reused)
+	require.Equal(t, cafs.GzipCompression, committed.BundleDescriptor.Compression)
+	require.Equal(t, compressed.BundleEntries[0].Hash, committed.BundleEntries[0].Hash)
+
+	// the files of a bundle of another version are uploaded again
+	keep = keep[:cafs.DefaultLeafSize/2]
+	v0 := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"keep": keep}, func(bd *model.BundleDescriptor) {
+		bd.Version = 0
+	})
+	committed, reused = commit(v0)
+	require.False(t, reused)
+	require.Equal(t, uint64(model.CurrentBundleVersion), committed.BundleDescriptor.Version)
+}
+
+func TestMutableFS_Commits(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	parent := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"file": []byte("parent")})
+	staging, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	bundle := New(NewBDescriptor(Message("mounted")), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+	dfs, err := NewMutableFSFrom(ctx, bundle, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(parent.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	), staging)
+	require.NoError(t, err)
+	fs := dfs.fsInternal
+	require.False(t, dfs.Dirty())
+
+	create := fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "new"}
+	require.NoError(t, fs.CreateFile(ctx, &create))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("first")}))
+	require.True(t, dfs.Dirty())
+
+	// a failed commit is saved to the staging directory, with the files uploaded
+	bundle.MetaStore = localfs.New(afero.NewReadOnlyFs(afero.NewMemMapFs()))
+	require.Error(t, dfs.CommitMessage("failing"))
+	status := dfs.Status()
+	require.True(t, status.Dirty)
+	require.Empty(t, status.Bundles)
+	require.NotEmpty(t, status.LastError)
+	require.Len(t, status.FailedCommits, 1)
+	data, err := ioutil.ReadFile(filepath.Join(staging, status.FailedCommits[0]))
+	require.NoError(t, err)
+	var failed FailedCommit
+	require.NoError(t, yaml.Unmarshal(data, &failed))
+	require.Equal(t, repo, failed.Repo)
+	require.Equal(t, "failing", failed.Bundle.Message)
+	require.Equal(t, []string{parent.BundleID}, failed.Bundle.Parents)
+	require.Len(t, failed.Entries, 2)
+
+	// each commit is a new bundle, with the message of the last commit by default
+	bundle.MetaStore = metaStore
+	require.NoError(t, dfs.CommitMessage("first"))
+	first := dfs.BundleID()
+	require.False(t, dfs.Dirty())
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("second")}))
+	require.True(t, dfs.Dirty())
+	require.NoError(t, dfs.Commit())
+	second := dfs.BundleID()
+	require.NotEqual(t, first, second)
+	status = dfs.Status()
+	require.Equal(t, []string{first, second}, status.Bundles)
+	require.False(t, status.Dirty)
+	require.Empty(t, status.LastError)
+	require.Equal(t, repo, status.Repo)
+
+	// each bundle has the bundle of the previous commit as parent
+	for _, c := range []struct {
+		id, message, parent string
+	}{{first, "first", parent.BundleID}, {second, "first", first}} {
+		committed := New(NewBDescriptor(), Repo(repo), BundleID(c.id), MetaStore(metaStore), BlobStore(blobStore))
+		require.NoError(t, PopulateFiles(ctx, committed))
+		require.Equal(t, c.message, committed.BundleDescriptor.Message)
+		require.Equal(t, []string{c.parent}, committed.BundleDescriptor.Parents)
+		require.Len(t, committed.BundleEntries, 2)
+	}
+}
+
+func TestMutableFS_CommitWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{
+		Name:        repo,
+		Description: "test",
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	}, metaStore))
+	staging, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+	bundle := New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+	dfs, err := NewMutableFS(bundle, staging)
+	require.NoError(t, err)
+	fs := dfs.fsInternal
+	dir := fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	require.NoError(t, fs.MkDir(ctx, &dir))
+	create := fuseops.CreateFileOp{Parent: dir.Entry.Child, Name: "committed"}
+	require.NoError(t, fs.CreateFile(ctx, &create))
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: create.Entry.Child, Data: []byte("content")}))
+
+	// the files created while committing are left for the next commit
+	committed := make(chan error)
+	go func() {
+		committed <- dfs.Commit()
+	}()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, fs.CreateFile(ctx, &fuseops.CreateFileOp{Parent: dir.Entry.Child, Name: strconv.Itoa(i)}))
+	}
+	require.NoError(t, <-committed)
+	bundle = New(NewBDescriptor(), Repo(repo), BundleID(dfs.BundleID()), MetaStore(metaStore), BlobStore(blobStore))
+	require.NoError(t, PopulateFiles(ctx, bundle))
+	names := make(map[string]bool)
+	for _, e := range bundle.BundleEntries {
+		names[e.NameWithPath] = true
+	}
+	require.True(t, names["dir/committed"])
+}
+
+func lookUpMutable(t *testing.T, fs *fsMutable, parent fuseops.InodeID, names ...string) fuseops.ChildInodeEntry {
+	var op fuseops.LookUpInodeOp
+	for _, name := range names {
+		op = fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		require.NoError(t, fs.LookUpInode(context.Background(), &op))
+		parent = op.Entry.Child
+	}
+	return op.Entry
+}
+
+func TestMutableFS_LinksAndXattrs(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	parent := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a/file": []byte("content")})
+	staging, err := ioutil.TempDir("", "staging")
+	require.NoError(t, err)
+	defer os.RemoveAll(staging)
+
+	bundle := New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore))
+	dfs, err := NewMutableFSFrom(ctx, bundle, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(parent.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	), staging)
+	require.NoError(t, err)
+	fs := dfs.fsInternal
+	a := lookUpMutable(t, fs, fuseops.RootInodeID, "a").Child
+	file := lookUpMutable(t, fs, a, "file").Child
+
+	symlink := fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: "a/file"}
+	require.NoError(t, fs.CreateSymlink(ctx, &symlink))
+	require.Equal(t, os.FileMode(symlinkMode), symlink.Entry.Attributes.Mode)
+	require.Equal(t, fuse.EEXIST, fs.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "link"}))
+	readLink := fuseops.ReadSymlinkOp{Inode: symlink.Entry.Child}
+	require.NoError(t, fs.ReadSymlink(ctx, &readLink))
+	require.Equal(t, "a/file", readLink.Target)
+
+	// hard links in the same directory and in others share the node
+	for _, link := range []struct {
+		parent fuseops.InodeID
+		name   string
+	}{{a, "same"}, {a, "gone"}, {fuseops.RootInodeID, "other"}} {
+		op := fuseops.CreateLinkOp{Parent: link.parent, Name: link.name, Target: file}
+		require.NoError(t, fs.CreateLink(ctx, &op))
+		require.Equal(t, file, op.Entry.Child)
+	}
+	require.Error(t, fs.CreateLink(ctx, &fuseops.CreateLinkOp{Parent: fuseops.RootInodeID, Name: "dir", Target: a}))
+	require.NoError(t, fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: a, Name: "gone"}))
+	require.Equal(t, uint32(3), lookUpMutable(t, fs, fuseops.RootInodeID, "other").Attributes.Nlink)
+	require.NoError(t, fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: lookUpMutable(t, fs, a, "same").Child, Data: []byte("C")}))
+
+	value := []byte{0xff, 0, 'v'}
+	require.NoError(t, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: file, Name: "user.value", Value: value}))
+	require.NoError(t, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: file, Name: "user.removed", Value: []byte("x")}))
+	require.NoError(t, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: symlink.Entry.Child, Name: "user.link", Value: []byte("l")}))
+	require.Equal(t, fuse.EEXIST, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: file, Name: "user.value", Flags: xattrCreate}))
+	require.Equal(t, fuse.ENOATTR, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: file, Name: "user.missing", Flags: xattrReplace}))
+	// bundles have no entries for directories to keep them in
+	require.Equal(t, syscall.ENOTSUP, fs.SetXattr(ctx, &fuseops.SetXattrOp{Inode: a, Name: "user.dir", Value: []byte("d")}))
+	require.Equal(t, fuse.ENOATTR, fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: a, Name: "user.dir"}))
+	require.NoError(t, fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: file, Name: "user.removed"}))
+	require.Equal(t, fuse.ENOATTR, fs.RemoveXattr(ctx, &fuseops.RemoveXattrOp{Inode: file, Name: "user.removed"}))
+
+	// an empty destination queries the size of the value
+	get := fuseops.GetXattrOp{Inode: file, Name: "user.value"}
+	require.Equal(t, syscall.ERANGE, fs.GetXattr(ctx, &get))
+	require.Equal(t, len(value), get.BytesRead)
+	get = fuseops.GetXattrOp{Inode: file, Name: "user.value", Dst: make([]byte, 10)}
+	require.NoError(t, fs.GetXattr(ctx, &get))
+	require.Equal(t, value, get.Dst[:get.BytesRead])
+	require.Equal(t, fuse.ENOATTR, fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: file, Name: "user.removed"}))
+	list := fuseops.ListXattrOp{Inode: file, Dst: make([]byte, 100)}
+	require.NoError(t, fs.ListXattr(ctx, &list))
+	require.Equal(t, "user.value\x00", string(list.Dst[:list.BytesRead]))
+
+	require.NoError(t, dfs.Commit())
+	committed := New(NewBDescriptor(), Repo(repo), BundleID(dfs.BundleID()), MetaStore(metaStore), BlobStore(blobStore))
+	require.NoError(t, PopulateFiles(ctx, committed))
+	entries := make(map[string]model.BundleEntry)
+	for _, e := range committed.BundleEntries {
+		entries[e.NameWithPath] = e
+	}
+	require.Len(t, entries, 4)
+	require.Equal(t, "a/file", entries["link"].Symlink)
+	require.Empty(t, entries["link"].Hash)
+	require.Equal(t, map[string][]byte{"user.link": []byte("l")}, entries["link"].Xattrs)
+	require.Equal(t, []byte("Content"), readEntry(t, committed, entries["a/file"]))
+	require.Equal(t, map[string][]byte{"user.value": value}, entries["a/file"].Xattrs)
+	require.Empty(t, entries["a/file"].Link)
+	for _, name := range []string{"a/same", "other"} {
+		require.Equal(t, "a/file", entries[name].Link)
+		require.Equal(t, entries["a/file"].Hash, entries[name].Hash)
+	}
+
+	// the read only filesystem exposes them back
+	ro, err := NewReadOnlyFS(ctx, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(committed.BundleID),
+		MetaStore(metaStore),
+		ConsumableStore(localfs.New(afero.NewMemMapFs())),
+		BlobStore(blobStore),
+	))
+	require.NoError(t, err)
+	rofs := ro.fsInternal
+	roLookUp := func(parent fuseops.InodeID, name string) fuseops.ChildInodeEntry {
+		op := fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		require.NoError(t, rofs.LookUpInode(ctx, &op))
+		return op.Entry
+	}
+	roLink := roLookUp(fuseops.RootInodeID, "link")
+	require.Equal(t, os.FileMode(symlinkMode), roLink.Attributes.Mode)
+	readLink = fuseops.ReadSymlinkOp{Inode: roLink.Child}
+	require.NoError(t, rofs.ReadSymlink(ctx, &readLink))
+	require.Equal(t, "a/file", readLink.Target)
+	roA := roLookUp(fuseops.RootInodeID, "a").Child
+	roFile := roLookUp(roA, "file")
+	require.Equal(t, uint32(3), roFile.Attributes.Nlink)
+	require.Equal(t, roFile.Child, roLookUp(roA, "same").Child)
+	require.Equal(t, roFile.Child, roLookUp(fuseops.RootInodeID, "other").Child)
+	get = fuseops.GetXattrOp{Inode: roFile.Child, Name: "user.value", Dst: make([]byte, 10)}
+	require.NoError(t, rofs.GetXattr(ctx, &get))
+	require.Equal(t, value, get.Dst[:get.BytesRead])
+	list = fuseops.ListXattrOp{Inode: roLink.Child, Dst: make([]byte, 100)}
+	require.NoError(t, rofs.ListXattr(ctx, &list))
+	require.Equal(t, "user.datamon.bundle\x00user.datamon.leafsize\x00user.datamon.repo\x00user.link\x00",
+		string(list.Dst[:list.BytesRead]))
+	require.Equal(t, fuse.ENOATTR, rofs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: roA, Name: "user.dir"}))
+
+	// the namespace is recovered from the journal
+	recovered, err := RecoverMutableFS(ctx, staging, metaStore, blobStore)
+	require.NoError(t, err)
+	require.False(t, recovered.Dirty())
+	rfs := recovered.fsInternal
+	readLink = fuseops.ReadSymlinkOp{Inode: lookUpMutable(t, rfs, fuseops.RootInodeID, "link").Child}
+	require.NoError(t, rfs.ReadSymlink(ctx, &readLink))
+	require.Equal(t, "a/file", readLink.Target)
+	require.Equal(t, file, lookUpMutable(t, rfs, fuseops.RootInodeID, "other").Child)
+	require.Equal(t, uint32(3), lookUpMutable(t, rfs, a, "same").Attributes.Nlink)
+	require.Equal(t, map[string][]byte{"user.value": value}, rfs.xattrs(file))
+	require.NoError(t, recovered.Close())
+
+	// mutable filesystems seeded from the bundle start with them
+	seeded, err := NewMutableFSFrom(ctx, New(NewBDescriptor(), Repo(repo), MetaStore(metaStore), BlobStore(blobStore)),
+		New(NewBDescriptor(), Repo(repo), BundleID(committed.BundleID), MetaStore(metaStore), BlobStore(blobStore)),
+		staging)
+	require.NoError(t, err)
+	sfs := seeded.fsInternal
+	sFile := lookUpMutable(t, sfs, fuseops.RootInodeID, "a", "file")
+	require.Equal(t, uint32(3), sFile.Attributes.Nlink)
+	require.Equal(t, sFile.Child, lookUpMutable(t, sfs, fuseops.RootInodeID, "other").Child)
+	require.Equal(t, map[string][]byte{"user.value": value}, sfs.xattrs(sFile.Child))
+	readLink = fuseops.ReadSymlinkOp{Inode: lookUpMutable(t, sfs, fuseops.RootInodeID, "link").Child}
+	require.NoError(t, sfs.ReadSymlink(ctx, &readLink))
+	require.Equal(t, "a/file", readLink.Target)
+	require.False(t, seeded.Dirty())
+	require.NoError(t, seeded.Close())
+}
+
+func TestReadOnlyFS_Xattrs(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	data := testContent(2, 0)
+	uploaded := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a/file": data})
+	ro, err := NewReadOnlyFS(ctx, New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(uploaded.BundleID),
+		MetaStore(metaStore),
+		ConsumableStore(localfs.New(afero.NewMemMapFs())),
+		BlobStore(blobStore),
+	))
+	require.NoError(t, err)
+	fs := ro.fsInternal
+	lookUp := fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "a"}
+	require.NoError(t, fs.LookUpInode(ctx, &lookUp))
+	dir := lookUp.Entry.Child
+	lookUp = fuseops.LookUpInodeOp{Parent: dir, Name: "file"}
+	require.NoError(t, fs.LookUpInode(ctx, &lookUp))
+	file := lookUp.Entry.Child
+
+	getXattr := func(iNode fuseops.InodeID, name string) string {
+		op := fuseops.GetXattrOp{Inode: iNode, Name: name, Dst: make([]byte, 256)}
+		require.NoError(t, fs.GetXattr(ctx, &op), name)
+		return string(op.Dst[:op.BytesRead])
+	}
+	require.Equal(t, uploaded.BundleEntries[0].Hash, getXattr(file, xattrHash))
+	require.Equal(t, uploaded.BundleID, getXattr(file, xattrBundle))
+	require.Equal(t, repo, getXattr(file, xattrRepo))
+	require.Equal(t, strconv.Itoa(len(data)), getXattr(file, xattrSize))
+	require.Equal(t, strconv.Itoa(int(uploaded.BundleDescriptor.LeafSize)), getXattr(file, xattrLeafSize))
+
+	// directories have the provenance of the bundle, and no content
+	for _, iNode := range []fuseops.InodeID{fuseops.RootInodeID, dir} {
+		require.Equal(t, uploaded.BundleID, getXattr(iNode, xattrBundle))
+		require.Equal(t, fuse.ENOATTR, fs.GetXattr(ctx, &fuseops.GetXattrOp{Inode: iNode, Name: xattrHash}))
+	}
+	list := fuseops.ListXattrOp{Inode: dir, Dst: make([]byte, 256)}
+	require.NoError(t, fs.ListXattr(ctx, &list))
+	require.Equal(t, "user.datamon.bundle\x00user.datamon.leafsize\x00user.datamon.repo\x00", string(list.Dst[:list.BytesRead]))
+	list = fuseops.ListXattrOp{Inode: file}
+	require.Equal(t, syscall.ERANGE, fs.ListXattr(ctx, &list))
+	require.Equal(t, len("user.datamon.bundle user.datamon.hash user.datamon.leafsize user.datamon.repo user.datamon.size "),
+		list.BytesRead)
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// CollectGarbage deletes the blobs which are not used by any bundle of any repo, and their entries in the reference index.
+//
+// The blobs in use are found from the file lists of the bundles, then every blob of the store is checked.
+// Uploads must not run during the collection: the blobs of a bundle which is not complete yet are not
+// in use, and would be deleted. deleted is called for every blob deleted, or which would be in a dry run.
+func CollectGarbage(ctx context.Context, metaStore, blobStore storage.Store, dryRun bool, deleted func(cafs.Key)) error {
+	live, err := liveBlobs(ctx, metaStore, blobStore)
+	if err != nil {
+		return err
+	}
+
+	var (
+		lock  sync.Mutex
+		swept []cafs.Key
+	)
+	err = cafs.Sweep(ctx, blobStore, "", func(k cafs.Key) bool {
+		return live[k]
+	}, dryRun, func(k cafs.Key) {
+		lock.Lock()
+		swept = append(swept, k)
+		lock.Unlock()
+		if deleted != nil {
+			deleted(k)
+		}
+	})
+	if err != nil || dryRun {
+		return err
+	}
+
+	var stale []string
+	for _, k := range swept {
+		for _, prefix := range []string{
+			model.GetArchivePathPrefixToRootReferences(k.String()),
+			model.GetArchivePathPrefixToLeafReferences(k.String()),
+		} {
+			refs, err := listKeysPrefix(ctx, metaStore, prefix)
+			if err != nil {
+				return err
+			}
+			stale = append(stale, refs...)
+		}
+	}
+	err = forEach(len(stale), func(i int) error {
+		return metaStore.Delete(ctx, stale[i])
+	})
+	if err != nil {
+		return fmt.Errorf("removing deleted blobs from the index: %v", err)
+	}
+	return nil
+}
+
+// liveBlobs returns the root keys used by the files of all bundles, and their leaves
+func liveBlobs(ctx context.Context, metaStore, blobStore storage.Store) (map[cafs.Key]bool, error) {
+	repos, err := listRepoNames(ctx, metaStore)
+	if err != nil {
+		return nil, err
+	}
+	// the leaf size is needed to read the root objects
+	roots := make(map[cafs.Key]uint32)
+	for _, repo := range repos {
+		bundleIDs, err := listBundleIDs(ctx, repo, metaStore)
+		if err != nil {
+			return nil, err
+		}
+		for _, bundleID := range bundleIDs {
+			bundle := New(NewBDescriptor(), Repo(repo), BundleID(bundleID), MetaStore(metaStore))
+			if err = PopulateFiles(ctx, bundle); err != nil {
+				return nil, err
+			}
+			for _, e := range bundle.BundleEntries {
+				if e.Purged != "" || e.Symlink != "" {
+					continue
+				}
+				key, err := cafs.KeyFromString(e.Hash)
+				if err != nil {
+					return nil, fmt.Errorf("file %s of bundle %s in repo %s: %v", e.NameWithPath, bundleID, repo, err)
+				}
+				roots[key] = bundle.BundleDescriptor.LeafSize
+			}
+		}
+	}
+
+	filesystems := make(map[uint32]cafs.Fs)
+	keys := make([]cafs.Key, 0, len(roots))
+	for key, leafSize := range roots {
+		if filesystems[leafSize] == nil {
+			fs, err := cafs.New(cafs.LeafSize(leafSize), cafs.Backend(blobStore))
+			if err != nil {
+				return nil, err
+			}
+			filesystems[leafSize] = fs
+		}
+		keys = append(keys, key)
+	}
+
+	var lock sync.Mutex
+	live := make(map[cafs.Key]bool, len(roots))
+	err = forEach(len(keys), func(i int) error {
+		fs := filesystems[roots[keys[i]]]
+		found, _, err := fs.Has(ctx, keys[i])
+		if err != nil || !found {
+			return err
+		}
+		leaves, err := fs.Leaves(ctx, keys[i])
+		if err != nil {
+			return fmt.Errorf("leaves of %s: %v", keys[i], err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		live[keys[i]] = true
+		for _, leaf := range leaves {
+			live[leaf] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return live, nil
+}
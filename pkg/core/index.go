@@ -0,0 +1,227 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+const indexConcurrency = 32
+
+// indexBundleFiles records the blobs used by the files of a bundle in the reference index.
+// leaves returns the leaf keys of a root key.
+func indexBundleFiles(
+	ctx context.Context,
+	store storage.Store,
+	repo, bundleID string,
+	entries []model.BundleEntry,
+	leaves func(cafs.Key) ([]cafs.Key, error),
+) error {
+	paths := make(map[string][]string)
+	for _, e := range entries {
+		if e.Symlink != "" {
+			// symbolic links have no content
+			continue
+		}
+		paths[e.Hash] = append(paths[e.Hash], e.NameWithPath)
+	}
+	roots := make([]string, 0, len(paths))
+	for root := range paths {
+		roots = append(roots, root)
+	}
+
+	return forEach(len(roots), func(i int) error {
+		root := roots[i]
+		buffer, err := yaml.Marshal(model.BlobReference{
+			Root:     root,
+			Repo:     repo,
+			BundleID: bundleID,
+			Paths:    paths[root],
+		})
+		if err != nil {
+			return err
+		}
+		err = store.Put(ctx, model.GetArchivePathToRootReference(root, repo, bundleID), bytes.NewReader(buffer), storage.OverWrite)
+		if err != nil {
+			return err
+		}
+		key, err := cafs.KeyFromString(root)
+		if err != nil {
+			return err
+		}
+		leafKeys, err := leaves(key)
+		if err != nil {
+			return fmt.Errorf("leaves of %s: %v", root, err)
+		}
+		for _, leaf := range leafKeys {
+			err = store.Put(ctx, model.GetArchivePathToLeafReference(leaf.String(), root), bytes.NewReader(nil), storage.OverWrite)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// indexUploadedBundle adds a bundle which is being uploaded to the reference index.
+// It runs before the bundle descriptor is written: when the upload fails after it,
+// the index refers to a bundle which does not exist until it is rebuilt.
+func indexUploadedBundle(ctx context.Context, bundle *Bundle, entries []model.BundleEntry, leaves func(cafs.Key) ([]cafs.Key, error)) error {
+	err := indexBundleFiles(ctx, bundle.MetaStore, bundle.RepoID, bundle.BundleID, entries, leaves)
+	if err != nil {
+		return fmt.Errorf("adding bundle %s to the reference index: %v", bundle.BundleID, err)
+	}
+	return nil
+}
+
+// FindBlobReferences returns the files of all bundles using a blob, from the reference index.
+// The key is either the root key of a file, or the key of one of its leaves.
+func FindBlobReferences(ctx context.Context, key string, store storage.Store) ([]model.BlobReference, error) {
+	roots, err := leafRoots(ctx, store, key)
+	if err != nil {
+		return nil, err
+	}
+	var refs []model.BlobReference
+	for _, root := range append([]string{key}, roots...) {
+		rootRefs, err := rootReferences(ctx, store, root)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, rootRefs...)
+	}
+	return refs, nil
+}
+
+// rootReferences returns the files of all bundles stored under a root key
+func rootReferences(ctx context.Context, store storage.Store, root string) ([]model.BlobReference, error) {
+	paths, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToRootReferences(root))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]model.BlobReference, 0, len(paths))
+	for _, path := range paths {
+		var ref model.BlobReference
+		if err = getYaml(ctx, store, path, &ref); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// leafRoots returns the root keys using a leaf key
+func leafRoots(ctx context.Context, store storage.Store, leaf string) ([]string, error) {
+	paths, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToLeafReferences(leaf))
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]string, 0, len(paths))
+	for _, path := range paths {
+		roots = append(roots, path[strings.LastIndex(path, "/")+1:])
+	}
+	return roots, nil
+}
+
+// getYaml reads a yaml object of the store into v
+func getYaml(ctx context.Context, store storage.Store, path string, v interface{}) error {
+	r, err := store.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	o, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(o, v)
+}
+
+// RebuildIndex rebuilds the reference index from the file lists of all the bundles.
+//
+// The existing index is dropped first, lookups are incomplete until the rebuild is done.
+func RebuildIndex(ctx context.Context, metaStore, blobStore storage.Store, indexed func(repo, bundleID string)) error {
+	stale, err := listKeysPrefix(ctx, metaStore, model.GetArchivePathPrefixToIndex())
+	if err != nil {
+		return err
+	}
+	err = forEach(len(stale), func(i int) error {
+		return metaStore.Delete(ctx, stale[i])
+	})
+	if err != nil {
+		return fmt.Errorf("dropping the index: %v", err)
+	}
+
+	repos, err := listRepoNames(ctx, metaStore)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		bundleIDs, err := listBundleIDs(ctx, repo, metaStore)
+		if err != nil {
+			return err
+		}
+		for _, bundleID := range bundleIDs {
+			bundle := New(NewBDescriptor(),
+				Repo(repo),
+				BundleID(bundleID),
+				MetaStore(metaStore),
+				BlobStore(blobStore),
+			)
+			if err = PopulateFiles(ctx, bundle); err != nil {
+				return err
+			}
+			fs, err := cafs.New(
+				cafs.LeafSize(bundle.BundleDescriptor.LeafSize),
+				cafs.Backend(blobStore),
+			)
+			if err != nil {
+				return err
+			}
+			err = indexBundleFiles(ctx, metaStore, repo, bundleID, bundle.BundleEntries, func(k cafs.Key) ([]cafs.Key, error) {
+				return fs.Leaves(ctx, k)
+			})
+			if err != nil {
+				return fmt.Errorf("indexing bundle %s of repo %s: %v", bundleID, repo, err)
+			}
+			if indexed != nil {
+				indexed(repo, bundleID)
+			}
+		}
+	}
+	return nil
+}
+
+// listKeysPrefix lists all the keys with the prefix, going through all the pages
+func listKeysPrefix(ctx context.Context, store storage.Store, prefix string) ([]string, error) {
+	var (
+		keys  []string
+		token string
+	)
+	for {
+		page, next, err := store.KeysPrefix(ctx, token, prefix, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			sort.Strings(keys)
+			return keys, nil
+		}
+		token = next
+	}
+}
+
+// forEach runs do for 0 to n-1 with bounded concurrency, and returns the first error
+func forEach(n int, do func(int) error) error {
+	return internal.Parallel(n, indexConcurrency, do)
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadTestBundle uploads files to a new bundle of the test repo, and returns it with its entries
+func uploadTestBundle(t *testing.T, metaStore, blobStore storage.Store, files map[string][]byte, opts ...BundleDescriptorOption) *Bundle {
+	ctx := context.Background()
+	consumableStore := localfs.New(afero.NewMemMapFs())
+	for name, data := range files {
+		require.NoError(t, consumableStore.Put(ctx, name, bytes.NewReader(data), storage.IfNotPresent))
+	}
+	if RepoExists(ctx, repo, metaStore) != nil {
+		require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{
+			Name:        repo,
+			Description: "test",
+			Timestamp:   time.Time{},
+			Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+		}, metaStore))
+	}
+	bundle := New(NewBDescriptor(opts...),
+		Repo(repo),
+		MetaStore(metaStore),
+		ConsumableStore(consumableStore),
+		BlobStore(blobStore),
+	)
+	require.NoError(t, Upload(ctx, bundle))
+
+	uploaded := New(NewBDescriptor(),
+		Repo(repo),
+		BundleID(bundle.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+	)
+	require.NoError(t, PopulateFiles(ctx, uploaded))
+	return uploaded
+}
+
+// testContent returns data spanning leaves leaves, different for each seed
+func testContent(leaves int, seed byte) []byte {
+	data := make([]byte, leaves*cafs.DefaultLeafSize)
+	for i := range data {
+		data[i] = byte(i%251) + seed
+	}
+	return data
+}
+
+func TestReferenceIndex(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+
+	data := testContent(3, 0)
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"a/file1": data,
+		"b/file2": data,
+		"other":   []byte("other content"),
+	})
+	var root string
+	for _, e := range bundle.BundleEntries {
+		if e.NameWithPath == "a/file1" {
+			root = e.Hash
+		}
+	}
+	require.NotEmpty(t, root)
+
+	check := func() {
+		refs, err := FindBlobReferences(ctx, root, metaStore)
+		require.NoError(t, err)
+		require.Len(t, refs, 1)
+		require.Equal(t, model.BlobReference{
+			Root:     root,
+			Repo:     repo,
+			BundleID: bundle.BundleID,
+			Paths:    refs[0].Paths,
+		}, refs[0])
+		require.ElementsMatch(t, []string{"a/file1", "b/file2"}, refs[0].Paths)
+
+		fs, err := cafs.New(cafs.LeafSize(cafs.DefaultLeafSize), cafs.Backend(blobStore))
+		require.NoError(t, err)
+		key, err := cafs.KeyFromString(root)
+		require.NoError(t, err)
+		leaves, err := fs.Leaves(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, leaves, 3)
+		refs, err = FindBlobReferences(ctx, leaves[1].String(), metaStore)
+		require.NoError(t, err)
+		require.Len(t, refs, 1)
+		require.Equal(t, root, refs[0].Root)
+
+		refs, err = FindBlobReferences(ctx, cafs.Key{}.String(), metaStore)
+		require.NoError(t, err)
+		require.Empty(t, refs)
+	}
+	check()
+
+	// the rebuilt index has the same content
+	require.NoError(t, metaStore.Delete(ctx, model.GetArchivePathToRootReference(root, repo, bundle.BundleID)))
+	var indexed []string
+	require.NoError(t, RebuildIndex(ctx, metaStore, blobStore, func(r, bundleID string) {
+		indexed = append(indexed, r+"/"+bundleID)
+	}))
+	require.Equal(t, []string{repo + "/" + bundle.BundleID}, indexed)
+	check()
+}
+
+// failingIndexStore fails to write the reference index
+type failingIndexStore struct {
+	storage.Store
+}
+
+func (s failingIndexStore) Put(ctx context.Context, key string, rdr io.Reader, exclusive bool) error {
+	if strings.HasPrefix(key, model.GetArchivePathPrefixToIndex()) {
+		return errors.New("index unavailable")
+	}
+	return s.Store.Put(ctx, key, rdr, exclusive)
+}
+
+func TestUploadIndexFailure(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{
+		Name:        repo,
+		Description: "test",
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	}, metaStore))
+	consumableStore := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, consumableStore.Put(ctx, "a", bytes.NewReader(testContent(1, 0)), storage.IfNotPresent))
+
+	bundle := New(NewBDescriptor(),
+		Repo(repo),
+		MetaStore(failingIndexStore{Store: metaStore}),
+		ConsumableStore(consumableStore),
+		BlobStore(localfs.New(afero.NewMemMapFs())),
+	)
+	err := Upload(ctx, bundle)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "index unavailable")
+
+	// the bundle is not published without its references
+	has, err := metaStore.Has(ctx, model.GetArchivePathToBundle(repo, bundle.BundleID))
+	require.NoError(t, err)
+	require.False(t, has)
+}
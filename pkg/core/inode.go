@@ -5,6 +5,9 @@ import (
 	"sync"
 
 	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/oneconcern/datamon/pkg/filetracker"
+	"github.com/oneconcern/datamon/pkg/model"
 )
 
 type iNodeGenerator struct {
@@ -24,6 +27,14 @@ type nodeEntry struct {
 	refCount          int
 	attr              fuseops.InodeAttributes
 	pathToBackingFile string // empty for directory
+	// The file of the parent bundle the file starts from, nil for new files
+	base *model.BundleEntry
+	// The writes on top of the base file, nil until the file is first read or written
+	tFile *filetracker.TFile
+	// The target of a symbolic link
+	target string
+	// The extended attributes, by name
+	xattrs map[string][]byte
 }
 
 func (g *iNodeGenerator) allocINode() fuseops.InodeID {
@@ -53,3 +64,12 @@ func (g *iNodeGenerator) freeINode(iNode fuseops.InodeID) {
 	}
 	g.lock.Unlock()
 }
+
+// Account for a node recovered from the journal, so that new nodes get other iNodes
+func (g *iNodeGenerator) recoverINode(iNode fuseops.InodeID) {
+	g.lock.Lock()
+	if iNode > g.highestInode {
+		g.highestInode = iNode
+	}
+	g.lock.Unlock()
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// SetLabel points a label of a repo to a bundle, replacing the bundle it pointed to before
+func SetLabel(ctx context.Context, store storage.Store, repo, name, bundleID string, contributor model.Contributor) error {
+	if err := validLabelName(name); err != nil {
+		return err
+	}
+	if err := repoWritable(ctx, store, repo); err != nil {
+		return err
+	}
+	if err := bundleExists(ctx, store, repo, bundleID); err != nil {
+		return err
+	}
+	buffer, err := yaml.Marshal(model.Label{
+		Name:         name,
+		BundleID:     bundleID,
+		Timestamp:    model.GetBundleTimeStamp(),
+		Contributors: []model.Contributor{contributor},
+	})
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, model.GetArchivePathToLabel(repo, name), bytes.NewReader(buffer), storage.OverWrite)
+}
+
+// GetLabel returns a label of a repo
+func GetLabel(ctx context.Context, store storage.Store, repo, name string) (model.Label, error) {
+	var label model.Label
+	has, err := store.Has(ctx, model.GetArchivePathToLabel(repo, name))
+	if err != nil {
+		return label, err
+	}
+	if !has {
+		return label, storage.NotFoundf("label %s not found in repo %s", name, repo)
+	}
+	err = getYaml(ctx, store, model.GetArchivePathToLabel(repo, name), &label)
+	return label, err
+}
+
+// ListLabels returns all the labels of a repo, by name
+func ListLabels(ctx context.Context, store storage.Store, repo string) ([]model.Label, error) {
+	if err := RepoExists(ctx, repo, store); err != nil {
+		return nil, err
+	}
+	return listLabels(ctx, store, repo)
+}
+
+// listLabels returns the labels of a repo, whether it exists or not
+func listLabels(ctx context.Context, store storage.Store, repo string) ([]model.Label, error) {
+	keys, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToLabels(repo))
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]model.Label, 0, len(keys))
+	for _, key := range keys {
+		var label model.Label
+		if err = getYaml(ctx, store, key, &label); err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// DeleteLabel removes a label from a repo, the bundle it points to is left alone
+func DeleteLabel(ctx context.Context, store storage.Store, repo, name string) error {
+	if err := repoWritable(ctx, store, repo); err != nil {
+		return err
+	}
+	if _, err := GetLabel(ctx, store, repo, name); err != nil {
+		return err
+	}
+	return store.Delete(ctx, model.GetArchivePathToLabel(repo, name))
+}
+
+func validLabelName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty field: label name is empty")
+	}
+	for _, c := range name {
+		if !unicode.IsDigit(c) && !unicode.IsLetter(c) && !strings.ContainsRune("-_.", c) {
+			return fmt.Errorf("invalid name: label name:%s contains unsupported character %q", name, c)
+		}
+	}
+	return nil
+}
+
+func bundleExists(ctx context.Context, store storage.Store, repo, bundleID string) error {
+	has, err := store.Has(ctx, model.GetArchivePathToBundle(repo, bundleID))
+	if err != nil {
+		return err
+	}
+	if !has {
+		return storage.NotFoundf("bundle %s not found in repo %s", bundleID, repo)
+	}
+	return nil
+}
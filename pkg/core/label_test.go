@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestLabels(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	contributor := model.Contributor{Name: "test", Email: "t@test.com"}
+
+	first := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": testContent(1, 0)})
+	second := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"b": testContent(1, 1)})
+
+	require.Error(t, SetLabel(ctx, metaStore, repo, "release 1.0", first.BundleID, contributor))
+	require.Error(t, SetLabel(ctx, metaStore, repo, "release-1.0", "nobundle", contributor))
+	require.Error(t, SetLabel(ctx, metaStore, "norepo", "release-1.0", first.BundleID, contributor))
+	_, err := GetLabel(ctx, metaStore, repo, "release-1.0")
+	require.Error(t, err)
+
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "release-1.0", first.BundleID, contributor))
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", first.BundleID, contributor))
+	// moving a label replaces the bundle it points to
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", second.BundleID, contributor))
+	label, err := GetLabel(ctx, metaStore, repo, "latest")
+	require.NoError(t, err)
+	require.Equal(t, second.BundleID, label.BundleID)
+	require.Equal(t, []model.Contributor{contributor}, label.Contributors)
+
+	labels, err := ListLabels(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.Len(t, labels, 2)
+	require.Equal(t, "latest", labels[0].Name)
+	require.Equal(t, "release-1.0", labels[1].Name)
+
+	require.NoError(t, DeleteLabel(ctx, metaStore, repo, "latest"))
+	require.Error(t, DeleteLabel(ctx, metaStore, repo, "latest"))
+	// the bundle is left alone
+	require.NoError(t, bundleExists(ctx, metaStore, repo, second.BundleID))
+	labels, err = ListLabels(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.Len(t, labels, 1)
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// ListOption filters, sorts and paginates ListBundles and ListRepos
+type ListOption func(*listOpts)
+
+type listOpts struct {
+	token       string
+	limit       int
+	since       time.Time
+	until       time.Time
+	contributor string
+	message     string
+	descending  bool
+}
+
+// ListToken starts the listing after the page ending with this token, as returned by the previous call.
+// A bundle token fails when that bundle was deleted since, a repo token goes on with the next repo.
+func ListToken(token string) ListOption {
+	return func(o *listOpts) {
+		o.token = token
+	}
+}
+
+// ListLimit is the maximum number of items returned by a call, 0 returns all of them
+func ListLimit(limit int) ListOption {
+	return func(o *listOpts) {
+		o.limit = limit
+	}
+}
+
+// ListSince only lists the items created at or after this time
+func ListSince(since time.Time) ListOption {
+	return func(o *listOpts) {
+		o.since = since
+	}
+}
+
+// ListUntil only lists the items created before this time
+func ListUntil(until time.Time) ListOption {
+	return func(o *listOpts) {
+		o.until = until
+	}
+}
+
+// ListContributor only lists the items with a contributor whose name or email contains this string
+func ListContributor(contributor string) ListOption {
+	return func(o *listOpts) {
+		o.contributor = contributor
+	}
+}
+
+// ListMessage only lists the bundles with a message, or the repos with a description, containing this string
+func ListMessage(message string) ListOption {
+	return func(o *listOpts) {
+		o.message = message
+	}
+}
+
+// ListDescending reverses the order of the listing: newest bundles first, repos in reverse alphabetical order
+func ListDescending(descending bool) ListOption {
+	return func(o *listOpts) {
+		o.descending = descending
+	}
+}
+
+func newListOpts(opts []ListOption) listOpts {
+	var o listOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	return o
+}
+
+// match is true when an item passes the filters
+func (o *listOpts) match(timestamp time.Time, text string, contributors ...model.Contributor) bool {
+	if !o.since.IsZero() && timestamp.Before(o.since) {
+		return false
+	}
+	if !o.until.IsZero() && !timestamp.Before(o.until) {
+		return false
+	}
+	if o.message != "" && !strings.Contains(text, o.message) {
+		return false
+	}
+	if o.contributor == "" {
+		return true
+	}
+	for _, c := range contributors {
+		if strings.Contains(c.String(), o.contributor) {
+			return true
+		}
+	}
+	return false
+}
+
+// page returns the bounds of the page of ids, in listing order, and the token of the next page.
+// The token is the last id of the page.
+//
+// When ids are sorted, the page after an unknown token starts at the first id after it, so
+// listings go on when the last item of the previous page was deleted. Otherwise an unknown
+// token is an error, rather than an empty page which looks like the end of the listing.
+//
+// Every page reads the descriptors of all the items, listing a large repo page by page costs as
+// many reads per page as a listing without limit.
+func (o *listOpts) page(ids []string, sorted bool) (int, int, string, error) {
+	start := 0
+	if o.token != "" {
+		start = -1
+		for i, id := range ids {
+			if id == o.token {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			if !sorted {
+				return 0, 0, "", storage.NotFoundf("invalid page token %s: no such item, the listing must be restarted", o.token)
+			}
+			start = sort.Search(len(ids), func(i int) bool {
+				if o.descending {
+					return ids[i] < o.token
+				}
+				return ids[i] > o.token
+			})
+		}
+	}
+	end := len(ids)
+	if o.limit > 0 && start+o.limit < end {
+		end = start + o.limit
+	}
+	if end < len(ids) {
+		return start, end, ids[end-1], nil
+	}
+	return start, end, "", nil
+}
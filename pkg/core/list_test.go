@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestListBundles(t *testing.T) {
+	ctx := context.Background()
+	store := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{
+		Name:        repo,
+		Description: "test",
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	}, store))
+	_, _, err := ListBundles(ctx, "missing", store)
+	require.Error(t, err)
+
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id := ksuid.New().String()
+		ids = append(ids, id)
+		author := "alice"
+		if i%2 == 1 {
+			author = "bob"
+		}
+		buffer, err := yaml.Marshal(model.BundleDescriptor{
+			ID:           id,
+			Message:      fmt.Sprintf("bundle %d", i),
+			Timestamp:    start.AddDate(0, 0, i),
+			Contributors: []model.Contributor{{Name: author, Email: author + "@test.com"}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, store.Put(ctx, model.GetArchivePathToBundle(repo, id), bytes.NewReader(buffer), storage.IfNotPresent))
+	}
+	bundleIDs := func(bundles []model.BundleDescriptor) []string {
+		res := make([]string, 0, len(bundles))
+		for _, bd := range bundles {
+			res = append(res, bd.ID)
+		}
+		return res
+	}
+
+	bundles, next, err := ListBundles(ctx, repo, store)
+	require.NoError(t, err)
+	require.Equal(t, ids, bundleIDs(bundles))
+	require.Empty(t, next)
+	require.Equal(t, "bundle 0", bundles[0].Message)
+
+	// pages
+	var paged []string
+	next = ""
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 3)
+		bundles, next, err = ListBundles(ctx, repo, store, ListLimit(2), ListToken(next))
+		require.NoError(t, err)
+		paged = append(paged, bundleIDs(bundles)...)
+		if next == "" {
+			break
+		}
+	}
+	require.Equal(t, ids, paged)
+
+	bundles, next, err = ListBundles(ctx, repo, store, ListLimit(2), ListDescending(true))
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[4], ids[3]}, bundleIDs(bundles))
+	require.Equal(t, ids[3], next)
+
+	// filters
+	bundles, _, err = ListBundles(ctx, repo, store, ListSince(start.AddDate(0, 0, 1)), ListUntil(start.AddDate(0, 0, 3)))
+	require.NoError(t, err)
+	require.Equal(t, ids[1:3], bundleIDs(bundles))
+	bundles, _, err = ListBundles(ctx, repo, store, ListContributor("bob@"))
+	require.NoError(t, err)
+	require.Equal(t, []string{ids[1], ids[3]}, bundleIDs(bundles))
+	bundles, _, err = ListBundles(ctx, repo, store, ListMessage("bundle 4"))
+	require.NoError(t, err)
+	require.Equal(t, ids[4:], bundleIDs(bundles))
+	// an unknown token is not taken for the end of the listing
+	_, _, err = ListBundles(ctx, repo, store, ListToken("unknown"))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, storage.ErrNotFound))
+}
+
+func TestListRepos(t *testing.T) {
+	ctx := context.Background()
+	store := localfs.New(afero.NewMemMapFs())
+	repos, next, err := ListRepos(ctx, store)
+	require.NoError(t, err)
+	require.Empty(t, repos)
+	require.Empty(t, next)
+
+	start := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	names := []string{"repo-a", "repo-b", "repo-c"}
+	for i, name := range names {
+		require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{
+			Name:        name,
+			Description: fmt.Sprintf("description %d", i),
+			Timestamp:   start.AddDate(0, 0, i),
+			Contributor: model.Contributor{Name: fmt.Sprintf("user%d", i), Email: "t@test.com"},
+		}, store))
+	}
+	repoNames := func(repos []model.RepoDescriptor) []string {
+		res := make([]string, 0, len(repos))
+		for _, rd := range repos {
+			res = append(res, rd.Name)
+		}
+		return res
+	}
+
+	repos, next, err = ListRepos(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, names, repoNames(repos))
+	require.Empty(t, next)
+	require.Equal(t, "description 1", repos[1].Description)
+
+	repos, next, err = ListRepos(ctx, store, ListLimit(2))
+	require.NoError(t, err)
+	require.Equal(t, names[:2], repoNames(repos))
+	require.Equal(t, "repo-b", next)
+	repos, next, err = ListRepos(ctx, store, ListLimit(2), ListToken(next))
+	require.NoError(t, err)
+	require.Equal(t, names[2:], repoNames(repos))
+	require.Empty(t, next)
+
+	// the listing goes on when the last repo of the previous page is gone
+	repos, _, err = ListRepos(ctx, store, ListLimit(2), ListToken("repo-bb"))
+	require.NoError(t, err)
+	require.Equal(t, names[2:], repoNames(repos))
+	repos, _, err = ListRepos(ctx, store, ListLimit(2), ListToken("repo-bb"), ListDescending(true))
+	require.NoError(t, err)
+	require.Equal(t, []string{"repo-b", "repo-a"}, repoNames(repos))
+
+	repos, _, err = ListRepos(ctx, store, ListDescending(true), ListSince(start.AddDate(0, 0, 1)))
+	require.NoError(t, err)
+	require.Equal(t, []string{"repo-c", "repo-b"}, repoNames(repos))
+	repos, _, err = ListRepos(ctx, store, ListContributor("user0"))
+	require.NoError(t, err)
+	require.Equal(t, names[:1], repoNames(repos))
+	repos, _, err = ListRepos(ctx, store, ListMessage("description 2"))
+	require.NoError(t, err)
+	require.Equal(t, names[2:], repoNames(repos))
+}
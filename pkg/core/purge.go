@@ -0,0 +1,321 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/segmentio/ksuid"
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// PurgeOption configures a purge
+type PurgeOption func(*purgeOpts)
+
+type purgeOpts struct {
+	repo        string
+	reason      string
+	contributor model.Contributor
+	dryRun      bool
+}
+
+// PurgeRepo only looks up the paths to purge in the bundles of a repo, instead of all repos
+func PurgeRepo(repo string) PurgeOption {
+	return func(o *purgeOpts) {
+		o.repo = repo
+	}
+}
+
+// PurgeReason is recorded in the audit record of the purge
+func PurgeReason(reason string) PurgeOption {
+	return func(o *purgeOpts) {
+		o.reason = reason
+	}
+}
+
+// PurgeContributor is recorded in the audit record of the purge
+func PurgeContributor(c model.Contributor) PurgeOption {
+	return func(o *purgeOpts) {
+		o.contributor = c
+	}
+}
+
+// PurgeDryRun only computes the record of the purge, nothing is deleted
+func PurgeDryRun(dryRun bool) PurgeOption {
+	return func(o *purgeOpts) {
+		o.dryRun = dryRun
+	}
+}
+
+type purgedRoot struct {
+	fs  cafs.Fs
+	key cafs.Key
+}
+
+// Purge deletes content from the blob store, even when bundles still use it.
+//
+// The content is given by the hashes of files or of their leaves, or by the paths of files in the bundles.
+// The leaves and root objects of the content are deleted, and the files using them are kept in the
+// bundle file lists as tombstones, so downloading them fails with the ID of the purge.
+// Files of other content sharing a deleted leaf can't be read anymore either: they are tombstoned
+// as well and listed as collateral in the audit record, which is kept in the metadata store.
+//
+// Purge relies on the reference index to find the bundles using the content, it should be rebuilt first
+// if an upload failed, since the index may then refer to a bundle which was never published.
+// An interrupted purge can be run again.
+func Purge(ctx context.Context, metaStore, blobStore storage.Store, hashes, paths []string, opts ...PurgeOption) (model.Purge, error) {
+	var o purgeOpts
+	for _, apply := range opts {
+		apply(&o)
+	}
+	id, err := ksuid.NewRandom()
+	if err != nil {
+		return model.Purge{}, err
+	}
+	record := model.Purge{
+		ID:          id.String(),
+		Timestamp:   model.GetBundleTimeStamp(),
+		Contributor: o.contributor,
+		Reason:      o.reason,
+		Hashes:      hashes,
+		Paths:       paths,
+	}
+
+	roots := make(map[string]bool)
+	for _, hash := range hashes {
+		if _, err = cafs.KeyFromString(hash); err != nil {
+			return record, fmt.Errorf("invalid hash %s: %v", hash, err)
+		}
+		// a leaf key purges the files using it
+		leafOf, err := leafRoots(ctx, metaStore, hash)
+		if err != nil {
+			return record, err
+		}
+		if len(leafOf) == 0 {
+			roots[hash] = true
+		}
+		for _, root := range leafOf {
+			roots[root] = true
+		}
+	}
+	if len(paths) > 0 {
+		pathHashes, err := hashesOfPaths(ctx, metaStore, o.repo, paths)
+		if err != nil {
+			return record, err
+		}
+		for _, hash := range pathHashes {
+			roots[hash] = true
+		}
+	}
+
+	// find the leaves of the content, with the leaf size of the bundles using it
+	var purged []purgedRoot
+	leaves := make(map[string]bool)
+	for _, root := range sortedKeys(roots) {
+		refs, err := rootReferences(ctx, metaStore, root)
+		if err != nil {
+			return record, err
+		}
+		record.Files = append(record.Files, refs...)
+		leafSize := uint32(cafs.DefaultLeafSize)
+		if len(refs) > 0 {
+			var bd model.BundleDescriptor
+			if err = getYaml(ctx, metaStore, model.GetArchivePathToBundle(refs[0].Repo, refs[0].BundleID), &bd); err != nil {
+				return record, err
+			}
+			leafSize = bd.LeafSize
+		}
+		fs, err := cafs.New(cafs.LeafSize(leafSize), cafs.Backend(blobStore))
+		if err != nil {
+			return record, err
+		}
+		key, err := cafs.KeyFromString(root)
+		if err != nil {
+			return record, err
+		}
+		found, _, err := fs.Has(ctx, key, cafs.HasOnlyRoots())
+		if err != nil {
+			return record, err
+		}
+		if !found {
+			if len(refs) == 0 {
+				if stored, _, _ := fs.Has(ctx, key); stored {
+					// with a flat layout, leaves are stored next to the roots
+					return record, fmt.Errorf("%s is not the hash of a file, nor a leaf in the reference index: rebuild the index if it is a leaf", root)
+				}
+			}
+			// not stored, or already deleted by an interrupted purge
+			continue
+		}
+		keys, err := fs.Leaves(ctx, key)
+		if err != nil {
+			return record, fmt.Errorf("leaves of %s: %v", root, err)
+		}
+		for _, k := range keys {
+			leaves[k.String()] = true
+		}
+		record.Roots = append(record.Roots, root)
+		purged = append(purged, purgedRoot{fs: fs, key: key})
+	}
+	if len(record.Roots) == 0 && len(record.Files) == 0 {
+		return record, fmt.Errorf("nothing to purge: no stored blob or bundle file matches")
+	}
+	record.Leaves = sortedKeys(leaves)
+
+	tombstones := make(map[string]bool)
+	for root := range roots {
+		tombstones[root] = true
+	}
+	for _, leaf := range record.Leaves {
+		leafOf, err := leafRoots(ctx, metaStore, leaf)
+		if err != nil {
+			return record, err
+		}
+		for _, root := range leafOf {
+			if tombstones[root] {
+				continue
+			}
+			tombstones[root] = true
+			refs, err := rootReferences(ctx, metaStore, root)
+			if err != nil {
+				return record, err
+			}
+			record.Collateral = append(record.Collateral, refs...)
+		}
+	}
+	if o.dryRun {
+		return record, nil
+	}
+
+	// tombstones first, so downloads fail clearly from now on
+	bundles := make(map[[2]string]bool)
+	for _, ref := range append(record.Files[:len(record.Files):len(record.Files)], record.Collateral...) {
+		bundles[[2]string{ref.Repo, ref.BundleID}] = true
+	}
+	for bundle := range bundles {
+		if err = tombstoneBundleFiles(ctx, metaStore, bundle[0], bundle[1], tombstones, record.ID); err != nil {
+			return record, fmt.Errorf("marking purged files in bundle %s of repo %s: %v", bundle[1], bundle[0], err)
+		}
+	}
+	err = forEach(len(purged), func(i int) error {
+		return purged[i].fs.Delete(ctx, purged[i].key)
+	})
+	if err != nil {
+		return record, fmt.Errorf("deleting blobs: %v", err)
+	}
+
+	var stale []string
+	for _, root := range sortedKeys(roots) {
+		refs, err := listKeysPrefix(ctx, metaStore, model.GetArchivePathPrefixToRootReferences(root))
+		if err != nil {
+			return record, err
+		}
+		stale = append(stale, refs...)
+	}
+	for _, leaf := range record.Leaves {
+		refs, err := listKeysPrefix(ctx, metaStore, model.GetArchivePathPrefixToLeafReferences(leaf))
+		if err != nil {
+			return record, err
+		}
+		stale = append(stale, refs...)
+	}
+	err = forEach(len(stale), func(i int) error {
+		return metaStore.Delete(ctx, stale[i])
+	})
+	if err != nil {
+		return record, fmt.Errorf("removing purged blobs from the index: %v", err)
+	}
+
+	buffer, err := yaml.Marshal(record)
+	if err != nil {
+		return record, err
+	}
+	return record, metaStore.Put(ctx, model.GetArchivePathToPurge(record.ID), bytes.NewReader(buffer), storage.IfNotPresent)
+}
+
+// hashesOfPaths returns the hashes of the files at paths in all bundles of the repo, or of all repos
+func hashesOfPaths(ctx context.Context, store storage.Store, repo string, paths []string) ([]string, error) {
+	repos := []string{repo}
+	if repo == "" {
+		var err error
+		if repos, err = listRepoNames(ctx, store); err != nil {
+			return nil, err
+		}
+	}
+	wanted := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		wanted[path] = false
+	}
+	hashes := make(map[string]bool)
+	for _, repo := range repos {
+		bundleIDs, err := listBundleIDs(ctx, repo, store)
+		if err != nil {
+			return nil, err
+		}
+		for _, bundleID := range bundleIDs {
+			bundle := New(NewBDescriptor(), Repo(repo), BundleID(bundleID), MetaStore(store))
+			if err = PopulateFiles(ctx, bundle); err != nil {
+				return nil, err
+			}
+			for _, e := range bundle.BundleEntries {
+				if _, ok := wanted[e.NameWithPath]; ok && e.Purged == "" && e.Symlink == "" {
+					wanted[e.NameWithPath] = true
+					hashes[e.Hash] = true
+				}
+			}
+		}
+	}
+	for path, found := range wanted {
+		if !found {
+			return nil, storage.NotFoundf("path %s not found in any bundle, or already purged", path)
+		}
+	}
+	return sortedKeys(hashes), nil
+}
+
+// tombstoneBundleFiles rewrites the file lists of a bundle, marking the files with a purged hash
+func tombstoneBundleFiles(ctx context.Context, store storage.Store, repo, bundleID string, hashes map[string]bool, purgeID string) error {
+	var bd model.BundleDescriptor
+	if err := getYaml(ctx, store, model.GetArchivePathToBundle(repo, bundleID), &bd); err != nil {
+		return err
+	}
+	for i := uint64(0); i < bd.BundleEntriesFileCount; i++ {
+		path := model.GetArchivePathToBundleFileList(repo, bundleID, i)
+		var entries model.BundleEntries
+		if err := getYaml(ctx, store, path, &entries); err != nil {
+			return err
+		}
+		changed := false
+		for j, e := range entries.BundleEntries {
+			if hashes[e.Hash] && e.Purged == "" {
+				entries.BundleEntries[j].Purged = purgeID
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		buffer, err := yaml.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		if err = store.Put(ctx, path, bytes.NewReader(buffer), storage.OverWrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+
+	secret := testContent(3, 0)
+	// shares the first leaf of the secret
+	sharing := append(secret[:len(secret)/3:len(secret)/3], testContent(1, 1)...)
+	bundle1 := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"a/secret": secret,
+		"kept":     testContent(1, 2),
+	})
+	bundle2 := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"b/copy":  secret,
+		"sharing": sharing,
+	})
+	hashes := make(map[string]string)
+	for _, e := range append(bundle1.BundleEntries, bundle2.BundleEntries...) {
+		hashes[e.NameWithPath] = e.Hash
+	}
+
+	download := func(bundleID, file string) error {
+		bundle := New(NewBDescriptor(),
+			Repo(repo),
+			BundleID(bundleID),
+			MetaStore(metaStore),
+			BlobStore(blobStore),
+			ConsumableStore(localfs.New(afero.NewMemMapFs())),
+		)
+		if file == "" {
+			return Publish(ctx, bundle)
+		}
+		return PublishFile(ctx, bundle, file)
+	}
+
+	record, err := Purge(ctx, metaStore, blobStore, nil, []string{"a/secret"}, PurgeRepo(repo), PurgeDryRun(true))
+	require.NoError(t, err)
+	require.Equal(t, []string{hashes["a/secret"]}, record.Roots)
+	require.Len(t, record.Leaves, 3)
+	require.ElementsMatch(t, []model.BlobReference{
+		{Root: hashes["a/secret"], Repo: repo, BundleID: bundle1.BundleID, Paths: []string{"a/secret"}},
+		{Root: hashes["a/secret"], Repo: repo, BundleID: bundle2.BundleID, Paths: []string{"b/copy"}},
+	}, record.Files)
+	require.Equal(t, []model.BlobReference{
+		{Root: hashes["sharing"], Repo: repo, BundleID: bundle2.BundleID, Paths: []string{"sharing"}},
+	}, record.Collateral)
+	require.NoError(t, download(bundle1.BundleID, "a/secret"))
+
+	record, err = Purge(ctx, metaStore, blobStore, []string{hashes["a/secret"]}, nil, PurgeReason("test"))
+	require.NoError(t, err)
+	require.Len(t, record.Files, 2)
+	require.Len(t, record.Collateral, 1)
+
+	var audit model.Purge
+	require.NoError(t, getYaml(ctx, metaStore, model.GetArchivePathToPurge(record.ID), &audit))
+	require.Equal(t, "test", audit.Reason)
+	require.Equal(t, record.Roots, audit.Roots)
+
+	err = download(bundle1.BundleID, "a/secret")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "purge "+record.ID)
+	err = download(bundle2.BundleID, "sharing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "purge "+record.ID)
+
+	// purged files are skipped by full downloads
+	require.NoError(t, download(bundle1.BundleID, ""))
+	require.NoError(t, download(bundle2.BundleID, ""))
+	require.NoError(t, download(bundle1.BundleID, "kept"))
+
+	fs, err := cafs.New(cafs.LeafSize(cafs.DefaultLeafSize), cafs.Backend(blobStore))
+	require.NoError(t, err)
+	key, err := cafs.KeyFromString(hashes["a/secret"])
+	require.NoError(t, err)
+	found, _, err := fs.Has(ctx, key)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	refs, err := FindBlobReferences(ctx, hashes["a/secret"], metaStore)
+	require.NoError(t, err)
+	require.Empty(t, refs)
+	for _, leaf := range record.Leaves {
+		refs, err = FindBlobReferences(ctx, leaf, metaStore)
+		require.NoError(t, err)
+		require.Empty(t, refs)
+	}
+
+	_, err = Purge(ctx, metaStore, blobStore, nil, []string{"a/secret"})
+	require.Error(t, err)
+}
+
+func TestPurgeLeaf(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	// flat layout: leaves and roots are stored side by side
+	blobStore := localfs.New(afero.NewMemMapFs())
+
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{
+		"secret": testContent(2, 0),
+		"kept":   testContent(1, 1),
+	})
+	hashes := make(map[string]string)
+	for _, e := range bundle.BundleEntries {
+		hashes[e.NameWithPath] = e.Hash
+	}
+	fs, err := cafs.New(cafs.LeafSize(cafs.DefaultLeafSize), cafs.Backend(blobStore))
+	require.NoError(t, err)
+	key, err := cafs.KeyFromString(hashes["secret"])
+	require.NoError(t, err)
+	leaves, err := fs.Leaves(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, leaves, 2)
+
+	// a leaf purges the files using it
+	record, err := Purge(ctx, metaStore, blobStore, []string{leaves[1].String()}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{hashes["secret"]}, record.Roots)
+	require.ElementsMatch(t, []string{leaves[0].String(), leaves[1].String()}, record.Leaves)
+	require.Equal(t, []model.BlobReference{
+		{Root: hashes["secret"], Repo: repo, BundleID: bundle.BundleID, Paths: []string{"secret"}},
+	}, record.Files)
+	require.Empty(t, record.Collateral)
+	found, _, err := fs.Has(ctx, key)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// a leaf missing from the index is not taken for a root
+	key, err = cafs.KeyFromString(hashes["kept"])
+	require.NoError(t, err)
+	leaves, err = fs.Leaves(ctx, key)
+	require.NoError(t, err)
+	require.NoError(t, metaStore.Delete(ctx, model.GetArchivePathToLeafReference(leaves[0].String(), hashes["kept"])))
+	_, err = Purge(ctx, metaStore, blobStore, []string{leaves[0].String()}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rebuild the index")
+}
@@ -3,7 +3,8 @@ package core
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"os"
 	"strings"
 
 	"github.com/oneconcern/datamon/pkg/model"
@@ -11,7 +12,7 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-func CreateRepo(repo model.RepoDescriptor, store storage.Store) error {
+func CreateRepo(ctx context.Context, repo model.RepoDescriptor, store storage.Store) error {
 	err := model.Validate(repo)
 	if err != nil {
 		return err
@@ -21,10 +22,10 @@ func CreateRepo(repo model.RepoDescriptor, store storage.Store) error {
 		return err
 	}
 	path := model.GetArchivePathToRepoDescriptor(repo.Name)
-	err = store.Put(context.Background(), path, bytes.NewReader(r), storage.IfNotPresent)
+	err = store.Put(ctx, path, bytes.NewReader(r), storage.IfNotPresent)
 	if err != nil {
-		if strings.Contains(err.Error(), "googleapi: Error 412: Precondition Failed, conditionNotMet") {
-			return fmt.Errorf("repo already exists: %s", repo.Name)
+		if errors.Is(err, os.ErrExist) || strings.Contains(err.Error(), "googleapi: Error 412: Precondition Failed, conditionNotMet") {
+			return storage.Existsf("repo already exists: %s", repo.Name)
 		}
 		return err
 	}
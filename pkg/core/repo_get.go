@@ -0,0 +1,32 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"gopkg.in/yaml.v2"
+)
+
+func GetRepoDescriptorByRepoName(ctx context.Context, repo string, store storage.Store) (model.RepoDescriptor, error) {
+	var rd model.RepoDescriptor
+	e := RepoExists(ctx, repo, store)
+	if e != nil {
+		return rd, e
+	}
+	r, err := store.Get(ctx, model.GetArchivePathToRepoDescriptor(repo))
+	if err != nil {
+		return rd, err
+	}
+	defer r.Close()
+	o, err := ioutil.ReadAll(r)
+	if err != nil {
+		return rd, err
+	}
+	err = yaml.Unmarshal(o, &rd)
+	if err != nil {
+		return rd, err
+	}
+	return rd, nil
+}
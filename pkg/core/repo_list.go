@@ -2,36 +2,61 @@ package core
 
 import (
 	"context"
-	"io/ioutil"
+	"sort"
 	"strings"
 
 	"github.com/oneconcern/datamon/pkg/model"
 	"github.com/oneconcern/datamon/pkg/storage"
-	yaml "gopkg.in/yaml.v2"
 )
 
-func ListRepos(store storage.Store) ([]string, error) {
-	// TODO: Don;t format string here, return a paginated list of id<->bd
-	// Get a list
-	ks, _, _ := store.KeysPrefix(context.Background(), "", model.GetArchivePathPrefixToRepos(), "", 1000000)
-	var keys = make([]string, 0)
-	for _, k := range ks {
-		c := strings.SplitN(k, "/", 3)[1]
-		r, err := store.Get(context.Background(), model.GetArchivePathToRepoDescriptor(c))
-		if err != nil {
-			return nil, err
-		}
-		o, err := ioutil.ReadAll(r)
-		if err != nil {
-			return nil, err
+// ListRepos returns the descriptors of the repos, by name, and the token of the next page.
+// The token is empty on the last page.
+func ListRepos(ctx context.Context, store storage.Store, opts ...ListOption) ([]model.RepoDescriptor, string, error) {
+	o := newListOpts(opts)
+	names, err := listRepoNames(ctx, store)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(names)
+	repos := make([]model.RepoDescriptor, len(names))
+	err = forEach(len(names), func(i int) error {
+		return getYaml(ctx, store, model.GetArchivePathToRepoDescriptor(names[i]), &repos[i])
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	matched := make([]model.RepoDescriptor, 0, len(repos))
+	for i, rd := range repos {
+		rd.Name = names[i]
+		if o.match(rd.Timestamp, rd.Description, rd.Contributor) {
+			matched = append(matched, rd)
 		}
-		var rd model.RepoDescriptor
-		err = yaml.Unmarshal(o, &rd)
-		if err != nil {
-			return nil, err
+	}
+	if o.descending {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
 		}
-		keys = append(keys, c+" , "+rd.Description+" , "+rd.Contributor.Name+" , "+rd.Contributor.Email+" , "+rd.Timestamp.String())
 	}
+	ids := make([]string, len(matched))
+	for i, rd := range matched {
+		ids[i] = rd.Name
+	}
+	start, end, next, err := o.page(ids, true)
+	if err != nil {
+		return nil, "", err
+	}
+	return matched[start:end], next, nil
+}
 
-	return keys, nil
+// listRepoNames returns the names of all the repos
+func listRepoNames(ctx context.Context, store storage.Store) ([]string, error) {
+	ks, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToRepos())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ks))
+	for _, k := range ks {
+		names = append(names, strings.SplitN(k, "/", 3)[1])
+	}
+	return names, nil
 }
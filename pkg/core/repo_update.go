@@ -0,0 +1,389 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/segmentio/ksuid"
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// RepoOption changes a repo descriptor in UpdateRepo
+type RepoOption func(*model.RepoDescriptor)
+
+// RepoDescription sets the description of a repo
+func RepoDescription(description string) RepoOption {
+	return func(rd *model.RepoDescriptor) {
+		rd.Description = description
+	}
+}
+
+// RepoContributor sets the contributor of a repo
+func RepoContributor(c model.Contributor) RepoOption {
+	return func(rd *model.RepoDescriptor) {
+		rd.Contributor = c
+	}
+}
+
+// RepoRetention sets the retention policy of a repo, used by PruneBundles. A policy without rules removes it.
+func RepoRetention(policy *model.Retention) RepoOption {
+	return func(rd *model.RepoDescriptor) {
+		if policy.IsEmpty() {
+			policy = nil
+		}
+		rd.Retention = policy
+	}
+}
+
+// LockOption changes how an operation takes the lock of a repo
+type LockOption func(*repoLock)
+
+// ResumeLock resumes an interrupted operation, which left the lock of a repo held by owner
+func ResumeLock(owner string) LockOption {
+	return func(l *repoLock) {
+		if owner != "" {
+			l.Owner = owner
+			l.resume = true
+		}
+	}
+}
+
+// UpdateRepo changes the descriptor of a repo, its name can't be changed
+func UpdateRepo(ctx context.Context, store storage.Store, repo string, opts ...RepoOption) error {
+	l, err := newRepoLock("update")
+	if err != nil {
+		return err
+	}
+	if _, err = l.lock(ctx, store, repo); err != nil {
+		return err
+	}
+	defer l.unlock(ctx, store, repo) // nolint:errcheck
+
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, store)
+	if err != nil {
+		return err
+	}
+	for _, apply := range opts {
+		apply(&rd)
+	}
+	rd.Name = repo
+	if err = model.Validate(rd); err != nil {
+		return err
+	}
+	return putRepoDescriptor(ctx, store, rd, storage.OverWrite)
+}
+
+// DeleteRepo deletes a repo. Repos with bundles are only deleted when forced, with all their bundles and labels.
+// The blobs of the bundles are left in the blob store, to be deleted by CollectGarbage.
+//
+// An interrupted deletion keeps the repo locked, it can be resumed with the owner of the lock,
+// even when the repo descriptor was already deleted.
+func DeleteRepo(ctx context.Context, store storage.Store, repo string, force bool, opts ...LockOption) error {
+	l, err := newRepoLock("delete", opts...)
+	if err != nil {
+		return err
+	}
+	resumed, err := l.lock(ctx, store, repo)
+	if err != nil {
+		return err
+	}
+	if err = RepoExists(ctx, repo, store); err != nil {
+		left, e := repoLeftovers(ctx, store, repo)
+		if e != nil {
+			return e
+		}
+		if !resumed && !left {
+			_ = l.unlock(ctx, store, repo)
+			return err
+		}
+	}
+	bundleIDs, err := listBundleIDs(ctx, repo, store)
+	if err != nil {
+		return err
+	}
+	if len(bundleIDs) > 0 && !force {
+		_ = l.unlock(ctx, store, repo)
+		return fmt.Errorf("repo %s has %d bundles, deleting it must be forced", repo, len(bundleIDs))
+	}
+	if err = deleteRepoMetadata(ctx, store, repo, bundleIDs); err != nil {
+		return err
+	}
+	return l.unlock(ctx, store, repo)
+}
+
+// repoLeftovers is true when bundles or labels of a repo remain without its descriptor
+func repoLeftovers(ctx context.Context, store storage.Store, repo string) (bool, error) {
+	for _, prefix := range []string{model.GetArchivePathPrefixToLabels(repo), model.GetArchivePathPrefixToBundles(repo)} {
+		keys, _, err := store.KeysPrefix(ctx, "", prefix, "", 1)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteRepoMetadata deletes the bundles and labels of a repo, then its descriptor
+func deleteRepoMetadata(ctx context.Context, store storage.Store, repo string, bundleIDs []string) error {
+	labels, err := labelsByBundle(ctx, store, repo)
+	if err != nil {
+		return err
+	}
+	for _, bundleID := range bundleIDs {
+		if err = deleteBundleMetadata(ctx, store, repo, bundleID, labels[bundleID]); err != nil {
+			return fmt.Errorf("deleting bundle %s: %v", bundleID, err)
+		}
+	}
+	// labels of missing bundles, and what is left of incomplete bundles
+	var stale []string
+	for _, prefix := range []string{model.GetArchivePathPrefixToLabels(repo), model.GetArchivePathPrefixToBundles(repo)} {
+		keys, err := listKeysPrefix(ctx, store, prefix)
+		if err != nil {
+			return err
+		}
+		stale = append(stale, keys...)
+	}
+	err = forEach(len(stale), func(i int) error {
+		return store.Delete(ctx, stale[i])
+	})
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, model.GetArchivePathToRepoDescriptor(repo))
+}
+
+// RenameRepo moves the bundles and labels of a repo to a new repo, and deletes the repo
+func RenameRepo(ctx context.Context, store storage.Store, repo, name string, opts ...LockOption) error {
+	return copyRepo(ctx, store, repo, name, true, opts...)
+}
+
+// CopyRepo copies the bundles and labels of a repo to a new repo
+func CopyRepo(ctx context.Context, store storage.Store, repo, name string, opts ...LockOption) error {
+	return copyRepo(ctx, store, repo, name, false, opts...)
+}
+
+// copyRepo copies a repo, both repos are locked while it runs.
+//
+// The descriptor of every bundle is copied last, so incomplete bundles are not listed.
+// An interrupted copy keeps both repos locked, it can be resumed with the owner of the locks.
+func copyRepo(ctx context.Context, store storage.Store, repo, name string, move bool, opts ...LockOption) error {
+	operation := fmt.Sprintf("copy %s to %s", repo, name)
+	if move {
+		operation = fmt.Sprintf("rename %s to %s", repo, name)
+	}
+	l, err := newRepoLock(operation, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err = l.lock(ctx, store, repo); err != nil {
+		return err
+	}
+	resumed, err := l.lock(ctx, store, name)
+	if err != nil {
+		_ = l.unlock(ctx, store, repo)
+		return err
+	}
+	// the descriptor is read once locked, so it can't change while it is copied
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, store)
+	if err == nil {
+		rd.Name = name
+		err = model.Validate(rd)
+	}
+	if err != nil {
+		_ = l.unlock(ctx, store, name)
+		_ = l.unlock(ctx, store, repo)
+		return err
+	}
+	if err = putRepoDescriptor(ctx, store, rd, storage.IfNotPresent); err != nil {
+		exists, e := store.Has(ctx, model.GetArchivePathToRepoDescriptor(name))
+		if e != nil || !exists {
+			return err
+		}
+		if !resumed {
+			_ = l.unlock(ctx, store, name)
+			_ = l.unlock(ctx, store, repo)
+			return storage.Existsf("repo already exists: %s", name)
+		}
+	}
+
+	bundleIDs, err := listBundleIDs(ctx, repo, store)
+	if err != nil {
+		return err
+	}
+	for _, bundleID := range bundleIDs {
+		if err = copyBundle(ctx, store, repo, name, bundleID, move); err != nil {
+			return fmt.Errorf("copying bundle %s: %v", bundleID, err)
+		}
+	}
+	labels, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToLabels(repo))
+	if err != nil {
+		return err
+	}
+	err = forEach(len(labels), func(i int) error {
+		return copyObject(ctx, store, labels[i], model.GetArchivePathPrefixToLabels(name)+labels[i][len(model.GetArchivePathPrefixToLabels(repo)):])
+	})
+	if err != nil {
+		return fmt.Errorf("copying labels: %v", err)
+	}
+	if move {
+		// bundles were moved, this deletes the labels and what was left by an interrupted run
+		if bundleIDs, err = listBundleIDs(ctx, repo, store); err != nil {
+			return err
+		}
+		if err = deleteRepoMetadata(ctx, store, repo, bundleIDs); err != nil {
+			return err
+		}
+	}
+	if err = l.unlock(ctx, store, repo); err != nil {
+		return err
+	}
+	return l.unlock(ctx, store, name)
+}
+
+// copyBundle copies the metadata of a bundle to another repo, and records it in the reference index
+func copyBundle(ctx context.Context, store storage.Store, repo, name, bundleID string, move bool) error {
+	bundle := New(NewBDescriptor(), Repo(repo), BundleID(bundleID), MetaStore(store))
+	if err := PopulateFiles(ctx, bundle); err != nil {
+		return err
+	}
+	keys, err := listKeysPrefix(ctx, store, model.GetArchivePathPrefixToBundle(repo, bundleID))
+	if err != nil {
+		return err
+	}
+	descriptor := model.GetArchivePathToBundle(repo, bundleID)
+	var files []string
+	for _, key := range keys {
+		if key != descriptor {
+			files = append(files, key)
+		}
+	}
+	prefix, target := model.GetArchivePathPrefixToBundle(repo, bundleID), model.GetArchivePathPrefixToBundle(name, bundleID)
+	err = forEach(len(files), func(i int) error {
+		return copyObject(ctx, store, files[i], target+files[i][len(prefix):])
+	})
+	if err != nil {
+		return err
+	}
+	if err = copyObject(ctx, store, descriptor, model.GetArchivePathToBundle(name, bundleID)); err != nil {
+		return err
+	}
+	// leaves are indexed by root, they don't change
+	err = indexBundleFiles(ctx, store, name, bundleID, bundle.BundleEntries, func(cafs.Key) ([]cafs.Key, error) {
+		return nil, nil
+	})
+	if err != nil || !move {
+		return err
+	}
+	return deleteBundleMetadata(ctx, store, repo, bundleID, nil)
+}
+
+func copyObject(ctx context.Context, store storage.Store, from, to string) error {
+	r, err := store.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, to, bytes.NewReader(b), storage.OverWrite)
+}
+
+func putRepoDescriptor(ctx context.Context, store storage.Store, rd model.RepoDescriptor, exclusive bool) error {
+	r, err := yaml.Marshal(rd)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, model.GetArchivePathToRepoDescriptor(rd.Name), bytes.NewReader(r), exclusive)
+}
+
+// repoLock is the lock of a repo taken by one call of an operation
+type repoLock struct {
+	model.RepoLock
+	resume bool
+}
+
+func newRepoLock(operation string, opts ...LockOption) (*repoLock, error) {
+	id, err := ksuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	l := &repoLock{RepoLock: model.RepoLock{Operation: operation, Owner: id.String()}}
+	for _, apply := range opts {
+		apply(l)
+	}
+	return l, nil
+}
+
+// lock takes the lock of a repo. It returns true when the lock was already held by the owner being resumed,
+// other calls fail while the lock is held, even for the same operation.
+func (l *repoLock) lock(ctx context.Context, store storage.Store, repo string) (bool, error) {
+	l.Timestamp = model.GetBundleTimeStamp()
+	buffer, err := yaml.Marshal(l.RepoLock)
+	if err != nil {
+		return false, err
+	}
+	err = store.Put(ctx, model.GetArchivePathToRepoLock(repo), bytes.NewReader(buffer), storage.IfNotPresent)
+	if err == nil {
+		return false, nil
+	}
+	var held model.RepoLock
+	if e := getYaml(ctx, store, model.GetArchivePathToRepoLock(repo), &held); e != nil {
+		return false, err
+	}
+	if l.resume && held.Owner == l.Owner && held.Operation == l.Operation {
+		return true, nil
+	}
+	return false, repoLockedError(repo, held)
+}
+
+// unlock releases the lock of a repo, unless another call holds it
+func (l *repoLock) unlock(ctx context.Context, store storage.Store, repo string) error {
+	has, err := store.Has(ctx, model.GetArchivePathToRepoLock(repo))
+	if err != nil || !has {
+		return err
+	}
+	var held model.RepoLock
+	if err = getYaml(ctx, store, model.GetArchivePathToRepoLock(repo), &held); err != nil {
+		return err
+	}
+	if held.Owner != l.Owner {
+		return repoLockedError(repo, held)
+	}
+	return store.Delete(ctx, model.GetArchivePathToRepoLock(repo))
+}
+
+// UnlockRepo removes the lock left on a repo by an interrupted operation, whatever its owner
+func UnlockRepo(ctx context.Context, store storage.Store, repo string) error {
+	return store.Delete(ctx, model.GetArchivePathToRepoLock(repo))
+}
+
+// repoWritable fails when a repo does not exist or is locked, for writers which don't take the lock
+func repoWritable(ctx context.Context, store storage.Store, repo string) error {
+	if err := RepoExists(ctx, repo, store); err != nil {
+		return err
+	}
+	has, err := store.Has(ctx, model.GetArchivePathToRepoLock(repo))
+	if err != nil || !has {
+		return err
+	}
+	var held model.RepoLock
+	if err = getYaml(ctx, store, model.GetArchivePathToRepoLock(repo), &held); err != nil {
+		return err
+	}
+	return repoLockedError(repo, held)
+}
+
+func repoLockedError(repo string, held model.RepoLock) error {
+	return fmt.Errorf("repo %s is locked by %q owned by %s since %s, resume it with its owner or unlock it if the operation was interrupted",
+		repo, held.Operation, held.Owner, held.Timestamp)
+}
@@ -0,0 +1,253 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func TestUpdateRepo(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	uploaded := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": []byte("a")})
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", uploaded.BundleID, model.Contributor{}))
+
+	contributor := model.Contributor{Name: "other", Email: "o@test.com"}
+	require.NoError(t, UpdateRepo(ctx, metaStore, repo, RepoDescription("updated"), RepoContributor(contributor)))
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, metaStore)
+	require.NoError(t, err)
+	require.Equal(t, repo, rd.Name)
+	require.Equal(t, "updated", rd.Description)
+	require.Equal(t, contributor, rd.Contributor)
+
+	require.Error(t, UpdateRepo(ctx, metaStore, repo, RepoDescription("")))
+	require.Error(t, UpdateRepo(ctx, metaStore, "missing", RepoDescription("updated")))
+
+	// concurrent writers fail while the repo is locked
+	l, err := newRepoLock("test")
+	require.NoError(t, err)
+	_, err = l.lock(ctx, metaStore, repo)
+	require.NoError(t, err)
+	err = UpdateRepo(ctx, metaStore, repo, RepoDescription("concurrent"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `locked by "test"`)
+	require.Contains(t, err.Error(), l.Owner)
+	require.Error(t, DeleteRepo(ctx, metaStore, repo, true))
+	bundle := New(NewBDescriptor(),
+		Repo(repo),
+		MetaStore(metaStore),
+		ConsumableStore(localfs.New(afero.NewMemMapFs())),
+		BlobStore(blobStore),
+	)
+	require.Error(t, Upload(ctx, bundle))
+	for _, write := range []func() error{
+		func() error { return SetLabel(ctx, metaStore, repo, "other", uploaded.BundleID, model.Contributor{}) },
+		func() error { return DeleteLabel(ctx, metaStore, repo, "latest") },
+		func() error { return DeleteBundle(ctx, metaStore, repo, uploaded.BundleID, DeleteForce(true)) },
+		func() error {
+			_, _, e := PruneBundles(ctx, metaStore, repo, false)
+			return e
+		},
+	} {
+		err = write()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `locked by "test"`)
+	}
+	_, err = GetLabel(ctx, metaStore, repo, "latest")
+	require.NoError(t, err)
+	require.NoError(t, UnlockRepo(ctx, metaStore, repo))
+	require.NoError(t, UpdateRepo(ctx, metaStore, repo, RepoDescription("unlocked")))
+}
+
+func TestDeleteRepo(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": []byte("a")})
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", bundle.BundleID, model.Contributor{}))
+
+	err := DeleteRepo(ctx, metaStore, repo, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "must be forced")
+	require.NoError(t, RepoExists(ctx, repo, metaStore))
+
+	require.NoError(t, DeleteRepo(ctx, metaStore, repo, true))
+	require.Error(t, RepoExists(ctx, repo, metaStore))
+	for _, prefix := range []string{
+		model.GetArchivePathPrefixToBundles(repo),
+		model.GetArchivePathPrefixToLabels(repo),
+		model.GetArchivePathToRepoLock(repo),
+	} {
+		keys, err := listKeysPrefix(ctx, metaStore, prefix)
+		require.NoError(t, err)
+		require.Empty(t, keys, prefix)
+	}
+	refs, err := FindBlobReferences(ctx, bundle.BundleEntries[0].Hash, metaStore)
+	require.NoError(t, err)
+	require.Empty(t, refs)
+
+	require.NoError(t, CreateRepo(ctx, model.RepoDescriptor{Name: repo, Description: "empty"}, metaStore))
+	require.NoError(t, DeleteRepo(ctx, metaStore, repo, false))
+}
+
+func TestDeleteRepo_Resume(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": []byte("a")})
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", bundle.BundleID, model.Contributor{}))
+
+	// interrupted after the descriptor was deleted
+	l, err := newRepoLock("delete")
+	require.NoError(t, err)
+	_, err = l.lock(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.NoError(t, metaStore.Delete(ctx, model.GetArchivePathToRepoDescriptor(repo)))
+	require.Error(t, DeleteRepo(ctx, metaStore, repo, true))
+	require.Error(t, DeleteRepo(ctx, metaStore, repo, false, ResumeLock(l.Owner)))
+
+	require.NoError(t, DeleteRepo(ctx, metaStore, repo, true, ResumeLock(l.Owner)))
+	for _, prefix := range []string{
+		model.GetArchivePathPrefixToBundles(repo),
+		model.GetArchivePathPrefixToLabels(repo),
+		model.GetArchivePathToRepoLock(repo),
+	} {
+		keys, err := listKeysPrefix(ctx, metaStore, prefix)
+		require.NoError(t, err)
+		require.Empty(t, keys, prefix)
+	}
+
+	// nothing left to delete
+	err = DeleteRepo(ctx, metaStore, repo, true)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, storage.ErrNotFound))
+	has, err := metaStore.Has(ctx, model.GetArchivePathToRepoLock(repo))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestRenameRepo(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": []byte("a"), "b": []byte("b")})
+	require.NoError(t, SetLabel(ctx, metaStore, repo, "latest", bundle.BundleID, model.Contributor{}))
+	hash := bundle.BundleEntries[0].Hash
+
+	require.NoError(t, CopyRepo(ctx, metaStore, repo, "copy"))
+	require.NoError(t, RepoExists(ctx, repo, metaStore))
+	requireSameBundle(t, metaStore, blobStore, "copy", bundle)
+	label, err := GetLabel(ctx, metaStore, "copy", "latest")
+	require.NoError(t, err)
+	require.Equal(t, bundle.BundleID, label.BundleID)
+	refs, err := FindBlobReferences(ctx, hash, metaStore)
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+
+	err = CopyRepo(ctx, metaStore, repo, "copy")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already exists")
+
+	require.NoError(t, RenameRepo(ctx, metaStore, repo, "renamed"))
+	require.Error(t, RepoExists(ctx, repo, metaStore))
+	requireSameBundle(t, metaStore, blobStore, "renamed", bundle)
+	_, err = GetLabel(ctx, metaStore, repo, "latest")
+	require.Error(t, err)
+	_, err = GetLabel(ctx, metaStore, "renamed", "latest")
+	require.NoError(t, err)
+	refs, err = FindBlobReferences(ctx, hash, metaStore)
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	for _, ref := range refs {
+		require.NotEqual(t, repo, ref.Repo)
+	}
+	for _, name := range []string{"copy", "renamed"} {
+		has, err := metaStore.Has(ctx, model.GetArchivePathToRepoLock(name))
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+}
+
+func TestRenameRepo_Resume(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	blobStore := localfs.New(afero.NewMemMapFs())
+	bundle := uploadTestBundle(t, metaStore, blobStore, map[string][]byte{"a": []byte("a")})
+
+	// an interrupted rename left the locks and the new repo
+	rd, err := GetRepoDescriptorByRepoName(ctx, repo, metaStore)
+	require.NoError(t, err)
+	rd.Name = "renamed"
+	require.NoError(t, putRepoDescriptor(ctx, metaStore, rd, storage.IfNotPresent))
+	for _, name := range []string{repo, "renamed"} {
+		buffer, err := yaml.Marshal(model.RepoLock{Operation: "rename " + repo + " to renamed", Owner: "interrupted"})
+		require.NoError(t, err)
+		require.NoError(t, metaStore.Put(ctx, model.GetArchivePathToRepoLock(name), bytes.NewReader(buffer), storage.IfNotPresent))
+	}
+	require.Error(t, CopyRepo(ctx, metaStore, repo, "renamed", ResumeLock("interrupted")))
+	require.Error(t, RenameRepo(ctx, metaStore, repo, "renamed"))
+
+	require.NoError(t, RenameRepo(ctx, metaStore, repo, "renamed", ResumeLock("interrupted")))
+	require.Error(t, RepoExists(ctx, repo, metaStore))
+	requireSameBundle(t, metaStore, blobStore, "renamed", bundle)
+}
+
+func TestRepoLock_Owner(t *testing.T) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+
+	first, err := newRepoLock("update")
+	require.NoError(t, err)
+	second, err := newRepoLock("update")
+	require.NoError(t, err)
+	require.NotEqual(t, first.Owner, second.Owner)
+
+	// another call of the same operation neither resumes nor releases the lock
+	resumed, err := first.lock(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.False(t, resumed)
+	_, err = second.lock(ctx, metaStore, repo)
+	require.Error(t, err)
+	require.Error(t, second.unlock(ctx, metaStore, repo))
+	has, err := metaStore.Has(ctx, model.GetArchivePathToRepoLock(repo))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	resuming, err := newRepoLock("update", ResumeLock(first.Owner))
+	require.NoError(t, err)
+	resumed, err = resuming.lock(ctx, metaStore, repo)
+	require.NoError(t, err)
+	require.True(t, resumed)
+	other, err := newRepoLock("delete", ResumeLock(first.Owner))
+	require.NoError(t, err)
+	_, err = other.lock(ctx, metaStore, repo)
+	require.Error(t, err)
+
+	require.NoError(t, first.unlock(ctx, metaStore, repo))
+	has, err = metaStore.Has(ctx, model.GetArchivePathToRepoLock(repo))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, first.unlock(ctx, metaStore, repo))
+}
+
+func requireSameBundle(t *testing.T, metaStore, blobStore storage.Store, repoName string, expected *Bundle) {
+	actual := New(NewBDescriptor(),
+		Repo(repoName),
+		BundleID(expected.BundleID),
+		MetaStore(metaStore),
+		BlobStore(blobStore),
+		ConsumableStore(localfs.New(afero.NewMemMapFs())),
+	)
+	require.NoError(t, Publish(context.Background(), actual))
+	require.Equal(t, expected.BundleEntries, actual.BundleEntries)
+}
@@ -8,13 +8,13 @@ import (
 	"github.com/oneconcern/datamon/pkg/storage"
 )
 
-func RepoExists(repo string, store storage.Store) error {
-	exists, err := store.Has(context.Background(), model.GetArchivePathToRepoDescriptor(repo))
+func RepoExists(ctx context.Context, repo string, store storage.Store) error {
+	exists, err := store.Has(ctx, model.GetArchivePathToRepoDescriptor(repo))
 	if err != nil {
 		return fmt.Errorf("repo validation failed: Hit err:%s", err)
 	}
 	if !exists {
-		return fmt.Errorf("repo validation: Repo:%s does not exist", repo)
+		return storage.NotFoundf("repo validation: Repo:%s does not exist", repo)
 	}
 	return nil
 }
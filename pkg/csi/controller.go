@@ -2,63 +2,379 @@ package csi
 
 import (
 	"context"
+	"sort"
+	"strings"
 
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
 )
 
-type controllerServer struct { //nolint:unused
+// Volumes are views of bundles: creating a volume pins the bundle it starts from in the attributes of the volume,
+// and nothing is stored until a mutable volume commits. Snapshots are bundles, with the ID <repo>/<bundle>.
+type controllerServer struct {
+	driver *Driver
+	node   *nodeServer
+	l      *zap.Logger
+}
+
+type controllerServerConfig struct {
+	driver *Driver
+	// node publishes the mutable volumes the controller snapshots, nil without node service
+	node *nodeServer
+}
+
+func newControllerServer(config *controllerServerConfig) csi.ControllerServer {
+	return &controllerServer{
+		driver: config.driver,
+		node:   config.node,
+		l:      config.driver.Config.Logger.With(zap.String("service", "controller")),
+	}
+}
+
+func snapshotID(repo, bundleID string) string {
+	return repo + "/" + bundleID
 }
 
-type controllerServerConfig struct { //nolint:unused
+func parseSnapshotID(id string) (repo, bundleID string, err error) {
+	i := strings.LastIndex(id, "/")
+	if i <= 0 || i == len(id)-1 {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid snapshot id %q, expected <repo>/<bundle>", id)
+	}
+	return id[:i], id[i+1:], nil
 }
 
-func newControllerServer(config *controllerServerConfig) csi.ControllerServer { // nolint:deadcode,unparam,unused
-	return &controllerServer{}
+func newSnapshot(repo, volumeID string, bd model.BundleDescriptor) *csi.Snapshot {
+	return &csi.Snapshot{
+		Id:             snapshotID(repo, bd.ID),
+		SourceVolumeId: volumeID,
+		CreatedAt:      bd.Timestamp.UnixNano(),
+		Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+	}
+}
+
+// validateCapabilities checks that volumes are file systems, mutable volumes written by a single node
+func validateCapabilities(capabilities []*csi.VolumeCapability, mode string) error {
+	if len(capabilities) == 0 {
+		return status.Error(codes.InvalidArgument, "missing volume capabilities")
+	}
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "datamon volumes are file systems, not block devices")
+		}
+		switch capability.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			if mode == modeMutable {
+				return status.Error(codes.InvalidArgument, "mutable volumes are written by a single node")
+			}
+		}
+	}
+	return nil
 }
 
 func (s *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	return nil, nil
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume name")
+	}
+	attrs := make(map[string]string, len(req.GetParameters()))
+	for k, v := range req.GetParameters() {
+		attrs[k] = v
+	}
+	if attrs[attrMode] == "" {
+		attrs[attrMode] = modeReadOnly
+	}
+	mode := attrs[attrMode]
+	if mode != modeReadOnly && mode != modeMutable {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown mode %q, expected %s or %s", mode, modeReadOnly, modeMutable)
+	}
+	if err := validateCapabilities(req.GetVolumeCapabilities(), mode); err != nil {
+		return nil, err
+	}
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		repo, bundleID, err := parseSnapshotID(snapshot.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if attrs[attrRepo] != "" && attrs[attrRepo] != repo {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is not a bundle of repo %s", snapshot.GetId(), attrs[attrRepo])
+		}
+		attrs[attrRepo], attrs[attrBundle] = repo, bundleID
+		delete(attrs, attrSourceLabel)
+		if mode == modeReadOnly {
+			delete(attrs, attrLabel)
+		}
+	}
+	repo := attrs[attrRepo]
+	if repo == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s parameter", attrRepo)
+	}
+	if _, err := s.driver.client.GetRepo(ctx, repo); err != nil {
+		return nil, statusError(err)
+	}
+
+	// pins the bundle the volume starts from
+	switch mode {
+	case modeReadOnly:
+		bundleID, err := s.driver.resolve(ctx, repo, attrs[attrBundle], attrs[attrLabel])
+		if err != nil {
+			return nil, statusError(err)
+		}
+		attrs[attrBundle] = bundleID
+		delete(attrs, attrLabel)
+	case modeMutable:
+		if attrs[attrBundle] != "" || attrs[attrSourceLabel] != "" {
+			bundleID, err := s.driver.resolve(ctx, repo, attrs[attrBundle], attrs[attrSourceLabel])
+			if err != nil {
+				return nil, statusError(err)
+			}
+			attrs[attrBundle] = bundleID
+			delete(attrs, attrSourceLabel)
+		}
+	}
+	if attrs[attrBundle] != "" {
+		if _, err := s.driver.client.GetBundle(ctx, repo, attrs[attrBundle]); err != nil {
+			return nil, statusError(err)
+		}
+	}
+	s.l.Info("created volume", zap.String("volume", req.GetName()), zap.String("repo", repo),
+		zap.String("bundle", attrs[attrBundle]), zap.String("mode", mode))
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			Id:            req.GetName(),
+			Attributes:    attrs,
+			ContentSource: req.GetVolumeContentSource(),
+		},
+	}, nil
 }
 
+// DeleteVolume keeps the bundles of the volume, volumes are only views of bundles.
+// The snapshot requests of the volume are deleted.
 func (s *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	return nil, nil
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if err := s.deleteSnapshotRequests(ctx, req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "delete snapshot requests of volume %s: %v", req.GetVolumeId(), err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (s *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, nil
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if err := validateCapabilities(req.GetVolumeCapabilities(), req.GetVolumeAttributes()[attrMode]); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: status.Convert(err).Message()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true}, nil
 }
 
 func (s *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	return nil, nil
+	var capabilities []*csi.ControllerServiceCapability
+	for _, c := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	} {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
 func (s *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (s *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (s *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (s *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// CreateSnapshot commits the files of a mutable volume as a new bundle, with the previous snapshot as parent,
+// or the bundle the volume started from for the first one. The snapshot of a read only volume is its bundle.
+//
+// The files of a volume are on the node publishing it: the controller snapshots the volumes published by the node
+// service of its own plugin, and requests the snapshots of the other volumes from their node, see requestSnapshot.
 func (s *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	id, name := req.GetSourceVolumeId(), req.GetName()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing source volume id")
+	}
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing snapshot name")
+	}
+	repo, bundleID, err := s.snapshot(ctx, id, name)
+	if err != nil {
+		return nil, err
+	}
+	bd, err := s.driver.client.GetBundle(ctx, repo, bundleID)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: newSnapshot(repo, id, bd)}, nil
+}
+
+// snapshot snapshots a volume published by the node of the controller, or requests the snapshot from its node
+func (s *controllerServer) snapshot(ctx context.Context, id, name string) (string, string, error) {
+	if s.node != nil {
+		repo, bundleID, err := s.node.snapshot(id, name)
+		if status.Code(err) != codes.FailedPrecondition {
+			return repo, bundleID, err
+		}
+	}
+	return s.requestSnapshot(ctx, id, name)
 }
 
+// DeleteSnapshot keeps the bundle of the snapshot: bundles are the history of repos,
+// pruned with the retention of the repo
 func (s *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing snapshot id")
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots lists the bundles of a snapshot, of the snapshots of a volume, or of all the repos.
+// Tokens are <repo>/<token of the bundles of the repo>.
 func (s *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	switch {
+	case req.GetSnapshotId() != "":
+		repo, bundleID, err := parseSnapshotID(req.GetSnapshotId())
+		if err != nil {
+			return nil, err
+		}
+		bd, err := s.driver.client.GetBundle(ctx, repo, bundleID)
+		if status.Code(statusError(err)) == codes.NotFound {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if err != nil {
+			return nil, statusError(err)
+		}
+		return &csi.ListSnapshotsResponse{
+			Entries: []*csi.ListSnapshotsResponse_Entry{{Snapshot: newSnapshot(repo, "", bd)}},
+		}, nil
+	case req.GetSourceVolumeId() != "":
+		return s.listVolumeSnapshots(ctx, req.GetSourceVolumeId())
+	default:
+		return s.listAllSnapshots(ctx, int(req.GetMaxEntries()), req.GetStartingToken())
+	}
+}
+
+// listVolumeSnapshots lists the snapshots of a volume taken by the node of the controller, or by the node publishing it
+func (s *controllerServer) listVolumeSnapshots(ctx context.Context, id string) (*csi.ListSnapshotsResponse, error) {
+	answered, err := s.answeredSnapshots(ctx, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "list snapshot requests of volume %s: %v", id, err)
+	}
+	bundles := make(map[string]string, len(answered))
+	for _, req := range answered {
+		bundles[req.BundleID] = req.Repo
+	}
+	if s.node != nil {
+		unlock := s.node.lock(id)
+		if v, ok := s.node.volume(id); ok {
+			for _, bundleID := range v.snapshots {
+				bundles[bundleID] = v.repo
+			}
+		}
+		unlock()
+	}
+	bundleIDs := make([]string, 0, len(bundles))
+	for bundleID := range bundles {
+		bundleIDs = append(bundleIDs, bundleID)
+	}
+	sort.Strings(bundleIDs)
+	resp := &csi.ListSnapshotsResponse{}
+	for _, bundleID := range bundleIDs {
+		bd, err := s.driver.client.GetBundle(ctx, bundles[bundleID], bundleID)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newSnapshot(bundles[bundleID], id, bd)})
+	}
+	return resp, nil
+}
+
+func (s *controllerServer) listAllSnapshots(ctx context.Context, max int, token string) (*csi.ListSnapshotsResponse, error) {
+	var startRepo, bundleToken string
+	if token != "" {
+		i := strings.Index(token, "/")
+		if i <= 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid token %q", token)
+		}
+		startRepo, bundleToken = token[:i], token[i+1:]
+	}
+	repos, err := s.repos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.SearchStrings(repos, startRepo)
+	if token != "" && (i == len(repos) || repos[i] != startRepo) {
+		return nil, status.Errorf(codes.Aborted, "invalid token %q: repo %s not found", token, startRepo)
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for ; i < len(repos); i++ {
+		repo := repos[i]
+		if max > 0 && len(resp.Entries) == max {
+			resp.NextToken = repo + "/"
+			break
+		}
+		opts := []core.ListOption{core.ListToken(bundleToken)}
+		if max > 0 {
+			opts = append(opts, core.ListLimit(max-len(resp.Entries)))
+		}
+		bundles, next, err := s.driver.client.ListBundles(ctx, repo, opts...)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		for _, bd := range bundles {
+			resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: newSnapshot(repo, "", bd)})
+		}
+		if next != "" {
+			resp.NextToken = repo + "/" + next
+			break
+		}
+		bundleToken = ""
+	}
+	return resp, nil
+}
+
+// repos returns the names of all the repos, sorted
+func (s *controllerServer) repos(ctx context.Context) ([]string, error) {
+	var (
+		names []string
+		token string
+	)
+	for {
+		repos, next, err := s.driver.client.ListRepos(ctx, core.ListToken(token))
+		if err != nil {
+			return nil, statusError(err)
+		}
+		for _, r := range repos {
+			names = append(names, r.Name)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	sort.Strings(names)
+	return names, nil
 }
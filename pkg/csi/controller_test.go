@@ -0,0 +1,362 @@
+package csi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+// startDriver serves the node and controller services of a driver on a unix socket
+func startDriver(t *testing.T, c *client.Client, dir string) (*grpc.ClientConn, func()) {
+	return startPlugin(t, c, dir, "node-1", true)
+}
+
+// startPlugin serves the node service of a driver on a unix socket, and its controller service when enabled
+func startPlugin(t *testing.T, c *client.Client, dir, nodeID string, controller bool) (*grpc.ClientConn, func()) {
+	driver := NewDriver(Config{
+		NodeID:               nodeID,
+		StagingDir:           filepath.Join(dir, "staging"),
+		SnapshotPollInterval: 10 * time.Millisecond,
+	}, c)
+	driver.mounter = dirMounter{client: c}
+	socket := filepath.Join(dir, "csi.sock")
+	driver.Start("unix://"+socket, true, controller)
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	require.NoError(t, err)
+	return conn, func() {
+		_ = conn.Close()
+		driver.Stop()
+	}
+}
+
+func uploadFiles(t *testing.T, c *client.Client, repo string, files map[string]string) string {
+	dir, done := tempDir(t)
+	defer done()
+	for name, content := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	bd, err := c.UploadDir(context.Background(), repo, dir, client.UploadMessage("test"))
+	require.NoError(t, err)
+	return bd.ID
+}
+
+func bundleFiles(t *testing.T, c *client.Client, repo, bundleID string) []string {
+	entries, err := c.ListFiles(context.Background(), repo, bundleID)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.NameWithPath)
+	}
+	return names
+}
+
+func TestController(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	base := uploadFiles(t, c, repo, map[string]string{"a.txt": "a"})
+	_, err := c.SetLabel(ctx, repo, "prod", base)
+	require.NoError(t, err)
+	conn, stop := startDriver(t, c, dir)
+	defer stop()
+	cs, ns := csi.NewControllerClient(conn), csi.NewNodeClient(conn)
+
+	caps, err := cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Len(t, caps.Capabilities, 3)
+
+	// a mutable volume starting from the bundle of a label
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{attrRepo: repo, attrMode: modeMutable, attrSourceLabel: "prod", attrLabel: "output"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "pvc-1", vol.Volume.Id)
+	require.Equal(t, map[string]string{attrRepo: repo, attrMode: modeMutable, attrBundle: base, attrLabel: "output"},
+		vol.Volume.Attributes)
+
+	target := filepath.Join(dir, "target")
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         vol.Volume.Id,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(),
+		VolumeAttributes: vol.Volume.Attributes,
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "b.txt"), []byte("b"), 0600))
+
+	// snapshots commit the volume as a bundle derived from the source
+	snap, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-1"})
+	require.NoError(t, err)
+	require.Equal(t, "pvc-1", snap.Snapshot.SourceVolumeId)
+	require.Equal(t, csi.SnapshotStatus_READY, snap.Snapshot.Status.Type)
+	again, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-1"})
+	require.NoError(t, err)
+	require.Equal(t, snap.Snapshot.Id, again.Snapshot.Id, "snapshots are idempotent")
+	snapRepo, snapBundle, err := parseSnapshotID(snap.Snapshot.Id)
+	require.NoError(t, err)
+	require.Equal(t, repo, snapRepo)
+	bd, err := c.GetBundle(ctx, repo, snapBundle)
+	require.NoError(t, err)
+	require.Equal(t, []string{base}, bd.Parents)
+	require.ElementsMatch(t, []string{"a.txt", "b.txt"}, bundleFiles(t, c, repo, snapBundle))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "c.txt"), []byte("c"), 0600))
+	snap2, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-2"})
+	require.NoError(t, err)
+	require.NotEqual(t, snap.Snapshot.Id, snap2.Snapshot.Id)
+	_, snap2Bundle, err := parseSnapshotID(snap2.Snapshot.Id)
+	require.NoError(t, err)
+	bd, err = c.GetBundle(ctx, repo, snap2Bundle)
+	require.NoError(t, err)
+	require.Equal(t, []string{snapBundle}, bd.Parents)
+
+	list, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"})
+	require.NoError(t, err)
+	require.Len(t, list.Entries, 2)
+	list, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: snap.Snapshot.Id})
+	require.NoError(t, err)
+	require.Len(t, list.Entries, 1)
+	require.Equal(t, snap.Snapshot.Id, list.Entries[0].Snapshot.Id)
+	list, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: repo + "/missing"})
+	require.NoError(t, err)
+	require.Empty(t, list.Entries)
+
+	// a read only volume restored from a snapshot
+	restored, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-2",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{Id: snap2.Snapshot.Id},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{attrRepo: repo, attrMode: modeReadOnly, attrBundle: snap2Bundle}, restored.Volume.Attributes)
+
+	// unpublishing commits and labels the last state
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "d.txt"), []byte("d"), 0600))
+	_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: target})
+	require.NoError(t, err)
+	label, err := c.GetLabel(ctx, repo, "output")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a.txt", "b.txt", "c.txt", "d.txt"}, bundleFiles(t, c, repo, label.BundleID))
+	// no node publishes the volume anymore
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = cs.CreateSnapshot(timeout, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-3"})
+	requireCode(t, codes.DeadlineExceeded, err)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err)
+}
+
+// syncStore serializes the reads and writes of objects, the plugins read the snapshot requests while they are
+// written and the files of the memory fs are truncated without lock
+type syncStore struct {
+	storage.Store
+	sync.Mutex
+}
+
+func (s *syncStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.Store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *syncStore) Put(ctx context.Context, key string, source io.Reader, exclusive bool) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.Store.Put(ctx, key, source, exclusive)
+}
+
+func TestController_SnapshotOtherNode(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	for _, plugin := range []string{"controller", "node"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, plugin), 0700))
+	}
+	c := newTestClientWithMeta(t, &syncStore{Store: localfs.New(afero.NewMemMapFs())})
+	base := uploadFiles(t, c, repo, map[string]string{"a.txt": "a"})
+	conn, stop := startPlugin(t, c, filepath.Join(dir, "controller"), "node-1", true)
+	defer stop()
+	nodeConn, stopNode := startPlugin(t, c, filepath.Join(dir, "node"), "node-2", false)
+	defer stopNode()
+	cs, ns := csi.NewControllerClient(conn), csi.NewNodeClient(nodeConn)
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{attrRepo: repo, attrMode: modeMutable, attrBundle: base},
+	})
+	require.NoError(t, err)
+	target := filepath.Join(dir, "target")
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         vol.Volume.Id,
+		TargetPath:       target,
+		VolumeCapability: mountCapability(),
+		VolumeAttributes: vol.Volume.Attributes,
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "b.txt"), []byte("b"), 0600))
+
+	// the node publishing the volume commits it for the controller
+	snap, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-1"})
+	require.NoError(t, err)
+	require.Equal(t, "pvc-1", snap.Snapshot.SourceVolumeId)
+	again, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "pvc-1", Name: "snap-1"})
+	require.NoError(t, err)
+	require.Equal(t, snap.Snapshot.Id, again.Snapshot.Id, "snapshots are idempotent")
+	_, snapBundle, err := parseSnapshotID(snap.Snapshot.Id)
+	require.NoError(t, err)
+	bd, err := c.GetBundle(ctx, repo, snapBundle)
+	require.NoError(t, err)
+	require.Equal(t, []string{base}, bd.Parents)
+	require.ElementsMatch(t, []string{"a.txt", "b.txt"}, bundleFiles(t, c, repo, snapBundle))
+
+	list, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"})
+	require.NoError(t, err)
+	require.Len(t, list.Entries, 1)
+	require.Equal(t, snap.Snapshot.Id, list.Entries[0].Snapshot.Id)
+
+	_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: target})
+	require.NoError(t, err)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+	require.NoError(t, err)
+	list, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-1"})
+	require.NoError(t, err)
+	require.Empty(t, list.Entries)
+}
+
+func TestController_ListAllSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	_, err := c.CreateRepo(ctx, "other-repo", "other")
+	require.NoError(t, err)
+	var want []string
+	for _, r := range []string{repo, repo, "other-repo"} {
+		want = append(want, snapshotID(r, uploadFiles(t, c, r, map[string]string{"a.txt": r})))
+	}
+	conn, stop := startDriver(t, c, dir)
+	defer stop()
+	cs := csi.NewControllerClient(conn)
+
+	list, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Entries, 3)
+	require.Empty(t, list.NextToken)
+
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 5, "paging ends")
+		list, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{MaxEntries: 1, StartingToken: token})
+		require.NoError(t, err)
+		for _, e := range list.Entries {
+			got = append(got, e.Snapshot.Id)
+		}
+		if token = list.NextToken; token == "" {
+			break
+		}
+	}
+	require.ElementsMatch(t, want, got)
+
+	_, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{StartingToken: "unknown-repo/x"})
+	requireCode(t, codes.Aborted, err)
+}
+
+func TestController_Errors(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	conn, stop := startDriver(t, c, dir)
+	defer stop()
+	cs := csi.NewControllerClient(conn)
+
+	multiWriter := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	for _, tc := range []struct {
+		name string
+		req  *csi.CreateVolumeRequest
+		code codes.Code
+	}{
+		{"missing name", &csi.CreateVolumeRequest{VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters: map[string]string{attrRepo: repo}}, codes.InvalidArgument},
+		{"missing repo", &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()}},
+			codes.InvalidArgument},
+		{"missing capabilities", &csi.CreateVolumeRequest{Name: "v", Parameters: map[string]string{attrRepo: repo}},
+			codes.InvalidArgument},
+		{"multi writer", &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{multiWriter},
+			Parameters: map[string]string{attrRepo: repo, attrMode: modeMutable}}, codes.InvalidArgument},
+		{"unknown repo", &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters: map[string]string{attrRepo: "missing", attrMode: modeMutable}}, codes.NotFound},
+		{"empty repo", &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters: map[string]string{attrRepo: repo}}, codes.NotFound},
+		{"unknown bundle", &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters: map[string]string{attrRepo: repo, attrMode: modeMutable, attrBundle: "missing"}}, codes.NotFound},
+	} {
+		_, err := cs.CreateVolume(ctx, tc.req)
+		require.Error(t, err, tc.name)
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
+
+	// a mutable volume may start empty
+	_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters: map[string]string{attrRepo: repo, attrMode: modeMutable}})
+	require.NoError(t, err)
+
+	valid, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "v",
+		VolumeCapabilities: []*csi.VolumeCapability{multiWriter},
+		VolumeAttributes:   map[string]string{attrRepo: repo, attrMode: modeMutable},
+	})
+	require.NoError(t, err)
+	require.False(t, valid.Supported)
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = cs.CreateSnapshot(timeout, &csi.CreateSnapshotRequest{SourceVolumeId: "v", Name: "s"})
+	requireCode(t, codes.DeadlineExceeded, err)
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "v", VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{Id: "invalid"}},
+		}})
+	requireCode(t, codes.InvalidArgument, err)
+}
@@ -1,10 +1,168 @@
 package csi
 
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
+)
+
+// DriverName is the name of the datamon CSI plugin, the provisioner of storage classes
+const DriverName = "datamon.oneconcern.com"
+
+// Driver serves datamon volumes to container orchestrators with the CSI services
 type Driver struct {
-	Config Config
+	Config     Config
+	client     *client.Client
+	mounter    mounter
+	server     NonBlockingGRPCServer
+	controller bool
+	// stop stops answering snapshot requests
+	stop chan struct{}
 }
 
 type Config struct {
-	Name    string
+	Name string
+	// Version is the version of the plugin, the version of the build by default
 	Version string
+	// NodeID identifies the node publishing volumes, the name of the kubernetes node
+	NodeID string
+	// StagingDir holds the caches of read only volumes and the files written to mutable volumes, with the records
+	// of the published volumes to unpublish them after the plugin restarted. It must survive the plugin.
+	StagingDir string
+	// SnapshotPollInterval is how often the nodes look for the snapshots requested by the controller,
+	// and the controller for their answers, a second by default
+	SnapshotPollInterval time.Duration
+	Logger               *zap.Logger
+}
+
+// NewDriver creates a driver serving the repos of a client
+func NewDriver(config Config, c *client.Client) *Driver {
+	if config.Name == "" {
+		config.Name = DriverName
+	}
+	if config.Version == "" {
+		config.Version = buildVersion()
+	}
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.SnapshotPollInterval == 0 {
+		config.SnapshotPollInterval = defaultSnapshotPollInterval
+	}
+	return &Driver{
+		Config:  config,
+		client:  c,
+		mounter: clientMounter{client: c},
+		server:  NewNonBlockingGRPCServer(),
+	}
+}
+
+// Run serves the identity service, and the node and controller services when enabled, on an endpoint
+// such as unix:///csi/csi.sock. It returns when the driver is stopped.
+func (d *Driver) Run(endpoint string, node, controller bool) {
+	d.Start(endpoint, node, controller)
+	d.server.Wait()
+}
+
+// Start serves the services of the driver in the background.
+// The controller snapshots the mutable volumes published by the node service of the same driver,
+// the node service answers the snapshot requests of the controller for the other volumes.
+func (d *Driver) Start(endpoint string, node, controller bool) {
+	var (
+		ns *nodeServer
+		cs csi.ControllerServer
+	)
+	if node {
+		ns = newNodeServer(d, d.mounter)
+		d.stop = make(chan struct{})
+		go ns.answerSnapshots(d.stop)
+	}
+	d.controller = controller
+	if controller {
+		cs = newControllerServer(&controllerServerConfig{driver: d, node: ns})
+	}
+	if ns == nil {
+		// a nil *nodeServer is not a nil csi.NodeServer
+		d.server.Start(endpoint, newIdentityServer(d), cs, nil, d.Config.Logger)
+		return
+	}
+	d.server.Start(endpoint, newIdentityServer(d), cs, ns, d.Config.Logger)
+}
+
+// Stop stops serving, after the pending calls complete
+func (d *Driver) Stop() {
+	if d.stop != nil {
+		close(d.stop)
+	}
+	d.server.Stop()
+}
+
+// buildVersion returns the version of the module of the binary, or the revision it was built from
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// resolve returns the bundle of a volume, selected by ID or label, the latest bundle of the repo by default
+func (d *Driver) resolve(ctx context.Context, repo, bundleID, label string) (string, error) {
+	switch {
+	case bundleID != "":
+		return bundleID, nil
+	case label != "":
+		l, err := d.client.GetLabel(ctx, repo, label)
+		return l.BundleID, err
+	default:
+		return d.client.LatestBundle(ctx, repo)
+	}
+}
+
+// statusError converts the errors of the client to gRPC status errors
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch client.Kind(err) {
+	case client.ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case client.ErrExists:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case client.ErrForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case client.ErrIO:
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
 }
@@ -2,16 +2,31 @@ package csi
 
 import (
 	"context"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
 )
 
-type identityServer struct { //nolint:unused
+// probeTimeout bounds the time stores have to respond to a probe
+const probeTimeout = 10 * time.Second
+
+type identityServer struct {
 	driver *Driver
+	l      *zap.Logger
 }
 
-func newIdentityServer(driver *Driver) csi.IdentityServer { // nolint:deadcode,unused
-	return &identityServer{driver: driver}
+func newIdentityServer(driver *Driver) csi.IdentityServer {
+	return &identityServer{
+		driver: driver,
+		l:      driver.Config.Logger.With(zap.String("service", "identity")),
+	}
 }
 
 func (s *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -22,19 +37,36 @@ func (s *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginIn
 }
 
 func (s *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	resp := &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{},
+	}
+	if s.driver.controller {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-		},
-	}, nil
+		})
+	}
+	return resp, nil
 }
 
+// Probe checks that the metadata and blob stores respond. The plugin is ready once they do,
+// and unhealthy when they refuse the credentials or miss buckets.
 func (s *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	err := s.driver.client.Ping(ctx)
+	if err == nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+	switch client.Kind(err) {
+	case client.ErrForbidden:
+		return nil, status.Errorf(codes.PermissionDenied, "stores refuse the credentials: %v", err)
+	case client.ErrNotFound:
+		return nil, status.Errorf(codes.FailedPrecondition, "missing store: %v", err)
+	}
+	s.l.Warn("stores are not ready", zap.Error(err))
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
 }
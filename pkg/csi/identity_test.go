@@ -0,0 +1,89 @@
+package csi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+// failingStore is a store failing to answer
+type failingStore struct {
+	storage.Store
+	err error
+}
+
+func (s failingStore) Has(context.Context, string) (bool, error) {
+	return false, s.err
+}
+
+func TestIdentityServer(t *testing.T) {
+	ctx := context.Background()
+	driver := NewDriver(Config{NodeID: "node-1"}, newTestClient(t))
+	ids := newIdentityServer(driver)
+
+	info, err := ids.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, DriverName, info.Name)
+	require.NotEmpty(t, info.VendorVersion)
+
+	caps, err := ids.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Empty(t, caps.Capabilities)
+	driver.controller = true
+	caps, err = ids.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Len(t, caps.Capabilities, 1)
+	require.Equal(t, csi.PluginCapability_Service_CONTROLLER_SERVICE, caps.Capabilities[0].GetService().Type)
+
+	probe, err := ids.Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err)
+	require.True(t, probe.Ready.Value)
+}
+
+func TestIdentityServer_Probe(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "unavailable", err: errors.New("connection reset"), code: codes.OK},
+		{name: "forbidden", err: storage.Forbiddenf("bucket"), code: codes.PermissionDenied},
+		{name: "missing bucket", err: storage.NotFoundf("bucket"), code: codes.FailedPrecondition},
+	} {
+		c, err := client.New(client.Config{Contributor: model.Contributor{Name: "test", Email: "t@test.com"}},
+			client.MetaStore(localfs.New(afero.NewMemMapFs())),
+			client.BlobStore(failingStore{Store: localfs.New(afero.NewMemMapFs()), err: tc.err}),
+		)
+		require.NoError(t, err)
+		probe, err := newIdentityServer(NewDriver(Config{}, c)).Probe(context.Background(), &csi.ProbeRequest{})
+		if tc.code != codes.OK {
+			requireCode(t, tc.code, err)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.False(t, probe.Ready.Value, tc.name)
+	}
+
+	// a missing directory is a missing store, not a missing key
+	dir, done := tempDir(t)
+	defer done()
+	c, err := client.New(client.Config{Contributor: model.Contributor{Name: "test", Email: "t@test.com"}},
+		client.MetaStore(localfs.New(afero.NewMemMapFs())),
+		client.BlobStore(localfs.New(afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(dir, "missing")))),
+	)
+	require.NoError(t, err)
+	_, err = newIdentityServer(NewDriver(Config{}, c)).Probe(context.Background(), &csi.ProbeRequest{})
+	requireCode(t, codes.FailedPrecondition, err)
+}
@@ -0,0 +1,120 @@
+package csi
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/core"
+)
+
+// mounter mounts the FUSE file systems of volumes
+type mounter interface {
+	mountReadOnly(ctx context.Context, repo, bundleID, target, cacheDir string) (filesystem, error)
+	mountMutable(ctx context.Context, repo, parentID, target, stagingDir, message string) (mutableFilesystem, error)
+	// recoverMutable recovers the files staged by a mutable volume mounted before the plugin restarted.
+	// The error is of kind client.ErrNotFound when nothing was staged.
+	recoverMutable(ctx context.Context, stagingDir string) (mutableFilesystem, error)
+	// unmount unmounts what is left mounted at a target, it succeeds when nothing is mounted
+	unmount(target string) error
+}
+
+type filesystem interface {
+	Unmount(path string) error
+}
+
+type mutableFilesystem interface {
+	filesystem
+	Commit() error
+	BundleID() string
+}
+
+// clientMounter mounts bundles with a datamon client
+type clientMounter struct {
+	client *client.Client
+}
+
+func (m clientMounter) mountReadOnly(ctx context.Context, repo, bundleID, target, cacheDir string) (filesystem, error) {
+	fs, err := m.client.Mount(ctx, repo, bundleID, target, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (m clientMounter) mountMutable(ctx context.Context, repo, parentID, target, stagingDir, message string) (mutableFilesystem, error) {
+	fs, err := m.client.MountMutable(ctx, repo, parentID, target, stagingDir, client.UploadMessage(message))
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (m clientMounter) recoverMutable(ctx context.Context, stagingDir string) (mutableFilesystem, error) {
+	fs, err := m.client.RecoverMutable(ctx, stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	return recoveredFS{fs}, nil
+}
+
+func (m clientMounter) unmount(target string) error {
+	return unmount(target)
+}
+
+// recoveredFS is a recovered mutable file system, not mounted anymore since the plugin restarted
+type recoveredFS struct {
+	*core.MutableFS
+}
+
+func (fs recoveredFS) Unmount(path string) error {
+	if err := unmount(path); err != nil {
+		return err
+	}
+	return fs.Close()
+}
+
+// staleFS is a read only file system mounted before the plugin restarted
+type staleFS struct {
+	m mounter
+}
+
+func (fs staleFS) Unmount(path string) error {
+	return fs.m.unmount(path)
+}
+
+// unmount unmounts a FUSE file system, left by a plugin that died or already unmounted
+func unmount(target string) error {
+	err := fuse.Unmount(target)
+	if err == nil {
+		return nil
+	}
+	if mounted, merr := isMountPoint(target); merr == nil && !mounted {
+		return nil
+	}
+	return err
+}
+
+// isMountPoint tells whether a file system is mounted at a path, from the mounts of the process
+func isMountPoint(path string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	// mount points are the fifth field, with spaces escaped
+	target := strings.Replace(filepath.Clean(path), " ", "\\040", -1)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[4] == target {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
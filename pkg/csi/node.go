@@ -2,41 +2,407 @@ package csi
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
+)
+
+// Attributes of datamon volumes, set by storage classes and inline volumes
+const (
+	// attrRepo is the repo of the volume
+	attrRepo = "repo"
+	// attrBundle is the bundle of a read only volume, the latest bundle of the repo by default,
+	// or the bundle a mutable volume starts from
+	attrBundle = "bundle"
+	// attrLabel is the label of the bundle of a read only volume,
+	// or the label set on the bundles committed by a mutable volume
+	attrLabel = "label"
+	// attrSourceLabel is the label of the bundle a mutable volume starts from
+	attrSourceLabel = "sourceLabel"
+	// attrMode is ro for read only volumes and rw for mutable volumes, that commit a new bundle when unpublished
+	attrMode = "mode"
+	// attrMessage is the message of the bundle committed by a mutable volume
+	attrMessage = "message"
+
+	modeReadOnly = "ro"
+	modeMutable  = "rw"
 )
 
-type nodeServer struct { //nolint:unused
+// volume is a volume published on the node
+type volume struct {
+	id     string
+	target string
+	repo   string
+	mode   string
+	label  string
+	// dir caches the files read from a read only volume, and stages the files written to a mutable volume
+	dir string
+	// bundleID is the bundle of a read only volume, or the bundle last committed by a mutable volume
+	bundleID string
+	// parentID is the bundle a mutable volume starts from
+	parentID  string
+	fs        filesystem
+	mutable   mutableFilesystem
+	committed bool
+	// snapshots maps the names of the snapshots of a mutable volume to their bundles
+	snapshots map[string]string
+}
+
+// volumeRecord is the state of a published volume, saved to the staging directory of the plugin
+// to unpublish the volume after the plugin restarted
+type volumeRecord struct {
+	ID        string `json:"id"`
+	Target    string `json:"target"`
+	Repo      string `json:"repo"`
+	Mode      string `json:"mode"`
+	Label     string `json:"label,omitempty"`
+	BundleID  string `json:"bundle,omitempty"`
+	ParentID  string `json:"parent,omitempty"`
+	Committed bool   `json:"committed,omitempty"`
+}
+
+type nodeServer struct {
+	driver  *Driver
+	mounter mounter
+	l       *zap.Logger
+
+	// mu guards the maps only: the calls on a volume hold the lock of its ID, so the volumes
+	// are mounted and committed without blocking the calls on other volumes
+	mu      sync.Mutex
+	volumes map[string]*volume
+	locks   map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newNodeServer(driver *Driver, m mounter) *nodeServer {
+	return &nodeServer{
+		driver:  driver,
+		mounter: m,
+		l:       driver.Config.Logger.With(zap.String("service", "node")),
+		volumes: make(map[string]*volume),
+		locks:   make(map[string]*volumeLock),
+	}
+}
+
+// lock locks a volume ID, published or not, and returns the function unlocking it
+func (n *nodeServer) lock(id string) func() {
+	n.mu.Lock()
+	l, ok := n.locks[id]
+	if !ok {
+		l = &volumeLock{}
+		n.locks[id] = l
+	}
+	l.refs++
+	n.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		n.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(n.locks, id)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// volume returns a published volume, the caller holds the lock of its ID
+func (n *nodeServer) volume(id string) (*volume, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v, ok := n.volumes[id]
+	return v, ok
+}
+
+func (n *nodeServer) setVolume(v *volume) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.volumes[v.id] = v
+}
+
+func (n *nodeServer) deleteVolume(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.volumes, id)
 }
 
-func newNodeServer() *nodeServer { // nolint:deadcode,unused
-	return &nodeServer{}
+// snapshot commits a mutable volume published on the node as a new bundle, once per snapshot name.
+// The snapshot of a read only volume is its bundle. It fails with FailedPrecondition when the volume
+// is not published on the node.
+func (n *nodeServer) snapshot(id, name string) (repo, bundleID string, err error) {
+	unlock := n.lock(id)
+	defer unlock()
+	v, ok := n.volume(id)
+	if !ok {
+		return "", "", status.Errorf(codes.FailedPrecondition, "volume %s is not published on node %s", id, n.driver.Config.NodeID)
+	}
+	bundleID = v.bundleID
+	if v.mutable != nil {
+		if bundleID, ok = v.snapshots[name]; !ok {
+			if err = v.mutable.Commit(); err != nil {
+				return "", "", status.Errorf(codes.Internal, "commit volume %s: %v", id, err)
+			}
+			bundleID = v.mutable.BundleID()
+			v.snapshots[name] = bundleID
+			n.l.Info("committed snapshot", zap.String("volume", id), zap.String("snapshot", name),
+				zap.String("repo", v.repo), zap.String("bundle", bundleID))
+		}
+	}
+	return v.repo, bundleID, nil
 }
 
 func (n *nodeServer) NodeStageVolume(context.Context, *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (n *nodeServer) NodeUnstageVolume(context.Context, *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "")
 }
 
 func (n *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	return nil, nil
+	id, target := req.GetVolumeId(), req.GetTargetPath()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing volume capability")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "datamon volumes are file systems, not block devices")
+	}
+	attrs := req.GetVolumeAttributes()
+	repo := attrs[attrRepo]
+	if repo == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s attribute", attrRepo)
+	}
+	mode := attrs[attrMode]
+	if mode == "" {
+		mode = modeReadOnly
+	}
+
+	unlock := n.lock(id)
+	defer unlock()
+	if v, ok := n.volume(id); ok {
+		if v.target != target {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published at %s", id, v.target)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	v := &volume{
+		id:     id,
+		target: target,
+		repo:   repo,
+		mode:   mode,
+		dir:    filepath.Join(n.driver.Config.StagingDir, id),
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	switch mode {
+	case modeReadOnly:
+		bundleID, err := n.driver.resolve(ctx, repo, attrs[attrBundle], attrs[attrLabel])
+		if err != nil {
+			return nil, statusError(err)
+		}
+		v.bundleID = bundleID
+		if v.fs, err = n.mounter.mountReadOnly(ctx, repo, bundleID, target, v.dir); err != nil {
+			return nil, statusError(err)
+		}
+	case modeMutable:
+		if req.GetReadonly() {
+			return nil, status.Errorf(codes.InvalidArgument, "mutable volume %s can't be published read only", id)
+		}
+		message := attrs[attrMessage]
+		if message == "" {
+			message = "Written to volume " + id
+		}
+		v.label = attrs[attrLabel]
+		v.snapshots = make(map[string]string)
+		var err error
+		if attrs[attrBundle] != "" || attrs[attrSourceLabel] != "" {
+			if v.parentID, err = n.driver.resolve(ctx, repo, attrs[attrBundle], attrs[attrSourceLabel]); err != nil {
+				return nil, statusError(err)
+			}
+		}
+		m, err := n.mounter.mountMutable(ctx, repo, v.parentID, target, v.dir, message)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		v.fs, v.mutable = m, m
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown mode %q, expected %s or %s", mode, modeReadOnly, modeMutable)
+	}
+	if err := n.save(v); err != nil {
+		_ = v.fs.Unmount(target)
+		return nil, status.Errorf(codes.Internal, "save volume %s: %v", id, err)
+	}
+	n.setVolume(v)
+	n.l.Info("published volume", zap.String("volume", id), zap.String("repo", repo), zap.String("bundle", v.bundleID),
+		zap.String("parent", v.parentID), zap.String("mode", mode), zap.String("target", target))
+	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (n *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	return nil, nil
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing target path")
+	}
+
+	unlock := n.lock(id)
+	defer unlock()
+	v, ok := n.volume(id)
+	if !ok {
+		var err error
+		v, err = n.restore(ctx, id)
+		if os.IsNotExist(err) {
+			// unpublished already, or the target is left mounted by a publication that failed
+			if err = n.mounter.unmount(req.GetTargetPath()); err != nil {
+				return nil, status.Errorf(codes.Internal, "unmount volume %s: %v", id, err)
+			}
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "restore volume %s: %v", id, err)
+		}
+		n.setVolume(v)
+	}
+	if v.mutable != nil && !v.committed {
+		// the volume stays published when the commit fails, and the orchestrator retries
+		if err := v.mutable.Commit(); err != nil {
+			return nil, status.Errorf(codes.Internal, "commit volume %s: %v", id, err)
+		}
+		v.committed = true
+		v.bundleID = v.mutable.BundleID()
+		n.l.Info("committed volume", zap.String("volume", id), zap.String("repo", v.repo), zap.String("bundle", v.bundleID))
+		if err := n.save(v); err != nil {
+			n.l.Warn("failed to save volume", zap.String("volume", id), zap.Error(err))
+		}
+	}
+	if v.mode == modeMutable && v.label != "" && v.bundleID != "" {
+		if _, err := n.driver.client.SetLabel(ctx, v.repo, v.label, v.bundleID); err != nil {
+			return nil, statusError(err)
+		}
+	}
+	if err := v.fs.Unmount(v.target); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmount volume %s: %v", id, err)
+	}
+	n.deleteVolume(id)
+	if err := os.RemoveAll(v.dir); err != nil {
+		n.l.Warn("failed to remove volume staging", zap.String("volume", id), zap.Error(err))
+	}
+	if err := os.Remove(n.recordPath(id)); err != nil {
+		n.l.Warn("failed to remove volume record", zap.String("volume", id), zap.Error(err))
+	}
+	n.l.Info("unpublished volume", zap.String("volume", id), zap.String("target", v.target))
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// recordPath is the path of the record of a published volume
+func (n *nodeServer) recordPath(id string) string {
+	return filepath.Join(n.driver.Config.StagingDir, id+".json")
+}
+
+// save records a published volume, replacing its record atomically
+func (n *nodeServer) save(v *volume) error {
+	b, err := json.Marshal(volumeRecord{
+		ID:        v.id,
+		Target:    v.target,
+		Repo:      v.repo,
+		Mode:      v.mode,
+		Label:     v.label,
+		BundleID:  v.bundleID,
+		ParentID:  v.parentID,
+		Committed: v.committed,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(n.driver.Config.StagingDir, 0750); err != nil {
+		return err
+	}
+	path := n.recordPath(v.id)
+	if err = ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// restore returns a volume published before the plugin restarted, from its record.
+// The files staged by a mutable volume are recovered to be committed, a volume that
+// has nothing left to recover is reported lost. The error is os.ErrNotExist without record.
+func (n *nodeServer) restore(ctx context.Context, id string) (*volume, error) {
+	b, err := ioutil.ReadFile(n.recordPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var r volumeRecord
+	if err = json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("invalid record %s: %v", n.recordPath(id), err)
+	}
+	v := &volume{
+		id:        r.ID,
+		target:    r.Target,
+		repo:      r.Repo,
+		mode:      r.Mode,
+		label:     r.Label,
+		dir:       filepath.Join(n.driver.Config.StagingDir, id),
+		bundleID:  r.BundleID,
+		parentID:  r.ParentID,
+		committed: r.Committed,
+		fs:        staleFS{m: n.mounter},
+		snapshots: make(map[string]string),
+	}
+	if v.mode != modeMutable || v.committed {
+		return v, nil
+	}
+	m, err := n.mounter.recoverMutable(ctx, v.dir)
+	if client.Kind(err) == client.ErrNotFound {
+		n.l.Error("lost the files of a mutable volume, nothing was staged to recover",
+			zap.String("volume", id), zap.String("repo", v.repo), zap.String("staging", v.dir))
+		v.committed = true
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("recover the files of mutable volume %s staged in %s: %v", id, v.dir, err)
+	}
+	v.fs, v.mutable = m, m
+	n.l.Info("recovered volume", zap.String("volume", id), zap.String("repo", v.repo), zap.String("staging", v.dir))
+	return v, nil
 }
 
-func (n *nodeServer) NodeGetID(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
-	return nil, nil
+func (n *nodeServer) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
+	return &csi.NodeGetIdResponse{NodeId: n.driver.Config.NodeID}, nil
 }
 
 func (n *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return nil, nil
+	return &csi.NodeGetInfoResponse{NodeId: n.driver.Config.NodeID}, nil
 }
 
 func (n *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	return nil, nil
+	// volumes are mounted when published: there is no staging
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{},
+	}, nil
 }
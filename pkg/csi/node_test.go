@@ -0,0 +1,403 @@
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+const repo = "csi-test-repo"
+
+// dirMounter mounts volumes as plain directories: read only volumes are downloaded,
+// and mutable volumes upload their directory when committed
+type dirMounter struct {
+	client *client.Client
+}
+
+type dirFS struct{}
+
+func (dirFS) Unmount(path string) error {
+	return os.RemoveAll(path)
+}
+
+type mutableDirFS struct {
+	dirFS
+	client        *client.Client
+	repo, message string
+	parentID      string
+	target        string
+	bundleID      string
+}
+
+// Commit uploads the directory, with the bundle of the previous commit as parent like mutable filesystems
+func (fs *mutableDirFS) Commit() error {
+	opts := []client.UploadOption{client.UploadMessage(fs.message)}
+	parentID := fs.parentID
+	if fs.bundleID != "" {
+		parentID = fs.bundleID
+	}
+	if parentID != "" {
+		opts = append(opts, client.UploadParents(parentID))
+	}
+	bd, err := fs.client.UploadDir(context.Background(), fs.repo, fs.target, opts...)
+	if err != nil {
+		return err
+	}
+	fs.bundleID = bd.ID
+	return nil
+}
+
+func (fs *mutableDirFS) BundleID() string {
+	return fs.bundleID
+}
+
+func (m dirMounter) mountReadOnly(ctx context.Context, repo, bundleID, target, cacheDir string) (filesystem, error) {
+	return dirFS{}, m.client.Download(ctx, repo, bundleID, target)
+}
+
+func (m dirMounter) mountMutable(ctx context.Context, repo, parentID, target, stagingDir, message string) (mutableFilesystem, error) {
+	if err := m.client.CheckRepo(ctx, repo); err != nil {
+		return nil, err
+	}
+	if parentID != "" {
+		if err := m.client.Download(ctx, repo, parentID, target); err != nil {
+			return nil, err
+		}
+	}
+	// the volume is staged in its target, the staging directory only records it to be recovered
+	if err := os.MkdirAll(stagingDir, 0700); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal([]string{repo, message, parentID, target})
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(stagingDir, "volume"), b, 0600); err != nil {
+		return nil, err
+	}
+	return &mutableDirFS{client: m.client, repo: repo, message: message, parentID: parentID, target: target}, nil
+}
+
+func (m dirMounter) recoverMutable(ctx context.Context, stagingDir string) (mutableFilesystem, error) {
+	b, err := ioutil.ReadFile(filepath.Join(stagingDir, "volume"))
+	if err != nil {
+		return nil, err
+	}
+	var staged []string
+	if err = json.Unmarshal(b, &staged); err != nil {
+		return nil, err
+	}
+	return &mutableDirFS{client: m.client, repo: staged[0], message: staged[1], parentID: staged[2], target: staged[3]}, nil
+}
+
+func (m dirMounter) unmount(target string) error {
+	return os.RemoveAll(target)
+}
+
+func newTestClient(t *testing.T) *client.Client {
+	return newTestClientWithMeta(t, localfs.New(afero.NewMemMapFs()))
+}
+
+func newTestClientWithMeta(t *testing.T, meta storage.Store) *client.Client {
+	c, err := client.New(client.Config{
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	},
+		client.MetaStore(meta),
+		client.BlobStore(localfs.New(afero.NewMemMapFs())),
+	)
+	require.NoError(t, err)
+	_, err = c.CreateRepo(context.Background(), repo, "test repo")
+	require.NoError(t, err)
+	return c
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "datamon-csi-")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func requireCode(t *testing.T, code codes.Code, err error) {
+	require.Error(t, err)
+	require.Equal(t, code, status.Code(err), err.Error())
+}
+
+func TestNodeServer(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	driver := NewDriver(Config{NodeID: "node-1", StagingDir: filepath.Join(dir, "staging")}, c)
+	n := newNodeServer(driver, dirMounter{client: c})
+
+	info, err := n.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "node-1", info.NodeId)
+	caps, err := n.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+	require.Empty(t, caps.Capabilities)
+
+	// a mutable volume commits a labeled bundle when unpublished
+	rw := filepath.Join(dir, "rw")
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "rw",
+		TargetPath:       rw,
+		VolumeCapability: mountCapability(),
+		VolumeAttributes: map[string]string{attrRepo: repo, attrMode: modeMutable, attrLabel: "output", attrMessage: "job"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rw, "result.csv"), []byte("a,b"), 0600))
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "rw", TargetPath: rw})
+	require.NoError(t, err)
+	label, err := c.GetLabel(ctx, repo, "output")
+	require.NoError(t, err)
+	bd, err := c.GetBundle(ctx, repo, label.BundleID)
+	require.NoError(t, err)
+	require.Equal(t, "job", bd.Message)
+
+	// read only volumes are the latest bundle, or the bundle of a label
+	for _, attrs := range []map[string]string{
+		{attrRepo: repo},
+		{attrRepo: repo, attrLabel: "output"},
+		{attrRepo: repo, attrBundle: label.BundleID, attrMode: modeReadOnly},
+	} {
+		ro := filepath.Join(dir, "ro")
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId:         "ro",
+			TargetPath:       ro,
+			VolumeCapability: mountCapability(),
+			Readonly:         true,
+			VolumeAttributes: attrs,
+		}
+		_, err = n.NodePublishVolume(ctx, req)
+		require.NoError(t, err)
+		_, err = n.NodePublishVolume(ctx, req)
+		require.NoError(t, err, "publishing is idempotent")
+		b, err := ioutil.ReadFile(filepath.Join(ro, "result.csv"))
+		require.NoError(t, err)
+		require.Equal(t, "a,b", string(b))
+		_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "ro", TargetPath: ro})
+		require.NoError(t, err)
+		_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "ro", TargetPath: ro})
+		require.NoError(t, err, "unpublishing is idempotent")
+	}
+	require.Empty(t, n.volumes)
+}
+
+func TestNodeServer_Errors(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	n := newNodeServer(NewDriver(Config{StagingDir: dir}, c), dirMounter{client: c})
+	target := filepath.Join(dir, "target")
+
+	for _, tc := range []struct {
+		name string
+		req  *csi.NodePublishVolumeRequest
+		code codes.Code
+	}{
+		{"missing id", &csi.NodePublishVolumeRequest{TargetPath: target, VolumeCapability: mountCapability()}, codes.InvalidArgument},
+		{"missing repo", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability()},
+			codes.InvalidArgument},
+		{"block", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeAttributes: map[string]string{attrRepo: repo},
+			VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}},
+			codes.InvalidArgument},
+		{"bad mode", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability(),
+			VolumeAttributes: map[string]string{attrRepo: repo, attrMode: "x"}}, codes.InvalidArgument},
+		{"read only mutable", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability(),
+			Readonly: true, VolumeAttributes: map[string]string{attrRepo: repo, attrMode: modeMutable}}, codes.InvalidArgument},
+		{"missing label", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability(),
+			VolumeAttributes: map[string]string{attrRepo: repo, attrLabel: "missing"}}, codes.NotFound},
+		{"empty repo", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability(),
+			VolumeAttributes: map[string]string{attrRepo: repo}}, codes.NotFound},
+		{"unknown repo", &csi.NodePublishVolumeRequest{VolumeId: "v", TargetPath: target, VolumeCapability: mountCapability(),
+			VolumeAttributes: map[string]string{attrRepo: "missing", attrMode: modeMutable}}, codes.NotFound},
+	} {
+		_, err := n.NodePublishVolume(ctx, tc.req)
+		require.Error(t, err, tc.name)
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
+	require.Empty(t, n.volumes)
+
+	_, err := n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{})
+	requireCode(t, codes.Unimplemented, err)
+}
+
+func TestNodeServer_Restart(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	driver := NewDriver(Config{NodeID: "node-1", StagingDir: filepath.Join(dir, "staging")}, c)
+	n := newNodeServer(driver, dirMounter{client: c})
+
+	rw, ro := filepath.Join(dir, "rw"), filepath.Join(dir, "ro")
+	_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "rw",
+		TargetPath:       rw,
+		VolumeCapability: mountCapability(),
+		VolumeAttributes: map[string]string{attrRepo: repo, attrMode: modeMutable, attrLabel: "output", attrMessage: "job"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rw, "result.csv"), []byte("a,b"), 0600))
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "lost",
+		TargetPath:       filepath.Join(dir, "lost"),
+		VolumeCapability: mountCapability(),
+		VolumeAttributes: map[string]string{attrRepo: repo, attrMode: modeMutable, attrLabel: "lost"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(driver.Config.StagingDir, "lost")))
+
+	// the volumes published before the plugin restarted are unpublished from their records
+	n = newNodeServer(driver, dirMounter{client: c})
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "rw", TargetPath: rw})
+	require.NoError(t, err)
+	label, err := c.GetLabel(ctx, repo, "output")
+	require.NoError(t, err)
+	bd, err := c.GetBundle(ctx, repo, label.BundleID)
+	require.NoError(t, err)
+	require.Equal(t, "job", bd.Message)
+	_, err = os.Stat(rw)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "ro",
+		TargetPath:       ro,
+		VolumeCapability: mountCapability(),
+		Readonly:         true,
+		VolumeAttributes: map[string]string{attrRepo: repo},
+	})
+	require.NoError(t, err)
+	n = newNodeServer(driver, dirMounter{client: c})
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "ro", TargetPath: ro})
+	require.NoError(t, err)
+	_, err = os.Stat(ro)
+	require.True(t, os.IsNotExist(err))
+
+	// a mutable volume with nothing staged is lost
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "lost", TargetPath: filepath.Join(dir, "lost")})
+	require.NoError(t, err)
+	_, err = c.GetLabel(ctx, repo, "lost")
+	require.Error(t, err)
+
+	// the target of an unknown volume is unmounted
+	unknown := filepath.Join(dir, "unknown")
+	require.NoError(t, os.MkdirAll(unknown, 0700))
+	_, err = n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "unknown", TargetPath: unknown})
+	require.NoError(t, err)
+	_, err = os.Stat(unknown)
+	require.True(t, os.IsNotExist(err))
+
+	records, err := filepath.Glob(filepath.Join(driver.Config.StagingDir, "*.json"))
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Empty(t, n.volumes)
+}
+
+func TestUnmount_NotMounted(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	mounted, err := isMountPoint(dir)
+	require.NoError(t, err)
+	require.False(t, mounted)
+	require.NoError(t, unmount(dir))
+	require.NoError(t, unmount(filepath.Join(dir, "missing")))
+}
+
+// blockingMounter blocks the commits of the mutable volume staged in a directory until released
+type blockingMounter struct {
+	dirMounter
+	dir      string
+	started  chan struct{}
+	released chan struct{}
+}
+
+type blockingFS struct {
+	mutableFilesystem
+	m blockingMounter
+}
+
+func (fs blockingFS) Commit() error {
+	close(fs.m.started)
+	<-fs.m.released
+	return fs.mutableFilesystem.Commit()
+}
+
+func (m blockingMounter) mountMutable(ctx context.Context, repo, parentID, target, stagingDir, message string) (mutableFilesystem, error) {
+	fs, err := m.dirMounter.mountMutable(ctx, repo, parentID, target, stagingDir, message)
+	if err != nil || stagingDir != m.dir {
+		return fs, err
+	}
+	return blockingFS{mutableFilesystem: fs, m: m}, nil
+}
+
+func TestNodeServer_ConcurrentVolumes(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	c := newTestClient(t)
+	driver := NewDriver(Config{NodeID: "node-1", StagingDir: filepath.Join(dir, "staging")}, c)
+	m := blockingMounter{
+		dirMounter: dirMounter{client: c},
+		dir:        filepath.Join(driver.Config.StagingDir, "slow"),
+		started:    make(chan struct{}),
+		released:   make(chan struct{}),
+	}
+	n := newNodeServer(driver, m)
+	publish := func(id string) {
+		_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         id,
+			TargetPath:       filepath.Join(dir, id),
+			VolumeCapability: mountCapability(),
+			VolumeAttributes: map[string]string{attrRepo: repo, attrMode: modeMutable},
+		})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, id, "a.txt"), []byte(id), 0600))
+	}
+	publish("slow")
+	publish("fast")
+
+	slow := make(chan error)
+	go func() {
+		_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "slow", TargetPath: filepath.Join(dir, "slow")})
+		slow <- err
+	}()
+	<-m.started
+
+	// the commit of a volume does not block the other volumes
+	_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "fast", TargetPath: filepath.Join(dir, "fast")})
+	require.NoError(t, err)
+	select {
+	case err = <-slow:
+		t.Fatalf("unpublished a volume during its commit: %v", err)
+	default:
+	}
+	close(m.released)
+	require.NoError(t, <-slow)
+	require.Empty(t, n.volumes)
+	require.Empty(t, n.locks)
+}
@@ -36,7 +36,9 @@ func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, c
 
 	s.wg.Add(1)
 
-	go s.serve(endpoint, ids, cs, ns, logger)
+	// the server is listening when Start returns, and may be stopped
+	listener := s.listen(endpoint, ids, cs, ns, logger)
+	go s.serve(listener, logger)
 }
 
 func (s *nonBlockingGRPCServer) Wait() {
@@ -51,7 +53,7 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, logger *zap.Logger) {
+func (s *nonBlockingGRPCServer) listen(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, logger *zap.Logger) net.Listener {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		logger.Fatal(err.Error())
@@ -92,8 +94,12 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		csi.RegisterNodeServer(server, ns)
 	}
 	logger.Info("Listening for connections", zap.Any("addr", listener))
+	return listener
+}
 
-	err = server.Serve(listener)
+func (s *nonBlockingGRPCServer) serve(listener net.Listener, logger *zap.Logger) {
+	defer s.wg.Done()
+	err := s.server.Serve(listener)
 	if err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
 	}
@@ -0,0 +1,227 @@
+package csi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// The files of a volume are on the node publishing it, the controller can't commit them: it writes a snapshot
+// request to the metadata store, and the node publishing the volume commits it and records the bundle in the request.
+// Answered requests are kept until the volume is deleted, they list the snapshots of the volume.
+
+// snapshotRequestsPrefix holds the snapshot requests in the metadata store, by volume
+const snapshotRequestsPrefix = "csi/snapshots/"
+
+// defaultSnapshotPollInterval is how often the nodes look for snapshot requests, and the controller for their answers
+const defaultSnapshotPollInterval = time.Second
+
+// snapshotRequest asks the node publishing a volume to snapshot it, the node sets the bundle or the error
+type snapshotRequest struct {
+	Volume   string `json:"volume"`
+	Name     string `json:"name"`
+	Node     string `json:"node,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	BundleID string `json:"bundle,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (r snapshotRequest) answered() bool {
+	return r.BundleID != "" || r.Error != ""
+}
+
+func snapshotRequestsPath(volumeID string) string {
+	return snapshotRequestsPrefix + volumeID + "/"
+}
+
+func snapshotRequestPath(volumeID, name string) string {
+	return snapshotRequestsPath(volumeID) + name + ".json"
+}
+
+func getSnapshotRequest(ctx context.Context, store storage.Store, path string) (snapshotRequest, error) {
+	var req snapshotRequest
+	r, err := store.Get(ctx, path)
+	if err != nil {
+		return req, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return req, err
+	}
+	err = json.Unmarshal(b, &req)
+	return req, err
+}
+
+func putSnapshotRequest(ctx context.Context, store storage.Store, req snapshotRequest, exclusive bool) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, snapshotRequestPath(req.Volume, req.Name), bytes.NewReader(b), exclusive)
+}
+
+// listSnapshotRequests returns the paths of the snapshot requests under a prefix, sorted
+func listSnapshotRequests(ctx context.Context, store storage.Store, prefix string) ([]string, error) {
+	var (
+		paths []string
+		token string
+	)
+	for {
+		keys, next, err := store.KeysPrefix(ctx, token, prefix, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if strings.HasSuffix(key, ".json") {
+				paths = append(paths, key)
+			}
+		}
+		if next == "" {
+			sort.Strings(paths)
+			return paths, nil
+		}
+		token = next
+	}
+}
+
+// requestSnapshot asks the node publishing a volume to snapshot it, and waits for its answer.
+// A request left unanswered when the call times out is answered later, and found by the retry of the call.
+func (s *controllerServer) requestSnapshot(ctx context.Context, id, name string) (string, string, error) {
+	store := s.driver.client.MetaStore()
+	path := snapshotRequestPath(id, name)
+	if err := putSnapshotRequest(ctx, store, snapshotRequest{Volume: id, Name: name}, storage.IfNotPresent); err != nil {
+		// requested already by a call that timed out
+		if found, e := store.Has(ctx, path); e != nil || !found {
+			return "", "", status.Errorf(codes.Unavailable, "request snapshot %s of volume %s: %v", name, id, err)
+		}
+	}
+	ticker := time.NewTicker(s.driver.Config.SnapshotPollInterval)
+	defer ticker.Stop()
+	for {
+		req, err := getSnapshotRequest(ctx, store, path)
+		switch {
+		case err != nil:
+			// stores replacing objects in place may be read while the node answers
+			s.l.Debug("failed to read snapshot request", zap.String("volume", id), zap.String("snapshot", name), zap.Error(err))
+		case req.Error != "":
+			// the retry of the call requests the snapshot again
+			if err = store.Delete(ctx, path); err != nil {
+				s.l.Warn("failed to delete snapshot request", zap.String("volume", id), zap.String("snapshot", name), zap.Error(err))
+			}
+			return "", "", status.Errorf(codes.Internal, "snapshot %s of volume %s failed on node %s: %s", name, id, req.Node, req.Error)
+		case req.BundleID != "":
+			return req.Repo, req.BundleID, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", status.Errorf(codes.DeadlineExceeded,
+				"volume %s was not snapshotted by the node publishing it yet, the volume may not be published", id)
+		case <-ticker.C:
+		}
+	}
+}
+
+// answeredSnapshots returns the bundles of the snapshots of a volume answered by its node
+func (s *controllerServer) answeredSnapshots(ctx context.Context, id string) (map[string]snapshotRequest, error) {
+	store := s.driver.client.MetaStore()
+	paths, err := listSnapshotRequests(ctx, store, snapshotRequestsPath(id))
+	if err != nil {
+		return nil, err
+	}
+	answered := make(map[string]snapshotRequest, len(paths))
+	for _, path := range paths {
+		req, err := getSnapshotRequest(ctx, store, path)
+		if err != nil {
+			return nil, err
+		}
+		if req.BundleID != "" {
+			answered[req.Name] = req
+		}
+	}
+	return answered, nil
+}
+
+// deleteSnapshotRequests deletes the snapshot requests of a deleted volume
+func (s *controllerServer) deleteSnapshotRequests(ctx context.Context, id string) error {
+	store := s.driver.client.MetaStore()
+	paths, err := listSnapshotRequests(ctx, store, snapshotRequestsPath(id))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err = store.Delete(ctx, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answerSnapshots snapshots the volumes published on the node when the controller requests it, until stopped
+func (n *nodeServer) answerSnapshots(stop <-chan struct{}) {
+	ticker := time.NewTicker(n.driver.Config.SnapshotPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := n.answerSnapshotRequests(context.Background()); err != nil {
+				n.l.Warn("failed to answer snapshot requests", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (n *nodeServer) answerSnapshotRequests(ctx context.Context) error {
+	store := n.driver.client.MetaStore()
+	paths, err := listSnapshotRequests(ctx, store, snapshotRequestsPrefix)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		id := strings.TrimPrefix(path, snapshotRequestsPrefix)
+		if i := strings.Index(id, "/"); i > 0 {
+			id = id[:i]
+		}
+		if _, ok := n.volume(id); !ok {
+			// published by another node
+			continue
+		}
+		req, err := getSnapshotRequest(ctx, store, path)
+		if err != nil {
+			// read while the controller writes it, it is answered at the next poll
+			n.l.Debug("failed to read snapshot request", zap.String("request", path), zap.Error(err))
+			continue
+		}
+		if req.answered() {
+			continue
+		}
+		repo, bundleID, err := n.snapshot(req.Volume, req.Name)
+		if status.Code(err) == codes.FailedPrecondition {
+			// unpublished meanwhile
+			continue
+		}
+		req.Node = n.driver.Config.NodeID
+		if err != nil {
+			req.Error = status.Convert(err).Message()
+		} else {
+			req.Repo, req.BundleID = repo, bundleID
+		}
+		if err = putSnapshotRequest(ctx, store, req, storage.OverWrite); err != nil {
+			return fmt.Errorf("answer snapshot request %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package filetracker
 
 import (
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"sync"
 	"unsafe"
@@ -22,6 +24,14 @@ type TFile struct {
 	tracker *iradix.Tree
 	lock    sync.Mutex
 	name    string
+
+	// The size of the base file, and the size of the file with the writes
+	baseSize int64
+	size     int64
+	// Part of the base file was truncated
+	truncated bool
+	// Reads the base file, opened on the first read
+	baseReader io.ReaderAt
 }
 
 func newTFile(baseStore storage.Store, file *afero.File, name string) *TFile {
@@ -34,14 +44,181 @@ func newTFile(baseStore storage.Store, file *afero.File, name string) *TFile {
 	}
 }
 
+// NewTFile tracks the writes made on top of the file of a base store with the given name and size.
+// Writes land in a local file, reads merge the ranges written to the local file with the base file.
+func NewTFile(baseStore storage.Store, file *afero.File, name string, size int64) *TFile {
+	t := newTFile(baseStore, file, name)
+	t.baseSize = size
+	t.size = size
+	return t
+}
+
+// Size is the size of the file, with the writes
+func (t *TFile) Size() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.size
+}
+
+// Modified tells whether the file was written
+func (t *TFile) Modified() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.tracker.Len() > 0 || t.truncated || t.size != t.baseSize
+}
+
 func (t *TFile) ReadAt(p []byte, off int64) (n int, err error) {
-	//TODO:
-	_, _ = getFileRange(off, int64(len(p)))
-	return 0, nil
+	t.lock.Lock()
+	tracker, size := t.tracker, t.size
+	t.lock.Unlock()
+	if off >= size {
+		return 0, io.EOF
+	}
+	_, end := getFileRange(off, int64(len(p)))
+	end = min(end, size)
+	for pos := off; pos < end; {
+		length, store := rangeToRead(tracker, pos, end-pos)
+		dst := p[pos-off : pos-off+length]
+		if store == mutable {
+			err = t.readFile(dst, pos)
+		} else {
+			err = t.readBase(dst, pos)
+		}
+		if err != nil {
+			return int(pos - off), err
+		}
+		pos += length
+	}
+	n = int(end - off)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readFile reads a range written to the local file
+func (t *TFile) readFile(p []byte, off int64) error {
+	n, err := (*t.file).ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// readBase reads a range of the base file, the range extending the base file reads as zeros
+func (t *TFile) readBase(p []byte, off int64) error {
+	t.lock.Lock()
+	inBase := int64(0)
+	if off < t.baseSize {
+		inBase = min(int64(len(p)), t.baseSize-off)
+	}
+	for i := inBase; i < int64(len(p)); i++ {
+		p[i] = 0
+	}
+	if inBase == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	if t.baseReader == nil {
+		reader, err := t.base.GetAt(context.Background(), t.name)
+		if err != nil {
+			t.lock.Unlock()
+			return err
+		}
+		t.baseReader = reader
+	}
+	reader := t.baseReader
+	t.lock.Unlock()
+	n, err := reader.ReadAt(p[:inBase], off)
+	if err == io.EOF && int64(n) == inBase {
+		return nil
+	}
+	return err
 }
 
 func (t *TFile) WriteAt(p []byte, off int64) (n int, err error) {
-	return 0, nil
+	n, err = (*t.file).WriteAt(p, off)
+	if n > 0 {
+		t.trackWrite(off, int64(n))
+		t.lock.Lock()
+		if off+int64(n) > t.size {
+			t.size = off + int64(n)
+		}
+		t.lock.Unlock()
+	}
+	return n, err
+}
+
+// Truncate changes the size of the file. Truncating drops the ranges written past the new size,
+// and extending the file leaves a hole of zeros, even where the base file had content before being truncated.
+func (t *TFile) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size %d truncating %s", size, t.name)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := (*t.file).Truncate(size); err != nil {
+		return err
+	}
+	t.truncate(size)
+	return nil
+}
+
+// TrackWrite tracks a range written to the local file before the file was tracked,
+// to recover the file from the local file and the ranges written to it.
+func (t *TFile) TrackWrite(off, length int64) {
+	t.trackWrite(off, length)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if off+length > t.size {
+		t.size = off + length
+	}
+}
+
+// TrackTruncate tracks a truncation of the file before it was tracked, the local file is left as is.
+func (t *TFile) TrackTruncate(size int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.truncate(size)
+}
+
+// Need to hold the lock.
+func (t *TFile) truncate(size int64) {
+	if size < t.size {
+		t.trimTracker(size)
+	}
+	if size < t.baseSize {
+		t.baseSize = size
+		t.truncated = true
+	}
+	t.size = size
+}
+
+// Deletes the keys past a size, ending the range written across it at that size. Need to hold the lock.
+func (t *TFile) trimTracker(size int64) {
+	txn := t.tracker.Txn()
+	insertEnd := false
+	t.tracker.Root().Walk(func(k []byte, v interface{}) bool {
+		isStart := v.(bool)
+		key := getOffset(k)
+		switch {
+		case key < size:
+			insertEnd = isStart
+		case key == size:
+			// A range starting at the size is empty, a range ending at it is kept
+			if isStart {
+				txn.Delete(k)
+			}
+			insertEnd = false
+		default:
+			txn.Delete(k)
+		}
+		return !terminate
+	})
+	if insertEnd {
+		txn.Insert(getKey(size), endFlag)
+	}
+	t.tracker = txn.Commit()
 }
 
 func getFileRange(offset int64, len int64) (int64, int64) {
@@ -72,9 +249,11 @@ func getOffset(k []byte) int64 {
 }
 
 // Deletes keys that are no longer required and inserts new keys to
-// allow reads to be performed correctly.
+// allow reads to be performed correctly. Ranges written next to each other are merged.
 func (t *TFile) trackWrite(offset int64, length int64) {
-
+	if length <= 0 {
+		return
+	}
 	start, end := getFileRange(offset, length)
 
 	// Lock to protect radix tree, reads can continue.
@@ -85,52 +264,36 @@ func (t *TFile) trackWrite(offset int64, length int64) {
 	insertStart := true
 	insertEnd := true
 
-	if t.tracker.Len() == 0 {
-
-		txn.Insert(getKey(start), startFlag)
-		txn.Insert(getKey(end), endFlag)
-		t.tracker = txn.Commit()
-
-		return
-	}
-
 	fn := func(k []byte, v interface{}) bool {
 		isStart := v.(bool)
-		isEnd := !isStart
 		key := getOffset(k)
 
-		deleteKey := func() {
-			if key <= end {
+		switch {
+		case key < start:
+			// The write starts in a written range when the last key before it is a start
+			insertStart = !isStart
+		case key == start:
+			// Either a range starts with the write, or a range ends where the write starts and is merged
+			if !isStart {
 				txn.Delete(k)
 			}
-		}
-		switch {
-		case isStart && (key == start):
 			insertStart = false
-			return !terminate
-		case isStart && (key < start):
-			// Only interim keys need deleting
-			return !terminate
-		case isStart && (key > start):
-			deleteKey()
-			return !terminate
-		case isEnd && (key < start):
-			// Previous end hit and can be ignored, process next key
-			return !terminate
-		case isEnd && (key > start):
-			// There is an end that is after start and no other key in the range.
-			// Skip inserting start, previous start will cover the range.
-			insertStart = false
-			// This key might need deleting and process other other keys
-			if key >= end {
-				insertEnd = false
-				return terminate
+		case key < end:
+			// Interim keys are covered by the write
+			txn.Delete(k)
+		case key == end:
+			// Either a range ends with the write, or a range starts where the write ends and is merged
+			if isStart {
+				txn.Delete(k)
 			}
-			deleteKey()
-			return !terminate
+			insertEnd = false
+			return terminate
 		default:
-			return !terminate
+			// The write ends in a written range when the first key after it is an end
+			insertEnd = isStart
+			return terminate
 		}
+		return !terminate
 	}
 
 	// TODO: To reduce the walk use prefix but needs to be walked twice offset and offset + length
@@ -153,6 +316,10 @@ func min(a, b int64) int64 {
 
 // Given an offset and len , return the next contiguous read possible and the backend store for it.
 func (t *TFile) getRangeToRead(offset int64, len int64) (int64, bool) {
+	return rangeToRead(t.tracker, offset, len)
+}
+
+func rangeToRead(tracker *iradix.Tree, offset int64, len int64) (int64, bool) {
 	contiguous := len
 	storage := base
 	fn := func(k []byte, v interface{}) bool {
@@ -180,6 +347,6 @@ func (t *TFile) getRangeToRead(offset int64, len int64) (int64, bool) {
 		return !terminate
 	}
 	// TODO: To reduce the walk use prefix but needs to be walked twice offset and offset + length
-	t.tracker.Root().Walk(fn)
+	tracker.Root().Walk(fn)
 	return contiguous, storage
 }
@@ -1,10 +1,24 @@
 package filetracker
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"testing/quick"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
 )
 
 type ioRange struct {
@@ -148,6 +162,39 @@ var writeSeq = []writeTest{
 			},
 		},
 	},
+	{ // Write right after the region, merged into it
+		write:  ioRange{23, 5},
+		keyLen: 2,
+		tests: []test{
+			{
+				request:  ioRange{offset: 0, len: 100},
+				expected: read{length: 28, fromBase: false},
+			},
+			{
+				request:  ioRange{offset: 28, len: 100},
+				expected: read{length: 100, fromBase: true},
+			},
+		},
+	},
+	{ // Write right before a new region, merged into it
+		write:  ioRange{30, 5},
+		keyLen: 4,
+		tests:  []test{},
+	},
+	{
+		write:  ioRange{29, 1},
+		keyLen: 4,
+		tests: []test{
+			{
+				request:  ioRange{offset: 28, len: 100},
+				expected: read{length: 1, fromBase: true},
+			},
+			{
+				request:  ioRange{offset: 29, len: 100},
+				expected: read{length: 6, fromBase: false},
+			},
+		},
+	},
 }
 
 func TestGetKey(t *testing.T) {
@@ -173,3 +220,220 @@ func TestTrackWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestTFile(t *testing.T) {
+	ctx := context.Background()
+	baseStore := localfs.New(afero.NewMemMapFs())
+	baseData := []byte("0123456789")
+	require.NoError(t, baseStore.Put(ctx, "file", bytes.NewReader(baseData), storage.IfNotPresent))
+	dir, err := ioutil.TempDir("", "tfile-")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	// the files of MemMapFs lose their content on writes past their end
+	file, err := afero.NewOsFs().Create(filepath.Join(dir, "1024"))
+	require.NoError(t, err)
+	defer file.Close()
+	tf := NewTFile(baseStore, &file, "file", int64(len(baseData)))
+
+	read := func(off int64, n int) string {
+		p := make([]byte, n)
+		r, err := tf.ReadAt(p, off)
+		if err != io.EOF {
+			require.NoError(t, err)
+		}
+		return string(p[:r])
+	}
+	require.Equal(t, "0123456789", read(0, 100))
+	_, err = tf.WriteAt([]byte("ab"), 2)
+	require.NoError(t, err)
+	_, err = tf.WriteAt([]byte("cd"), 4)
+	require.NoError(t, err)
+	require.Equal(t, "01abcd6789", read(0, 10))
+	require.Equal(t, "bcd6", read(3, 4))
+
+	// extending the file leaves a hole of zeros
+	_, err = tf.WriteAt([]byte("xy"), 12)
+	require.NoError(t, err)
+	require.Equal(t, int64(14), tf.Size())
+	require.Equal(t, "89\x00\x00xy", read(8, 10))
+	_, err = tf.ReadAt(make([]byte, 1), 14)
+	require.Equal(t, io.EOF, err)
+}
+
+// tfileOp writes data at an offset, or truncates the file to a size
+type tfileOp struct {
+	truncate bool
+	off      int64
+	data     []byte
+	size     int64
+}
+
+// tfileCase is a base file and a sequence of operations applied on top of it
+type tfileCase struct {
+	base []byte
+	ops  []tfileOp
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	_, _ = r.Read(p)
+	return p
+}
+
+func (tfileCase) Generate(r *rand.Rand, size int) reflect.Value {
+	c := tfileCase{base: randomBytes(r, r.Intn(64))}
+	for i := r.Intn(size) + 1; i > 0; i-- {
+		if r.Intn(5) == 0 {
+			c.ops = append(c.ops, tfileOp{truncate: true, size: r.Int63n(96)})
+			continue
+		}
+		c.ops = append(c.ops, tfileOp{off: r.Int63n(96), data: randomBytes(r, r.Intn(32)+1)})
+	}
+	return reflect.ValueOf(c)
+}
+
+// apply the operation to the model of the file
+func (op tfileOp) apply(model []byte) []byte {
+	end := op.size
+	if !op.truncate {
+		end = op.off + int64(len(op.data))
+	}
+	if end > int64(len(model)) {
+		model = append(model, make([]byte, end-int64(len(model)))...)
+	}
+	if op.truncate {
+		return model[:op.size]
+	}
+	copy(model[op.off:], op.data)
+	return model
+}
+
+// checkTracker checks that the ranges written start and end in turn, and end within the file
+func checkTracker(tf *TFile) error {
+	expectStart := true
+	last := int64(-1)
+	var err error
+	tf.tracker.Root().Walk(func(k []byte, v interface{}) bool {
+		key := getOffset(k)
+		switch {
+		case v.(bool) != expectStart:
+			err = fmt.Errorf("key %d: expected start %v", key, expectStart)
+		case key <= last:
+			err = fmt.Errorf("key %d after %d", key, last)
+		case key > tf.size:
+			err = fmt.Errorf("key %d past the size %d", key, tf.size)
+		}
+		expectStart = !expectStart
+		last = key
+		return err != nil
+	})
+	if err == nil && !expectStart {
+		err = fmt.Errorf("range started at %d does not end", last)
+	}
+	return err
+}
+
+func TestTFile_Model(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tfile-")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	r := rand.New(rand.NewSource(1))
+	i := 0
+
+	check := func(c tfileCase) error {
+		i++
+		baseStore := localfs.New(afero.NewMemMapFs())
+		if err := baseStore.Put(ctx, "file", bytes.NewReader(c.base), storage.IfNotPresent); err != nil {
+			return err
+		}
+		file, err := afero.NewOsFs().Create(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		tf := NewTFile(baseStore, &file, "file", int64(len(c.base)))
+		model := append([]byte{}, c.base...)
+
+		for j, op := range c.ops {
+			if op.truncate {
+				err = tf.Truncate(op.size)
+			} else {
+				_, err = tf.WriteAt(op.data, op.off)
+			}
+			if err != nil {
+				return fmt.Errorf("op %d: %v", j, err)
+			}
+			model = op.apply(model)
+			if err = checkTracker(tf); err != nil {
+				return fmt.Errorf("op %d: %v", j, err)
+			}
+			if tf.Size() != int64(len(model)) {
+				return fmt.Errorf("op %d: size %d, expected %d", j, tf.Size(), len(model))
+			}
+			off := r.Int63n(int64(len(model)) + 1)
+			p := make([]byte, r.Intn(len(model)+8)+1)
+			expected := model[off:min(off+int64(len(p)), int64(len(model)))]
+			n, err := tf.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("op %d: %v", j, err)
+			}
+			if (err == io.EOF) != (len(expected) < len(p)) {
+				return fmt.Errorf("op %d: unexpected error %v reading %d bytes at %d", j, err, len(p), off)
+			}
+			if !bytes.Equal(p[:n], expected) {
+				return fmt.Errorf("op %d: read %x at %d, expected %x", j, p[:n], off, expected)
+			}
+		}
+		if !tf.Modified() && !bytes.Equal(model, c.base) {
+			return fmt.Errorf("unmodified file differs from its base")
+		}
+		return nil
+	}
+	require.NoError(t, quick.Check(func(c tfileCase) bool {
+		if err := check(c); err != nil {
+			t.Logf("base %x, ops %+v: %v", c.base, c.ops, err)
+			return false
+		}
+		return true
+	}, &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(2))}))
+}
+
+func TestTFile_ReadWhileTruncating(t *testing.T) {
+	ctx := context.Background()
+	baseStore := localfs.New(afero.NewMemMapFs())
+	baseData := bytes.Repeat([]byte("0123456789"), 100)
+	require.NoError(t, baseStore.Put(ctx, "file", bytes.NewReader(baseData), storage.IfNotPresent))
+	dir, err := ioutil.TempDir("", "tfile-")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	file, err := afero.NewOsFs().Create(filepath.Join(dir, "1024"))
+	require.NoError(t, err)
+	defer file.Close()
+	tf := NewTFile(baseStore, &file, "file", int64(len(baseData)))
+
+	// reads see the base file before or after each truncation
+	done := make(chan error, 1)
+	go func() {
+		for size := int64(len(baseData)); size > 100; size-- {
+			if err := tf.Truncate(size); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			require.Equal(t, int64(101), tf.Size())
+			return
+		default:
+		}
+		p := make([]byte, 10)
+		n, err := tf.ReadAt(p, 0)
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", string(p[:n]))
+	}
+}
@@ -20,8 +20,10 @@ type BundleDescriptor struct {
 	Parents                []string      `json:"parents,omitempty" yaml:"parents,omitempty"`
 	Timestamp              time.Time     `json:"timestamp,omitempty" yaml:"timestamp,omitempty"`
 	Contributors           []Contributor `json:"contributors" yaml:"contributors"`
-	BundleEntriesFileCount uint64        `json:"count" yaml:"count"`                         // Number of files which have BundleDescriptor Entries
-	Version                uint64        `json:"version,omitempty" yaml:"version,omitempty"` // Version for the bundle
+	BundleEntriesFileCount uint64        `json:"count" yaml:"count"`                                 // Number of files which have BundleDescriptor Entries
+	Version                uint64        `json:"version,omitempty" yaml:"version,omitempty"`         // Version for the bundle
+	Compression            string        `json:"compression,omitempty" yaml:"compression,omitempty"` // Codec used to compress the blobs written by the bundle
+	Chunker                *Chunker      `json:"chunker,omitempty" yaml:"chunker,omitempty"`         // Splitting of files into blobs, fixed leaf size when not set
 	_                      struct{}
 }
 
@@ -39,13 +41,26 @@ type ArchivePathComponents struct {
 
 // List of files, directories (empty) skipped
 type BundleEntry struct {
-	Hash         string      `json:"hash" yaml:"hash"`
-	NameWithPath string      `json:"name" yaml:"name"`
-	FileMode     os.FileMode `json:"mode" yaml:"mode"`
-	Size         uint64      `json:"size" yaml:"size"`
+	Hash         string            `json:"hash" yaml:"hash"`
+	NameWithPath string            `json:"name" yaml:"name"`
+	FileMode     os.FileMode       `json:"mode" yaml:"mode"`
+	Size         uint64            `json:"size" yaml:"size"`
+	Purged       string            `json:"purged,omitempty" yaml:"purged,omitempty"`   // ID of the purge which deleted the content of the file
+	Symlink      string            `json:"symlink,omitempty" yaml:"symlink,omitempty"` // Target of a symbolic link, which has no content and no hash
+	Link         string            `json:"link,omitempty" yaml:"link,omitempty"`       // Path of the file of the bundle this file is a hard link to, with the same hash
+	Xattrs       map[string][]byte `json:"xattrs,omitempty" yaml:"xattrs,omitempty"`   // Extended attributes of the file
 	_            struct{}
 }
 
+// Chunker describes how the files of a bundle are split into blobs of variable size
+type Chunker struct {
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	Min       uint32 `json:"min" yaml:"min"`
+	Avg       uint32 `json:"avg" yaml:"avg"`
+	Max       uint32 `json:"max" yaml:"max"`
+	_         struct{}
+}
+
 // Contributor who created the object
 type Contributor struct {
 	Name  string `json:"name" yaml:"name"`
@@ -75,6 +90,10 @@ func GetArchivePathToBundle(repo string, bundleID string) string {
 	return fmt.Sprint(getArchivePathToBundles(), repo, "/", bundleID, "/bundle.json")
 }
 
+func GetArchivePathPrefixToBundle(repo string, bundleID string) string {
+	return fmt.Sprint(getArchivePathToBundles(), repo, "/", bundleID, "/")
+}
+
 func GetArchivePathPrefixToBundles(repo string) string {
 	return fmt.Sprint(getArchivePathToBundles(), repo+"/")
 }
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"fmt"
+)
+
+// BlobReference records the files of a bundle stored under a root key.
+//
+// The reference index maps every root key to the bundles using it, and every leaf key to its root keys.
+type BlobReference struct {
+	Root     string   `json:"root" yaml:"root"`
+	Repo     string   `json:"repo" yaml:"repo"`
+	BundleID string   `json:"bundle" yaml:"bundle"`
+	Paths    []string `json:"paths" yaml:"paths"`
+	_        struct{}
+}
+
+func GetArchivePathPrefixToIndex() string {
+	return fmt.Sprint("index/")
+}
+
+// GetArchivePathToRootReference is the path of the reference of a root key by a bundle
+func GetArchivePathToRootReference(root, repo, bundleID string) string {
+	return fmt.Sprint(GetArchivePathPrefixToRootReferences(root), repo, "/", bundleID, ".yaml")
+}
+
+func GetArchivePathPrefixToRootReferences(root string) string {
+	return fmt.Sprint(GetArchivePathPrefixToIndex(), "roots/", root, "/")
+}
+
+// GetArchivePathToLeafReference is the path of the empty object recording that a root key uses a leaf key
+func GetArchivePathToLeafReference(leaf, root string) string {
+	return fmt.Sprint(GetArchivePathPrefixToLeafReferences(leaf), root)
+}
+
+func GetArchivePathPrefixToLeafReferences(leaf string) string {
+	return fmt.Sprint(GetArchivePathPrefixToIndex(), "leaves/", leaf, "/")
+}
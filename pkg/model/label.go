@@ -0,0 +1,24 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Label is a name pointing to a bundle of a repo, like a git tag.
+// Labeled bundles are protected from deletion.
+type Label struct {
+	Name         string        `json:"name" yaml:"name"`
+	BundleID     string        `json:"id" yaml:"id"`
+	Timestamp    time.Time     `json:"timestamp,omitempty" yaml:"timestamp,omitempty"`
+	Contributors []Contributor `json:"contributors" yaml:"contributors"`
+	_            struct{}
+}
+
+func GetArchivePathToLabel(repo string, name string) string {
+	return fmt.Sprint(GetArchivePathPrefixToLabels(repo), name, ".yaml")
+}
+
+func GetArchivePathPrefixToLabels(repo string) string {
+	return fmt.Sprint("labels/", repo, "/")
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Purge is the audit record of the deletion of specific content from the blob store.
+//
+// The files using the content are kept in the bundle file lists as tombstones, marked with the ID of the purge.
+type Purge struct {
+	ID          string          `json:"id" yaml:"id"`
+	Timestamp   time.Time       `json:"timestamp" yaml:"timestamp"`
+	Contributor Contributor     `json:"contributor" yaml:"contributor"`
+	Reason      string          `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Hashes      []string        `json:"hashes,omitempty" yaml:"hashes,omitempty"`         // hashes requested to be purged
+	Paths       []string        `json:"paths,omitempty" yaml:"paths,omitempty"`           // paths requested to be purged
+	Roots       []string        `json:"roots" yaml:"roots"`                               // root keys deleted, with their leaves
+	Leaves      []string        `json:"leaves" yaml:"leaves"`                             // leaf keys deleted
+	Files       []BlobReference `json:"files" yaml:"files"`                               // files whose content was purged
+	Collateral  []BlobReference `json:"collateral,omitempty" yaml:"collateral,omitempty"` // other files sharing a deleted leaf, now unreadable
+	_           struct{}
+}
+
+func GetArchivePathPrefixToPurges() string {
+	return fmt.Sprint("purges/")
+}
+
+func GetArchivePathToPurge(id string) string {
+	return fmt.Sprint(GetArchivePathPrefixToPurges(), id, ".yaml")
+}
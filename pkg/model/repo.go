@@ -12,6 +12,40 @@ type RepoDescriptor struct {
 	Description string      `json:"description,omitempty" yaml:"description,omitempty"`
 	Timestamp   time.Time   `json:"timestamp,omitempty" yaml:"timestamp,omitempty"`
 	Contributor Contributor `json:"contributor,omitempty" yaml:"contributor,omitempty"`
+	Encryption  *Encryption `json:"encryption,omitempty" yaml:"encryption,omitempty"` // Set when the repo data is encrypted client side
+	Retention   *Retention  `json:"retention,omitempty" yaml:"retention,omitempty"`   // Bundles to keep when pruning the repo
+}
+
+// Retention is the policy deciding which bundles of a repo are kept when it is pruned.
+// A bundle is kept when any of the rules keeps it, a policy without rules keeps every bundle.
+// Labeled bundles and the parents of kept bundles are always kept.
+type Retention struct {
+	KeepLast int `json:"keepLast,omitempty" yaml:"keepLast,omitempty"` // keep the last N bundles
+	KeepDays int `json:"keepDays,omitempty" yaml:"keepDays,omitempty"` // keep the bundles younger than N days
+	_        struct{}
+}
+
+// IsEmpty is true when the policy has no rule
+func (r *Retention) IsEmpty() bool {
+	return r == nil || (r.KeepLast <= 0 && r.KeepDays <= 0)
+}
+
+// Encryption records how the data of a repo is encrypted
+type Encryption struct {
+	Algorithm string `json:"algorithm" yaml:"algorithm"`
+	KeyID     string `json:"keyID" yaml:"keyID"` // Key encryption key used to wrap the data keys
+}
+
+// RepoLock is held while an operation changes a repo, so concurrent writers fail instead of racing
+type RepoLock struct {
+	Operation string    `json:"operation" yaml:"operation"`
+	Owner     string    `json:"owner" yaml:"owner"` // unique to the call holding the lock, needed to resume it
+	Timestamp time.Time `json:"timestamp" yaml:"timestamp"`
+	_         struct{}
+}
+
+func GetArchivePathToRepoLock(repo string) string {
+	return fmt.Sprint("locks/repos/", repo, ".yaml")
 }
 
 func GetArchivePathToRepoDescriptor(repo string) string {
@@ -0,0 +1,191 @@
+// Copyright © 2018 One Concern
+
+// Package progress tracks the advancement of long running bundle and cafs operations.
+package progress
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a point in time view of the progress of an operation.
+type Event struct {
+	FilesDone      int64         `json:"filesDone" yaml:"filesDone"`
+	FilesTotal     int64         `json:"filesTotal" yaml:"filesTotal"`
+	BytesDone      int64         `json:"bytesDone" yaml:"bytesDone"`
+	BytesTotal     int64         `json:"bytesTotal,omitempty" yaml:"bytesTotal,omitempty"` // 0 when unknown
+	BytesDuplicate int64         `json:"bytesDuplicate" yaml:"bytesDuplicate"`             // Bytes that were already present in the blob store
+	Elapsed        time.Duration `json:"elapsed" yaml:"elapsed"`
+	DedupRatio     float64       `json:"dedupRatio" yaml:"dedupRatio"`
+	BytesPerSecond float64       `json:"bytesPerSecond" yaml:"bytesPerSecond"`
+	ETA            time.Duration `json:"eta" yaml:"eta"` // 0 when it can't be estimated yet
+	Done           bool          `json:"done" yaml:"done"`
+	_              struct{}
+}
+
+// Option to configure a tracker
+type Option func(*Tracker)
+
+// OnUpdate registers a callback invoked every time the tracker advances.
+//
+// The callback is called synchronously from the goroutine doing the work, so it must be cheap.
+func OnUpdate(fn func(Event)) Option {
+	return func(t *Tracker) {
+		t.notify = fn
+	}
+}
+
+// Events registers a channel that receives an event every time the tracker advances.
+//
+// Sends never block, events are dropped when the channel is full.
+func Events(c chan<- Event) Option {
+	return func(t *Tracker) {
+		t.events = c
+	}
+}
+
+// Tracker accumulates progress for an operation. It is safe for concurrent use.
+//
+// A nil *Tracker is valid and ignores all updates, callers don't need to check before reporting.
+type Tracker struct {
+	start      time.Time
+	filesTotal int64
+	filesDone  int64
+	bytesTotal int64
+	bytesDone  int64
+	bytesDup   int64
+	done       int32
+	notify     func(Event)
+	events     chan<- Event
+	closed     bool
+	mu         sync.RWMutex // Guards sends on events against close
+}
+
+// New creates a tracker, the clock for throughput starts now.
+func New(opts ...Option) *Tracker {
+	t := &Tracker{start: time.Now()}
+	for _, apply := range opts {
+		apply(t)
+	}
+	return t
+}
+
+// AddFiles increments the number of files expected.
+func (t *Tracker) AddFiles(n int64) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.filesTotal, n)
+	t.update()
+}
+
+// AddBytes increments the number of bytes expected.
+func (t *Tracker) AddBytes(n int64) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.bytesTotal, n)
+	t.update()
+}
+
+// FileDone records the completion of a file.
+func (t *Tracker) FileDone() {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.filesDone, 1)
+	t.update()
+}
+
+// BytesDone records processed bytes, duplicate is set when the bytes were already stored.
+func (t *Tracker) BytesDone(n int64, duplicate bool) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.bytesDone, n)
+	if duplicate {
+		atomic.AddInt64(&t.bytesDup, n)
+	}
+	t.update()
+}
+
+// Finish marks the operation as complete, emits a final event and closes the events channel if any.
+func (t *Tracker) Finish() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt32(&t.done, 1)
+	t.update()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.events != nil && !t.closed {
+		close(t.events)
+	}
+	t.closed = true
+}
+
+// Snapshot returns the current state of the tracker.
+func (t *Tracker) Snapshot() Event {
+	if t == nil {
+		return Event{}
+	}
+	e := Event{
+		FilesDone:      atomic.LoadInt64(&t.filesDone),
+		FilesTotal:     atomic.LoadInt64(&t.filesTotal),
+		BytesDone:      atomic.LoadInt64(&t.bytesDone),
+		BytesTotal:     atomic.LoadInt64(&t.bytesTotal),
+		BytesDuplicate: atomic.LoadInt64(&t.bytesDup),
+		Elapsed:        time.Since(t.start),
+		Done:           atomic.LoadInt32(&t.done) == 1,
+	}
+	if e.BytesDone > 0 {
+		e.DedupRatio = float64(e.BytesDuplicate) / float64(e.BytesDone)
+	}
+	if secs := e.Elapsed.Seconds(); secs > 0 {
+		e.BytesPerSecond = float64(e.BytesDone) / secs
+	}
+	e.ETA = estimate(e)
+	return e
+}
+
+// Estimate the remaining time from bytes when the total is known, otherwise from files.
+func estimate(e Event) time.Duration {
+	if e.Done {
+		return 0
+	}
+	var done, total int64
+	switch {
+	case e.BytesTotal > 0:
+		done, total = e.BytesDone, e.BytesTotal
+	case e.FilesTotal > 0:
+		done, total = e.FilesDone, e.FilesTotal
+	}
+	if done <= 0 || done >= total {
+		return 0
+	}
+	remaining := float64(total-done) / float64(done)
+	return time.Duration(remaining * float64(e.Elapsed))
+}
+
+func (t *Tracker) update() {
+	if t.notify == nil && t.events == nil {
+		return
+	}
+	e := t.Snapshot()
+	if t.notify != nil {
+		t.notify(e)
+	}
+	if t.events == nil {
+		return
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.events <- e:
+	default:
+	}
+}
@@ -0,0 +1,95 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_Snapshot(t *testing.T) {
+	tr := New()
+	tr.AddFiles(4)
+	tr.AddBytes(400)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(duplicate bool) {
+			defer wg.Done()
+			tr.BytesDone(100, duplicate)
+			tr.FileDone()
+		}(i == 0)
+	}
+	wg.Wait()
+
+	e := tr.Snapshot()
+	require.Equal(t, int64(2), e.FilesDone)
+	require.Equal(t, int64(4), e.FilesTotal)
+	require.Equal(t, int64(200), e.BytesDone)
+	require.Equal(t, int64(100), e.BytesDuplicate)
+	require.Equal(t, 0.5, e.DedupRatio)
+	require.False(t, e.Done)
+
+	tr.Finish()
+	e = tr.Snapshot()
+	require.True(t, e.Done)
+	require.Zero(t, e.ETA)
+}
+
+func TestTracker_Nil(t *testing.T) {
+	var tr *Tracker
+	tr.AddFiles(1)
+	tr.BytesDone(1, true)
+	tr.FileDone()
+	tr.Finish()
+	require.Equal(t, Event{}, tr.Snapshot())
+}
+
+func TestTracker_Events(t *testing.T) {
+	c := make(chan Event, 10)
+	var calls int
+	tr := New(Events(c), OnUpdate(func(Event) { calls++ }))
+	tr.AddFiles(1)
+	tr.FileDone()
+	tr.Finish()
+
+	var events []Event
+	for e := range c {
+		events = append(events, e)
+	}
+	require.Len(t, events, 3)
+	require.True(t, events[2].Done)
+	require.Equal(t, 3, calls)
+
+	// Updates after finish are ignored by the closed channel.
+	tr.FileDone()
+}
+
+func TestEstimate(t *testing.T) {
+	e := Event{BytesDone: 25, BytesTotal: 100, Elapsed: time.Second}
+	require.Equal(t, 3*time.Second, estimate(e))
+
+	e = Event{FilesDone: 1, FilesTotal: 2, Elapsed: time.Second}
+	require.Equal(t, time.Second, estimate(e))
+
+	e = Event{FilesTotal: 2, Elapsed: time.Second}
+	require.Zero(t, estimate(e))
+}
+
+func TestJSONLines(t *testing.T) {
+	var b bytes.Buffer
+	tr := New()
+	tr.AddFiles(2)
+	tr.FileDone()
+	stop := Watch(tr, time.Hour, JSONLines(&b))
+	stop()
+
+	var e Event
+	require.NoError(t, json.Unmarshal(b.Bytes(), &e))
+	require.Equal(t, int64(1), e.FilesDone)
+	require.Equal(t, int64(2), e.FilesTotal)
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 One Concern
+
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+const barWidth = 30
+
+// Renderer writes an event in a human or machine readable form
+type Renderer func(Event)
+
+// Bar renders events as a single line progress bar, redrawn in place. Meant for terminals.
+func Bar(w io.Writer) Renderer {
+	return func(e Event) {
+		var ratio float64
+		switch {
+		case e.Done:
+			ratio = 1
+		case e.BytesTotal > 0:
+			ratio = float64(e.BytesDone) / float64(e.BytesTotal)
+		case e.FilesTotal > 0:
+			ratio = float64(e.FilesDone) / float64(e.FilesTotal)
+		}
+		if ratio > 1 {
+			ratio = 1
+		}
+		filled := int(ratio * barWidth)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+
+		bytes := units.HumanSize(float64(e.BytesDone))
+		if e.BytesTotal > 0 {
+			bytes += "/" + units.HumanSize(float64(e.BytesTotal))
+		}
+		eta := "--"
+		if e.ETA > 0 {
+			eta = e.ETA.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "\r[%s] %3.0f%% files %d/%d %s %s/s dedup %.0f%% eta %s\x1b[K",
+			bar, ratio*100, e.FilesDone, e.FilesTotal, bytes,
+			units.HumanSize(e.BytesPerSecond), e.DedupRatio*100, eta)
+		if e.Done {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// JSONLines renders every event as one JSON object per line. Meant for logs and pipelines.
+func JSONLines(w io.Writer) Renderer {
+	enc := json.NewEncoder(w)
+	return func(e Event) {
+		_ = enc.Encode(e)
+	}
+}
+
+// Watch renders the state of the tracker every interval until the returned function is called,
+// which renders the final state and waits for the watcher to exit.
+func Watch(t *Tracker, interval time.Duration, render Renderer) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				render(t.Snapshot())
+			case <-done:
+				render(t.Snapshot())
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright © 2018 One Concern
+
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// KeySize is the size in bytes of data keys and local key encryption keys (AES-256)
+const KeySize = 32
+
+// KeyProvider wraps and unwraps the per object data keys with a key encryption key.
+//
+// A KMS backed implementation only needs to delegate these calls to the KMS, the key encryption
+// key never has to leave it.
+type KeyProvider interface {
+	// KeyID identifies the key encryption key, it is recorded alongside every wrapped data key.
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+type localKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewLocalKey creates a key provider that wraps data keys with AES-GCM using the given 32 byte key.
+func NewLocalKey(kek []byte) (KeyProvider, error) {
+	if len(kek) != KeySize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes, got %d", KeySize, len(kek))
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(kek)
+	return &localKey{
+		id:   "local:" + hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+// NewKeyFile creates a local key provider from a file holding a 32 byte key, either raw or hex encoded.
+func NewKeyFile(path string) (KeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %v", err)
+	}
+	if len(b) != KeySize {
+		b, err = hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s is neither a raw nor a hex encoded %d byte key", path, KeySize)
+		}
+	}
+	return NewLocalKey(b)
+}
+
+// GenerateKey returns a new random hex encoded key, suitable as the content of a key file.
+func GenerateKey() (string, error) {
+	k, err := randomBytes(KeySize)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(k), nil
+}
+
+func (l *localKey) KeyID() string {
+	return l.id
+}
+
+func (l *localKey) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	nonce, err := randomBytes(l.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, dataKey, []byte(l.id)), nil
+}
+
+func (l *localKey) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != l.id {
+		return nil, storage.Forbiddenf("data key was wrapped with key %q, configured key is %q", keyID, l.id)
+	}
+	ns := l.aead.NonceSize()
+	if len(wrapped) < ns {
+		return nil, ErrCorrupted
+	}
+	return l.aead.Open(nil, wrapped[:ns], wrapped[ns:], []byte(l.id))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,239 @@
+// Copyright © 2018 One Concern
+
+// Package encrypted provides a storage.Store decorator that encrypts objects before they reach the backing store.
+//
+// Every object is sealed with AES-256-GCM under its own random data key. The data key is wrapped by a
+// KeyProvider (envelope encryption) and stored in the object header, so rotating or revoking the key
+// encryption key never requires reading the payloads.
+//
+// Object layout:
+//
+//	magic (8) | key id length (1) | key id | wrapped key length (2) | wrapped key | nonce (12) | ciphertext
+//
+// Everything before the ciphertext is authenticated as additional data.
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/oneconcern/datamon/pkg/storage"
+)
+
+// Algorithm recorded in repo descriptors for data written through this package
+const Algorithm = "aes-256-gcm-envelope"
+
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+const (
+	// ErrCorrupted is returned when an object can't be decrypted
+	ErrCorrupted errString = "encrypted object is corrupted or was tampered with"
+	// ErrNotEncrypted is returned when reading an object that was stored in clear text
+	ErrNotEncrypted errString = "object is not encrypted"
+)
+
+var magic = []byte("DMENC\x00\x00\x01")
+
+// Option to configure the encrypted store
+type Option func(*encryptedStore)
+
+// Exclude stores the keys matched by the predicate in clear text.
+//
+// This is meant for objects that must stay readable without a key, such as repo descriptors
+// recording that a repo is encrypted.
+func Exclude(match func(key string) bool) Option {
+	return func(s *encryptedStore) {
+		s.exclude = match
+	}
+}
+
+// New wraps the store so that object bodies are encrypted at rest. Keys are stored as is.
+func New(store storage.Store, keys KeyProvider, opts ...Option) storage.Store {
+	s := &encryptedStore{
+		store:   store,
+		keys:    keys,
+		exclude: func(string) bool { return false },
+	}
+	for _, apply := range opts {
+		apply(s)
+	}
+	return s
+}
+
+type encryptedStore struct {
+	store   storage.Store
+	keys    KeyProvider
+	exclude func(string) bool
+}
+
+func (s *encryptedStore) String() string {
+	return "encrypted+" + s.store.String()
+}
+
+func (s *encryptedStore) Has(ctx context.Context, key string) (bool, error) {
+	return s.store.Has(ctx, key)
+}
+
+func (s *encryptedStore) Ping(ctx context.Context) error {
+	return storage.Ping(ctx, s.store)
+}
+
+func (s *encryptedStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if s.exclude(key) {
+		return s.store.Get(ctx, key)
+	}
+	plain, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(plain)), nil
+}
+
+func (s *encryptedStore) GetAt(ctx context.Context, key string) (io.ReaderAt, error) {
+	if s.exclude(key) {
+		return s.store.GetAt(ctx, key)
+	}
+	plain, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plain), nil
+}
+
+func (s *encryptedStore) Put(ctx context.Context, key string, source io.Reader, exclusive bool) error {
+	if s.exclude(key) {
+		return s.store.Put(ctx, key, source, exclusive)
+	}
+	plain, err := readAll(source)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.seal(ctx, plain)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, key, bytes.NewReader(sealed), exclusive)
+}
+
+func (s *encryptedStore) Delete(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, key)
+}
+
+func (s *encryptedStore) Keys(ctx context.Context) ([]string, error) {
+	return s.store.Keys(ctx)
+}
+
+func (s *encryptedStore) Clear(ctx context.Context) error {
+	return s.store.Clear(ctx)
+}
+
+func (s *encryptedStore) KeysPrefix(ctx context.Context, token, prefix, delimiter string, count int) ([]string, string, error) {
+	return s.store.KeysPrefix(ctx, token, prefix, delimiter, count)
+}
+
+func (s *encryptedStore) seal(ctx context.Context, plain []byte) ([]byte, error) {
+	dataKey, err := randomBytes(KeySize)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	keyID := s.keys.KeyID()
+
+	header := make([]byte, 0, len(magic)+1+len(keyID)+2+len(wrapped)+len(nonce))
+	header = append(header, magic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(wrapped)))
+	header = append(header, l[:]...)
+	header = append(header, wrapped...)
+	header = append(header, nonce...)
+
+	return aead.Seal(header, nonce, plain, header), nil
+}
+
+func (s *encryptedStore) open(ctx context.Context, key string) ([]byte, error) {
+	rdr, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	sealed, err := readAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(sealed, magic) {
+		return nil, ErrNotEncrypted
+	}
+	pos := len(magic)
+	next := func(n int) ([]byte, bool) {
+		if n < 0 || pos+n > len(sealed) {
+			return nil, false
+		}
+		b := sealed[pos : pos+n]
+		pos += n
+		return b, true
+	}
+
+	l, ok := next(1)
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	keyID, ok := next(int(l[0]))
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	l, ok = next(2)
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	wrapped, ok := next(int(binary.BigEndian.Uint16(l)))
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	dataKey, err := s.keys.UnwrapKey(ctx, string(keyID), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ok := next(aead.NonceSize())
+	if !ok {
+		return nil, ErrCorrupted
+	}
+	plain, err := aead.Open(nil, nonce, sealed[pos:], sealed[:pos])
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return plain, nil
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, storage.MaxObjectSizeInMemory+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > storage.MaxObjectSizeInMemory {
+		return nil, storage.ErrObjectTooBig
+	}
+	return b, nil
+}
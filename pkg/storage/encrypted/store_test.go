@@ -0,0 +1,126 @@
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/internal"
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+func testKey(t *testing.T) KeyProvider {
+	k, err := GenerateKey()
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "encrypted-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	require.NoError(t, ioutil.WriteFile(path, []byte(k+"\n"), 0600))
+	kp, err := NewKeyFile(path)
+	require.NoError(t, err)
+	return kp
+}
+
+func TestEncryptedStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	raw := localfs.New(afero.NewMemMapFs())
+	store := New(raw, testKey(t))
+
+	data := []byte("some personal data")
+	require.NoError(t, store.Put(ctx, "a/b", bytes.NewReader(data), true))
+
+	rdr, err := store.Get(ctx, "a/b")
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	ra, err := store.GetAt(ctx, "a/b")
+	require.NoError(t, err)
+	buf := make([]byte, 8)
+	_, err = ra.ReadAt(buf, 5)
+	require.NoError(t, err)
+	require.Equal(t, data[5:13], buf)
+
+	rdr, err = raw.Get(ctx, "a/b")
+	require.NoError(t, err)
+	sealed, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, data))
+}
+
+func TestEncryptedStore_WrongKey(t *testing.T) {
+	ctx := context.Background()
+	raw := localfs.New(afero.NewMemMapFs())
+	require.NoError(t, New(raw, testKey(t)).Put(ctx, "k", bytes.NewReader([]byte("data")), true))
+
+	_, err := New(raw, testKey(t)).Get(ctx, "k")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "wrapped with key")
+}
+
+func TestEncryptedStore_Tampered(t *testing.T) {
+	ctx := context.Background()
+	raw := localfs.New(afero.NewMemMapFs())
+	kp := testKey(t)
+	require.NoError(t, New(raw, kp).Put(ctx, "k", bytes.NewReader([]byte("data")), true))
+
+	rdr, err := raw.Get(ctx, "k")
+	require.NoError(t, err)
+	sealed, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 0xff
+	require.NoError(t, raw.Put(ctx, "k", bytes.NewReader(sealed), false))
+
+	_, err = New(raw, kp).Get(ctx, "k")
+	require.Equal(t, ErrCorrupted, err)
+}
+
+func TestEncryptedStore_Exclude(t *testing.T) {
+	ctx := context.Background()
+	raw := localfs.New(afero.NewMemMapFs())
+	store := New(raw, testKey(t), Exclude(func(k string) bool { return strings.HasPrefix(k, "repos/") }))
+
+	require.NoError(t, store.Put(ctx, "repos/r/repo.json", bytes.NewReader([]byte("clear")), true))
+	rdr, err := raw.Get(ctx, "repos/r/repo.json")
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, "clear", string(got))
+
+	require.NoError(t, raw.Put(ctx, "bundles/x", bytes.NewReader([]byte("clear")), true))
+	_, err = store.Get(ctx, "bundles/x")
+	require.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestEncryptedStore_ContentAddressing(t *testing.T) {
+	ctx := context.Background()
+	data := internal.RandBytesMaskImprSrc(3*1024 + 17)
+	const leafSize = 1024
+
+	plainFs, err := cafs.New(cafs.LeafSize(leafSize), cafs.Backend(localfs.New(afero.NewMemMapFs())))
+	require.NoError(t, err)
+	_, plainKey, _, _, err := plainFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	encFs, err := cafs.New(cafs.LeafSize(leafSize), cafs.Backend(New(localfs.New(afero.NewMemMapFs()), testKey(t))))
+	require.NoError(t, err)
+	_, encKey, _, _, err := encFs.Put(ctx, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, plainKey, encKey)
+
+	rdr, err := encFs.Get(ctx, encKey)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
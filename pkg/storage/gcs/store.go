@@ -54,13 +54,9 @@ func (g *gcs) String() string {
 }
 
 func (g *gcs) Has(ctx context.Context, objectName string) (bool, error) {
-	client, err := gcsStorage.NewClient(ctx, option.WithScopes(gcsStorage.ScopeReadOnly))
+	_, err := g.readOnlyClient.Bucket(g.bucket).Object(objectName).Attrs(ctx)
 	if err != nil {
-		return false, err
-	}
-	_, err = client.Bucket(g.bucket).Object(objectName).Attrs(ctx)
-	if err != nil {
-		if err != gcsStorage.ErrObjectNotExist {
+		if err == gcsStorage.ErrObjectNotExist {
 			return false, nil
 		}
 		return false, err
@@ -68,6 +64,12 @@ func (g *gcs) Has(ctx context.Context, objectName string) (bool, error) {
 	return true, nil
 }
 
+// Ping checks that the bucket exists: objects of a missing bucket are reported missing, not the bucket
+func (g *gcs) Ping(ctx context.Context) error {
+	_, err := g.readOnlyClient.Bucket(g.bucket).Attrs(ctx)
+	return err
+}
+
 type gcsReader struct {
 	objectReader io.ReadCloser
 }
@@ -137,16 +139,28 @@ func (g *gcs) PutCRC(ctx context.Context, objectName string, reader io.Reader, d
 }
 
 func (g *gcs) Delete(ctx context.Context, objectName string) error {
-	return g.client.Bucket(g.bucket).Object(objectName).Delete(ctx)
+	err := g.client.Bucket(g.bucket).Object(objectName).Delete(ctx)
+	if err == gcsStorage.ErrObjectNotExist {
+		// deleting is idempotent, like with the other stores
+		return nil
+	}
+	return err
 }
 
 func (g *gcs) Keys(ctx context.Context) ([]string, error) {
-	keys, _, err := g.KeysPrefix(ctx, "", "", "", 0)
-	if err != nil {
-		return nil, err
+	var keys []string
+	var token string
+	for {
+		page, next, err := g.KeysPrefix(ctx, token, "", "", 0)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		token = next
 	}
-
-	return keys, nil
 }
 
 func (g *gcs) KeysPrefix(ctx context.Context, pageToken string, prefix string, delimiter string, count int) ([]string, string, error) {
@@ -48,6 +48,14 @@ func (i *instrumentedStore) spanFromContext(ctx context.Context, name string) op
 	return span
 }
 
+func (i *instrumentedStore) Ping(ctx context.Context) error {
+	span := i.spanFromContext(ctx, i.opName("Ping"))
+	defer span.Finish()
+	i.logs.Info("storage ping")
+
+	return Ping(ctx, i.store)
+}
+
 func (i *instrumentedStore) Has(ctx context.Context, key string) (bool, error) {
 	span := i.spanFromContext(ctx, i.opName("Has"))
 	defer span.Finish()
@@ -4,16 +4,20 @@ package localfs
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/oneconcern/datamon/pkg/storage"
 	"github.com/spf13/afero"
 )
 
+// PageSize is the default number of keys returned by KeysPrefix
+const PageSize = 1000
+
 // New creates a new local file system backed storage model
 func New(fs afero.Fs) storage.Store {
 	if fs == nil {
@@ -64,6 +68,18 @@ func (l *localFS) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	}, err
 }
 
+// Ping checks that the directory of the store exists
+func (l *localFS) Ping(ctx context.Context) error {
+	fi, err := l.fs.Stat("/")
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("the root of the store is not a directory")
+	}
+	return nil
+}
+
 type readCloser struct {
 	reader io.Reader
 }
@@ -82,20 +98,28 @@ func (l *localFS) Put(ctx context.Context, key string, source io.Reader, exclusi
 			return fmt.Errorf("ensuring directories for %q: %v", key, err)
 		}
 	}
-	flag := os.O_CREATE | os.O_WRONLY | os.O_SYNC | 0600
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC | os.O_SYNC | 0600
 	if exclusive {
+		// not every afero fs honors O_EXCL
+		found, err := afero.Exists(l.fs, key)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("create record for %q: %w", key, os.ErrExist)
+		}
 		flag |= os.O_EXCL
 	}
 	target, err := l.fs.OpenFile(key, flag, 0600)
 	if err != nil {
-		return fmt.Errorf("create record for %q: %v", key, err)
+		return fmt.Errorf("create record for %q: %w", key, err)
 	}
 	s := readCloser{
 		reader: source,
 	}
 	// If reader implements writeto use it.
-	wt := source.(io.WriterTo)
-	if wt != nil {
+	wt, ok := source.(io.WriterTo)
+	if ok {
 		_, err = wt.WriteTo(target)
 		if err != nil {
 			return fmt.Errorf("write record for %q: %v", key, err)
@@ -146,9 +170,40 @@ func (l *localFS) Keys(ctx context.Context) ([]string, error) {
 	return res, nil
 }
 
-//TODO discuss the implementation with @Ivan & @Ritesh
+// KeysPrefix lists the keys starting with prefix in lexical order, after the key given as page token.
+//
+// With a delimiter, keys sharing the part of their name up to the first delimiter after the prefix are
+// returned once, as that common prefix. count limits the size of the page, 0 uses the default page size.
 func (l *localFS) KeysPrefix(ctx context.Context, token, prefix, delimiter string, count int) ([]string, string, error) {
-	return nil, "", errors.New("unimplemented")
+	all, err := l.Keys(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(all)
+	if count <= 0 {
+		count = PageSize
+	}
+
+	keys := make([]string, 0, count)
+	for _, k := range all {
+		k = filepath.ToSlash(k)
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				k = k[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if k <= token || (len(keys) > 0 && keys[len(keys)-1] == k) {
+			continue
+		}
+		if len(keys) == count {
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, k)
+	}
+	return keys, "", nil
 }
 
 func (l *localFS) Clear(ctx context.Context) error {
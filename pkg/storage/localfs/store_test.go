@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/oneconcern/datamon/pkg/storage"
@@ -31,6 +33,16 @@ func TestHas(t *testing.T) {
 	require.False(t, has)
 }
 
+func TestPing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datamon-localfs-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, storage.Ping(context.Background(), New(afero.NewBasePathFs(afero.NewOsFs(), dir))))
+	err = storage.Ping(context.Background(), New(afero.NewBasePathFs(afero.NewOsFs(), filepath.Join(dir, "missing"))))
+	require.True(t, os.IsNotExist(err), "%v", err)
+}
+
 func TestGet(t *testing.T) {
 	bs, cleanup := setupStore(t)
 	defer cleanup()
@@ -57,6 +69,33 @@ func TestKeys(t *testing.T) {
 	require.Len(t, keys, 2)
 }
 
+func TestKeysPrefix(t *testing.T) {
+	bs, cleanup := setupStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	for _, k := range []string{"dir/a", "dir/b", "dir/sub/c", "other/d"} {
+		require.NoError(t, bs.Put(ctx, k, bytes.NewReader([]byte(k)), storage.IfNotPresent))
+	}
+
+	keys, token, err := bs.KeysPrefix(ctx, "", "dir/", "", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dir/a", "dir/b", "dir/sub/c"}, keys)
+	require.Empty(t, token)
+
+	keys, token, err = bs.KeysPrefix(ctx, "", "dir/", "", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dir/a", "dir/b"}, keys)
+	require.Equal(t, "dir/b", token)
+	keys, token, err = bs.KeysPrefix(ctx, token, "dir/", "", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dir/sub/c"}, keys)
+	require.Empty(t, token)
+
+	keys, _, err = bs.KeysPrefix(ctx, "", "", "/", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dir/", "other/", "seventeentons", "sixteentons"}, keys)
+}
+
 func TestDelete(t *testing.T) {
 	bs, cleanup := setupStore(t)
 	defer cleanup()
@@ -93,6 +132,20 @@ func TestPut(t *testing.T) {
 
 	k, _ := bs.Keys(context.Background())
 	assert.Len(t, k, 3)
+
+	// overwriting with shorter content leaves nothing of the previous content
+	err = bs.Put(context.Background(), "seventeentons", bytes.NewBufferString("short"), storage.OverWrite)
+	require.NoError(t, err)
+	rdr, err = bs.Get(context.Background(), "seventeentons")
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(rdr)
+	require.NoError(t, err)
+	require.NoError(t, rdr.Close())
+	assert.Equal(t, "short", string(b))
+
+	err = bs.Put(context.Background(), "eighteentons", bytes.NewBufferString("overwritten"), storage.IfNotPresent)
+	require.Error(t, err)
+	require.NoError(t, bs.Put(context.Background(), "eighteentons", bytes.NewBufferString("overwritten"), storage.OverWrite))
 }
 
 func setupStore(t testing.TB) (storage.Store, func()) {
@@ -158,6 +158,15 @@ func (s *s3FS) Clear(ctx context.Context) error {
 	return del.Delete(ctx, s3manager.NewDeleteListIterator(s.s3, params))
 }
 
+// Ping checks that the bucket exists
+func (s *s3FS) Ping(ctx context.Context) error {
+	_, err := s.s3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if rerr, ok := err.(awserr.RequestFailure); ok && rerr.StatusCode() == 404 {
+		return storage.NotFoundf("bucket %s does not exist", s.bucket)
+	}
+	return err
+}
+
 func (s *s3FS) String() string {
 	return "s3@" + s.bucket
 }
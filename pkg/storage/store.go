@@ -5,6 +5,7 @@ package storage
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 )
@@ -27,6 +28,30 @@ const (
 	ErrObjectTooBig errString = "object too big to be read into memory"
 )
 
+// kindError has a message of its own, and matches one of the errors above with errors.Is
+type kindError struct {
+	kind errString
+	msg  string
+}
+
+func (e kindError) Error() string { return e.msg }
+func (e kindError) Unwrap() error { return e.kind }
+
+// NotFoundf formats an error matching ErrNotFound
+func NotFoundf(format string, args ...interface{}) error {
+	return kindError{kind: ErrNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+// Existsf formats an error matching ErrExists
+func Existsf(format string, args ...interface{}) error {
+	return kindError{kind: ErrExists, msg: fmt.Sprintf(format, args...)}
+}
+
+// Forbiddenf formats an error matching ErrForbidden
+func Forbiddenf(format string, args ...interface{}) error {
+	return kindError{kind: ErrForbidden, msg: fmt.Sprintf(format, args...)}
+}
+
 // Store implementations know how to write entries to a K/V model.Store.
 //
 // Typically this is something file system-like. Examples are S3, local FS, NFS, ...
@@ -47,6 +72,25 @@ type StoreCRC interface {
 	PutCRC(context.Context, string, io.Reader, bool, uint32) error
 }
 
+// Pinger is implemented by the stores checking that their bucket or directory exists
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// pingKey is the key looked up to check that stores which are not a Pinger respond
+const pingKey = "datamon-ping"
+
+// Ping checks that a store responds. The bucket or directory of the store is checked when the store is a Pinger,
+// other stores only answer whether a key exists.
+func Ping(ctx context.Context, store Store) error {
+	if p, ok := store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	// a missing key is an answer
+	_, err := store.Has(ctx, pingKey)
+	return err
+}
+
 func ReadTee(ctx context.Context, sStore Store, source string, dStore Store, destination string) ([]byte, error) {
 	reader, err := sStore.Get(ctx, source)
 	if err != nil {
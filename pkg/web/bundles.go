@@ -0,0 +1,143 @@
+// Copyright © 2018 One Concern
+
+package web
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+)
+
+// latest is the alias of the latest bundle of a repo in routes
+const latest = "latest"
+
+// listOptions reads the paging and filtering query parameters of lists
+func listOptions(r *http.Request) ([]core.ListOption, error) {
+	q := r.URL.Query()
+	opts := []core.ListOption{
+		core.ListToken(q.Get("token")),
+		core.ListContributor(q.Get("contributor")),
+		core.ListMessage(q.Get("message")),
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, badRequestf("invalid limit %q", v)
+		}
+		opts = append(opts, core.ListLimit(limit))
+	}
+	for name, option := range map[string]func(time.Time) core.ListOption{
+		"since": core.ListSince,
+		"until": core.ListUntil,
+	} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, badRequestf("invalid %s %q, expecting an RFC3339 time", name, v)
+			}
+			opts = append(opts, option(t))
+		}
+	}
+	if v := q.Get("desc"); v != "" {
+		desc, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, badRequestf("invalid desc %q", v)
+		}
+		opts = append(opts, core.ListDescending(desc))
+	}
+	return opts, nil
+}
+
+func (s *Server) listRepos(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	repos, next, err := s.client.ListRepos(r.Context(), opts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listPage{Items: repos, NextToken: next})
+}
+
+func (s *Server) getRepo(w http.ResponseWriter, r *http.Request, repo string) {
+	rd, err := s.client.GetRepo(r.Context(), repo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rd)
+}
+
+func (s *Server) listBundles(w http.ResponseWriter, r *http.Request, repo string) {
+	opts, err := listOptions(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	bundles, next, err := s.client.ListBundles(r.Context(), repo, opts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listPage{Items: bundles, NextToken: next})
+}
+
+// bundle returns the descriptor of a bundle, resolving the latest alias
+func (s *Server) bundle(r *http.Request, repo, bundleID string) (model.BundleDescriptor, error) {
+	if bundleID == latest {
+		id, err := s.client.LatestBundle(r.Context(), repo)
+		if err != nil {
+			return model.BundleDescriptor{}, err
+		}
+		bundleID = id
+	}
+	return s.client.GetBundle(r.Context(), repo, bundleID)
+}
+
+func (s *Server) getBundle(w http.ResponseWriter, r *http.Request, repo, bundleID string) {
+	bd, err := s.bundle(r, repo, bundleID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bd)
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request, repo, bundleID string) {
+	bd, err := s.bundle(r, repo, bundleID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	files, err := s.client.ListFiles(r.Context(), repo, bd.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listPage{Items: files})
+}
+
+// getFile streams a file of a bundle. Range requests read only the leaves they need.
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request, repo, bundleID, file string) {
+	bd, err := s.bundle(r, repo, bundleID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	f, err := s.client.OpenFile(r.Context(), repo, bd.ID, file)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+	// bundles are immutable, the bundle and the path identify the content
+	w.Header().Set("ETag", strconv.Quote(bd.ID+"/"+file))
+	http.ServeContent(w, r, path.Base(file), bd.Timestamp, f)
+}
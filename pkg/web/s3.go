@@ -0,0 +1,493 @@
+// Copyright © 2018 One Concern
+
+package web
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/core"
+	"github.com/oneconcern/datamon/pkg/model"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+
+	// bundle file lists kept in memory by the gateway. Bundles don't change, but once cached
+	// a deleted bundle is still listed until evicted, and purged files still listed fail to read.
+	s3CachedBundles = 128
+)
+
+// S3Gateway serves the bundles of the repos as read only S3 buckets, for the tools that speak S3.
+//
+// Each repo is a bucket, holding an object per file of each bundle: <bundle or label>/<path>.
+// Buckets are addressed in the path of requests, clients must use path style requests.
+// GetObject, HeadObject, ListObjects (v1 and v2), HeadBucket, GetBucketLocation and ListBuckets are supported.
+// Request signatures are not verified.
+type S3Gateway struct {
+	client *client.Client
+
+	mu      sync.Mutex
+	bundles map[string]*s3Bundle
+	order   []string
+}
+
+// s3Bundle holds the files of a bundle, sorted by name
+type s3Bundle struct {
+	bd    model.BundleDescriptor
+	files []model.BundleEntry
+}
+
+func (b *s3Bundle) file(name string) (model.BundleEntry, bool) {
+	i := sort.Search(len(b.files), func(i int) bool { return b.files[i].NameWithPath >= name })
+	if i < len(b.files) && b.files[i].NameWithPath == name {
+		return b.files[i], true
+	}
+	return model.BundleEntry{}, false
+}
+
+// NewS3Gateway creates a gateway reading the repos of a client
+func NewS3Gateway(c *client.Client) *S3Gateway {
+	return &S3Gateway{
+		client:  c,
+		bundles: make(map[string]*s3Bundle),
+	}
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         uint64 `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3ListResult is the result of ListObjects, the fields of both versions are set by their version only
+type s3ListResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the gateway is read only", r.URL.Path)
+		return
+	}
+	bucket, key := strings.TrimPrefix(r.URL.Path, "/"), ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	q := r.URL.Query()
+	switch {
+	case bucket == "":
+		g.listBuckets(w, r)
+	case key != "":
+		g.getObject(w, r, bucket, key)
+	case r.Method == http.MethodHead:
+		if _, err := g.client.GetRepo(r.Context(), bucket); err != nil {
+			g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case has(q, "location"):
+		if _, err := g.client.GetRepo(r.Context(), bucket); err != nil {
+			g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+			return
+		}
+		writeXML(w, http.StatusOK, s3Location{Xmlns: s3Namespace})
+	case len(q) == 0 || has(q, "list-type") || has(q, "prefix") || has(q, "delimiter") || has(q, "marker") ||
+		has(q, "max-keys") || has(q, "encoding-type"):
+		g.listObjects(w, r, bucket)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "the gateway only serves objects and their lists", r.URL.Path)
+	}
+}
+
+func has(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	result := s3ListBucketsResult{Xmlns: s3Namespace, Owner: s3Owner{ID: "datamon", DisplayName: "datamon"}}
+	var token string
+	for {
+		repos, next, err := g.client.ListRepos(r.Context(), core.ListToken(token))
+		if err != nil {
+			g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+			return
+		}
+		for _, rd := range repos {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: rd.Name, CreationDate: rd.Timestamp.UTC().Format(s3TimeFormat)})
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// bundle resolves a bundle ID or a label of a repo to the files of a bundle
+func (g *S3Gateway) bundle(r *http.Request, repo, ref string) (*s3Bundle, error) {
+	if b := g.cached(repo, ref); b != nil {
+		return b, nil
+	}
+	bd, err := g.client.GetBundle(r.Context(), repo, ref)
+	if client.Kind(err) == client.ErrNotFound {
+		label, lerr := g.client.GetLabel(r.Context(), repo, ref)
+		if lerr != nil {
+			return nil, err
+		}
+		if b := g.cached(repo, label.BundleID); b != nil {
+			return b, nil
+		}
+		bd, err = g.client.GetBundle(r.Context(), repo, label.BundleID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := g.client.ListFiles(r.Context(), repo, bd.ID)
+	if err != nil {
+		return nil, err
+	}
+	b := &s3Bundle{bd: bd, files: make([]model.BundleEntry, 0, len(entries))}
+	for _, e := range entries {
+		if e.Purged == "" && e.Symlink == "" {
+			b.files = append(b.files, e)
+		}
+	}
+	sort.Slice(b.files, func(i, j int) bool { return b.files[i].NameWithPath < b.files[j].NameWithPath })
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := repo + "/" + bd.ID
+	if _, ok := g.bundles[key]; !ok {
+		if len(g.order) >= s3CachedBundles {
+			delete(g.bundles, g.order[0])
+			g.order = g.order[1:]
+		}
+		g.bundles[key] = b
+		g.order = append(g.order, key)
+	}
+	return b, nil
+}
+
+func (g *S3Gateway) cached(repo, bundleID string) *s3Bundle {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.bundles[repo+"/"+bundleID]
+}
+
+// refs returns the bundle IDs and the labels of a repo, in the order of the keys of their objects
+func (g *S3Gateway) refs(r *http.Request, repo string) ([]string, error) {
+	seen := make(map[string]bool)
+	var refs []string
+	var token string
+	for {
+		bundles, next, err := g.client.ListBundles(r.Context(), repo, core.ListToken(token))
+		if err != nil {
+			return nil, err
+		}
+		for _, bd := range bundles {
+			seen[bd.ID] = true
+			refs = append(refs, bd.ID)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	labels, err := g.client.ListLabels(r.Context(), repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		if !seen[l.Name] {
+			refs = append(refs, l.Name)
+		}
+	}
+	// keys start with the ref and a slash: "a/..." sorts after "a-b/..."
+	sort.Slice(refs, func(i, j int) bool { return refs[i]+"/" < refs[j]+"/" })
+	return refs, nil
+}
+
+// listObjects lists the objects of a bucket after a marker, rolling up the keys with a delimiter after the prefix.
+// Only the file lists of the bundles holding keys of the page are read.
+func (g *S3Gateway) listObjects(w http.ResponseWriter, r *http.Request, repo string) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("invalid max-keys %q", v), r.URL.Path)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = s3URLEncode
+	}
+	result := s3ListResult{
+		Xmlns:        s3Namespace,
+		Name:         repo,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		MaxKeys:      maxKeys,
+		EncodingType: q.Get("encoding-type"),
+	}
+	var marker string
+	if v2 {
+		result.StartAfter = encode(q.Get("start-after"))
+		marker = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "invalid continuation token", r.URL.Path)
+				return
+			}
+			result.ContinuationToken = token
+			marker = string(decoded)
+		}
+	} else {
+		marker = q.Get("marker")
+		encoded := encode(marker)
+		result.Marker = &encoded
+	}
+
+	if _, err := g.client.GetRepo(r.Context(), repo); err != nil {
+		g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	refs, err := g.refs(r, repo)
+	if err != nil {
+		g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+		return
+	}
+
+	var last, lastPrefix string
+	count := 0
+	// add adds a key or a common prefix to the page, it returns false once the page is full
+	add := func(key string, object *s3Object) bool {
+		if key <= marker || key == lastPrefix {
+			return true
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			return false
+		}
+		count++
+		last = key
+		if object == nil {
+			lastPrefix = key
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(key)})
+			return true
+		}
+		object.Key = encode(key)
+		result.Contents = append(result.Contents, *object)
+		return true
+	}
+	// rollup returns the common prefix of a key, empty when the key is not rolled up
+	rollup := func(key string) string {
+		if delimiter == "" || len(key) < len(prefix) {
+			return ""
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+			return key[:len(prefix)+i+len(delimiter)]
+		}
+		return ""
+	}
+
+refs:
+	for _, ref := range refs {
+		head := ref + "/"
+		if !strings.HasPrefix(head, prefix) && !strings.HasPrefix(prefix, head) {
+			continue
+		}
+		if marker != "" && head < marker && !strings.HasPrefix(marker, head) && !strings.HasPrefix(head, marker) {
+			continue // all the keys of the bundle are before the marker
+		}
+		if cp := rollup(head); cp != "" {
+			// the bundle is rolled up before its files
+			if !add(cp, nil) {
+				break
+			}
+			continue
+		}
+		b, err := g.bundle(r, repo, ref)
+		if err != nil {
+			g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+			return
+		}
+		for _, e := range b.files {
+			key := head + e.NameWithPath
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if cp := rollup(key); cp != "" {
+				if !add(cp, nil) {
+					break refs
+				}
+				continue
+			}
+			if !add(key, &s3Object{
+				LastModified: b.bd.Timestamp.UTC().Format(s3TimeFormat),
+				ETag:         strconv.Quote(e.Hash),
+				Size:         e.Size,
+				StorageClass: "STANDARD",
+			}) {
+				break refs
+			}
+		}
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+	} else if result.IsTruncated && delimiter != "" {
+		result.NextMarker = encode(last)
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, repo, key string) {
+	if err := g.client.CheckRepo(r.Context(), repo); err != nil {
+		g.writeError(w, err, "NoSuchBucket", r.URL.Path)
+		return
+	}
+	ref, name := key, ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		ref, name = key[:i], key[i+1:]
+	}
+	b, err := g.bundle(r, repo, ref)
+	if err != nil {
+		g.writeError(w, err, "NoSuchKey", r.URL.Path)
+		return
+	}
+	e, ok := b.file(name)
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist", r.URL.Path)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", strconv.Quote(e.Hash))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if r.Method == http.MethodHead {
+		w.Header().Set("Last-Modified", b.bd.Timestamp.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.FormatUint(e.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	f, err := g.client.OpenEntry(r.Context(), repo, b.bd, e)
+	if err != nil {
+		g.writeError(w, err, "NoSuchKey", r.URL.Path)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, path.Base(name), b.bd.Timestamp, f)
+}
+
+// writeError replies with the S3 error of the kind of an error
+func (g *S3Gateway) writeError(w http.ResponseWriter, err error, notFound, resource string) {
+	switch client.Kind(err) {
+	case client.ErrNotFound:
+		writeS3Error(w, http.StatusNotFound, notFound, err.Error(), resource)
+	case client.ErrForbidden:
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", err.Error(), resource)
+	default:
+		log.Printf("S3 request failed: %s", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", err.Error(), resource)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message, resource string) {
+	writeXML(w, status, s3Error{Code: code, Message: message, Resource: resource})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// s3URLEncode encodes keys for encoding-type=url, decoded alike by the clients unquoting plus signs or not
+func s3URLEncode(s string) string {
+	s = strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	return strings.Replace(s, "%2F", "/", -1)
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awssession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+// newTestGateway serves a bundle labeled prod, and returns an S3 client of the gateway and its metadata store
+func newTestGateway(t *testing.T, files map[string][]byte) (*s3.S3, storage.Store, string, func()) {
+	ctx := context.Background()
+	metaStore := localfs.New(afero.NewMemMapFs())
+	c, err := client.New(client.Config{
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	},
+		client.MetaStore(metaStore),
+		client.BlobStore(localfs.New(afero.NewMemMapFs())),
+	)
+	require.NoError(t, err)
+	_, err = c.CreateRepo(ctx, repo, "test repo")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "datamon-s3-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0700))
+		require.NoError(t, ioutil.WriteFile(p, content, 0600))
+	}
+	bd, err := c.UploadDir(ctx, repo, dir, client.UploadMessage("s3"))
+	require.NoError(t, err)
+	_, err = c.SetLabel(ctx, repo, "prod", bd.ID)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewS3Gateway(c))
+	sess, err := awssession.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("datamon", "datamon", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+	})
+	require.NoError(t, err)
+	return s3.New(sess), metaStore, bd.ID, srv.Close
+}
+
+func keys(out *s3.ListObjectsV2Output) ([]string, []string) {
+	var objects, prefixes []string
+	for _, o := range out.Contents {
+		objects = append(objects, aws.StringValue(o.Key))
+	}
+	for _, p := range out.CommonPrefixes {
+		prefixes = append(prefixes, aws.StringValue(p.Prefix))
+	}
+	return objects, prefixes
+}
+
+func awsCode(t *testing.T, err error) string {
+	require.Error(t, err)
+	aerr, ok := err.(awserr.Error)
+	require.True(t, ok, "%v", err)
+	return aerr.Code()
+}
+
+func TestS3Gateway(t *testing.T) {
+	large := make([]byte, cafs.DefaultLeafSize+100)
+	rand.New(rand.NewSource(1)).Read(large)
+	svc, metaStore, bundleID, done := newTestGateway(t, map[string][]byte{
+		"a.txt":         []byte("a"),
+		"dir/b.txt":     []byte("bb"),
+		"dir/sub/c.txt": []byte("ccc"),
+		"large.bin":     large,
+		"with space":    []byte("space"),
+	})
+	defer done()
+
+	buckets, err := svc.ListBuckets(&s3.ListBucketsInput{})
+	require.NoError(t, err)
+	require.Len(t, buckets.Buckets, 1)
+	require.Equal(t, repo, aws.StringValue(buckets.Buckets[0].Name))
+	_, err = svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(repo)})
+	require.NoError(t, err)
+
+	// bundles and labels are the top level directories
+	out, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(repo), Delimiter: aws.String("/")})
+	require.NoError(t, err)
+	objects, prefixes := keys(out)
+	require.Empty(t, objects)
+	require.Equal(t, []string{bundleID + "/", "prod/"}, prefixes)
+
+	out, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(repo),
+		Prefix:    aws.String(bundleID + "/"),
+		Delimiter: aws.String("/"),
+	})
+	require.NoError(t, err)
+	objects, prefixes = keys(out)
+	require.Equal(t, []string{bundleID + "/a.txt", bundleID + "/large.bin", bundleID + "/with space"}, objects)
+	require.Equal(t, []string{bundleID + "/dir/"}, prefixes)
+	require.Equal(t, int64(4), aws.Int64Value(out.KeyCount))
+	require.Equal(t, int64(len(large)), aws.Int64Value(out.Contents[1].Size))
+
+	out, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(repo), Prefix: aws.String("prod/dir/")})
+	require.NoError(t, err)
+	objects, _ = keys(out)
+	require.Equal(t, []string{"prod/dir/b.txt", "prod/dir/sub/c.txt"}, objects)
+
+	out, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:       aws.String(repo),
+		Prefix:       aws.String("prod/with"),
+		EncodingType: aws.String("url"),
+	})
+	require.NoError(t, err)
+	objects, _ = keys(out)
+	require.Equal(t, []string{"prod/with%20space"}, objects)
+
+	// pages
+	var paged []string
+	pages := 0
+	require.NoError(t, svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(repo), MaxKeys: aws.Int64(2)},
+		func(page *s3.ListObjectsV2Output, last bool) bool {
+			pages++
+			objects, _ := keys(page)
+			paged = append(paged, objects...)
+			return true
+		}))
+	require.Len(t, paged, 10)
+	require.Equal(t, 5, pages)
+	require.Equal(t, bundleID+"/a.txt", paged[0])
+	require.Equal(t, "prod/with space", paged[9])
+
+	v1, err := svc.ListObjects(&s3.ListObjectsInput{
+		Bucket: aws.String(repo),
+		Prefix: aws.String("prod/"),
+		Marker: aws.String("prod/dir/sub/c.txt"),
+	})
+	require.NoError(t, err)
+	require.Len(t, v1.Contents, 2)
+	require.Equal(t, "prod/large.bin", aws.StringValue(v1.Contents[0].Key))
+
+	// objects
+	got, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(repo), Key: aws.String("prod/dir/sub/c.txt")})
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(got.Body)
+	require.NoError(t, err)
+	got.Body.Close()
+	require.Equal(t, "ccc", string(body))
+	require.Equal(t, "text/plain; charset=utf-8", aws.StringValue(got.ContentType))
+
+	got, err = svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(repo),
+		Key:    aws.String(bundleID + "/large.bin"),
+		Range:  aws.String("bytes=2097100-2097199"),
+	})
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(got.Body)
+	require.NoError(t, err)
+	got.Body.Close()
+	require.Equal(t, large[2097100:2097200], body)
+	require.Equal(t, "bytes 2097100-2097199/2097252", aws.StringValue(got.ContentRange))
+
+	// the files of cached bundles are read without reading their file lists again
+	lists, _, err := metaStore.KeysPrefix(context.Background(), "", model.GetArchivePathPrefixToBundle(repo, bundleID), "", 100)
+	require.NoError(t, err)
+	for _, k := range lists {
+		if k != model.GetArchivePathToBundle(repo, bundleID) {
+			require.NoError(t, metaStore.Delete(context.Background(), k))
+		}
+	}
+	got, err = svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(repo), Key: aws.String(bundleID + "/dir/b.txt")})
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(got.Body)
+	require.NoError(t, err)
+	got.Body.Close()
+	require.Equal(t, "bb", string(body))
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(repo), Key: aws.String("prod/large.bin")})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(large)), aws.Int64Value(head.ContentLength))
+	require.NotEmpty(t, aws.StringValue(head.ETag))
+	require.NotNil(t, head.LastModified)
+
+	// errors
+	_, err = svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(repo), Key: aws.String("prod/missing")})
+	require.Equal(t, "NotFound", awsCode(t, err))
+	_, err = svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(repo), Key: aws.String("staging/a.txt")})
+	require.Equal(t, s3.ErrCodeNoSuchKey, awsCode(t, err))
+	_, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("missing")})
+	require.Equal(t, s3.ErrCodeNoSuchBucket, awsCode(t, err))
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(repo), Key: aws.String("prod/a.txt")})
+	require.Equal(t, "MethodNotAllowed", awsCode(t, err))
+}
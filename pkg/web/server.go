@@ -0,0 +1,212 @@
+// Copyright © 2018 One Concern
+
+// Package web serves repos and bundles over HTTP, for consumers that do not run the datamon CLI.
+//
+// All the routes are under /v1:
+//
+//	GET    /v1/repos                                      list repos
+//	GET    /v1/repos/{repo}                               repo descriptor
+//	GET    /v1/repos/{repo}/bundles                       list bundles
+//	POST   /v1/repos/{repo}/bundles                       upload a bundle from a multipart form
+//	GET    /v1/repos/{repo}/bundles/{bundle}              bundle descriptor, {bundle} may be "latest"
+//	GET    /v1/repos/{repo}/bundles/{bundle}/files        list files
+//	GET    /v1/repos/{repo}/bundles/{bundle}/files/{path} download a file, with Range support
+//	POST   /v1/repos/{repo}/uploads                       start an upload session
+//	PUT    /v1/repos/{repo}/uploads/{id}/files/{path}     stage a file
+//	POST   /v1/repos/{repo}/uploads/{id}                  commit the staged files as a bundle
+//	DELETE /v1/repos/{repo}/uploads/{id}                  abort an upload session
+//
+// Lists are paged like the CLI: they return {"items": [...], "nextToken": "..."}, and accept
+// the limit, token, since, until, contributor, message and desc query parameters.
+// Failures return {"error": "...", "kind": "..."} with a matching status code.
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/oneconcern/datamon/pkg/client"
+)
+
+// Option configures a server
+type Option func(*Server)
+
+// Token requires requests to authenticate with a bearer token
+func Token(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// StagingDir is the directory holding the files of uploads until they are committed,
+// the temporary directory of the OS by default
+func StagingDir(dir string) Option {
+	return func(s *Server) {
+		s.stagingDir = dir
+	}
+}
+
+// Server is the http.Handler serving the API
+type Server struct {
+	client     *client.Client
+	token      string
+	stagingDir string
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// New creates a server running the requests with a client
+func New(c *client.Client, opts ...Option) *Server {
+	s := &Server{
+		client:     c,
+		stagingDir: os.TempDir(),
+		sessions:   make(map[string]*session),
+	}
+	for _, apply := range opts {
+		apply(s)
+	}
+	return s
+}
+
+// errorResult is the body of failed requests
+type errorResult struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+// listPage is the body of lists
+type listPage struct {
+	Items     interface{} `json:"items"`
+	NextToken string      `json:"nextToken,omitempty"`
+}
+
+// errBadRequest is the kind of errors of requests that can't be run
+var errBadRequest = errors.New("bad request")
+
+func badRequestf(format string, args ...interface{}) error {
+	return &client.Error{Kind: errBadRequest, Err: fmt.Errorf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="datamon"`)
+		writeError(w, &client.Error{Kind: client.ErrForbidden, Err: fmt.Errorf("missing or invalid bearer token")})
+		return
+	}
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 7)
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "repos" {
+		http.NotFound(w, r)
+		return
+	}
+	var repo string
+	if len(parts) > 2 {
+		repo = parts[2]
+	}
+	switch {
+	case len(parts) == 2:
+		s.get(w, r, s.listRepos)
+	case len(parts) == 3:
+		s.get(w, r, func(w http.ResponseWriter, r *http.Request) { s.getRepo(w, r, repo) })
+	case parts[3] == "bundles":
+		s.bundles(w, r, repo, parts[4:])
+	case parts[3] == "uploads":
+		s.uploads(w, r, repo, parts[4:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) bundles(w http.ResponseWriter, r *http.Request, repo string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.uploadForm(w, r, repo)
+	case len(parts) == 0:
+		s.get(w, r, func(w http.ResponseWriter, r *http.Request) { s.listBundles(w, r, repo) })
+	case len(parts) == 1:
+		s.get(w, r, func(w http.ResponseWriter, r *http.Request) { s.getBundle(w, r, repo, parts[0]) })
+	case parts[1] != "files":
+		http.NotFound(w, r)
+	case len(parts) == 2:
+		s.get(w, r, func(w http.ResponseWriter, r *http.Request) { s.listFiles(w, r, repo, parts[0]) })
+	default:
+		s.get(w, r, func(w http.ResponseWriter, r *http.Request) { s.getFile(w, r, repo, parts[0], parts[2]) })
+	}
+}
+
+func (s *Server) uploads(w http.ResponseWriter, r *http.Request, repo string, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		s.startUpload(w, r, repo)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.commitUpload(w, r, repo, parts[0])
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.abortUpload(w, r, repo, parts[0])
+	case len(parts) == 3 && parts[1] == "files" && r.Method == http.MethodPut:
+		s.stageFile(w, r, repo, parts[0], parts[2])
+	case len(parts) == 1 || len(parts) == 3 && parts[1] == "files":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// get runs the handlers of read only routes
+func (s *Server) get(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	handler(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(s.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// writeError replies with the status code of the kind of an error
+func writeError(w http.ResponseWriter, err error) {
+	status, kind := http.StatusInternalServerError, "error"
+	switch client.Kind(err) {
+	case errBadRequest:
+		status, kind = http.StatusBadRequest, "bad-request"
+	case client.ErrNotFound:
+		status, kind = http.StatusNotFound, "not-found"
+	case client.ErrExists:
+		status, kind = http.StatusConflict, "already-exists"
+	case client.ErrForbidden:
+		status, kind = http.StatusForbidden, "auth"
+		if w.Header().Get("WWW-Authenticate") != "" {
+			status = http.StatusUnauthorized
+		}
+	case client.ErrIO:
+		status, kind = http.StatusBadGateway, "io"
+	}
+	if status == http.StatusInternalServerError {
+		log.Printf("Request failed: %s", err)
+	}
+	writeJSON(w, status, errorResult{Error: err.Error(), Kind: kind})
+}
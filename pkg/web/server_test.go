@@ -0,0 +1,219 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/oneconcern/datamon/pkg/cafs"
+	"github.com/oneconcern/datamon/pkg/client"
+	"github.com/oneconcern/datamon/pkg/model"
+	"github.com/oneconcern/datamon/pkg/storage/localfs"
+)
+
+const (
+	repo  = "web-test-repo"
+	token = "secret"
+)
+
+type testServer struct {
+	*testing.T
+	url string
+}
+
+func newTestServer(t *testing.T) (*testServer, func()) {
+	c, err := client.New(client.Config{
+		Contributor: model.Contributor{Name: "test", Email: "t@test.com"},
+	},
+		client.MetaStore(localfs.New(afero.NewMemMapFs())),
+		client.BlobStore(localfs.New(afero.NewMemMapFs())),
+	)
+	require.NoError(t, err)
+	_, err = c.CreateRepo(context.Background(), repo, "test repo")
+	require.NoError(t, err)
+	staging, err := ioutil.TempDir("", "datamon-web-")
+	require.NoError(t, err)
+	srv := httptest.NewServer(New(c, Token(token), StagingDir(staging)))
+	return &testServer{T: t, url: srv.URL}, func() {
+		srv.Close()
+		require.Empty(t, readDir(t, staging), "staged files are removed")
+		_ = os.RemoveAll(staging)
+	}
+}
+
+func readDir(t *testing.T, dir string) []string {
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+// do runs an authenticated request, and decodes the json body of the response in v when not nil
+func (s *testServer) do(method, path string, body io.Reader, header http.Header, status int, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, s.url+path, body)
+	require.NoError(s, err)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(s, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(s, err)
+	require.Equal(s, status, resp.StatusCode, string(b))
+	if v != nil {
+		require.NoError(s, json.Unmarshal(b, v), string(b))
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return resp
+}
+
+type bundlePage struct {
+	Items     []model.BundleDescriptor `json:"items"`
+	NextToken string                   `json:"nextToken"`
+}
+
+func TestServer_Auth(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	resp, err := http.Get(s.url + "/v1/repos")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+
+	var repos struct {
+		Items []model.RepoDescriptor `json:"items"`
+	}
+	s.do(http.MethodGet, "/v1/repos", nil, nil, http.StatusOK, &repos)
+	require.Len(t, repos.Items, 1)
+	require.Equal(t, repo, repos.Items[0].Name)
+}
+
+func TestServer_Errors(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	var e errorResult
+	s.do(http.MethodGet, "/v1/repos/missing/bundles", nil, nil, http.StatusNotFound, &e)
+	require.Equal(t, "not-found", e.Kind)
+	s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles?limit=x", nil, nil, http.StatusBadRequest, &e)
+	require.Equal(t, "bad-request", e.Kind)
+	s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles/latest", nil, nil, http.StatusNotFound, &e)
+	s.do(http.MethodPut, "/v1/repos/"+repo+"/uploads/unknown/files/a", nil, nil, http.StatusNotFound, &e)
+	s.do(http.MethodDelete, "/v1/repos/"+repo, nil, nil, http.StatusMethodNotAllowed, nil)
+	s.do(http.MethodGet, "/v2/repos", nil, nil, http.StatusNotFound, nil)
+}
+
+func TestServer_StagedUpload(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	large := make([]byte, cafs.DefaultLeafSize+1000)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	var upload uploadResult
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/uploads", nil, nil, http.StatusCreated, &upload)
+	require.NotEmpty(t, upload.ID)
+	files := "/v1/repos/" + repo + "/uploads/" + upload.ID + "/files/"
+	s.do(http.MethodPut, files+"data/large.bin", bytes.NewReader(large), nil, http.StatusNoContent, nil)
+	s.do(http.MethodPut, files+"../readme.txt", bytes.NewReader([]byte("hello")), nil, http.StatusNoContent, nil)
+
+	var e errorResult
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/uploads/"+upload.ID, bytes.NewReader([]byte(`{}`)), nil, http.StatusBadRequest, &e)
+	var bd model.BundleDescriptor
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/uploads/"+upload.ID, bytes.NewReader([]byte(`{"message": "staged"}`)),
+		nil, http.StatusCreated, &bd)
+	require.NotEmpty(t, bd.ID)
+	require.Equal(t, "staged", bd.Message)
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/uploads/"+upload.ID, bytes.NewReader([]byte(`{"message": "again"}`)),
+		nil, http.StatusNotFound, &e)
+
+	var page bundlePage
+	s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles", nil, nil, http.StatusOK, &page)
+	require.Len(t, page.Items, 1)
+	require.Equal(t, bd.ID, page.Items[0].ID)
+	var latest model.BundleDescriptor
+	s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles/latest", nil, nil, http.StatusOK, &latest)
+	require.Equal(t, bd.ID, latest.ID)
+
+	var entries struct {
+		Items []model.BundleEntry `json:"items"`
+	}
+	s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles/"+bd.ID+"/files", nil, nil, http.StatusOK, &entries)
+	names := []string{}
+	for _, e := range entries.Items {
+		names = append(names, e.NameWithPath)
+	}
+	require.ElementsMatch(t, []string{"data/large.bin", "readme.txt"}, names)
+
+	// whole files and ranges
+	file := "/v1/repos/" + repo + "/bundles/" + bd.ID + "/files/"
+	resp := s.do(http.MethodGet, file+"readme.txt", nil, nil, http.StatusOK, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	offset := int(cafs.DefaultLeafSize) - 10
+	resp = s.do(http.MethodGet, file+"data/large.bin", nil,
+		http.Header{"Range": {"bytes=" + strconv.Itoa(offset) + "-" + strconv.Itoa(offset+99)}}, http.StatusPartialContent, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	require.Equal(t, large[offset:offset+100], body)
+	resp = s.do(http.MethodGet, file+"data/large.bin", nil, http.Header{"Range": {"bytes=-10"}}, http.StatusPartialContent, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	require.Equal(t, large[len(large)-10:], body)
+	s.do(http.MethodGet, file+"missing", nil, nil, http.StatusNotFound, &e)
+}
+
+func TestServer_AbortUpload(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	var upload uploadResult
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/uploads", nil, nil, http.StatusCreated, &upload)
+	s.do(http.MethodPut, "/v1/repos/"+repo+"/uploads/"+upload.ID+"/files/a", bytes.NewReader([]byte("a")), nil, http.StatusNoContent, nil)
+	s.do(http.MethodDelete, "/v1/repos/"+repo+"/uploads/"+upload.ID, nil, nil, http.StatusNoContent, nil)
+	s.do(http.MethodDelete, "/v1/repos/"+repo+"/uploads/"+upload.ID, nil, nil, http.StatusNotFound, nil)
+}
+
+func TestServer_FormUpload(t *testing.T) {
+	s, done := newTestServer(t)
+	defer done()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	require.NoError(t, mw.WriteField("message", "form"))
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="dir/a.csv"`)
+	part, err := mw.CreatePart(h)
+	require.NoError(t, err)
+	_, err = part.Write([]byte("a,b\n1,2\n"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	var bd model.BundleDescriptor
+	s.do(http.MethodPost, "/v1/repos/"+repo+"/bundles", &buf, http.Header{"Content-Type": {mw.FormDataContentType()}},
+		http.StatusCreated, &bd)
+	require.Equal(t, "form", bd.Message)
+	resp := s.do(http.MethodGet, "/v1/repos/"+repo+"/bundles/"+bd.ID+"/files/dir/a.csv", nil, nil, http.StatusOK, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	require.Equal(t, "a,b\n1,2\n", string(body))
+}
@@ -0,0 +1,220 @@
+// Copyright © 2018 One Concern
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/oneconcern/datamon/pkg/client"
+)
+
+// session is an upload in progress: the files staged so far, waiting to be committed as a bundle
+type session struct {
+	repo string
+	dir  string
+}
+
+// uploadResult is the body of a started upload session
+type uploadResult struct {
+	ID string `json:"id"`
+}
+
+// commitRequest is the body committing an upload session
+type commitRequest struct {
+	Message     string `json:"message"`
+	Compression string `json:"compression,omitempty"`
+	Chunker     string `json:"chunker,omitempty"`
+}
+
+func (c commitRequest) options() []client.UploadOption {
+	return []client.UploadOption{
+		client.UploadMessage(c.Message),
+		client.UploadCompression(c.Compression),
+		client.UploadChunker(c.Chunker),
+	}
+}
+
+// stagedPath returns the path of a file of a bundle in a staging directory.
+// Files can't escape the directory.
+func stagedPath(dir, file string) (string, error) {
+	clean := path.Clean("/" + file)
+	if clean == "/" {
+		return "", badRequestf("invalid file path %q", file)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func stageFile(dir, file string, r io.Reader) error {
+	dest, err := stagedPath(dir, file)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func removeStaging(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove staged files %s: %s", dir, err)
+	}
+}
+
+// session returns an upload session of a repo, removing it when the upload ends
+// so that it is committed or aborted once
+func (s *Server) session(repo, id string, end bool) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || sess.repo != repo {
+		return nil, &client.Error{Kind: client.ErrNotFound, Err: fmt.Errorf("upload %s not found for repo %s", id, repo)}
+	}
+	if end {
+		delete(s.sessions, id)
+	}
+	return sess, nil
+}
+
+func (s *Server) startUpload(w http.ResponseWriter, r *http.Request, repo string) {
+	if err := s.client.CheckRepo(r.Context(), repo); err != nil {
+		writeError(w, err)
+		return
+	}
+	dir, err := ioutil.TempDir(s.stagingDir, "datamon-upload-")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	id := ksuid.New().String()
+	s.mu.Lock()
+	s.sessions[id] = &session{repo: repo, dir: dir}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, uploadResult{ID: id})
+}
+
+func (s *Server) stageFile(w http.ResponseWriter, r *http.Request, repo, id, file string) {
+	sess, err := s.session(repo, id, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err = stageFile(sess.dir, file, r.Body); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) commitUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	var req commitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequestf("invalid commit request: %s", err))
+		return
+	}
+	if req.Message == "" {
+		writeError(w, badRequestf("a message is required to commit a bundle"))
+		return
+	}
+	sess, err := s.session(repo, id, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer removeStaging(sess.dir)
+	bd, err := s.client.UploadDir(r.Context(), repo, sess.dir, req.options()...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, bd)
+}
+
+func (s *Server) abortUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	sess, err := s.session(repo, id, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	removeStaging(sess.dir)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadForm uploads a bundle from a multipart form. The form has message, compression and chunker fields,
+// and a part per file, the path of the file in the bundle being the filename of the part.
+func (s *Server) uploadForm(w http.ResponseWriter, r *http.Request, repo string) {
+	if err := s.client.CheckRepo(r.Context(), repo); err != nil {
+		writeError(w, err)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, badRequestf("expecting a multipart form: %s", err))
+		return
+	}
+	dir, err := ioutil.TempDir(s.stagingDir, "datamon-upload-")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer removeStaging(dir)
+	var req commitRequest
+	fields := map[string]*string{
+		"message":     &req.Message,
+		"compression": &req.Compression,
+		"chunker":     &req.Chunker,
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, badRequestf("invalid multipart form: %s", err))
+			return
+		}
+		// the filename of the part keeps its directories, unlike part.FileName()
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if file := params["filename"]; file != "" {
+			err = stageFile(dir, file, part)
+		} else if field, ok := fields[part.FormName()]; ok {
+			var value []byte
+			value, err = ioutil.ReadAll(io.LimitReader(part, 64*1024))
+			*field = string(value)
+		}
+		_ = part.Close()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if req.Message == "" {
+		writeError(w, badRequestf("a message is required to upload a bundle"))
+		return
+	}
+	bd, err := s.client.UploadDir(r.Context(), repo, dir, req.options()...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, bd)
+}